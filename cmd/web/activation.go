@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+var (
+	// an address only gets a few activation emails, so the form cannot be used to flood an inbox
+	activationResendAccountLimit = rateLimit{Limit: 3, Window: time.Hour}
+	activationResendIPLimit      = rateLimit{Limit: 10, Window: time.Hour}
+)
+
+const defaultActivationExpiry = 48 * time.Hour
+
+func (app *Config) GETResendActivationPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+	app.render(w, r, "resend-activation.page.gohtml", nil)
+}
+
+// Sends a new activation link to a user who has never activated their account, e.g. because the
+// first one expired or never arrived
+func (app *Config) POSTResendActivationPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/activate-account/resend", http.StatusSeeOther)
+		return
+	}
+
+	email := db.NormalizeEmail(r.PostForm.Get("email"))
+
+	// addresses are counted whether or not they have an account, so the limit gives nothing away
+	limits := map[string]rateLimit{
+		"activation:account:" + email:  activationResendAccountLimit,
+		"activation:ip:" + clientIP(r): activationResendIPLimit,
+	}
+	for key, limit := range limits {
+		allowed, err := app.RateLimiter.Allow(key, limit)
+		if err != nil {
+			// send the email rather than leave the user stuck
+			app.ErrorLog.Println("Error checking activation email rate limit: ", err)
+			continue
+		}
+		if !allowed {
+			app.Session.Put(r.Context(), "error", "Too many activation emails were asked for. Please try again later.")
+			http.Redirect(w, r, "/activate-account/resend", http.StatusSeeOther)
+			return
+		}
+	}
+
+	// respond the same way whether or not the account exists, or is already activated,
+	// so this form cannot be used to find out who has an account
+	app.Session.Put(r.Context(), "flash", "If that email belongs to an account that is not activated yet, a new activation link has been sent.")
+
+	user, err := app.Models.User.GetByEmail(email)
+	if err != nil {
+		app.ErrorLog.Println("Error getting user by email: ", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	// an account an admin deactivated was activated before, and must not be activated again
+	if user.ActivatedAt != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	app.sendActivationEmail(user.Email)
+
+	app.InfoLog.Printf("Activation email sent again to user %d", user.ID)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// sendActivationEmail sends a new user the link that activates their account
+func (app *Config) sendActivationEmail(email string) {
+	activateURL := fmt.Sprintf("%s/activate-account?email=%s", "http://localhost:8811", url.QueryEscape(email)) // TODO - get this from environment variable
+	signedURL := GenerateTokenFromString(PurposeActivate, activateURL)
+
+	app.sendEmail(Message{
+		To:       email,
+		Subject:  "Activate your account",
+		Template: "confirmation-email",
+		Data:     template.HTMLEscapeString(signedURL),
+		DataMap:  map[string]any{"expiry": describeDuration(app.ActivationExpiry)},
+	})
+}
+
+// describeDuration writes a duration the way it is said, e.g. "2 days" or "1 hour"
+func describeDuration(d time.Duration) string {
+	amount, unit := int(d/time.Minute), "minute"
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		amount, unit = int(d/(24*time.Hour)), "day"
+	case d >= time.Hour && d%time.Hour == 0:
+		amount, unit = int(d/time.Hour), "hour"
+	}
+
+	if amount == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", amount, unit)
+}
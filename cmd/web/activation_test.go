@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_describeDuration(t *testing.T) {
+	var tests = []struct {
+		duration time.Duration
+		expected string
+	}{
+		{48 * time.Hour, "2 days"},
+		{24 * time.Hour, "1 day"},
+		{36 * time.Hour, "36 hours"},
+		{time.Hour, "1 hour"},
+		{90 * time.Minute, "90 minutes"},
+		{time.Minute, "1 minute"},
+	}
+
+	for _, e := range tests {
+		if got := describeDuration(e.duration); got != e.expected {
+			t.Errorf("%s: expected %q, got %q", e.duration, e.expected, got)
+		}
+	}
+}
+
+func TestConfig_POSTResendActivationPage(t *testing.T) {
+	var tests = []struct {
+		name             string
+		email            string
+		expectedLocation string
+		expectedMail     bool
+	}{
+		{"inactive account", " Jane@Example.com", "/login", true},
+		{"active account", "test@example.com", "/login", false},
+		{"deactivated account", "deactivated@example.com", "/login", false},
+		{"inactive account again", "jane@example.com", "/login", true},
+		{"inactive account once more", "jane@example.com", "/login", true},
+		{"too many emails", "jane@example.com", "/activate-account/resend", false},
+	}
+
+	app := testApp
+	app.RateLimiter = NewMemoryRateLimiter(time.Now)
+
+	for _, e := range tests {
+		mail := catchMail(&app)
+
+		req, _ := http.NewRequest("POST", "/activate-account/resend", strings.NewReader(url.Values{"email": {e.email}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:51234"
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		http.HandlerFunc(app.POSTResendActivationPage).ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, location)
+		}
+
+		close(mail)
+		var sent []Message
+		for msg := range mail {
+			sent = append(sent, msg)
+		}
+		if (len(sent) == 1) != e.expectedMail {
+			t.Errorf("%s: expected an activation email to be sent to be %t, got %d emails", e.name, e.expectedMail, len(sent))
+		}
+		if len(sent) == 1 && (sent[0].To != "jane@example.com" || !strings.Contains(sent[0].Data.(string), "/activate-account?email=jane%40example.com")) {
+			t.Errorf("%s: did not find the activation link for jane@example.com in %+v", e.name, sent[0])
+		}
+	}
+}
+
+func TestConfig_GETActivateAccount(t *testing.T) {
+	var tests = []struct {
+		name             string
+		url              string
+		expiry           time.Duration
+		expectedLocation string
+		expectedFlash    bool
+	}{
+		{"valid link", GenerateTokenFromString(PurposeActivate, "http://localhost:8811/activate-account?email=jane%40example.com"), defaultActivationExpiry, "/login", true},
+		{"unsigned link", "http://localhost:8811/activate-account?email=jane%40example.com", defaultActivationExpiry, "/login", false},
+		{"expired link", GenerateTokenFromString(PurposeActivate, "http://localhost:8811/activate-account?email=jane%40example.com"), 0, "/activate-account/resend", false},
+		{"link for another purpose", GenerateTokenFromString(PurposeReset, "http://localhost:8811/activate-account?email=jane%40example.com"), defaultActivationExpiry, "/login", false},
+		{"already activated", GenerateTokenFromString(PurposeActivate, "http://localhost:8811/activate-account?email=test%40example.com"), defaultActivationExpiry, "/login", true},
+		{"deactivated account", GenerateTokenFromString(PurposeActivate, "http://localhost:8811/activate-account?email=deactivated%40example.com"), defaultActivationExpiry, "/login", false},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		app.ActivationExpiry = e.expiry
+		app.UsedTokens = NewMemoryTokenStore(time.Now)
+
+		req, _ := http.NewRequest("GET", strings.TrimPrefix(e.url, "http://localhost:8811"), nil)
+		req.RequestURI = req.URL.RequestURI() // as the server sets it
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		http.HandlerFunc(app.GETActivateAccount).ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, location)
+		}
+		if app.Session.Exists(ctx, "flash") != e.expectedFlash {
+			t.Errorf("%s: expected a flash message to be %t", e.name, e.expectedFlash)
+		}
+	}
+}
+
+func TestConfig_GETActivateAccount_Replayed(t *testing.T) {
+	app := testApp
+	app.UsedTokens = NewMemoryTokenStore(time.Now)
+
+	// jane@example.com stays inactive in the test models, as if she had been deactivated after
+	// following the link
+	link := strings.TrimPrefix(GenerateTokenFromString(PurposeActivate, "http://localhost:8811/activate-account?email=jane%40example.com"), "http://localhost:8811")
+
+	for i, expectedFlash := range []bool{true, false} {
+		req, _ := http.NewRequest("GET", link, nil)
+		req.RequestURI = req.URL.RequestURI() // as the server sets it
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		http.HandlerFunc(app.GETActivateAccount).ServeHTTP(httptest.NewRecorder(), req)
+
+		if app.Session.Exists(ctx, "flash") != expectedFlash {
+			t.Errorf("visit %d: expected the account to be activated to be %t", i+1, expectedFlash)
+		}
+	}
+}
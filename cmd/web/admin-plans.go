@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+const maxTrialDays = 365
+
+// Admin route
+// Lists every plan, including archived plans and old versions, with a form to create a new plan
+func (app *Config) GETAdminPlans(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	plans, err := app.Models.Plan.GetAllWithArchived()
+	if err != nil {
+		app.ErrorLog.Println("Error getting plans: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plans")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "admin-plans.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"plans":      plans,
+			"currencies": db.SupportedCurrencies,
+		},
+	})
+}
+
+// Admin route
+// Creates a new plan, which new subscribers can choose straight away
+func (app *Config) POSTAdminPlans(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to create plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	plan, err := planFromForm(r.PostForm)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	planID, err := app.Models.Plan.Insert(plan)
+	if err != nil {
+		app.ErrorLog.Println("Error inserting plan: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to create plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	app.InfoLog.Printf("Admin %d created plan %d\n", app.Session.GetInt(r.Context(), "userID"), planID)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminPlanCreated,
+		TargetType: db.AuditTargetPlan,
+		TargetID:   strconv.Itoa(planID),
+		Changes:    db.AuditChanges(nil, planAuditFields(plan)),
+	})
+	app.Session.Put(r.Context(), "flash", "Plan created")
+	http.Redirect(w, r, fmt.Sprintf("/admin/plan?id=%d", planID), http.StatusSeeOther)
+}
+
+// Admin route
+// Shows one plan, with forms to rename it, change its prices, and archive it
+func (app *Config) GETAdminPlan(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	planID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting plan id: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting plan: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	// the price form shows the plan's prices the way they are entered
+	prices := make(map[string]string)
+	for currency, amount := range plan.Prices {
+		prices[currency] = amountInput(amount, currency)
+	}
+
+	app.render(w, r, "admin-plan.page.gohtml", &TemplateData{
+		StringMap: prices,
+		Data: map[string]any{
+			"plan":       plan,
+			"currencies": db.SupportedCurrencies,
+		},
+	})
+}
+
+// Admin route
+// Renames a plan
+func (app *Config) POSTAdminPlan(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	plan, ok := app.adminPlanFromForm(w, r)
+	if !ok {
+		return
+	}
+	planPage := fmt.Sprintf("/admin/plan?id=%d", plan.ID)
+
+	name, err := planNameFromForm(r.PostForm)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, planPage, http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.Plan.Rename(plan.ID, name)
+	if err != nil {
+		app.ErrorLog.Println("Error renaming plan: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to rename plan")
+		http.Redirect(w, r, planPage, http.StatusSeeOther)
+		return
+	}
+
+	app.InfoLog.Printf("Admin %d renamed plan %d to %q\n", app.Session.GetInt(r.Context(), "userID"), plan.ID, name)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminPlanUpdated,
+		TargetType: db.AuditTargetPlan,
+		TargetID:   strconv.Itoa(plan.ID),
+		Changes:    map[string]db.AuditChange{"name": {From: plan.PlanName, To: name}},
+	})
+	app.Session.Put(r.Context(), "flash", "Plan renamed")
+	http.Redirect(w, r, planPage, http.StatusSeeOther)
+}
+
+// Admin route
+// Changes a plan's prices. The plan is replaced by a new version at the new prices, so that its
+// current subscribers keep paying their old price.
+func (app *Config) POSTAdminPlanPrices(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	plan, ok := app.adminPlanFromForm(w, r)
+	if !ok {
+		return
+	}
+	planPage := fmt.Sprintf("/admin/plan?id=%d", plan.ID)
+
+	prices, err := pricesFromForm(r.PostForm)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, planPage, http.StatusSeeOther)
+		return
+	}
+
+	if maps.Equal(prices, plan.Prices) {
+		app.Session.Put(r.Context(), "warning", "The prices have not changed")
+		http.Redirect(w, r, planPage, http.StatusSeeOther)
+		return
+	}
+
+	newID, err := app.Models.Plan.NewVersion(plan.ID, prices)
+	if err != nil {
+		app.ErrorLog.Println("Error creating plan version: ", err)
+		if errors.Is(err, db.ErrPlanArchived) {
+			app.Session.Put(r.Context(), "error", "The prices of an archived plan cannot be changed")
+		} else {
+			app.Session.Put(r.Context(), "error", "Unable to change prices")
+		}
+		http.Redirect(w, r, planPage, http.StatusSeeOther)
+		return
+	}
+
+	app.InfoLog.Printf("Admin %d replaced plan %d with version %d\n", app.Session.GetInt(r.Context(), "userID"), plan.ID, newID)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminPlanUpdated,
+		TargetType: db.AuditTargetPlan,
+		TargetID:   strconv.Itoa(plan.ID),
+		Note:       fmt.Sprintf("Replaced by version %d, plan %d", plan.Version+1, newID),
+		Changes:    map[string]db.AuditChange{"prices": {From: plan.Prices, To: prices}},
+	})
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Created version %d of the plan. Current subscribers keep their old price.", plan.Version+1))
+	http.Redirect(w, r, fmt.Sprintf("/admin/plan?id=%d", newID), http.StatusSeeOther)
+}
+
+// Admin route
+// Takes a plan off sale. Its subscribers keep it.
+func (app *Config) POSTAdminArchivePlan(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	plan, ok := app.adminPlanFromForm(w, r)
+	if !ok {
+		return
+	}
+	planPage := fmt.Sprintf("/admin/plan?id=%d", plan.ID)
+
+	err := app.Models.Plan.Archive(plan.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error archiving plan: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to archive plan")
+		http.Redirect(w, r, planPage, http.StatusSeeOther)
+		return
+	}
+
+	app.InfoLog.Printf("Admin %d archived plan %d\n", app.Session.GetInt(r.Context(), "userID"), plan.ID)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminPlanUpdated,
+		TargetType: db.AuditTargetPlan,
+		TargetID:   strconv.Itoa(plan.ID),
+		Changes:    map[string]db.AuditChange{"archived": {From: false, To: true}},
+	})
+	app.Session.Put(r.Context(), "flash", "Plan archived. New subscribers can no longer choose it.")
+	http.Redirect(w, r, planPage, http.StatusSeeOther)
+}
+
+// Admin route
+// Puts an archived plan back on sale
+func (app *Config) POSTAdminRestorePlan(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	plan, ok := app.adminPlanFromForm(w, r)
+	if !ok {
+		return
+	}
+	planPage := fmt.Sprintf("/admin/plan?id=%d", plan.ID)
+
+	err := app.Models.Plan.Restore(plan.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error restoring plan: ", err)
+		if errors.Is(err, db.ErrPlanSuperseded) {
+			app.Session.Put(r.Context(), "error", "This version of the plan has been replaced by a newer one")
+		} else {
+			app.Session.Put(r.Context(), "error", "Unable to restore plan")
+		}
+		http.Redirect(w, r, planPage, http.StatusSeeOther)
+		return
+	}
+
+	app.InfoLog.Printf("Admin %d restored plan %d\n", app.Session.GetInt(r.Context(), "userID"), plan.ID)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminPlanUpdated,
+		TargetType: db.AuditTargetPlan,
+		TargetID:   strconv.Itoa(plan.ID),
+		Changes:    map[string]db.AuditChange{"archived": {From: true, To: false}},
+	})
+	app.Session.Put(r.Context(), "flash", "The plan is available again")
+	http.Redirect(w, r, planPage, http.StatusSeeOther)
+}
+
+// adminPlanFromForm gets the plan an admin form was submitted for. If that fails, the admin is
+// redirected to the list of plans, and false is returned.
+func (app *Config) adminPlanFromForm(w http.ResponseWriter, r *http.Request) (*db.Plan, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return nil, false
+	}
+
+	planID, err := strconv.Atoi(r.PostForm.Get("id"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting plan id: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return nil, false
+	}
+
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting plan: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return nil, false
+	}
+
+	return plan, true
+}
+
+// planFromForm reads a new plan from a submitted form. The error is fit to show to the user.
+func planFromForm(form url.Values) (db.Plan, error) {
+	var plan db.Plan
+
+	name, err := planNameFromForm(form)
+	if err != nil {
+		return plan, err
+	}
+
+	trialDays := 0
+	if value := strings.TrimSpace(form.Get("trial-days")); value != "" {
+		trialDays, err = strconv.Atoi(value)
+		if err != nil || trialDays < 0 || trialDays > maxTrialDays {
+			return plan, fmt.Errorf("A free trial can be from 0 to %d days long", maxTrialDays)
+		}
+	}
+
+	family := strings.TrimSpace(form.Get("family"))
+	if len(family) > maxNameLength {
+		return plan, fmt.Errorf("A plan family can be at most %d characters long", maxNameLength)
+	}
+
+	prices, err := pricesFromForm(form)
+	if err != nil {
+		return plan, err
+	}
+
+	plan = db.Plan{
+		PlanName:   name,
+		PlanAmount: prices[db.DefaultCurrency],
+		Currency:   db.DefaultCurrency,
+		Prices:     prices,
+		TrialDays:  trialDays,
+		PlanFamily: family,
+	}
+
+	return plan, nil
+}
+
+// planNameFromForm reads a plan's name from a submitted form. The error is fit to show to the user.
+func planNameFromForm(form url.Values) (string, error) {
+	name := strings.TrimSpace(form.Get("name"))
+	if name == "" {
+		return "", errors.New("Please enter a name for the plan")
+	}
+	if len(name) > maxNameLength {
+		return "", fmt.Errorf("A plan name can be at most %d characters long", maxNameLength)
+	}
+	return name, nil
+}
+
+// pricesFromForm reads a plan's prices from the price-<currency> fields of a submitted form. A plan
+// is always sold in db.DefaultCurrency, and in any other currency that is given a price.
+// The error is fit to show to the user.
+func pricesFromForm(form url.Values) (map[string]int, error) {
+	prices := make(map[string]int)
+
+	for _, currency := range db.SupportedCurrencies {
+		value := strings.TrimSpace(form.Get("price-" + currency))
+		if value == "" {
+			if currency == db.DefaultCurrency {
+				return nil, fmt.Errorf("Please enter a price in %s", db.DefaultCurrency)
+			}
+			continue
+		}
+
+		amount, err := parseAmount(value, currency)
+		if err != nil {
+			return nil, err
+		}
+		prices[currency] = amount
+	}
+
+	return prices, nil
+}
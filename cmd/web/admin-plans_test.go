@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func Test_parseAmount(t *testing.T) {
+	var tests = []struct {
+		name        string
+		value       string
+		currency    string
+		expected    int
+		expectError bool
+	}{
+		{"dollars and cents", "10.50", "USD", 1050, false},
+		{"one decimal", "10.5", "USD", 1050, false},
+		{"whole dollars", " 10 ", "USD", 1000, false},
+		{"yen", "1500", "JPY", 1500, false},
+		{"yen have no minor unit", "15.5", "JPY", 0, true},
+		{"too many decimals", "10.505", "USD", 0, true},
+		{"trailing point", "10.", "USD", 0, true},
+		{"negative", "-10", "USD", 0, true},
+		{"not a number", "abc", "USD", 0, true},
+		{"empty", "", "USD", 0, true},
+	}
+
+	for _, e := range tests {
+		amount, err := parseAmount(e.value, e.currency)
+		if (err != nil) != e.expectError {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectError, err)
+		}
+		if amount != e.expected {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expected, amount)
+		}
+	}
+}
+
+func Test_amountInput(t *testing.T) {
+	var tests = []struct {
+		amount   int
+		currency string
+		expected string
+	}{
+		{1050, "USD", "10.50"},
+		{5, "EUR", "0.05"},
+		{1500, "JPY", "1500"},
+	}
+
+	for _, e := range tests {
+		got := amountInput(e.amount, e.currency)
+		if got != e.expected {
+			t.Errorf("%d %s: expected %q, got %q", e.amount, e.currency, e.expected, got)
+		}
+
+		// what is written must read back the same
+		if amount, err := parseAmount(got, e.currency); err != nil || amount != e.amount {
+			t.Errorf("%d %s: read back %d, %v", e.amount, e.currency, amount, err)
+		}
+	}
+}
+
+func Test_planFromForm(t *testing.T) {
+	var tests = []struct {
+		name        string
+		form        url.Values
+		expectError bool
+	}{
+		{"valid", url.Values{"name": {"Gold Plan"}, "trial-days": {"14"}, "price-USD": {"30.00"}, "price-JPY": {"4500"}}, false},
+		{"no trial", url.Values{"name": {"Gold Plan"}, "price-USD": {"30"}}, false},
+		{"missing name", url.Values{"name": {" "}, "price-USD": {"30.00"}}, true},
+		{"missing USD price", url.Values{"name": {"Gold Plan"}, "price-EUR": {"30.00"}}, true},
+		{"invalid price", url.Values{"name": {"Gold Plan"}, "price-USD": {"30.00"}, "price-JPY": {"45.50"}}, true},
+		{"negative trial", url.Values{"name": {"Gold Plan"}, "trial-days": {"-1"}, "price-USD": {"30.00"}}, true},
+		{"trial too long", url.Values{"name": {"Gold Plan"}, "trial-days": {"366"}, "price-USD": {"30.00"}}, true},
+	}
+
+	for _, e := range tests {
+		_, err := planFromForm(e.form)
+		if (err != nil) != e.expectError {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectError, err)
+		}
+	}
+
+	plan, _ := planFromForm(url.Values{"name": {"Gold Plan"}, "trial-days": {"14"}, "price-USD": {"30.00"}, "price-JPY": {"4500"}})
+	if plan.PlanAmount != 3000 || plan.Currency != db.DefaultCurrency || plan.TrialDays != 14 {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+	if len(plan.Prices) != 2 || plan.Prices["JPY"] != 4500 {
+		t.Errorf("expected prices in USD and JPY, got %v", plan.Prices)
+	}
+}
+
+func TestConfig_AdminPlanActions(t *testing.T) {
+	var tests = []struct {
+		name             string
+		handler          http.HandlerFunc
+		form             url.Values
+		expectedLocation string
+		expectedFlashKey string
+	}{
+		{"create", testApp.POSTAdminPlans, url.Values{"name": {"Gold Plan"}, "price-USD": {"30.00"}}, "/admin/plan?id=6", "flash"},
+		{"create without a price", testApp.POSTAdminPlans, url.Values{"name": {"Gold Plan"}}, "/admin/plans", "error"},
+		{"rename", testApp.POSTAdminPlan, url.Values{"id": {"1"}, "name": {"Bronze Plan"}}, "/admin/plan?id=1", "flash"},
+		{"rename without a name", testApp.POSTAdminPlan, url.Values{"id": {"1"}, "name": {""}}, "/admin/plan?id=1", "error"},
+		{"change prices", testApp.POSTAdminPlanPrices, url.Values{"id": {"1"}, "price-USD": {"12.00"}, "price-JPY": {"1800"}}, "/admin/plan?id=6", "flash"},
+		{"unchanged prices", testApp.POSTAdminPlanPrices, url.Values{"id": {"1"}, "price-USD": {"10.00"}, "price-JPY": {"1500"}}, "/admin/plan?id=1", "warning"},
+		{"archive", testApp.POSTAdminArchivePlan, url.Values{"id": {"1"}}, "/admin/plan?id=1", "flash"},
+		{"restore", testApp.POSTAdminRestorePlan, url.Values{"id": {"5"}}, "/admin/plan?id=5", "flash"},
+		{"no plan", testApp.POSTAdminArchivePlan, url.Values{"id": {""}}, "/admin/plans", "error"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/plan", strings.NewReader(e.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		testApp.Session.Put(ctx, "userID", 3)
+
+		e.handler.ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, location)
+		}
+		if !testApp.Session.Exists(ctx, e.expectedFlashKey) {
+			t.Errorf("%s: expected a %s message", e.name, e.expectedFlashKey)
+		}
+	}
+}
+
+func TestConfig_GETAdminPlans(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/plans", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	testApp.Session.Put(ctx, "userID", 3)
+
+	handler := http.HandlerFunc(testApp.GETAdminPlans)
+	handler.ServeHTTP(res, req)
+
+	html := res.Body.String()
+	for _, expected := range []string{"/admin/plan?id=1", "/admin/plan?id=5", "Archived", `name="price-JPY"`} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("expected %q on the page", expected)
+		}
+	}
+}
+
+func TestConfig_GETSubscribeToPlan_Archived(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/members/subscribe?plan=5", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	testApp.Session.Put(ctx, "userID", 1)
+	testApp.Session.Put(ctx, "user", db.User{ID: 1, Active: 1})
+
+	handler := http.HandlerFunc(testApp.GETSubscribeToPlan)
+	handler.ServeHTTP(res, req)
+
+	if location := res.Header().Get("Location"); location != "/members/plans" {
+		t.Errorf("expected redirect to /members/plans, got %s", location)
+	}
+	if !testApp.Session.Exists(ctx, "error") {
+		t.Error("expected an error message")
+	}
+}
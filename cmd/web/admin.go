@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+const (
+	adminUsersPerPage = 25
+	maxNameLength     = 255
+)
+
+// Pagination describes one page of a list that is split over several pages
+type Pagination struct {
+	Page     int // starts at 1
+	Pages    int
+	Total    int // the number of items on all pages
+	PrevPage int // 0 on the first page
+	NextPage int // 0 on the last page
+}
+
+// Admin route
+// Lists users, optionally only those whose name or email matches a search, a page at a time
+func (app *Config) GETAdminUsers(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	users, err := app.Models.User.GetAll()
+	if err != nil {
+		app.ErrorLog.Println("Error getting users: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get users")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil {
+		page = 1
+	}
+
+	users, pagination := paginateUsers(searchUsers(users, search), page, adminUsersPerPage)
+
+	app.render(w, r, "admin-users.page.gohtml", &TemplateData{
+		StringMap: map[string]string{
+			"search":      search,
+			"searchQuery": url.QueryEscape(search),
+		},
+		Data: map[string]any{
+			"users":      users,
+			"pagination": pagination,
+		},
+	})
+}
+
+// Admin route
+// Shows one user, with a form to edit them
+func (app *Config) GETAdminUser(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user id: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"user": user,
+			"self": user.ID == app.Session.GetInt(r.Context(), "userID"),
+		},
+	})
+}
+
+// Admin route
+// Saves a user's name and email address
+func (app *Config) POSTAdminUser(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	user, ok := app.adminUserFromForm(w, r)
+	if !ok {
+		return
+	}
+	userPage := fmt.Sprintf("/admin/user?id=%d", user.ID)
+
+	email, firstName, lastName, err := userDetailsFromForm(r.PostForm)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, userPage, http.StatusSeeOther)
+		return
+	}
+
+	before := userAuditFields(*user)
+	oldEmail := user.Email
+
+	if email != oldEmail {
+		// users log in with their email address, so two users cannot share one
+		err = app.Models.User.ChangeEmail(user.ID, email)
+		if errors.Is(err, db.ErrDuplicateEmail) {
+			app.Session.Put(r.Context(), "error", "Another user already has that email address")
+			http.Redirect(w, r, userPage, http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			app.ErrorLog.Println("Error changing email address: ", err)
+			app.Session.Put(r.Context(), "error", "Unable to save user")
+			http.Redirect(w, r, userPage, http.StatusSeeOther)
+			return
+		}
+		user.Email = email
+		app.sendEmailChangedNotice(oldEmail)
+	}
+
+	user.FirstName = firstName
+	user.LastName = lastName
+
+	err = app.Models.User.Update(*user)
+	if err != nil {
+		app.ErrorLog.Println("Error updating user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save user")
+		http.Redirect(w, r, userPage, http.StatusSeeOther)
+		return
+	}
+	app.refreshSessionUser(r, user.ID)
+
+	app.InfoLog.Printf("Admin %d updated user %d\n", app.Session.GetInt(r.Context(), "userID"), user.ID)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminUserUpdated,
+		TargetType: db.AuditTargetUser,
+		TargetID:   strconv.Itoa(user.ID),
+		Changes:    db.AuditChanges(before, userAuditFields(*user)),
+	})
+	app.Session.Put(r.Context(), "flash", "User saved")
+	http.Redirect(w, r, userPage, http.StatusSeeOther)
+}
+
+// Admin route
+// Deactivates a user, who can then no longer log in
+func (app *Config) POSTAdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+	app.setUserActive(w, r, false)
+}
+
+// Admin route
+// Reactivates a user that was deactivated
+func (app *Config) POSTAdminReactivateUser(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+	app.setUserActive(w, r, true)
+}
+
+// Admin route
+// Deletes a user. Their subscription is canceled and their customer is deleted with the payment provider
+// first, then their personal details are removed; their invoices are kept for the tax records.
+func (app *Config) POSTAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	user, ok := app.adminUserFromForm(w, r)
+	if !ok {
+		return
+	}
+
+	adminID := app.Session.GetInt(r.Context(), "userID")
+	if user.ID == adminID {
+		app.Session.Put(r.Context(), "error", "You cannot delete your own account")
+		http.Redirect(w, r, fmt.Sprintf("/admin/user?id=%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := app.cancelForDeletion(*user)
+	if err == nil {
+		err = app.Models.User.Anonymize(user.ID)
+	}
+	if err != nil {
+		app.ErrorLog.Println("Error deleting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to delete user")
+		http.Redirect(w, r, fmt.Sprintf("/admin/user?id=%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	app.endUserSessions(r, user.ID, "User deleted")
+
+	app.InfoLog.Printf("Admin %d deleted user %d (%s)\n", adminID, user.ID, user.Email)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminUserDeleted,
+		TargetType: db.AuditTargetUser,
+		TargetID:   strconv.Itoa(user.ID),
+		Changes:    db.AuditChanges(userAuditFields(*user), nil),
+	})
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Deleted %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// cancelForDeletion stops a user that is about to be deleted from being charged again: their current
+// subscription is canceled, and their customer is deleted with the payment provider
+func (app *Config) cancelForDeletion(user db.User) error {
+	subscription, err := app.Models.Subscription.GetCurrentForUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if subscription != nil {
+		err = app.Models.Subscription.UpdateStatus(subscription.ID, db.SubscriptionCanceled, "Account deleted")
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.PaymentCustomerID != "" {
+		return app.Payments.DeleteCustomer(user.PaymentCustomerID)
+	}
+	return nil
+}
+
+// setUserActive activates or deactivates the user in the submitted form. Admins cannot deactivate themselves.
+func (app *Config) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	user, ok := app.adminUserFromForm(w, r)
+	if !ok {
+		return
+	}
+	userPage := fmt.Sprintf("/admin/user?id=%d", user.ID)
+
+	adminID := app.Session.GetInt(r.Context(), "userID")
+	if !active && user.ID == adminID {
+		app.Session.Put(r.Context(), "error", "You cannot deactivate your own account")
+		http.Redirect(w, r, userPage, http.StatusSeeOther)
+		return
+	}
+
+	before := userAuditFields(*user)
+	user.Active = 0
+	if active {
+		user.Active = 1
+	}
+
+	err := app.Models.User.Update(*user)
+	if err != nil {
+		app.ErrorLog.Println("Error updating user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save user")
+		http.Redirect(w, r, userPage, http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAdminUserUpdated,
+		TargetType: db.AuditTargetUser,
+		TargetID:   strconv.Itoa(user.ID),
+		Changes:    db.AuditChanges(before, userAuditFields(*user)),
+	})
+	if !active {
+		app.endUserSessions(r, user.ID, "User deactivated")
+	}
+
+	if active {
+		app.InfoLog.Printf("Admin %d reactivated user %d\n", adminID, user.ID)
+		app.Session.Put(r.Context(), "flash", fmt.Sprintf("%s can log in again", user.Email))
+	} else {
+		app.InfoLog.Printf("Admin %d deactivated user %d\n", adminID, user.ID)
+		app.Session.Put(r.Context(), "flash", fmt.Sprintf("%s can no longer log in", user.Email))
+	}
+	http.Redirect(w, r, userPage, http.StatusSeeOther)
+}
+
+// endUserSessions logs a user out everywhere, so that a user an admin deactivated or deleted cannot
+// go on using the sessions they were logged in with
+func (app *Config) endUserSessions(r *http.Request, userID int, note string) {
+	ended, err := app.endOtherSessions(userID, "")
+	if err != nil {
+		app.ErrorLog.Println("Error ending sessions: ", err)
+	} else if ended > 0 {
+		app.audit(r, db.AuditEvent{Action: db.AuditSessionsRevoked, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(userID), Note: fmt.Sprintf("%s, %d sessions", note, ended)})
+	}
+}
+
+// adminUserFromForm gets the user an admin form was submitted for. If that fails, the admin is
+// redirected to the list of users, and false is returned.
+func (app *Config) adminUserFromForm(w http.ResponseWriter, r *http.Request) (*db.User, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+
+	userID, err := strconv.Atoi(r.PostForm.Get("id"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user id: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// refreshSessionUser reloads the user in the session, when an admin changed their own details
+func (app *Config) refreshSessionUser(r *http.Request, userID int) {
+	if userID != app.Session.GetInt(r.Context(), "userID") {
+		return
+	}
+
+	u, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		return
+	}
+	app.Session.Put(r.Context(), "user", *u)
+}
+
+// userDetailsFromForm reads a user's email address and name from a submitted form. The error is fit
+// to show to the user.
+func userDetailsFromForm(form url.Values) (email, firstName, lastName string, err error) {
+	email, err = emailFromForm(form)
+	if err != nil {
+		return email, firstName, lastName, err
+	}
+	firstName, lastName, err = nameFromForm(form)
+	return email, firstName, lastName, err
+}
+
+// emailFromForm reads an email address from a submitted form, in the form it is stored in. The
+// error is fit to show to the user.
+func emailFromForm(form url.Values) (string, error) {
+	email := db.NormalizeEmail(form.Get("email"))
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return email, errors.New("Please enter a valid email address")
+	}
+	if len(email) > maxNameLength {
+		return email, fmt.Errorf("Email addresses can be at most %d characters long", maxNameLength)
+	}
+
+	return email, nil
+}
+
+// nameFromForm reads a user's first and last name from a submitted form. The error is fit to show
+// to the user.
+func nameFromForm(form url.Values) (firstName, lastName string, err error) {
+	firstName = strings.TrimSpace(form.Get("first-name"))
+	lastName = strings.TrimSpace(form.Get("last-name"))
+
+	if firstName == "" || lastName == "" {
+		return firstName, lastName, errors.New("Please enter a first and last name")
+	}
+	if len(firstName) > maxNameLength || len(lastName) > maxNameLength {
+		return firstName, lastName, fmt.Errorf("Names can be at most %d characters long", maxNameLength)
+	}
+
+	return firstName, lastName, nil
+}
+
+// searchUsers returns the users whose name or email address contains the search text, ignoring case.
+// An empty search matches every user.
+func searchUsers(users []*db.User, search string) []*db.User {
+	search = strings.ToLower(strings.TrimSpace(search))
+	if search == "" {
+		return users
+	}
+
+	var found []*db.User
+	for _, u := range users {
+		name := strings.ToLower(fmt.Sprintf("%s %s", u.FirstName, u.LastName))
+		if strings.Contains(name, search) || strings.Contains(strings.ToLower(u.Email), search) {
+			found = append(found, u)
+		}
+	}
+	return found
+}
+
+// paginateUsers returns one page of users. A page past either end of the list gives the first or last page.
+func paginateUsers(users []*db.User, page, perPage int) ([]*db.User, Pagination) {
+	p := newPagination(len(users), page, perPage)
+
+	start := (p.Page - 1) * perPage
+	end := min(start+perPage, len(users))
+
+	return users[start:end], p
+}
+
+// newPagination describes one page of a list of total items. A page past either end of the list
+// gives the first or last page.
+func newPagination(total, page, perPage int) Pagination {
+	pages := max((total+perPage-1)/perPage, 1)
+	page = min(max(page, 1), pages)
+
+	p := Pagination{
+		Page:  page,
+		Pages: pages,
+		Total: total,
+	}
+	if page > 1 {
+		p.PrevPage = page - 1
+	}
+	if page < pages {
+		p.NextPage = page + 1
+	}
+
+	return p
+}
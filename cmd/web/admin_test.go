@@ -0,0 +1,282 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func TestConfig_AdminOnly(t *testing.T) {
+	var tests = []struct {
+		name         string
+		userID       int
+		twoFactor    bool
+		expectedCode int
+	}{
+		{"admin", 3, true, http.StatusOK},
+		{"admin without two-factor authentication", 3, false, http.StatusSeeOther},
+		{"member", 1, true, http.StatusSeeOther},
+		{"not logged in", 0, false, http.StatusTemporaryRedirect},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/users", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		if e.userID > 0 {
+			testApp.Session.Put(ctx, "userID", e.userID)
+		}
+		if e.twoFactor {
+			testApp.Session.Put(ctx, "twoFactor", true)
+		}
+
+		// run the handler behind the same middleware as in adminRouter()
+		handler := testApp.Auth(testApp.AdminOnly(http.HandlerFunc(testApp.GETAdminUsers)))
+		handler.ServeHTTP(res, req)
+
+		if res.Code != e.expectedCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedCode, res.Code)
+		}
+	}
+}
+
+func TestConfig_GETAdminUsers(t *testing.T) {
+	var tests = []struct {
+		name         string
+		url          string
+		expectedHTML []string
+		hiddenHTML   []string
+	}{
+		{"all users", "/admin/users", []string{"Test User", "Jane Doe", "3 users, page 1 of 1"}, nil},
+		{"search by name", "/admin/users?q=jane", []string{"Jane Doe", "1 users"}, []string{"Test User"}},
+		{"search by email", "/admin/users?q=ADMIN%40", []string{"admin@example.com"}, []string{"Jane Doe"}},
+		{"no match", "/admin/users?q=nobody", []string{"No users found."}, nil},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		testApp.Session.Put(ctx, "userID", 3)
+
+		handler := http.HandlerFunc(testApp.GETAdminUsers)
+		handler.ServeHTTP(res, req)
+
+		html := res.Body.String()
+		for _, expected := range e.expectedHTML {
+			if !strings.Contains(html, expected) {
+				t.Errorf("%s: expected %q on the page", e.name, expected)
+			}
+		}
+		for _, hidden := range e.hiddenHTML {
+			if strings.Contains(html, hidden) {
+				t.Errorf("%s: did not expect %q on the page", e.name, hidden)
+			}
+		}
+	}
+}
+
+func Test_paginateUsers(t *testing.T) {
+	var users []*db.User
+	for i := 1; i <= 7; i++ {
+		users = append(users, &db.User{ID: i})
+	}
+
+	var tests = []struct {
+		name          string
+		page          int
+		expectedIDs   []int
+		expectedPage  int
+		expectedPrev  int
+		expectedNext  int
+		expectedPages int
+	}{
+		{"first page", 1, []int{1, 2, 3}, 1, 0, 2, 3},
+		{"middle page", 2, []int{4, 5, 6}, 2, 1, 3, 3},
+		{"last page", 3, []int{7}, 3, 2, 0, 3},
+		{"before the first page", 0, []int{1, 2, 3}, 1, 0, 2, 3},
+		{"past the last page", 9, []int{7}, 3, 2, 0, 3},
+	}
+
+	for _, e := range tests {
+		page, p := paginateUsers(users, e.page, 3)
+
+		var ids []int
+		for _, u := range page {
+			ids = append(ids, u.ID)
+		}
+		if len(ids) != len(e.expectedIDs) || ids[0] != e.expectedIDs[0] || ids[len(ids)-1] != e.expectedIDs[len(e.expectedIDs)-1] {
+			t.Errorf("%s: expected users %v, got %v", e.name, e.expectedIDs, ids)
+		}
+		if p.Page != e.expectedPage || p.PrevPage != e.expectedPrev || p.NextPage != e.expectedNext || p.Pages != e.expectedPages {
+			t.Errorf("%s: unexpected pagination %+v", e.name, p)
+		}
+		if p.Total != 7 {
+			t.Errorf("%s: expected 7 users in total, got %d", e.name, p.Total)
+		}
+	}
+
+	if page, p := paginateUsers(nil, 1, 3); len(page) != 0 || p.Pages != 1 {
+		t.Errorf("expected one empty page without users, got %d users on %d pages", len(page), p.Pages)
+	}
+}
+
+func Test_userDetailsFromForm(t *testing.T) {
+	var tests = []struct {
+		name        string
+		form        url.Values
+		expectError bool
+	}{
+		{"valid", url.Values{"email": {" jane@example.com "}, "first-name": {"Jane"}, "last-name": {"Doe"}}, false},
+		{"invalid email", url.Values{"email": {"jane"}, "first-name": {"Jane"}, "last-name": {"Doe"}}, true},
+		{"email with a name", url.Values{"email": {"Jane <jane@example.com>"}, "first-name": {"Jane"}, "last-name": {"Doe"}}, true},
+		{"missing name", url.Values{"email": {"jane@example.com"}, "first-name": {"Jane"}}, true},
+		{"name too long", url.Values{"email": {"jane@example.com"}, "first-name": {strings.Repeat("a", maxNameLength+1)}, "last-name": {"Doe"}}, true},
+	}
+
+	for _, e := range tests {
+		_, _, _, err := userDetailsFromForm(e.form)
+		if (err != nil) != e.expectError {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectError, err)
+		}
+	}
+}
+
+func TestConfig_AdminUserActions(t *testing.T) {
+	var tests = []struct {
+		name             string
+		handler          http.HandlerFunc
+		userID           string
+		extra            url.Values
+		expectedLocation string
+		expectedFlashKey string
+	}{
+		{"edit", testApp.POSTAdminUser, "1", url.Values{"email": {"test@example.com"}, "first-name": {"Test"}, "last-name": {"Person"}}, "/admin/user?id=1", "flash"},
+		{"edit with invalid email", testApp.POSTAdminUser, "1", url.Values{"email": {"nope"}, "first-name": {"Test"}, "last-name": {"Person"}}, "/admin/user?id=1", "error"},
+		{"edit email to one in use", testApp.POSTAdminUser, "1", url.Values{"email": {"Admin@Example.com"}, "first-name": {"Test"}, "last-name": {"Person"}}, "/admin/user?id=1", "error"},
+		{"edit email", testApp.POSTAdminUser, "1", url.Values{"email": {"Test.Person@example.com"}, "first-name": {"Test"}, "last-name": {"Person"}}, "/admin/user?id=1", "flash"},
+		{"deactivate", testApp.POSTAdminDeactivateUser, "1", nil, "/admin/user?id=1", "flash"},
+		{"deactivate yourself", testApp.POSTAdminDeactivateUser, "3", nil, "/admin/user?id=3", "error"},
+		{"reactivate", testApp.POSTAdminReactivateUser, "1", nil, "/admin/user?id=1", "flash"},
+		{"delete", testApp.POSTAdminDeleteUser, "1", nil, "/admin/users", "flash"},
+		{"delete yourself", testApp.POSTAdminDeleteUser, "3", nil, "/admin/user?id=3", "error"},
+		{"no user", testApp.POSTAdminDeleteUser, "", nil, "/admin/users", "error"},
+	}
+
+	for _, e := range tests {
+		form := url.Values{"id": {e.userID}}
+		for k, v := range e.extra {
+			form[k] = v
+		}
+
+		req, _ := http.NewRequest("POST", "/admin/user", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		testApp.Session.Put(ctx, "userID", 3)
+
+		e.handler.ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, location)
+		}
+		if !testApp.Session.Exists(ctx, e.expectedFlashKey) {
+			t.Errorf("%s: expected a %s message", e.name, e.expectedFlashKey)
+		}
+	}
+}
+
+// customerDeletingGateway records the customers deleted with the payment provider
+type customerDeletingGateway struct {
+	*FakeGateway
+	deleted []string
+}
+
+func (g *customerDeletingGateway) DeleteCustomer(customerID string) error {
+	g.deleted = append(g.deleted, customerID)
+	return nil
+}
+
+func TestConfig_POSTAdminDeleteUser(t *testing.T) {
+	app := testApp
+	gateway := &customerDeletingGateway{FakeGateway: NewFakeGateway()}
+	subscriptions := &db.SubscriptionTest{}
+	app.Payments = gateway
+	app.Models.Subscription = subscriptions
+
+	form := url.Values{"id": {"1"}}
+	req, _ := http.NewRequest("POST", "/admin/user/delete", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	app.Session.Put(ctx, "userID", 3)
+
+	handler := http.HandlerFunc(app.POSTAdminDeleteUser)
+	handler.ServeHTTP(res, req)
+
+	if location := res.Header().Get("Location"); location != "/admin/users" {
+		t.Errorf("expected redirect to /admin/users, got %s", location)
+	}
+
+	// the user is not charged again once they are gone
+	changes := subscriptions.Changes()
+	if len(changes) != 1 || changes[0].Method != "UpdateStatus" || changes[0].Status != db.SubscriptionCanceled {
+		t.Errorf("expected the subscription to be canceled, got %v", changes)
+	}
+	if len(gateway.deleted) != 1 || gateway.deleted[0] != "cus_test" {
+		t.Errorf("expected customer cus_test to be deleted with the payment provider, got %v", gateway.deleted)
+	}
+}
+
+func TestConfig_AdminEndsUserSessions(t *testing.T) {
+	var tests = []struct {
+		name    string
+		handler func(app *Config) http.HandlerFunc
+	}{
+		{"deactivate", func(app *Config) http.HandlerFunc { return app.POSTAdminDeactivateUser }},
+		{"delete", func(app *Config) http.HandlerFunc { return app.POSTAdminDeleteUser }},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		app.SessionIndex = NewMemorySessionIndex()
+		app.Payments = NewFakeGateway()
+		app.Models.Subscription = &db.SubscriptionTest{}
+
+		_, laptop := loggedInSession(t, app, 1, "Firefox")
+		_, phone := loggedInSession(t, app, 1, "Safari")
+		_, someoneElse := loggedInSession(t, app, 2, "Chrome")
+
+		form := url.Values{"id": {"1"}}
+		req, _ := http.NewRequest("POST", "/admin/user", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		app.Session.Put(ctx, "userID", 3)
+
+		e.handler(&app).ServeHTTP(res, req)
+
+		for token, expected := range map[string]bool{laptop: false, phone: false, someoneElse: true} {
+			if _, found, _ := app.Session.Store.Find(token); found != expected {
+				t.Errorf("%s: expected session %s to exist to be %t", e.name, sessionID(token), expected)
+			}
+		}
+		if sessions, _ := app.SessionIndex.List(1); len(sessions) != 0 {
+			t.Errorf("%s: expected no sessions left, got %d", e.name, len(sessions))
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+const (
+	auditEventsPerPage = 50
+	maxUserAgentLength = 512
+	auditDateLayout    = "2006-01-02" // as sent by <input type="date">
+)
+
+// audit records an event in the audit log. The request the event came from, if any, gives the IP
+// address and user agent, and the actor if the event does not name one. Pass a nil request for
+// events the app causes by itself, such as renewals. An event that cannot be recorded is logged,
+// but does not stop whatever was being audited.
+func (app *Config) audit(r *http.Request, event db.AuditEvent) {
+	if r != nil {
+		if event.ActorID == 0 {
+			event.ActorID = app.Session.GetInt(r.Context(), "userID")
+		}
+		event.IPAddress = clientIP(r)
+		event.UserAgent = userAgent(r)
+	}
+
+	err := app.Models.AuditEvent.Insert(event)
+	if err != nil {
+		app.ErrorLog.Printf("Error recording audit event %s: %v\n", event.Action, err)
+	}
+}
+
+// clientIP returns the IP address a request came from. Forwarding headers are not trusted, as
+// anyone can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userAgent returns the user agent a request came from, cut to at most maxUserAgentLength bytes
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		// cut on a character boundary, so what is stored is still valid UTF-8
+		ua = strings.ToValidUTF8(ua[:maxUserAgentLength], "")
+	}
+	return ua
+}
+
+// userAuditFields returns the fields of a user that are compared in the audit log
+func userAuditFields(u db.User) map[string]any {
+	return map[string]any{
+		"email":      u.Email,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"active":     u.Active,
+		"is_admin":   u.IsAdmin,
+	}
+}
+
+// planAuditFields returns the fields of a plan that are compared in the audit log
+func planAuditFields(p db.Plan) map[string]any {
+	return map[string]any{
+		"name":       p.PlanName,
+		"prices":     p.Prices,
+		"trial_days": p.TrialDays,
+		"family":     p.PlanFamily,
+		"archived":   p.Archived(),
+	}
+}
+
+// Admin route
+// Shows the audit log, newest first, optionally only the events of one action, user, or period
+func (app *Config) GETAdminAudit(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	filter, err := auditFilterFromQuery(r.URL.Query())
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/admin/audit", http.StatusSeeOther)
+		return
+	}
+
+	total, err := app.Models.AuditEvent.Count(filter)
+	if err != nil {
+		app.ErrorLog.Println("Error counting audit events: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get the audit log")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil {
+		page = 1
+	}
+	pagination := newPagination(total, page, auditEventsPerPage)
+
+	events, err := app.Models.AuditEvent.Find(filter, auditEventsPerPage, (pagination.Page-1)*auditEventsPerPage)
+	if err != nil {
+		app.ErrorLog.Println("Error getting audit events: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get the audit log")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	// the filter is kept when moving between pages and exporting
+	query := auditQuery(filter)
+
+	app.render(w, r, "admin-audit.page.gohtml", &TemplateData{
+		StringMap: map[string]string{
+			"action": filter.Action,
+			"user":   query.Get("user"),
+			"from":   query.Get("from"),
+			"until":  query.Get("until"),
+			"query":  query.Encode(),
+		},
+		Data: map[string]any{
+			"events":     events,
+			"actions":    db.AuditActions,
+			"pagination": pagination,
+		},
+	})
+}
+
+// Admin route
+// Downloads the events of the audit log that match the same filters as the audit viewer, as CSV
+func (app *Config) GETAdminAuditExport(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	filter, err := auditFilterFromQuery(r.URL.Query())
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/admin/audit", http.StatusSeeOther)
+		return
+	}
+
+	events, err := app.Models.AuditEvent.Find(filter, 0, 0)
+	if err != nil {
+		app.ErrorLog.Println("Error getting audit events: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to export the audit log")
+		http.Redirect(w, r, "/admin/audit?"+auditQuery(filter).Encode(), http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-events-%s.csv"`, time.Now().Format("20060102")))
+
+	err = writeAuditCSV(w, events)
+	if err != nil {
+		app.ErrorLog.Println("Error writing audit export: ", err)
+		return
+	}
+
+	app.InfoLog.Printf("Admin %d exported %d audit events\n", app.Session.GetInt(r.Context(), "userID"), len(events))
+}
+
+// writeAuditCSV writes events as CSV, one event per row after a header row
+func writeAuditCSV(w io.Writer, events []*db.AuditEvent) error {
+	out := csv.NewWriter(w)
+
+	err := out.Write([]string{"id", "time", "action", "actor_id", "target_type", "target_id", "ip_address", "user_agent", "note", "changes"})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		actor := ""
+		if e.ActorID > 0 {
+			actor = strconv.Itoa(e.ActorID)
+		}
+
+		err = out.Write([]string{
+			strconv.Itoa(e.ID),
+			e.CreatedAt.Format("2006-01-02 15:04:05"),
+			e.Action,
+			actor,
+			e.TargetType,
+			csvCell(e.TargetID),
+			e.IPAddress,
+			csvCell(e.UserAgent),
+			csvCell(e.Note),
+			csvCell(strings.Join(e.ChangesForDisplay(), "\n")),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// csvCell keeps a spreadsheet from running a value as a formula. Values such as user agents come
+// from users, and a value starting with one of =+-@ would otherwise be run when the export is opened.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// auditFilterFromQuery reads the filters of the audit viewer from a query string: an action, a
+// user id, and a first and last day. The error is fit to show to the user.
+func auditFilterFromQuery(query url.Values) (db.AuditFilter, error) {
+	var filter db.AuditFilter
+
+	if action := query.Get("action"); action != "" {
+		if !slices.Contains(db.AuditActions, action) {
+			return filter, errors.New("Please choose an action from the list")
+		}
+		filter.Action = action
+	}
+
+	if user := strings.TrimSpace(query.Get("user")); user != "" {
+		userID, err := strconv.Atoi(user)
+		if err != nil || userID <= 0 {
+			return filter, errors.New("Please enter a user id")
+		}
+		filter.UserID = userID
+	}
+
+	if from := query.Get("from"); from != "" {
+		day, err := time.ParseInLocation(auditDateLayout, from, time.Local)
+		if err != nil {
+			return filter, errors.New("Please enter a valid date to show events from")
+		}
+		filter.From = day
+	}
+
+	if until := query.Get("until"); until != "" {
+		day, err := time.ParseInLocation(auditDateLayout, until, time.Local)
+		if err != nil {
+			return filter, errors.New("Please enter a valid date to show events until")
+		}
+		// the last day is included in full
+		filter.Until = day.AddDate(0, 0, 1)
+	}
+
+	if !filter.From.IsZero() && !filter.Until.IsZero() && !filter.From.Before(filter.Until) {
+		return filter, errors.New("The first day must not be after the last day")
+	}
+
+	return filter, nil
+}
+
+// auditQuery writes a filter as the query string auditFilterFromQuery reads
+func auditQuery(filter db.AuditFilter) url.Values {
+	query := url.Values{}
+	if filter.Action != "" {
+		query.Set("action", filter.Action)
+	}
+	if filter.UserID > 0 {
+		query.Set("user", strconv.Itoa(filter.UserID))
+	}
+	if !filter.From.IsZero() {
+		query.Set("from", filter.From.Format(auditDateLayout))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.AddDate(0, 0, -1).Format(auditDateLayout))
+	}
+	return query
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func Test_AuditChanges(t *testing.T) {
+	before := map[string]any{"email": "a@example.com", "active": 1, "removed": "x"}
+	after := map[string]any{"email": "b@example.com", "active": 1, "added": "y"}
+
+	changes := db.AuditChanges(before, after)
+
+	if len(changes) != 3 {
+		t.Errorf("expected 3 changed fields, got %v", changes)
+	}
+	if c := changes["email"]; c.From != "a@example.com" || c.To != "b@example.com" {
+		t.Errorf("unexpected change of email: %+v", c)
+	}
+	if _, ok := changes["active"]; ok {
+		t.Error("did not expect an unchanged field")
+	}
+	if c := changes["removed"]; c.From != "x" || c.To != nil {
+		t.Errorf("unexpected change of a removed field: %+v", c)
+	}
+	if c := changes["added"]; c.From != nil || c.To != "y" {
+		t.Errorf("unexpected change of an added field: %+v", c)
+	}
+}
+
+func Test_auditFilterFromQuery(t *testing.T) {
+	var tests = []struct {
+		name        string
+		query       url.Values
+		expectError bool
+	}{
+		{"no filter", url.Values{}, false},
+		{"every filter", url.Values{"action": {db.AuditLoginFailed}, "user": {"3"}, "from": {"2026-01-01"}, "until": {"2026-01-31"}}, false},
+		{"one day", url.Values{"from": {"2026-01-01"}, "until": {"2026-01-01"}}, false},
+		{"unknown action", url.Values{"action": {"drop table"}}, true},
+		{"invalid user", url.Values{"user": {"jane"}}, true},
+		{"invalid date", url.Values{"from": {"01/02/2026"}}, true},
+		{"from after until", url.Values{"from": {"2026-02-01"}, "until": {"2026-01-01"}}, true},
+	}
+
+	for _, e := range tests {
+		filter, err := auditFilterFromQuery(e.query)
+		if (err != nil) != e.expectError {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectError, err)
+			continue
+		}
+
+		// the viewer keeps the filter in its links, so it must read back the same
+		if err == nil {
+			if back, _ := auditFilterFromQuery(auditQuery(filter)); back != filter {
+				t.Errorf("%s: expected %+v after reading back, got %+v", e.name, filter, back)
+			}
+		}
+	}
+
+	filter, _ := auditFilterFromQuery(url.Values{"until": {"2026-01-31"}})
+	if !filter.Until.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("expected the last day to be included, got %s", filter.Until)
+	}
+}
+
+func Test_writeAuditCSV(t *testing.T) {
+	events := []*db.AuditEvent{
+		{
+			ID:         1,
+			Action:     db.AuditAdminUserUpdated,
+			ActorID:    3,
+			TargetType: db.AuditTargetUser,
+			TargetID:   "1",
+			IPAddress:  "203.0.113.5",
+			UserAgent:  "=HYPERLINK(\"http://example.com\")",
+			Changes:    map[string]db.AuditChange{"last_name": {From: "User", To: "Person"}},
+		},
+		{ID: 2, Action: db.AuditLoginFailed, Note: "Unknown email address"},
+	}
+
+	var out bytes.Buffer
+	err := writeAuditCSV(&out, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %d rows", len(rows))
+	}
+	if rows[1][3] != "3" || rows[2][3] != "" {
+		t.Errorf("expected actors 3 and none, got %q and %q", rows[1][3], rows[2][3])
+	}
+	if !strings.HasPrefix(rows[1][7], "'=") {
+		t.Errorf("expected a formula to be escaped, got %q", rows[1][7])
+	}
+	if rows[1][9] != `last_name: "User" → "Person"` {
+		t.Errorf("unexpected changes %q", rows[1][9])
+	}
+}
+
+func TestConfig_audit_Login(t *testing.T) {
+	postedData := strings.NewReader(url.Values{
+		"email":    {"test@example.com"},
+		"password": {"abc12345"},
+	}.Encode())
+
+	req, _ := http.NewRequest("POST", "/login", postedData)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "audit-test")
+	req.RemoteAddr = "203.0.113.5:4321"
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.POSTLoginPage)
+	handler.ServeHTTP(res, req)
+
+	events, _ := testApp.Models.AuditEvent.Find(db.AuditFilter{Action: db.AuditLoginSucceeded, UserID: 1}, 1, 0)
+	if len(events) != 1 {
+		t.Fatal("expected the login to be recorded")
+	}
+	if e := events[0]; e.ActorID != 1 || e.IPAddress != "203.0.113.5" || e.UserAgent != "audit-test" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestConfig_audit_AdminEdit(t *testing.T) {
+	form := url.Values{"id": {"1"}, "email": {"test@example.com"}, "first-name": {"Test"}, "last-name": {"Person"}}
+
+	req, _ := http.NewRequest("POST", "/admin/user", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	testApp.Session.Put(ctx, "userID", 3)
+
+	handler := http.HandlerFunc(testApp.POSTAdminUser)
+	handler.ServeHTTP(res, req)
+
+	events, _ := testApp.Models.AuditEvent.Find(db.AuditFilter{Action: db.AuditAdminUserUpdated, UserID: 3}, 1, 0)
+	if len(events) != 1 {
+		t.Fatal("expected the edit to be recorded")
+	}
+	e := events[0]
+	if e.ActorID != 3 || e.TargetID != "1" {
+		t.Errorf("expected admin 3 to have edited user 1, got %+v", e)
+	}
+	if c, ok := e.Changes["last_name"]; !ok || c.From != "User" || c.To != "Person" || len(e.Changes) != 1 {
+		t.Errorf("expected only the last name to change, got %v", e.Changes)
+	}
+}
+
+func TestConfig_GETAdminAudit(t *testing.T) {
+	testApp.Models.AuditEvent.Insert(db.AuditEvent{Action: db.AuditPasswordChanged, ActorID: 2, TargetType: db.AuditTargetUser, TargetID: "2", Note: "<b>audit note</b>"})
+
+	var tests = []struct {
+		name         string
+		url          string
+		expectedHTML string
+		hiddenHTML   string
+	}{
+		{"all events", "/admin/audit", "&lt;b&gt;audit note&lt;/b&gt;", "<b>audit note</b>"},
+		{"filtered", "/admin/audit?action=password.changed&user=2", "&lt;b&gt;audit note", ""},
+		{"filtered out", "/admin/audit?action=password.changed&user=99", "No events found.", "audit note"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		testApp.Session.Put(ctx, "userID", 3)
+
+		handler := http.HandlerFunc(testApp.GETAdminAudit)
+		handler.ServeHTTP(res, req)
+
+		html := res.Body.String()
+		if !strings.Contains(html, e.expectedHTML) {
+			t.Errorf("%s: expected %q on the page", e.name, e.expectedHTML)
+		}
+		if e.hiddenHTML != "" && strings.Contains(html, e.hiddenHTML) {
+			t.Errorf("%s: did not expect %q on the page", e.name, e.hiddenHTML)
+		}
+	}
+}
+
+func TestConfig_GETAdminAuditExport(t *testing.T) {
+	testApp.Models.AuditEvent.Insert(db.AuditEvent{Action: db.AuditRefunded, TargetType: db.AuditTargetCharge, TargetID: "ch_export"})
+
+	req, _ := http.NewRequest("GET", "/admin/audit/export?action=payment.refunded", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	testApp.Session.Put(ctx, "userID", 3)
+
+	handler := http.HandlerFunc(testApp.GETAdminAuditExport)
+	handler.ServeHTTP(res, req)
+
+	if contentType := res.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/csv") {
+		t.Errorf("expected CSV, got %s", contentType)
+	}
+	if !strings.Contains(res.Body.String(), "ch_export") {
+		t.Error("expected the refund in the export")
+	}
+	if strings.Contains(res.Body.String(), db.AuditPasswordChanged) {
+		t.Error("did not expect events of other actions in the export")
+	}
+}
+
+func TestConfig_audit_LoginError(t *testing.T) {
+	app := testApp
+	app.Models.AuditEvent = &db.AuditEventTest{}
+	throttle := NewMemoryLoginThrottle(time.Now)
+	app.LoginThrottle = throttle
+
+	postedData := strings.NewReader(url.Values{
+		"email":    {"test@example.com"},
+		"password": {db.TestPasswordError},
+	}.Encode())
+
+	req, _ := http.NewRequest("POST", "/login", postedData)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(app.POSTLoginPage)
+	handler.ServeHTTP(res, req)
+
+	if app.Session.Exists(ctx, "userID") {
+		t.Error("did not expect to be logged in")
+	}
+
+	events, _ := app.Models.AuditEvent.Find(db.AuditFilter{Action: db.AuditLoginFailed}, 0, 0)
+	if len(events) != 1 || events[0].TargetID != "1" {
+		t.Fatalf("expected a failed login of user 1 to be recorded, got %+v", events)
+	}
+
+	// the attempt counts towards locking the account out
+	for i := 1; i < accountPolicy.FreeAttempts; i++ {
+		app.recordFailedLogin("test@example.com", "192.0.2.1")
+	}
+	if lockout, _ := throttle.Failed("test@example.com", "192.0.2.1"); lockout == 0 {
+		t.Error("expected the failed password check to count towards a lockout")
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
 	"github.com/phpdave11/gofpdf"
@@ -11,11 +15,322 @@ import (
 var pathToManual = "./pdf"
 var pathToTmpPDFWrite = "./tmp"
 
-// For now, this is a dummy function
-// In a real application, this function would generate an invoice
-// using financial data from the user and plan, and accounting for taxes, discounts, etc.
-func (app *Config) GenerateInvoice(u db.User, plan *db.Plan) (string, error) {
-	return plan.PlanAmountFormatted, nil
+var invoicePaymentTerms = 7 // days from issue until an invoice is due
+
+// company details printed at the top of every invoice
+var invoiceCompanyName = "GoCode.ca"
+var invoiceCompanyAddress = []string{"123 Main Street", "Toronto, ON M5V 2T6", "Canada"}
+var invoiceCompanyEmail = "info@mycompany.com"
+
+// reverseChargeNote is printed on invoices that are reverse charged
+var reverseChargeNote = "Reverse charge: the customer is liable to account for the tax on this invoice."
+
+// GenerateInvoice builds the invoice for one billing period of the plan. The invoice is not saved;
+// the caller links it to a subscription and stores it with Models.Invoice.Insert.
+// Taxes are charged according to the user's billing address; discounts are added by applyDiscount.
+func (app *Config) GenerateInvoice(u db.User, plan *db.Plan) (*db.Invoice, error) {
+	if plan.PlanAmount < 0 {
+		return nil, fmt.Errorf("plan %d has a negative amount", plan.ID)
+	}
+
+	issued := time.Now()
+
+	invoice := db.Invoice{
+		UserID:   u.ID,
+		Status:   db.InvoiceOpen,
+		Currency: plan.Currency,
+		Locale:   u.Locale,
+		IssuedAt: issued,
+		DueAt:    issued.AddDate(0, 0, invoicePaymentTerms),
+		LineItems: []*db.InvoiceLineItem{
+			{
+				Description: fmt.Sprintf("%s (monthly subscription)", plan.PlanName),
+				Quantity:    1,
+				UnitAmount:  plan.PlanAmount,
+				Amount:      plan.PlanAmount,
+			},
+		},
+	}
+
+	err := app.applyTax(&invoice, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
+
+// GenerateProrationInvoice builds the invoice for changing a subscription to another plan part way
+// through its billing period. The user is credited for the time left on the current plan, and
+// charged for the same time on the new plan; the period itself does not change.
+// Both plans must be priced in the currency the user pays in.
+func (app *Config) GenerateProrationInvoice(u db.User, current *db.Subscription, plan *db.Plan, now time.Time) (*db.Invoice, error) {
+	if plan.PlanAmount < 0 {
+		return nil, fmt.Errorf("plan %d has a negative amount", plan.ID)
+	}
+	if plan.Currency != current.Plan.Currency {
+		return nil, fmt.Errorf("plan %d is priced in %s, but subscription %d is paid in %s",
+			plan.ID, plan.Currency, current.ID, current.Plan.Currency)
+	}
+
+	credit := prorate(current.Plan.PlanAmount, current.CurrentPeriodStart, current.CurrentPeriodEnd, now)
+	charge := prorate(plan.PlanAmount, current.CurrentPeriodStart, current.CurrentPeriodEnd, now)
+
+	invoice := db.Invoice{
+		UserID:   u.ID,
+		Status:   db.InvoiceOpen,
+		Currency: plan.Currency,
+		Locale:   u.Locale,
+		IssuedAt: now,
+		DueAt:    now.AddDate(0, 0, invoicePaymentTerms),
+		LineItems: []*db.InvoiceLineItem{
+			{
+				Description: fmt.Sprintf("Unused time on %s after %s", current.Plan.PlanName, now.Format("Jan 2, 2006")),
+				Quantity:    1,
+				UnitAmount:  -credit,
+				Amount:      -credit,
+			},
+			{
+				Description: fmt.Sprintf("Remaining time on %s until %s", plan.PlanName, current.CurrentPeriodEnd.Format("Jan 2, 2006")),
+				Quantity:    1,
+				UnitAmount:  charge,
+				Amount:      charge,
+			},
+		},
+	}
+
+	err := app.applyTax(&invoice, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
+
+// currentSubscription returns the user's subscription if it is on a trial, active or past due, or nil
+// if they have none. A user with a current subscription changes plan; anyone else starts a new
+// subscription instead.
+func (app *Config) currentSubscription(userID int) (*db.Subscription, error) {
+	subscription, err := app.Models.Subscription.GetCurrentForUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// prorate returns the part of a period's amount that covers the time from now until the end of the period
+func prorate(amount int, periodStart, periodEnd, now time.Time) int {
+	period := periodEnd.Sub(periodStart)
+	remaining := periodEnd.Sub(now)
+
+	switch {
+	case period <= 0 || remaining <= 0:
+		return 0
+	case remaining >= period:
+		return amount
+	}
+
+	return int(math.Round(float64(amount) * float64(remaining) / float64(period)))
+}
+
+// calculateTotals adds up the line items of an invoice, and works out its tax lines from the subtotal.
+// Tax is added to the subtotal, unless the invoice's prices already include it.
+func calculateTotals(invoice *db.Invoice) {
+	// lines that were just added are formatted like the rest of the invoice
+	defer invoice.Localize(invoice.Locale)
+
+	invoice.Subtotal = 0
+	for _, item := range invoice.LineItems {
+		invoice.Subtotal += item.Amount
+	}
+
+	// the tax included in a price is worked out from the price before tax
+	net := invoice.Subtotal
+	if invoice.TaxInclusive {
+		rate := 0
+		for _, line := range invoice.TaxLines {
+			rate += line.Rate
+		}
+		net = withoutTax(invoice.Subtotal, rate)
+	}
+
+	invoice.Tax = 0
+	for _, line := range invoice.TaxLines {
+		line.Amount = taxOn(net, line.Rate)
+		invoice.Tax += line.Amount
+	}
+
+	if !invoice.TaxInclusive {
+		invoice.Total = invoice.Subtotal + invoice.Tax
+		return
+	}
+
+	// rounding each tax line must not change the price, so any cent left over goes on the last one
+	if n := len(invoice.TaxLines); n > 0 {
+		difference := invoice.Subtotal - net - invoice.Tax
+		invoice.TaxLines[n-1].Amount += difference
+		invoice.Tax += difference
+	}
+	invoice.Total = invoice.Subtotal
+}
+
+// GenerateInvoicePDF renders a saved invoice as a pdf document, ready to be attached to the invoice email
+func (app *Config) GenerateInvoicePDF(u db.User, invoice *db.Invoice) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetTitle(fmt.Sprintf("Invoice %s", invoice.NumberForDisplay()), false)
+	pdf.SetAuthor(invoiceCompanyName, false)
+
+	// the core fonts are not unicode, so everything that may hold other characters, such as currency
+	// symbols like € and ¥ or the customer's name and address, is translated to their encoding
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.AddPage()
+
+	// company header, with the invoice details on the right
+	pdf.SetFont("Arial", "B", 20)
+	pdf.CellFormat(110, 10, invoiceCompanyName, "", 0, "L", false, 0, "")
+	pdf.CellFormat(70, 10, "INVOICE", "", 1, "R", false, 0, "")
+
+	pdf.SetFont("Arial", "", 10)
+	details := []string{
+		fmt.Sprintf("Invoice number: %s", invoice.NumberForDisplay()),
+		fmt.Sprintf("Issued: %s", invoice.IssuedAt.Format("January 2, 2006")),
+		fmt.Sprintf("Due: %s", invoice.DueAt.Format("January 2, 2006")),
+	}
+	companyLines := append(append([]string{}, invoiceCompanyAddress...), invoiceCompanyEmail)
+	for i := 0; i < len(companyLines) || i < len(details); i++ {
+		var left, right string
+		if i < len(companyLines) {
+			left = companyLines[i]
+		}
+		if i < len(details) {
+			right = details[i]
+		}
+		pdf.CellFormat(110, 5, left, "", 0, "L", false, 0, "")
+		pdf.CellFormat(70, 5, right, "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(10)
+
+	// customer billing details
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(0, 6, "Bill To", "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 10)
+	pdf.CellFormat(0, 5, tr(fmt.Sprintf("%s %s", u.FirstName, u.LastName)), "", 1, "L", false, 0, "")
+	for _, line := range u.BillingAddress.Lines() {
+		pdf.CellFormat(0, 5, tr(line), "", 1, "L", false, 0, "")
+	}
+	pdf.CellFormat(0, 5, tr(u.Email), "", 1, "L", false, 0, "")
+	if u.TaxID != "" {
+		pdf.CellFormat(0, 5, tr(fmt.Sprintf("Tax ID: %s", u.TaxID)), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(10)
+
+	// line items
+	widths := []float64{100, 20, 30, 30}
+	pdf.SetFont("Arial", "B", 10)
+	pdf.SetFillColor(230, 230, 230)
+	for i, heading := range []string{"Description", "Quantity", "Unit Price", "Amount"} {
+		align := "R"
+		if i == 0 {
+			align = "L"
+		}
+		pdf.CellFormat(widths[i], 7, heading, "B", 0, align, true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Arial", "", 10)
+	for _, item := range invoice.LineItems {
+		pdf.CellFormat(widths[0], 7, tr(item.Description), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 7, fmt.Sprintf("%d", item.Quantity), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[2], 7, tr(item.UnitAmountForDisplay()), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, tr(item.AmountForDisplay()), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(2)
+
+	// tax and totals
+	totalsOffset := widths[0] + widths[1]
+	type totalLine struct {
+		label  string
+		amount string
+	}
+	totals := []totalLine{{"Subtotal", invoice.SubtotalForDisplay()}}
+	for _, line := range invoice.TaxLines {
+		label := line.Description()
+		if invoice.TaxInclusive {
+			label = fmt.Sprintf("Incl. %s", label)
+		}
+		totals = append(totals, totalLine{label, line.AmountForDisplay()})
+	}
+	if len(invoice.TaxLines) == 0 {
+		totals = append(totals, totalLine{"Tax", invoice.TaxForDisplay()})
+	}
+	totals = append(totals, totalLine{"Total", invoice.TotalForDisplay()})
+
+	for i, line := range totals {
+		border := ""
+		if i == len(totals)-1 {
+			pdf.SetFont("Arial", "B", 10)
+			border = "T"
+		}
+		pdf.CellFormat(totalsOffset, 7, "", "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 7, tr(line.label), border, 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, tr(line.amount), border, 1, "R", false, 0, "")
+	}
+
+	if invoice.ReverseCharge {
+		pdf.Ln(5)
+		pdf.SetFont("Arial", "", 10)
+		pdf.CellFormat(0, 5, tr(reverseChargeNote), "", 1, "L", false, 0, "")
+	}
+
+	if invoice.Status == db.InvoicePaid {
+		pdf.Ln(10)
+		pdf.SetFont("Arial", "B", 14)
+		pdf.SetTextColor(0, 128, 0)
+		pdf.CellFormat(0, 8, "PAID", "", 1, "R", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	}
+
+	return pdf
+}
+
+// sendInvoiceEmail emails a saved invoice to the user, with the invoice pdf attached
+func (app *Config) sendInvoiceEmail(u db.User, invoiceID int) {
+	invoice, err := app.Models.Invoice.GetOne(invoiceID)
+	if err != nil {
+		app.ErrorChan <- fmt.Errorf("error getting invoice %d: %v", invoiceID, err)
+		return
+	}
+	invoice.Localize(u.Locale)
+
+	msg := Message{
+		To:       u.Email,
+		Subject:  "Your Invoice",
+		Template: "invoice-email",
+		Data:     invoice,
+		DataMap: map[string]any{
+			"reverseChargeNote": reverseChargeNote,
+		},
+	}
+
+	pdf := app.GenerateInvoicePDF(u, invoice)
+	filePath := fmt.Sprintf("%s/%s_%d_invoice.pdf", pathToTmpPDFWrite, invoice.NumberForDisplay(), u.ID)
+	err = pdf.OutputFileAndClose(filePath)
+	if err != nil {
+		// still send the invoice email, just without the pdf
+		app.ErrorChan <- fmt.Errorf("error generating invoice pdf: %v", err)
+	} else {
+		msg.AttachmentMap = map[string]string{
+			fmt.Sprintf("%s.pdf", invoice.NumberForDisplay()): filePath,
+		}
+	}
+
+	app.sendEmail(msg)
 }
 
 // For now, this is a dummy function
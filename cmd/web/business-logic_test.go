@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+	"github.com/phpdave11/gofpdf"
+	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+)
+
+func TestConfig_GenerateInvoicePDF(t *testing.T) {
+	user := db.User{
+		ID:        1,
+		Email:     "testUser@example.com",
+		FirstName: "Test",
+		LastName:  "User",
+	}
+	invoice, _ := testApp.Models.Invoice.GetOne(1)
+
+	pdf := testApp.GenerateInvoicePDF(user, invoice)
+	pdf.SetCompression(false) // leave the page content readable, so we can look for text in it
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		t.Fatal("error writing invoice pdf: ", err)
+	}
+
+	// parse the document back in, as another pdf would when importing it
+	var rs io.ReadSeeker = bytes.NewReader(buf.Bytes())
+	importer := gofpdi.NewImporter()
+	importer.ImportPageFromStream(gofpdf.New("P", "mm", "A4", ""), &rs, 1, "/MediaBox")
+
+	sizes := importer.GetPageSizes()
+	if len(sizes) != 1 {
+		t.Errorf("expected a single page invoice, got %d pages", len(sizes))
+	}
+	if w, h := sizes[1]["/MediaBox"]["w"], sizes[1]["/MediaBox"]["h"]; math.Round(w) != 595 || math.Round(h) != 842 {
+		t.Errorf("expected an A4 page, got %.0f x %.0f points", w, h)
+	}
+
+	// check that all the parts of the invoice made it into the document. Text in a pdf
+	// is written inside brackets, so any brackets in the text itself are escaped.
+	content := buf.String()
+	escape := strings.NewReplacer("(", `\(`, ")", `\)`)
+	for _, expected := range []string{
+		invoiceCompanyName,
+		invoice.NumberForDisplay(),
+		"Test User",
+		"testUser@example.com",
+		invoice.LineItems[0].Description,
+		"Tax",
+		"Total",
+		invoice.TotalForDisplay(),
+	} {
+		if !strings.Contains(content, escape.Replace(expected)) {
+			t.Errorf("expected invoice pdf to contain %q", expected)
+		}
+	}
+}
+
+func TestConfig_GenerateInvoicePDF_Translated(t *testing.T) {
+	user := db.User{
+		ID:             1,
+		Email:          "jose@example.com",
+		FirstName:      "José",
+		LastName:       "Müller",
+		BillingAddress: db.Address{Line1: "Straße 1", City: "Köln", Country: "DE"},
+	}
+	invoice, _ := testApp.Models.Invoice.GetOne(1)
+	invoice.ReverseCharge = true
+
+	pdf := testApp.GenerateInvoicePDF(user, invoice)
+	pdf.SetCompression(false) // leave the page content readable, so we can look for text in it
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		t.Fatal("error writing invoice pdf: ", err)
+	}
+
+	// the core fonts are encoded in cp1252, where é is 0xe9, ü is 0xfc, ß is 0xdf and ö is 0xf6
+	content := buf.String()
+	for _, expected := range []string{"Jos\xe9 M\xfcller", "Stra\xdfe 1", "K\xf6ln", reverseChargeNote} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("expected invoice pdf to contain %q", expected)
+		}
+	}
+}
+
+func TestConfig_GenerateProrationInvoice(t *testing.T) {
+	periodStart := time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)
+	current := &db.Subscription{
+		ID:                 1,
+		PlanID:             1,
+		Status:             db.SubscriptionActive,
+		CurrentPeriodStart: periodStart,
+		CurrentPeriodEnd:   db.NextPeriodEnd(periodStart), // a 30 day period
+		Plan:               &db.Plan{ID: 1, PlanName: "Bronze Plan", PlanAmount: 1000},
+	}
+	gold := &db.Plan{ID: 3, PlanName: "Gold Plan", PlanAmount: 3000}
+
+	var tests = []struct {
+		name           string
+		now            time.Time
+		expectedCredit int
+		expectedCharge int
+	}{
+		{"start of period", periodStart, -1000, 3000},
+		{"a third of the way through", periodStart.AddDate(0, 0, 10), -667, 2000},
+		{"end of period", current.CurrentPeriodEnd, 0, 0},
+	}
+
+	for _, e := range tests {
+		invoice, err := testApp.GenerateProrationInvoice(db.User{ID: 1}, current, gold, e.now)
+		if err != nil {
+			t.Fatalf("%s: error generating invoice: %v", e.name, err)
+		}
+
+		if len(invoice.LineItems) != 2 {
+			t.Fatalf("%s: expected a credit and a charge line, got %d lines", e.name, len(invoice.LineItems))
+		}
+		if invoice.LineItems[0].Amount != e.expectedCredit {
+			t.Errorf("%s: expected a credit of %d, got %d", e.name, e.expectedCredit, invoice.LineItems[0].Amount)
+		}
+		if invoice.LineItems[1].Amount != e.expectedCharge {
+			t.Errorf("%s: expected a charge of %d, got %d", e.name, e.expectedCharge, invoice.LineItems[1].Amount)
+		}
+		if invoice.Total != e.expectedCredit+e.expectedCharge {
+			t.Errorf("%s: expected a total of %d, got %d", e.name, e.expectedCredit+e.expectedCharge, invoice.Total)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
@@ -18,6 +19,20 @@ type Config struct {
 	Wait          *sync.WaitGroup
 	Models        db.Models
 	Mailer        Mail
+	Payments      PaymentGateway
+	LoginThrottle LoginThrottle
+	SessionIndex  SessionIndex
+	WebhookSecret []byte // shared with the payment provider to sign webhooks
+	TOTPKey       []byte // encrypts the two-factor secrets of users; 32 bytes, for AES-256
+	SellerCountry string // where the business is registered for tax; sales there are never reverse charged
 	ErrorChan     chan error
 	ErrorChanDone chan bool
+
+	RenewalInterval time.Duration // how often to look for subscriptions that are due for renewal
+	RenewalDone     chan bool
+	DunningSchedule []int // days after a failed payment on which it is retried; the last retry ends the grace period
+
+	RateLimiter      RateLimiter
+	UsedTokens       TokenStore    // one-time links that have been used
+	ActivationExpiry time.Duration // how long the link that activates a new account works for
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// couponForPlan looks up a promotion code the user entered, and checks that it can be used with the plan
+func (app *Config) couponForPlan(code string, plan *db.Plan) (*db.Coupon, error) {
+	coupon, err := app.Models.Coupon.GetByCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	err = coupon.Validate(plan.ID, plan.Currency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	coupon.Locale = plan.Locale
+
+	return coupon, nil
+}
+
+// couponErrorMessage tells the user why a promotion code was not accepted
+func couponErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, db.ErrCouponInactive):
+		return "That promotion code is not valid."
+	case errors.Is(err, db.ErrCouponExpired):
+		return "That promotion code has expired."
+	case errors.Is(err, db.ErrCouponNotForPlan):
+		return "That promotion code cannot be used with this plan."
+	case errors.Is(err, db.ErrCouponWrongCurrency):
+		return "That promotion code cannot be used in your currency."
+	case errors.Is(err, db.ErrCouponUsedUp):
+		return "That promotion code has been fully redeemed."
+	case errors.Is(err, db.ErrCouponAlreadyRedeemed):
+		return "You have already used that promotion code."
+	default:
+		return "Unable to apply the promotion code"
+	}
+}
+
+// applyDiscount adds the coupon's discount to an invoice as a line item of its own
+func applyDiscount(invoice *db.Invoice, coupon *db.Coupon) {
+	calculateTotals(invoice)
+
+	discount := coupon.Discount(invoice.Subtotal)
+	if discount == 0 {
+		return
+	}
+
+	invoice.LineItems = append(invoice.LineItems, &db.InvoiceLineItem{
+		Description: fmt.Sprintf("Discount (%s: %s)", coupon.Code, coupon.DiscountForDisplay()),
+		Quantity:    1,
+		UnitAmount:  -discount,
+		Amount:      -discount,
+	})
+
+	calculateTotals(invoice)
+}
+
+// subscriptionCoupon returns the coupon that discounts the subscription's next invoice, or nil if there is none.
+// A coupon keeps discounting a subscription it was redeemed for, even after it expires or is used up.
+func (app *Config) subscriptionCoupon(subscription *db.Subscription) (*db.Coupon, error) {
+	if !subscription.HasDiscount() {
+		return nil, nil
+	}
+
+	return app.Models.Coupon.GetOne(subscription.CouponID)
+}
+
+// cancelRedemption gives back a coupon redemption when the checkout it was made for fails
+func (app *Config) cancelRedemption(redemptionID int) {
+	if redemptionID == 0 {
+		return
+	}
+
+	err := app.Models.Coupon.CancelRedemption(redemptionID)
+	if err != nil {
+		app.ErrorLog.Printf("Error canceling coupon redemption %d: %v\n", redemptionID, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func Test_applyDiscount(t *testing.T) {
+	var tests = []struct {
+		name          string
+		coupon        db.Coupon
+		expectedTotal int
+	}{
+		{"percent", db.Coupon{Code: "SAVE20", DiscountType: db.CouponPercent, PercentOff: 20}, 800},
+		{"percent is rounded", db.Coupon{Code: "SAVE33", DiscountType: db.CouponPercent, PercentOff: 33}, 670},
+		{"fixed", db.Coupon{Code: "FIVEOFF", DiscountType: db.CouponFixed, AmountOff: 500}, 500},
+		{"fixed is capped at the total", db.Coupon{Code: "BIGOFF", DiscountType: db.CouponFixed, AmountOff: 5000}, 0},
+	}
+
+	for _, e := range tests {
+		invoice, _ := testApp.GenerateInvoice(db.User{ID: 1}, &db.Plan{ID: 1, PlanName: "Test Plan", PlanAmount: 1000})
+
+		applyDiscount(invoice, &e.coupon)
+
+		if invoice.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d, got %d", e.name, e.expectedTotal, invoice.Total)
+		}
+		if len(invoice.LineItems) != 2 || invoice.LineItems[1].Amount != e.expectedTotal-1000 {
+			t.Errorf("%s: expected the discount as a line item of %d", e.name, e.expectedTotal-1000)
+		}
+	}
+}
+
+func TestConfig_couponForPlan(t *testing.T) {
+	plan := &db.Plan{ID: 1, PlanName: "Test Plan", PlanAmount: 1000}
+
+	var tests = []struct {
+		name        string
+		code        string
+		expectedErr error
+	}{
+		{"valid", "SAVE20", nil},
+		{"code is not case sensitive", " save20 ", nil},
+		{"expired", "EXPIRED", db.ErrCouponExpired},
+		{"other plan", "GOLDONLY", db.ErrCouponNotForPlan},
+	}
+
+	for _, e := range tests {
+		_, err := testApp.couponForPlan(e.code, plan)
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+	}
+
+	if _, err := testApp.couponForPlan("NOSUCHCODE", plan); couponErrorMessage(err) != "That promotion code is not valid." {
+		t.Errorf("expected an unknown code to be reported as not valid, got %v", err)
+	}
+}
+
+func TestCoupon_Validate(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Hour)
+
+	var tests = []struct {
+		name        string
+		coupon      db.Coupon
+		expectedErr error
+	}{
+		{"valid", db.Coupon{Active: true}, nil},
+		{"inactive", db.Coupon{}, db.ErrCouponInactive},
+		{"expired", db.Coupon{Active: true, ExpiresAt: &expired}, db.ErrCouponExpired},
+		{"restricted to another plan", db.Coupon{Active: true, PlanID: 2}, db.ErrCouponNotForPlan},
+		{"used up", db.Coupon{Active: true, MaxRedemptions: 10, TimesRedeemed: 10}, db.ErrCouponUsedUp},
+		{"fixed in the same currency", db.Coupon{Active: true, DiscountType: db.CouponFixed, Currency: "USD"}, nil},
+		{"fixed in another currency", db.Coupon{Active: true, DiscountType: db.CouponFixed, Currency: "EUR"}, db.ErrCouponWrongCurrency},
+		{"percent in any currency", db.Coupon{Active: true, DiscountType: db.CouponPercent, Currency: "EUR"}, nil},
+	}
+
+	for _, e := range tests {
+		if err := e.coupon.Validate(1, "USD", now); !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
+
+func TestCoupon_Periods(t *testing.T) {
+	once := db.Coupon{Duration: db.CouponOnce}
+	if p := once.Periods(); p == nil || *p != 1 {
+		t.Error("expected a once coupon to discount one invoice")
+	}
+
+	repeating := db.Coupon{Duration: db.CouponRepeating, DurationMonths: 3}
+	if p := repeating.Periods(); p == nil || *p != 3 {
+		t.Error("expected a repeating coupon to discount its number of months")
+	}
+
+	forever := db.Coupon{Duration: db.CouponForever}
+	if forever.Periods() != nil {
+		t.Error("expected a forever coupon to discount every invoice")
+	}
+}
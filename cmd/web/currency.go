@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// requestLocale returns the supported locale that best fits the languages the user's browser asks for
+func requestLocale(r *http.Request) string {
+	return db.MatchLocale(r.Header.Get("Accept-Language"))
+}
+
+// userCurrency returns the currency the user pays in. A user picks their currency once, when they
+// first subscribe; until then, the currency they asked for is used, or else the one of their locale.
+func userCurrency(u db.User, requested, locale string) string {
+	switch {
+	case u.Currency != "":
+		return u.Currency
+	case u.Plan != nil && u.Plan.Currency != "":
+		// subscribed before the user's currency was stored
+		return u.Plan.Currency
+	case db.IsSupportedCurrency(requested):
+		return requested
+	default:
+		return db.CurrencyForLocale(locale)
+	}
+}
+
+// hasChosenCurrency reports whether the user's currency is settled, so they can no longer pick another one
+func hasChosenCurrency(u db.User) bool {
+	return u.Currency != "" || (u.Plan != nil && u.Plan.Currency != "")
+}
+
+// priceInCurrency returns the plan priced in the given currency, formatted for the locale
+func priceInCurrency(plan *db.Plan, currency, locale string) (*db.Plan, error) {
+	priced, err := plan.InCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	priced.Localize(locale)
+
+	return priced, nil
+}
+
+// saveCurrency stores the currency of the user's first subscription as the currency they pay in from now on
+func (app *Config) saveCurrency(u db.User, currency string) {
+	if u.Currency != "" {
+		return
+	}
+
+	_, err := app.Models.User.SetCurrency(u.ID, currency)
+	if err != nil {
+		app.ErrorLog.Printf("Error saving currency of user %d: %v\n", u.ID, err)
+	}
+}
+
+// parseAmount reads an amount entered in the major unit of a currency, e.g. "10.50" USD, and returns
+// it in the minor unit, e.g. 1050. Amounts in JPY, which has no minor unit, cannot have decimals.
+func parseAmount(value, currency string) (int, error) {
+	exponent := db.CurrencyExponent(currency)
+
+	whole, fraction, hasFraction := strings.Cut(strings.TrimSpace(value), ".")
+	if whole == "" || len(fraction) > exponent || (hasFraction && fraction == "") {
+		return 0, fmt.Errorf("Please enter a valid amount in %s", currency)
+	}
+
+	for _, c := range whole + fraction {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("Please enter a valid amount in %s", currency)
+		}
+	}
+
+	// pad the fraction out to the minor unit, so "10.5" USD is 1050 cents
+	amount, err := strconv.Atoi(whole + fraction + strings.Repeat("0", exponent-len(fraction)))
+	if err != nil {
+		return 0, fmt.Errorf("Please enter a valid amount in %s", currency)
+	}
+
+	return amount, nil
+}
+
+// amountInput writes an amount in the minor unit of a currency the way parseAmount reads it
+func amountInput(amount int, currency string) string {
+	exponent := db.CurrencyExponent(currency)
+	if exponent == 0 {
+		return strconv.Itoa(amount)
+	}
+
+	unit := int(math.Pow10(exponent))
+	return fmt.Sprintf("%d.%0*d", amount/unit, exponent, amount%unit)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func Test_FormatMoney(t *testing.T) {
+	var tests = []struct {
+		name     string
+		amount   int
+		currency string
+		locale   string
+		expected string
+	}{
+		{"dollars in the US", 123456, "USD", "en-US", "$1,234.56"},
+		{"euros in Germany", 123456, "EUR", "de-DE", "1.234,56\u00a0€"},
+		{"euros in France", 123456, "EUR", "fr-FR", "1\u00a0234,56\u00a0€"},
+		{"pounds in the UK", 123456, "GBP", "en-GB", "£1,234.56"},
+		{"yen have no minor unit", 1500, "JPY", "en-US", "¥1,500"},
+		{"foreign dollars are told apart", 123456, "CAD", "en-US", "CA$1,234.56"},
+		{"credits are negative", -500, "USD", "en-US", "-$5.00"},
+		{"defaults", 1000, "", "", "$10.00"},
+	}
+
+	for _, e := range tests {
+		if got := db.FormatMoney(e.amount, e.currency, e.locale); got != e.expected {
+			t.Errorf("%s: expected %q, got %q", e.name, e.expected, got)
+		}
+	}
+}
+
+func Test_requestLocale(t *testing.T) {
+	var tests = []struct {
+		acceptLanguage string
+		expected       string
+	}{
+		{"de-DE,de;q=0.9,en;q=0.8", "de-DE"},
+		{"fr-CH, fr;q=0.9", "fr-FR"},
+		{"ja", "ja-JP"},
+		{"", db.DefaultLocale},
+		{"not a language", db.DefaultLocale},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", e.acceptLanguage)
+
+		if got := requestLocale(req); got != e.expected {
+			t.Errorf("%q: expected %s, got %s", e.acceptLanguage, e.expected, got)
+		}
+	}
+}
+
+func Test_userCurrency(t *testing.T) {
+	var tests = []struct {
+		name      string
+		user      db.User
+		requested string
+		locale    string
+		expected  string
+	}{
+		{"stored currency", db.User{Currency: "EUR"}, "JPY", "en-US", "EUR"},
+		{"currency of the current plan", db.User{Plan: &db.Plan{Currency: "CAD"}}, "JPY", "en-US", "CAD"},
+		{"requested currency", db.User{}, "JPY", "en-US", "JPY"},
+		{"unsupported currency", db.User{}, "XYZ", "de-DE", "EUR"},
+		{"currency of the locale", db.User{}, "", "en-GB", "GBP"},
+	}
+
+	for _, e := range tests {
+		if got := userCurrency(e.user, e.requested, e.locale); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func Test_priceInCurrency(t *testing.T) {
+	plan, _ := testApp.Models.Plan.GetOne(1)
+
+	priced, err := priceInCurrency(plan, "JPY", "ja-JP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priced.PlanAmount != 1500 || priced.Currency != "JPY" {
+		t.Errorf("expected the plan to cost 1500 JPY, got %d %s", priced.PlanAmount, priced.Currency)
+	}
+	if plan.Currency != db.DefaultCurrency {
+		t.Error("expected the original plan to keep its currency")
+	}
+
+	_, err = priceInCurrency(plan, "GBP", "en-GB")
+	if !errors.Is(err, db.ErrNoPriceInCurrency) {
+		t.Errorf("expected ErrNoPriceInCurrency, got %v", err)
+	}
+}
+
+func TestConfig_GETSubscribeToPlan_Currency(t *testing.T) {
+	var tests = []struct {
+		name         string
+		url          string
+		user         db.User
+		expectedCode int
+		expectedHTML string
+	}{
+		{"requested currency", "/members/subscribe?plan=1&currency=JPY", db.User{ID: 1, Active: 1}, http.StatusOK, "¥1,500/month"},
+		{"stored currency wins", "/members/subscribe?plan=1&currency=JPY", db.User{ID: 1, Active: 1, Currency: "USD"}, http.StatusOK, "$10.00/month"},
+		{"plan not sold in the currency", "/members/subscribe?plan=1", db.User{ID: 1, Active: 1, Currency: "GBP"}, http.StatusSeeOther, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req.Header.Set("Accept-Language", "en-US")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		testApp.Session.Put(ctx, "userID", e.user.ID)
+		testApp.Session.Put(ctx, "user", e.user)
+
+		handler := http.HandlerFunc(testApp.GETSubscribeToPlan)
+		handler.ServeHTTP(res, req)
+
+		if res.Code != e.expectedCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedCode, res.Code)
+		}
+		if e.expectedHTML != "" && !strings.Contains(res.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: expected %q on the page", e.name, e.expectedHTML)
+		}
+	}
+}
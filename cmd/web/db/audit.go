@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditLoginSucceeded      = "login.succeeded"
+	AuditLoginFailed         = "login.failed"
+	AuditAccountActivated    = "account.activated"
+	AuditPasswordChanged     = "password.changed"
+	AuditEmailChanged        = "email.changed"
+	AuditTwoFactorEnabled    = "two_factor.enabled"
+	AuditTwoFactorDisabled   = "two_factor.disabled"
+	AuditRecoveryCodesReset  = "two_factor.recovery_codes_replaced"
+	AuditSessionsRevoked     = "session.revoked"
+	AuditPlanChanged         = "subscription.plan_changed"
+	AuditPlanChangeScheduled = "subscription.plan_change_scheduled"
+	AuditRefunded            = "payment.refunded"
+	AuditAdminUserUpdated    = "admin.user_updated"
+	AuditAdminUserDeleted    = "admin.user_deleted"
+	AuditAdminPlanCreated    = "admin.plan_created"
+	AuditAdminPlanUpdated    = "admin.plan_updated"
+)
+
+// AuditActions lists every action recorded in the audit log, in the order the audit viewer offers them
+var AuditActions = []string{
+	AuditLoginSucceeded,
+	AuditLoginFailed,
+	AuditAccountActivated,
+	AuditPasswordChanged,
+	AuditEmailChanged,
+	AuditTwoFactorEnabled,
+	AuditTwoFactorDisabled,
+	AuditRecoveryCodesReset,
+	AuditSessionsRevoked,
+	AuditPlanChanged,
+	AuditPlanChangeScheduled,
+	AuditRefunded,
+	AuditAdminUserUpdated,
+	AuditAdminUserDeleted,
+	AuditAdminPlanCreated,
+	AuditAdminPlanUpdated,
+}
+
+// Types of the things an audit event can be about
+const (
+	AuditTargetUser         = "user"
+	AuditTargetPlan         = "plan"
+	AuditTargetSubscription = "subscription"
+	AuditTargetCharge       = "charge"
+)
+
+// AuditEvent is the type for one entry in the audit log of security-relevant and billing events.
+// Events are only ever added to the log, never changed or removed.
+type AuditEvent struct {
+	ID         int
+	Action     string
+	ActorID    int    // the user who did it; 0 if nobody was logged in, or the app did it by itself
+	TargetType string // what it was done to, e.g. AuditTargetUser
+	TargetID   string
+	IPAddress  string
+	UserAgent  string
+	Note       string                 // e.g. why a login failed
+	Changes    map[string]AuditChange // by field name
+	CreatedAt  time.Time
+}
+
+// AuditChange is the value of one field before and after an audited change. From is nil for
+// a field that was set for the first time, and To is nil for a field that was removed.
+type AuditChange struct {
+	From any `json:"from,omitempty"`
+	To   any `json:"to,omitempty"`
+}
+
+// AuditFilter selects events from the audit log. Zero fields match every event.
+type AuditFilter struct {
+	Action string
+	UserID int       // events done by, or done to, this user
+	From   time.Time // events at or after this time
+	Until  time.Time // events before this time
+}
+
+// AuditChanges compares the fields of a thing before and after a change, and returns the
+// fields whose value changed
+func AuditChanges(before, after map[string]any) map[string]AuditChange {
+	changes := make(map[string]AuditChange)
+
+	for field, from := range before {
+		to, ok := after[field]
+		if !ok {
+			changes[field] = AuditChange{From: from}
+			continue
+		}
+		if fmt.Sprint(from) != fmt.Sprint(to) {
+			changes[field] = AuditChange{From: from, To: to}
+		}
+	}
+
+	for field, to := range after {
+		if _, ok := before[field]; !ok {
+			changes[field] = AuditChange{To: to}
+		}
+	}
+
+	return changes
+}
+
+// ChangesForDisplay describes the changes of the event, one field per line, e.g. `email: "a@example.com" → "b@example.com"`
+func (e *AuditEvent) ChangesForDisplay() []string {
+	fields := make([]string, 0, len(e.Changes))
+	for field := range e.Changes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var lines []string
+	for _, field := range fields {
+		change := e.Changes[field]
+		from, _ := json.Marshal(change.From)
+		to, _ := json.Marshal(change.To)
+		lines = append(lines, fmt.Sprintf("%s: %s → %s", field, from, to))
+	}
+	return lines
+}
+
+// Insert adds an event to the audit log
+func (e *AuditEvent) Insert(event AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+	if event.Changes == nil {
+		changes = []byte("{}")
+	}
+
+	stmt := `insert into audit_events (action, actor_id, target_type, target_id, ip_address, user_agent, note, changes, created_at)
+			values ($1, nullif($2, 0), $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = db.ExecContext(ctx, stmt,
+		event.Action,
+		event.ActorID,
+		event.TargetType,
+		event.TargetID,
+		event.IPAddress,
+		event.UserAgent,
+		event.Note,
+		string(changes),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Find returns the events that match the filter, newest first. A limit of 0 returns every matching event.
+func (e *AuditEvent) Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	where, args := filter.where()
+	query := fmt.Sprintf(`select id, action, coalesce(actor_id, 0), target_type, target_id, ip_address, user_agent, note, changes, created_at
+		from audit_events %s order by created_at desc, id desc`, where)
+
+	if limit > 0 {
+		args = append(args, limit, offset)
+		query += fmt.Sprintf(" limit $%d offset $%d", len(args)-1, len(args))
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+
+	for rows.Next() {
+		var event AuditEvent
+		var changes []byte
+		err := rows.Scan(
+			&event.ID,
+			&event.Action,
+			&event.ActorID,
+			&event.TargetType,
+			&event.TargetID,
+			&event.IPAddress,
+			&event.UserAgent,
+			&event.Note,
+			&changes,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(changes, &event.Changes)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// Count returns the number of events that match the filter
+func (e *AuditEvent) Count(filter AuditFilter) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	where, args := filter.where()
+
+	var count int
+	err := db.QueryRowContext(ctx, "select count(*) from audit_events "+where, args...).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// where returns the where clause that applies the filter, and its arguments
+func (f AuditFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+
+	if f.Action != "" {
+		args = append(args, f.Action)
+		conditions = append(conditions, fmt.Sprintf("action = $%d", len(args)))
+	}
+	if f.UserID > 0 {
+		args = append(args, f.UserID, AuditTargetUser, fmt.Sprint(f.UserID))
+		conditions = append(conditions, fmt.Sprintf("(actor_id = $%d or (target_type = $%d and target_id = $%d))", len(args)-2, len(args)-1, len(args)))
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !f.Until.IsZero() {
+		args = append(args, f.Until)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "where " + strings.Join(conditions, " and "), args
+}
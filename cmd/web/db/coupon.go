@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Coupon discount types
+const (
+	CouponPercent = "percent"
+	CouponFixed   = "fixed"
+)
+
+// Coupon durations: how many invoices of a subscription a coupon discounts
+const (
+	CouponOnce      = "once"
+	CouponRepeating = "repeating"
+	CouponForever   = "forever"
+)
+
+var (
+	ErrCouponInactive        = errors.New("coupon: no longer active")
+	ErrCouponExpired         = errors.New("coupon: expired")
+	ErrCouponNotForPlan      = errors.New("coupon: not valid for this plan")
+	ErrCouponUsedUp          = errors.New("coupon: redemption limit reached")
+	ErrCouponAlreadyRedeemed = errors.New("coupon: already redeemed by this user")
+	ErrCouponWrongCurrency   = errors.New("coupon: not valid in this currency")
+)
+
+// Coupon is the type for promotion codes that discount a subscription. Amounts are in the minor unit of Currency.
+type Coupon struct {
+	ID             int
+	Code           string
+	DiscountType   string
+	PercentOff     int    // for percent coupons
+	AmountOff      int    // for fixed coupons
+	Currency       string // of AmountOff; fixed coupons can only be used with plans paid in this currency
+	Duration       string
+	DurationMonths int // for repeating coupons
+	MaxRedemptions int // 0 for no limit
+	TimesRedeemed  int
+	ExpiresAt      *time.Time // after which the coupon can no longer be redeemed; nil if it never expires
+	PlanID         int        // the only plan the coupon can be used with; 0 for any plan
+	Active         bool
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Locale         string // the locale amounts are formatted for; not stored
+}
+
+// NormalizeCouponCode makes codes case insensitive, and ignores surrounding spaces
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate checks that the coupon can be redeemed for a plan, paid in the given currency, at the given time
+func (c *Coupon) Validate(planID int, currency string, now time.Time) error {
+	switch {
+	case !c.Active:
+		return ErrCouponInactive
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return ErrCouponExpired
+	case c.PlanID != 0 && c.PlanID != planID:
+		return ErrCouponNotForPlan
+	case c.DiscountType == CouponFixed && c.Currency != currency:
+		return ErrCouponWrongCurrency
+	case c.MaxRedemptions > 0 && c.TimesRedeemed >= c.MaxRedemptions:
+		return ErrCouponUsedUp
+	}
+	return nil
+}
+
+// Discount returns how much the coupon takes off an amount. The discount is never more than the amount.
+func (c *Coupon) Discount(amount int) int {
+	if amount <= 0 {
+		return 0
+	}
+
+	var discount int
+	switch c.DiscountType {
+	case CouponPercent:
+		discount = (amount*c.PercentOff + 50) / 100 // rounded to the nearest minor unit
+	case CouponFixed:
+		discount = c.AmountOff
+	}
+
+	return min(discount, amount)
+}
+
+// Periods returns how many invoices the coupon discounts, or nil if it discounts every invoice
+func (c *Coupon) Periods() *int {
+	var periods int
+	switch c.Duration {
+	case CouponOnce:
+		periods = 1
+	case CouponRepeating:
+		periods = c.DurationMonths
+	default:
+		return nil
+	}
+	return &periods
+}
+
+// DiscountForDisplay describes the discount, e.g. "20% off for 3 months"
+func (c *Coupon) DiscountForDisplay() string {
+	discount := fmt.Sprintf("%s off", FormatMoney(c.AmountOff, c.Currency, c.Locale))
+	if c.DiscountType == CouponPercent {
+		discount = fmt.Sprintf("%d%% off", c.PercentOff)
+	}
+
+	switch c.Duration {
+	case CouponOnce:
+		return discount + " the first month"
+	case CouponRepeating:
+		return fmt.Sprintf("%s for %d months", discount, c.DurationMonths)
+	default:
+		return discount + " every month"
+	}
+}
+
+// GetByCode returns the coupon with the given code. Codes are not case sensitive.
+func (c *Coupon) GetByCode(code string) (*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, code, discount_type, percent_off, amount_off, currency, duration, duration_months,
+			max_redemptions, times_redeemed, expires_at, coalesce(plan_id, 0), active, created_at, updated_at
+			from coupons
+			where code = $1`
+
+	row := db.QueryRowContext(ctx, query, NormalizeCouponCode(code))
+
+	return scanCoupon(row)
+}
+
+// GetOne returns one coupon by id
+func (c *Coupon) GetOne(id int) (*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, code, discount_type, percent_off, amount_off, currency, duration, duration_months,
+			max_redemptions, times_redeemed, expires_at, coalesce(plan_id, 0), active, created_at, updated_at
+			from coupons
+			where id = $1`
+
+	row := db.QueryRowContext(ctx, query, id)
+
+	return scanCoupon(row)
+}
+
+// Redeem uses up one redemption of the coupon for the user, and returns the ID of the redemption.
+// The redemption limit and expiry date are checked again here, so a coupon is never redeemed more
+// often than allowed, however many users redeem it at the same time. Each user can redeem a coupon once.
+func (c *Coupon) Redeem(couponID, userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	stmt := `update coupons set times_redeemed = times_redeemed + 1, updated_at = $1
+			where id = $2 and active
+			and (max_redemptions = 0 or times_redeemed < max_redemptions)
+			and (expires_at is null or expires_at > $1)
+			returning id`
+
+	var id int
+	err = tx.QueryRowContext(ctx, stmt, now, couponID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCouponUsedUp
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into coupon_redemptions (coupon_id, user_id, redeemed_at)
+			values ($1, $2, $3)
+			on conflict (coupon_id, user_id) do nothing
+			returning id`
+
+	var redemptionID int
+	err = tx.QueryRowContext(ctx, stmt, couponID, userID, now).Scan(&redemptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCouponAlreadyRedeemed
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return redemptionID, nil
+}
+
+// CancelRedemption gives back a redemption, for when the checkout it was made for does not go through
+func (c *Coupon) CancelRedemption(redemptionID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var couponID int
+	err = tx.QueryRowContext(ctx, `delete from coupon_redemptions where id = $1 returning coupon_id`, redemptionID).Scan(&couponID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update coupons set times_redeemed = times_redeemed - 1, updated_at = $1 where id = $2`
+
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), couponID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func scanCoupon(row scanner) (*Coupon, error) {
+	var coupon Coupon
+
+	err := row.Scan(
+		&coupon.ID,
+		&coupon.Code,
+		&coupon.DiscountType,
+		&coupon.PercentOff,
+		&coupon.AmountOff,
+		&coupon.Currency,
+		&coupon.Duration,
+		&coupon.DurationMonths,
+		&coupon.MaxRedemptions,
+		&coupon.TimesRedeemed,
+		&coupon.ExpiresAt,
+		&coupon.PlanID,
+		&coupon.Active,
+		&coupon.CreatedAt,
+		&coupon.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &coupon, nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"math"
+	"slices"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// DefaultCurrency is the currency of plans.plan_amount, and of users who have not picked a currency
+const DefaultCurrency = "USD"
+
+// DefaultLocale formats amounts for users whose locale is not known
+const DefaultLocale = "en-US"
+
+// SupportedCurrencies are the ISO 4217 codes of the currencies plans can be priced and paid in
+var SupportedCurrencies = []string{"USD", "CAD", "EUR", "GBP", "JPY"}
+
+// supportedLocales are the locales amounts are formatted for; the first one is the fallback
+var supportedLocales = []language.Tag{
+	language.AmericanEnglish,
+	language.MustParse("en-CA"),
+	language.BritishEnglish,
+	language.CanadianFrench,
+	language.MustParse("fr-FR"),
+	language.MustParse("de-DE"),
+	language.MustParse("ja-JP"),
+}
+
+var localeMatcher = language.NewMatcher(supportedLocales)
+
+// IsSupportedCurrency reports whether plans can be priced and paid in the currency
+func IsSupportedCurrency(code string) bool {
+	return slices.Contains(SupportedCurrencies, code)
+}
+
+// MatchLocale picks the supported locale that best fits an Accept-Language header
+func MatchLocale(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return DefaultLocale
+	}
+
+	_, index, _ := localeMatcher.Match(tags...)
+	return supportedLocales[index].String()
+}
+
+// CurrencyForLocale returns the currency of the locale's region, if plans can be paid in it,
+// and DefaultCurrency otherwise
+func CurrencyForLocale(locale string) string {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return DefaultCurrency
+	}
+
+	region, _ := tag.Region()
+	unit, ok := currency.FromRegion(region)
+	if !ok || !IsSupportedCurrency(unit.String()) {
+		return DefaultCurrency
+	}
+
+	return unit.String()
+}
+
+// CurrencyExponent returns the number of digits after the decimal point of the currency's minor unit,
+// e.g. 2 for USD, where amounts are in cents, and 0 for JPY, which has no minor unit
+func CurrencyExponent(code string) int {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return 2
+	}
+
+	scale, _ := currency.Standard.Rounding(unit)
+	return scale
+}
+
+// FormatMoney formats an amount in the minor unit of a currency the way it is written in the locale,
+// e.g. 123456 USD as "$1,234.56" in en-US, and 123456 EUR as "1.234,56 €" in de-DE. An empty currency
+// or locale means the default. Credits are shown as negative amounts.
+func FormatMoney(amount int, code, locale string) string {
+	if amount < 0 {
+		return "-" + FormatMoney(-amount, code, locale)
+	}
+
+	if code == "" {
+		code = DefaultCurrency
+	}
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		unit = currency.MustParseISO(DefaultCurrency)
+	}
+
+	tag, err := language.Parse(locale)
+	if err != nil || locale == "" {
+		tag = supportedLocales[0]
+	}
+
+	scale := CurrencyExponent(unit.String())
+	printer := message.NewPrinter(tag)
+
+	value := printer.Sprint(number.Decimal(float64(amount)/math.Pow10(scale), number.Scale(scale)))
+	symbol := printer.Sprint(currency.Symbol(unit))
+
+	if symbolFollowsAmount(tag) {
+		return value + "\u00a0" + symbol
+	}
+	return symbol + value
+}
+
+// symbolFollowsAmount reports whether the locale writes the currency symbol after the amount, separated by
+// a no-break space
+func symbolFollowsAmount(tag language.Tag) bool {
+	base, _ := tag.Base()
+	switch base.String() {
+	case "fr", "de":
+		return true
+	default:
+		return false
+	}
+}
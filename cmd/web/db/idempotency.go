@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyKey is the type for keys that guard requests which must only ever be processed once,
+// no matter how many times the browser sends them
+type IdempotencyKey struct {
+	Key       string
+	UserID    int
+	CreatedAt time.Time
+}
+
+// Claim records that the request identified by key is being processed for the given user.
+// It returns false if the key was claimed before, in which case the request must not be processed again.
+func (k *IdempotencyKey) Claim(key string, userID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into idempotency_keys (key, user_id, created_at)
+			values ($1, $2, $3)
+			on conflict (key) do nothing`
+
+	result, err := db.ExecContext(ctx, stmt, key, userID, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// Release gives back a key whose request failed before it changed anything, so that the same request
+// can be sent again
+func (k *IdempotencyKey) Release(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from idempotency_keys where key = $1`, key)
+	return err
+}
@@ -1,19 +1,112 @@
 package db
 
+import "time"
+
 type UserInterface interface {
 	GetAll() ([]*User, error)
 	GetByEmail(email string) (*User, error)
 	GetOne(id int) (*User, error)
 	Update(user User) error
-	DeleteByID(id int) error
+	ChangeEmail(id int, email string) error
+	UpdatePaymentDetails(id int, customerID, paymentMethodID string) error
+	UpdateBillingDetails(id int, address Address, taxID string) error
+	SetCurrency(id int, currency string) (bool, error)
+	UpdateLocale(id int, locale string) error
+	Activate(id int) (bool, error)
+	Anonymize(id int) error
 	Insert(user User) (int, error)
-	ResetPassword(password string) error
-	PasswordMatches(plainText string) (bool, error)
+	ResetPassword(id int, password string) error
+	PasswordMatches(user User, plainText string) (bool, error)
 }
 
 type PlanInterface interface {
 	GetAll() ([]*Plan, error)
+	GetAllWithArchived() ([]*Plan, error)
 	GetOne(id int) (*Plan, error)
-	SubscribeUserToPlan(user User, plan Plan) error
+	Insert(plan Plan) (int, error)
+	Rename(id int, name string) error
+	Archive(id int) error
+	Restore(id int) error
+	NewVersion(id int, prices map[string]int) (int, error)
+	SubscribeUserToPlan(user User, plan Plan) (int, error)
 	AmountForDisplay() string
 }
+
+type SubscriptionInterface interface {
+	GetOne(id int) (*Subscription, error)
+	GetCurrentForUser(userID int) (*Subscription, error)
+	GetHistoryForUser(userID int) ([]*Subscription, error)
+	UpdateStatus(id int, status, reason string) error
+	GetDueForRenewal(now time.Time) ([]*Subscription, error)
+	AdvancePeriod(id int, periodEnd time.Time) error
+	StartTrial(userID int, plan Plan, trialEnd time.Time) (int, error)
+	HasHadTrial(userID int, planFamily string) (bool, error)
+	GetTrialsEndingBefore(t time.Time) ([]*Subscription, error)
+	MarkTrialReminderSent(id int) error
+	ChangePlan(id int, plan Plan, reason string) (int, error)
+	SchedulePlanChange(id int, planID int) error
+	Cancel(id int, reason string) error
+	ScheduleCancellation(id int, reason string) error
+	Reactivate(id int) error
+	StartDunning(id int, reason string, nextRetryAt time.Time) error
+	RecordFailedRetry(id int, nextRetryAt time.Time) error
+	GetDueForRetry(now time.Time) ([]*Subscription, error)
+	ApplyCoupon(id int, couponID int, periodsLeft *int) error
+	UseCouponPeriod(id int) error
+}
+
+type InvoiceInterface interface {
+	Insert(invoice Invoice) (int, error)
+	GetOne(id int) (*Invoice, error)
+	GetAllForUser(userID int) ([]*Invoice, error)
+	GetByChargeID(chargeID string) (*Invoice, error)
+	GetOpenForSubscription(subscriptionID int) (*Invoice, error)
+	GetForPeriod(subscriptionID int, periodStart time.Time) (*Invoice, error)
+	MarkPaid(id int, chargeID string) error
+	Reopen(id int) error
+	Void(id int) error
+	MarkDisputed(id int) error
+}
+
+type IdempotencyKeyInterface interface {
+	Claim(key string, userID int) (bool, error)
+	Release(key string) error
+}
+
+type WebhookEventInterface interface {
+	Record(event WebhookEvent) (bool, error)
+	MarkProcessed(id string) error
+	GetUnprocessed(from, to time.Time) ([]*WebhookEvent, error)
+}
+
+type LockInterface interface {
+	TryAcquire(key int64) (release func(), acquired bool, err error)
+}
+
+type CouponInterface interface {
+	GetByCode(code string) (*Coupon, error)
+	GetOne(id int) (*Coupon, error)
+	Redeem(couponID, userID int) (int, error)
+	CancelRedemption(redemptionID int) error
+}
+
+type TaxRateInterface interface {
+	GetForLocation(country, region string) ([]*TaxRate, error)
+}
+
+type AuditEventInterface interface {
+	Insert(event AuditEvent) error
+	Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, error)
+	Count(filter AuditFilter) (int, error)
+}
+
+type TwoFactorInterface interface {
+	GetForUser(userID int) (*TwoFactor, error)
+	StartEnrollment(userID int, encryptedSecret string) error
+	Enable(userID int, step int64, recoveryCodeHashes []string) error
+	UseStep(userID int, step int64) (bool, error)
+	UseRecoveryCode(userID int, codeHash string) (bool, error)
+	RecoveryCodesLeft(userID int) (int, error)
+	ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error
+	Disable(userID int) error
+}
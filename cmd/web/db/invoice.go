@@ -0,0 +1,458 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Invoice states
+const (
+	InvoiceOpen = "open"
+	InvoicePaid = "paid"
+	InvoiceVoid = "void"
+)
+
+// Invoice is the type for invoices. Amounts are stored in cents.
+type Invoice struct {
+	ID             int
+	InvoiceNumber  int
+	UserID         int
+	SubscriptionID int
+	Status         string
+	Subtotal       int
+	Tax            int
+	Total          int
+	Currency       string // the currency all amounts on the invoice are in
+	Locale         string // the locale amounts are formatted for; not stored
+	TaxInclusive   bool   // the subtotal already includes the tax, so it is not added to the total
+	ReverseCharge  bool   // no tax is charged, because the customer accounts for it themselves
+	IssuedAt       time.Time
+	DueAt          time.Time
+	PaidAt         *time.Time
+	VoidedAt       *time.Time
+	DisputedAt     *time.Time // when the customer disputed the charge that paid the invoice; nil if they have not
+	ChargeID       string     // the payment provider's id for the charge that paid the invoice
+	PeriodStart    *time.Time // start of the subscription period a renewal invoice bills; nil for other invoices
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	LineItems      []*InvoiceLineItem
+	TaxLines       []*InvoiceTaxLine
+}
+
+// InvoiceLineItem is the type for one line on an invoice
+type InvoiceLineItem struct {
+	ID          int
+	InvoiceID   int
+	Description string
+	Quantity    int
+	UnitAmount  int
+	Amount      int
+	CreatedAt   time.Time
+	Currency    string // copied from the invoice, to format the amounts
+	Locale      string
+}
+
+// NumberForDisplay formats the invoice number the way it is shown to customers
+func (i *Invoice) NumberForDisplay() string {
+	return fmt.Sprintf("INV-%06d", i.InvoiceNumber)
+}
+
+// SubtotalForDisplay formats the invoice subtotal as a currency string
+func (i *Invoice) SubtotalForDisplay() string {
+	return FormatMoney(i.Subtotal, i.Currency, i.Locale)
+}
+
+// TaxForDisplay formats the tax on the invoice as a currency string
+func (i *Invoice) TaxForDisplay() string {
+	return FormatMoney(i.Tax, i.Currency, i.Locale)
+}
+
+// TotalForDisplay formats the invoice total as a currency string
+func (i *Invoice) TotalForDisplay() string {
+	return FormatMoney(i.Total, i.Currency, i.Locale)
+}
+
+// Localize formats the invoice's amounts, and those of its lines, for a locale
+func (i *Invoice) Localize(locale string) {
+	if i.Currency == "" {
+		i.Currency = DefaultCurrency
+	}
+	i.Locale = locale
+
+	for _, item := range i.LineItems {
+		item.Currency = i.Currency
+		item.Locale = locale
+	}
+	for _, line := range i.TaxLines {
+		line.Currency = i.Currency
+		line.Locale = locale
+	}
+}
+
+// UnitAmountForDisplay formats the unit price of the line item as a currency string
+func (l *InvoiceLineItem) UnitAmountForDisplay() string {
+	return FormatMoney(l.UnitAmount, l.Currency, l.Locale)
+}
+
+// AmountForDisplay formats the line item amount as a currency string
+func (l *InvoiceLineItem) AmountForDisplay() string {
+	return FormatMoney(l.Amount, l.Currency, l.Locale)
+}
+
+// nextInvoiceNumber takes the next invoice number in tx. The counter row stays locked until the
+// transaction ends, which serialises concurrent inserts, and a transaction that is rolled back
+// gives its number back.
+func nextInvoiceNumber(ctx context.Context, tx *sql.Tx) (int, error) {
+	var number int
+	stmt := `insert into invoice_numbers (id, last_number) values (1, 1)
+			on conflict (id) do update set last_number = invoice_numbers.last_number + 1
+			returning last_number`
+
+	err := tx.QueryRowContext(ctx, stmt).Scan(&number)
+	return number, err
+}
+
+// Insert saves an invoice and its line items, and returns the ID of the new invoice.
+// The invoice is given the next invoice number in the same transaction, so numbers
+// are handed out in order and without gaps.
+func (i *Invoice) Insert(invoice Invoice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	number, err := nextInvoiceNumber(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	var subscriptionID any
+	if invoice.SubscriptionID > 0 {
+		subscriptionID = invoice.SubscriptionID
+	}
+
+	var newID int
+	stmt := `insert into invoices (invoice_number, user_id, subscription_id, status, subtotal, tax, total,
+			currency, tax_inclusive, reverse_charge, issued_at, due_at, period_start, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		number,
+		invoice.UserID,
+		subscriptionID,
+		InvoiceOpen,
+		invoice.Subtotal,
+		invoice.Tax,
+		invoice.Total,
+		invoice.Currency,
+		invoice.TaxInclusive,
+		invoice.ReverseCharge,
+		invoice.IssuedAt,
+		invoice.DueAt,
+		invoice.PeriodStart,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into invoice_line_items (invoice_id, description, quantity, unit_amount, amount, created_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	for _, item := range invoice.LineItems {
+		_, err = tx.ExecContext(ctx, stmt, newID, item.Description, item.Quantity, item.UnitAmount, item.Amount, time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	stmt = `insert into invoice_tax_lines (invoice_id, name, rate, amount, created_at)
+			values ($1, $2, $3, $4, $5)`
+
+	for _, line := range invoice.TaxLines {
+		_, err = tx.ExecContext(ctx, stmt, newID, line.Name, line.Rate, line.Amount, time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetOne returns one invoice by id, including its line items and tax lines
+func (i *Invoice) GetOne(id int) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, invoice_number, user_id, coalesce(subscription_id, 0), status, subtotal, tax, total,
+			currency, tax_inclusive, reverse_charge, issued_at, due_at, paid_at, voided_at, disputed_at, charge_id,
+			period_start, created_at, updated_at
+			from invoices
+			where id = $1`
+
+	row := db.QueryRowContext(ctx, query, id)
+
+	invoice, err := scanInvoice(row)
+	if err != nil {
+		return nil, err
+	}
+
+	// get line items
+	query = `select id, invoice_id, description, quantity, unit_amount, amount, created_at
+			from invoice_line_items
+			where invoice_id = $1
+			order by id`
+
+	rows, err := db.QueryContext(ctx, query, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item InvoiceLineItem
+		err := rows.Scan(
+			&item.ID,
+			&item.InvoiceID,
+			&item.Description,
+			&item.Quantity,
+			&item.UnitAmount,
+			&item.Amount,
+			&item.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invoice.LineItems = append(invoice.LineItems, &item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// get tax lines
+	query = `select id, invoice_id, name, rate, amount, created_at
+			from invoice_tax_lines
+			where invoice_id = $1
+			order by id`
+
+	taxRows, err := db.QueryContext(ctx, query, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer taxRows.Close()
+
+	for taxRows.Next() {
+		var line InvoiceTaxLine
+		err := taxRows.Scan(
+			&line.ID,
+			&line.InvoiceID,
+			&line.Name,
+			&line.Rate,
+			&line.Amount,
+			&line.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invoice.TaxLines = append(invoice.TaxLines, &line)
+	}
+
+	if err = taxRows.Err(); err != nil {
+		return nil, err
+	}
+
+	invoice.Localize("")
+
+	return invoice, nil
+}
+
+// GetAllForUser returns all of a user's invoices, newest first. Line items are not loaded.
+func (i *Invoice) GetAllForUser(userID int) ([]*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, invoice_number, user_id, coalesce(subscription_id, 0), status, subtotal, tax, total,
+			currency, tax_inclusive, reverse_charge, issued_at, due_at, paid_at, voided_at, disputed_at, charge_id,
+			period_start, created_at, updated_at
+			from invoices
+			where user_id = $1
+			order by invoice_number desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, rows.Err()
+}
+
+// GetByChargeID returns the invoice that was paid by the given charge
+func (i *Invoice) GetByChargeID(chargeID string) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id from invoices where charge_id = $1`
+
+	var id int
+	err := db.QueryRowContext(ctx, query, chargeID).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.GetOne(id)
+}
+
+// GetForPeriod returns the renewal invoice of a subscription for the period that starts at
+// periodStart, or sql.ErrNoRows if that period has not been invoiced yet
+func (i *Invoice) GetForPeriod(subscriptionID int, periodStart time.Time) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id from invoices where subscription_id = $1 and period_start = $2`
+
+	var id int
+	err := db.QueryRowContext(ctx, query, subscriptionID, periodStart).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.GetOne(id)
+}
+
+// GetOpenForSubscription returns the most recent unpaid invoice for a subscription
+func (i *Invoice) GetOpenForSubscription(subscriptionID int) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id from invoices where subscription_id = $1 and status = $2
+			order by invoice_number desc limit 1`
+
+	var id int
+	err := db.QueryRowContext(ctx, query, subscriptionID, InvoiceOpen).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.GetOne(id)
+}
+
+// MarkPaid marks an open invoice as paid by the given charge
+func (i *Invoice) MarkPaid(id int, chargeID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set status = $1, charge_id = $2, paid_at = $3, updated_at = $3 where id = $4 and status = $5`
+
+	_, err := db.ExecContext(ctx, stmt, InvoicePaid, chargeID, time.Now(), id, InvoiceOpen)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reopen marks a paid invoice as unpaid again, for when the payment provider reports
+// that the charge which paid it has failed after all
+func (i *Invoice) Reopen(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set status = $1, paid_at = null, updated_at = $2 where id = $3 and status = $4`
+
+	_, err := db.ExecContext(ctx, stmt, InvoiceOpen, time.Now(), id, InvoicePaid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Void cancels an open invoice, so that it no longer needs to be paid. The invoice
+// and its number are kept, so the numbering stays gapless.
+func (i *Invoice) Void(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set status = $1, voided_at = $2, updated_at = $2 where id = $3 and status = $4`
+
+	_, err := db.ExecContext(ctx, stmt, InvoiceVoid, time.Now(), id, InvoiceOpen)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkDisputed records that the customer disputed the charge that paid an invoice. The invoice
+// keeps its status until the dispute is resolved.
+func (i *Invoice) MarkDisputed(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set disputed_at = $1, updated_at = $1 where id = $2 and disputed_at is null`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func scanInvoice(row scanner) (*Invoice, error) {
+	var invoice Invoice
+
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.InvoiceNumber,
+		&invoice.UserID,
+		&invoice.SubscriptionID,
+		&invoice.Status,
+		&invoice.Subtotal,
+		&invoice.Tax,
+		&invoice.Total,
+		&invoice.Currency,
+		&invoice.TaxInclusive,
+		&invoice.ReverseCharge,
+		&invoice.IssuedAt,
+		&invoice.DueAt,
+		&invoice.PaidAt,
+		&invoice.VoidedAt,
+		&invoice.DisputedAt,
+		&invoice.ChargeID,
+		&invoice.PeriodStart,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	invoice.Localize("")
+
+	return &invoice, nil
+}
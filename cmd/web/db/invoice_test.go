@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// TestNextInvoiceNumber needs a Postgres database, given as a DSN in TEST_DSN. The counter is kept in
+// a temporary table, so the database's own invoice numbers are left alone.
+func TestNextInvoiceNumber(t *testing.T) {
+	dsn := os.Getenv("TEST_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DSN not set")
+	}
+
+	pool, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	// temporary tables only exist on the connection that created them
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `create temporary table invoice_numbers (id integer primary key, last_number integer not null)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		commit   bool
+		expected int
+	}{
+		{"first invoice", false, 1},
+		{"number of a rolled back invoice is given out again", true, 1},
+		{"next invoice", true, 2},
+		{"and the one after", true, 3},
+	}
+
+	for _, e := range tests {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		number, err := nextInvoiceNumber(ctx, tx)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if number != e.expected {
+			t.Errorf("%s: expected invoice number %d, got %d", e.name, e.expected, number)
+		}
+
+		if e.commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// AdvisoryLock uses Postgres advisory locks to make sure that a piece of background work
+// is only done by one instance of the app at a time, however many replicas are running
+type AdvisoryLock struct{}
+
+// TryAcquire takes the lock identified by key if it is free, without waiting for it.
+// If the lock was acquired, release must be called once the work is done.
+func (l *AdvisoryLock) TryAcquire(key int64) (func(), bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// advisory locks belong to the database session, so hold on to one connection until release
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+
+	var acquired bool
+	err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, key).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, false, err
+	}
+
+	release := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+
+		_, err := conn.ExecContext(ctx, `select pg_advisory_unlock($1)`, key)
+		if err != nil {
+			// never hand a connection that may still hold the lock back to the pool
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+
+	return release, true, nil
+}
@@ -15,8 +15,17 @@ func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: &User{},
-		Plan: &Plan{},
+		User:           &User{},
+		Plan:           &Plan{},
+		Subscription:   &Subscription{},
+		Invoice:        &Invoice{},
+		IdempotencyKey: &IdempotencyKey{},
+		WebhookEvent:   &WebhookEvent{},
+		Lock:           &AdvisoryLock{},
+		Coupon:         &Coupon{},
+		TaxRate:        &TaxRate{},
+		AuditEvent:     &AuditEvent{},
+		TwoFactor:      &TwoFactor{},
 	}
 }
 
@@ -24,6 +33,15 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User UserInterface
-	Plan PlanInterface
+	User           UserInterface
+	Plan           PlanInterface
+	Subscription   SubscriptionInterface
+	Invoice        InvoiceInterface
+	IdempotencyKey IdempotencyKeyInterface
+	WebhookEvent   WebhookEventInterface
+	Lock           LockInterface
+	Coupon         CouponInterface
+	TaxRate        TaxRateInterface
+	AuditEvent     AuditEventInterface
+	TwoFactor      TwoFactorInterface
 }
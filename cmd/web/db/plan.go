@@ -2,27 +2,56 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 )
 
+var (
+	// ErrNoPriceInCurrency is returned for a plan that is not sold in the currency asked for
+	ErrNoPriceInCurrency = errors.New("plan: not priced in this currency")
+	// ErrPlanArchived is returned for changing the price of a plan that is off sale
+	ErrPlanArchived = errors.New("plan: archived")
+	// ErrPlanSuperseded is returned for putting an old version of a plan back on sale
+	ErrPlanSuperseded = errors.New("plan: replaced by a newer version")
+)
+
 // Plan is the type for subscription plans
 type Plan struct {
 	ID                  int
 	PlanName            string
-	PlanAmount          int
-	PlanAmountFormatted string
+	PlanAmount          int    // in the minor unit of Currency
+	PlanAmountFormatted string // PlanAmount, formatted for Locale
+	Currency            string
+	Prices              map[string]int // the plan's price in each currency it is sold in, by currency code
+	Locale              string         // the locale amounts are formatted for; not stored
+	TrialDays           int            // length of the free trial new subscribers get; 0 for no trial
+	PlanFamily          string         // plans in the same family share one free trial per user
+	Version             int            // starts at 1, and goes up each time the plan's price changes
+	PreviousVersionID   int            // the version this one replaced; 0 for the first version
+	ArchivedAt          *time.Time     // when the plan was taken off sale; nil while new subscribers can choose it
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
 
+// GetAll returns the plans new subscribers can choose from, leaving out archived plans
 func (p *Plan) GetAll() ([]*Plan, error) {
+	return p.getAll(`where archived_at is null`)
+}
+
+// GetAllWithArchived returns every plan, including archived plans and old versions of plans
+func (p *Plan) GetAllWithArchived() ([]*Plan, error) {
+	return p.getAll(``)
+}
+
+// getAll returns the plans that match the where clause, with their prices
+func (p *Plan) getAll(where string) ([]*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at
-	from plans order by id`
+	query := fmt.Sprintf(`select %s from plans %s order by id`, planColumns, where)
 
 	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
@@ -33,79 +62,384 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 	var plans []*Plan
 
 	for rows.Next() {
-		var plan Plan
-		err := rows.Scan(
-			&plan.ID,
-			&plan.PlanName,
-			&plan.PlanAmount,
-			&plan.CreatedAt,
-			&plan.UpdatedAt,
-		)
-		plan.PlanAmountFormatted = plan.AmountForDisplay()
-
+		plan, err := scanPlan(rows)
 		if err != nil {
 			log.Println("Error scanning", err)
 			return nil, err
 		}
 
-		plans = append(plans, &plan)
+		plans = append(plans, plan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the plans' prices in the other currencies they are sold in
+	query = `select plan_id, currency, amount from plan_prices`
+
+	prices, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer prices.Close()
+
+	byID := make(map[int]*Plan, len(plans))
+	for _, plan := range plans {
+		byID[plan.ID] = plan
+	}
+
+	for prices.Next() {
+		var planID, amount int
+		var currency string
+		if err := prices.Scan(&planID, &currency, &amount); err != nil {
+			return nil, err
+		}
+		if plan, ok := byID[planID]; ok {
+			plan.Prices[currency] = amount
+		}
 	}
 
-	return plans, nil
+	return plans, prices.Err()
 }
 
-// GetOne returns one plan by id
+// GetOne returns one plan by id. Archived plans are returned too, as they still have subscribers.
 func (p *Plan) GetOne(id int) (*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
+	query := fmt.Sprintf(`select %s from plans where id = $1`, planColumns)
 
-	var plan Plan
 	row := db.QueryRowContext(ctx, query, id)
 
+	plan, err := scanPlan(row)
+	if err != nil {
+		return nil, err
+	}
+
+	// the plan's prices in the other currencies it is sold in
+	query = `select currency, amount from plan_prices where plan_id = $1`
+
+	rows, err := db.QueryContext(ctx, query, plan.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var currency string
+		var amount int
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, err
+		}
+		plan.Prices[currency] = amount
+	}
+
+	return plan, rows.Err()
+}
+
+// Insert saves a new plan, with its prices, and returns the ID of the new plan. The plan must have
+// a price in DefaultCurrency.
+func (p *Plan) Insert(plan Plan) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	newID, err := insertPlan(ctx, tx, plan, 1, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Rename changes the name of a plan. A plan without a family keeps the family of its old name,
+// so renaming it does not give anyone a second free trial.
+func (p *Plan) Rename(id int, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update plans set plan_family = coalesce(nullif(plan_family, ''), plan_name), plan_name = $1, updated_at = $2
+			where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, name, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Archive takes a plan off sale. Its subscribers keep it, and are renewed on it as before.
+func (p *Plan) Archive(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update plans set archived_at = $1, updated_at = $1 where id = $2 and archived_at is null`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Restore puts an archived plan back on sale. A plan that was replaced by a newer version cannot be restored.
+func (p *Plan) Restore(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update plans set archived_at = null, updated_at = $1
+			where id = $2 and not exists (select 1 from plans newer where newer.previous_version_id = plans.id)`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	if restored, err := result.RowsAffected(); err == nil && restored == 0 {
+		return ErrPlanSuperseded
+	}
+
+	return nil
+}
+
+// NewVersion replaces a plan with a new version at new prices, and returns the ID of the new version.
+// The old version is archived, so current subscribers keep their old price, while new subscribers
+// get the new one. The new version keeps the plan's name, trial and family, and the coupons for it.
+func (p *Plan) NewVersion(id int, prices map[string]int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// lock the plan, so two price changes cannot both create a new version of it
+	query := fmt.Sprintf(`select %s from plans where id = $1 for update`, planColumns)
+
+	current, err := scanPlan(tx.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return 0, err
+	}
+	if current.ArchivedAt != nil {
+		return 0, ErrPlanArchived
+	}
+
+	next := *current
+	next.Prices = prices
+	next.PlanFamily = current.Family()
+
+	newID, err := insertPlan(ctx, tx, next, current.Version+1, &current.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `update plans set archived_at = $1, updated_at = $1 where id = $2`
+
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), current.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	// coupons for the plan carry on working for it at its new price, rather than only for a version
+	// nobody can subscribe to any more
+	stmt = `update coupons set plan_id = $1, updated_at = $2 where plan_id = $3`
+
+	_, err = tx.ExecContext(ctx, stmt, newID, time.Now(), current.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// insertPlan saves a plan and its prices in a transaction
+func insertPlan(ctx context.Context, tx *sql.Tx, plan Plan, version int, previousVersionID *int) (int, error) {
+	amount, ok := plan.Prices[DefaultCurrency]
+	if !ok {
+		return 0, ErrNoPriceInCurrency
+	}
+
+	var newID int
+	stmt := `insert into plans (plan_name, plan_amount, trial_days, plan_family, version, previous_version_id,
+			created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := tx.QueryRowContext(ctx, stmt,
+		plan.PlanName,
+		amount,
+		plan.TrialDays,
+		plan.PlanFamily,
+		version,
+		previousVersionID,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into plan_prices (plan_id, currency, amount, created_at, updated_at) values ($1, $2, $3, $4, $4)`
+
+	for currency, amount := range plan.Prices {
+		if currency == DefaultCurrency {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, stmt, newID, currency, amount, time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return newID, nil
+}
+
+// planColumns are the columns scanPlan reads, in order
+const planColumns = `id, plan_name, plan_amount, trial_days, plan_family, version, coalesce(previous_version_id, 0),
+	archived_at, created_at, updated_at`
+
+// scanPlan reads a plan from a row of planColumns, priced in DefaultCurrency
+func scanPlan(row scanner) (*Plan, error) {
+	var plan Plan
+
 	err := row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.TrialDays,
+		&plan.PlanFamily,
+		&plan.Version,
+		&plan.PreviousVersionID,
+		&plan.ArchivedAt,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
-	plan.PlanAmountFormatted = plan.AmountForDisplay()
-
 	if err != nil {
 		return nil, err
 	}
+	plan.setDefaultPrice()
+
+	return &plan, nil
+}
+
+// setDefaultPrice prices a plan that was just loaded in DefaultCurrency, which plan_amount is in
+func (p *Plan) setDefaultPrice() {
+	p.Currency = DefaultCurrency
+	p.Prices = map[string]int{DefaultCurrency: p.PlanAmount}
+	p.PlanAmountFormatted = p.AmountForDisplay()
+}
+
+// amountIn returns a plan's amount in a currency, from its amount in DefaultCurrency and its amount in
+// plan_prices, which is null when the plan is not sold in that currency
+func amountIn(currency string, defaultAmount int, price sql.NullInt64) (int, error) {
+	if currency == DefaultCurrency {
+		return defaultAmount, nil
+	}
+	if !price.Valid {
+		return 0, ErrNoPriceInCurrency
+	}
+	return int(price.Int64), nil
+}
+
+// InCurrency returns a copy of the plan, priced in the given currency
+func (p *Plan) InCurrency(code string) (*Plan, error) {
+	amount, ok := p.Prices[code]
+	if !ok {
+		return nil, ErrNoPriceInCurrency
+	}
+
+	plan := *p
+	plan.PlanAmount = amount
+	plan.Currency = code
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
 
 	return &plan, nil
 }
 
-// SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
+// Localize formats the plan's price for a locale
+func (p *Plan) Localize(locale string) {
+	p.Locale = locale
+	p.PlanAmountFormatted = p.AmountForDisplay()
+}
+
+// SubscribeUserToPlan subscribes a user to one plan. Any current subscription the user
+// has is canceled rather than deleted, so that it remains part of the user's history.
+// The ID of the new subscription is returned.
+func (p *Plan) SubscribeUserToPlan(user User, plan Plan) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	// delete existing plan, if any
-	stmt := `delete from user_plans where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, user.ID)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	// subscribe to new plan
-	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
-			values ($1, $2, $3, $4)`
+	now := time.Now()
 
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
+	// end the current subscription, if any
+	stmt := `update user_plans set status = $1, canceled_at = $2, change_reason = $3, updated_at = $2
+			where user_id = $4 and status in ('trialing', 'active', 'past_due')`
+
+	result, err := tx.ExecContext(ctx, stmt, SubscriptionCanceled, now, fmt.Sprintf("Changed to %s", plan.PlanName), user.ID)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	reason := "New subscription"
+	if changed, err := result.RowsAffected(); err == nil && changed > 0 {
+		reason = "Plan change"
+	}
+
+	// subscribe to new plan, in the currency the plan is priced in
+	var newID int
+	stmt = `insert into user_plans (user_id, plan_id, status, started_at, current_period_start, current_period_end,
+			billing_day, currency, change_reason, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, user.ID, plan.ID, SubscriptionActive, now, now, NextPeriodEnd(now),
+		now.Day(), plan.Currency, reason, now, now).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Archived reports whether the plan is off sale. Its subscribers keep it, but no one new can choose it.
+func (p *Plan) Archived() bool {
+	return p.ArchivedAt != nil
+}
+
+// Family returns the family the plan belongs to. A plan without a family is a family of its own.
+func (p *Plan) Family() string {
+	if p.PlanFamily == "" {
+		return p.PlanName
+	}
+	return p.PlanFamily
 }
 
-// AmountForDisplay formats the price we have in the DB as a currency string
+// AmountForDisplay formats the plan's price as a currency string
 func (p *Plan) AmountForDisplay() string {
-	amount := float64(p.PlanAmount) / 100.0
-	return fmt.Sprintf("$%.2f", amount)
+	return FormatMoney(p.PlanAmount, p.Currency, p.Locale)
 }
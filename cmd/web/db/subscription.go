@@ -0,0 +1,758 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Subscription states. A subscription is current while it is trialing, active or past due;
+// canceled and expired subscriptions are kept as the user's subscription history.
+const (
+	SubscriptionTrialing = "trialing"
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+	SubscriptionExpired  = "expired"
+)
+
+// ErrStatusChange is returned for moving a subscription into a state it cannot reach from its current one
+var ErrStatusChange = errors.New("subscription: cannot change to this status")
+
+// statusChanges are the states a subscription in each state can move to. Canceled and expired
+// subscriptions are history, and do not change any more.
+var statusChanges = map[string][]string{
+	SubscriptionTrialing: {SubscriptionActive, SubscriptionPastDue, SubscriptionCanceled, SubscriptionExpired},
+	SubscriptionActive:   {SubscriptionPastDue, SubscriptionCanceled, SubscriptionExpired},
+	SubscriptionPastDue:  {SubscriptionActive, SubscriptionCanceled, SubscriptionExpired},
+}
+
+// CanChangeStatus reports whether a subscription can move from one state to another
+func CanChangeStatus(from, to string) bool {
+	return slices.Contains(statusChanges[from], to)
+}
+
+// Subscription is the type for one row of the user_plans table: a user's subscription
+// to a plan, and how it came to be in its current state
+type Subscription struct {
+	ID                 int
+	UserID             int
+	PlanID             int
+	Status             string
+	StartedAt          time.Time
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+	BillingDay         int // day of the month periods end on, in months that have it
+	CanceledAt         *time.Time
+	ChangeReason       string
+	PastDueSince       *time.Time // when the payment that made the subscription past due failed
+	DunningAttempts    int        // how many times that payment has been retried
+	NextRetryAt        *time.Time // when the payment will next be retried; nil if it will not be
+	ScheduledPlanID    int        // plan the subscription changes to at the end of the period; 0 if none
+	CancelAtPeriodEnd  bool       // the user canceled, but keeps access until the end of the period
+	CancellationReason string     // the reason the user gave for canceling, if any
+	TrialEndsAt        *time.Time // when the free trial ends; nil if the subscription did not start with one
+	TrialReminderSent  bool
+	CouponID           int  // coupon that discounts the subscription's invoices; 0 if none
+	CouponPeriodsLeft  *int // how many more invoices the coupon discounts; nil if it discounts every invoice
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	Plan               *Plan
+}
+
+// ChangeStatus moves the subscription into a new state, recording the reason for the change. A
+// canceled subscription records when it was canceled, and leaving the past due state clears the
+// subscription's dunning details.
+func (s *Subscription) ChangeStatus(status, reason string, now time.Time) error {
+	if !CanChangeStatus(s.Status, status) {
+		return fmt.Errorf("%w: from %s to %s", ErrStatusChange, s.Status, status)
+	}
+
+	s.Status = status
+	s.ChangeReason = reason
+	s.UpdatedAt = now
+
+	if status == SubscriptionCanceled {
+		s.CanceledAt = &now
+	}
+	if status != SubscriptionPastDue {
+		s.PastDueSince = nil
+		s.DunningAttempts = 0
+		s.NextRetryAt = nil
+	}
+
+	return nil
+}
+
+// HasDiscount reports whether the subscription's next invoice is discounted by a coupon
+func (s *Subscription) HasDiscount() bool {
+	return s.CouponID > 0 && (s.CouponPeriodsLeft == nil || *s.CouponPeriodsLeft > 0)
+}
+
+// NextPeriodEnd returns the end of the period that follows the current one
+func (s *Subscription) NextPeriodEnd() time.Time {
+	return PeriodEndAfter(s.CurrentPeriodEnd, s.BillingDay)
+}
+
+// IsCurrent reports whether the subscription still gives the user access to its plan
+func (s *Subscription) IsCurrent() bool {
+	switch s.Status {
+	case SubscriptionTrialing, SubscriptionActive, SubscriptionPastDue:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetOne returns one subscription by id
+func (s *Subscription) GetOne(id int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.plan_id, up.status, up.started_at,
+			coalesce(up.current_period_start, up.started_at), up.current_period_end, up.billing_day,
+			up.canceled_at, up.change_reason, up.past_due_since, up.dunning_attempts, up.next_retry_at,
+			coalesce(up.scheduled_plan_id, 0), up.cancel_at_period_end, up.cancellation_reason,
+			up.trial_ends_at, up.trial_reminder_sent_at is not null,
+			coalesce(up.coupon_id, 0), up.coupon_periods_left, up.created_at, up.updated_at,
+			p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.id = $1`
+
+	row := db.QueryRowContext(ctx, query, id)
+
+	return scanSubscription(row)
+}
+
+// GetCurrentForUser returns the subscription that currently gives the user access to a plan.
+// If the user has no current subscription, sql.ErrNoRows is returned.
+func (s *Subscription) GetCurrentForUser(userID int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.plan_id, up.status, up.started_at,
+			coalesce(up.current_period_start, up.started_at), up.current_period_end, up.billing_day,
+			up.canceled_at, up.change_reason, up.past_due_since, up.dunning_attempts, up.next_retry_at,
+			coalesce(up.scheduled_plan_id, 0), up.cancel_at_period_end, up.cancellation_reason,
+			up.trial_ends_at, up.trial_reminder_sent_at is not null,
+			coalesce(up.coupon_id, 0), up.coupon_periods_left, up.created_at, up.updated_at,
+			p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.user_id = $1 and up.status in ('trialing', 'active', 'past_due')`
+
+	row := db.QueryRowContext(ctx, query, userID)
+
+	return scanSubscription(row)
+}
+
+// GetHistoryForUser returns every subscription the user has ever had, most recent first
+func (s *Subscription) GetHistoryForUser(userID int) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.plan_id, up.status, up.started_at,
+			coalesce(up.current_period_start, up.started_at), up.current_period_end, up.billing_day,
+			up.canceled_at, up.change_reason, up.past_due_since, up.dunning_attempts, up.next_retry_at,
+			coalesce(up.scheduled_plan_id, 0), up.cancel_at_period_end, up.cancellation_reason,
+			up.trial_ends_at, up.trial_reminder_sent_at is not null,
+			coalesce(up.coupon_id, 0), up.coupon_periods_left, up.created_at, up.updated_at,
+			p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.user_id = $1
+			order by up.started_at desc, up.id desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []*Subscription
+
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// UpdateStatus moves a subscription into a new state, recording the reason for the change. The
+// change follows the rules of ChangeStatus; a change they do not allow returns ErrStatusChange.
+func (s *Subscription) UpdateStatus(id int, status, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the subscription, so that it is changed from the state it is in
+	subscription := Subscription{ID: id}
+	query := `select status, canceled_at, past_due_since, dunning_attempts, next_retry_at
+			from user_plans where id = $1 for update`
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(
+		&subscription.Status,
+		&subscription.CanceledAt,
+		&subscription.PastDueSince,
+		&subscription.DunningAttempts,
+		&subscription.NextRetryAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = subscription.ChangeStatus(status, reason, time.Now())
+	if err != nil {
+		return err
+	}
+
+	stmt := `update user_plans set
+		status = $1,
+		change_reason = $2,
+		canceled_at = $3,
+		past_due_since = $4,
+		dunning_attempts = $5,
+		next_retry_at = $6,
+		updated_at = $7
+		where id = $8`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		subscription.Status,
+		subscription.ChangeReason,
+		subscription.CanceledAt,
+		subscription.PastDueSince,
+		subscription.DunningAttempts,
+		subscription.NextRetryAt,
+		subscription.UpdatedAt,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetDueForRenewal returns the active subscriptions whose current period has ended by the given time,
+// and the trials that have ended by then and are due to convert to paid subscriptions
+func (s *Subscription) GetDueForRenewal(now time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.plan_id, up.status, up.started_at,
+			coalesce(up.current_period_start, up.started_at), up.current_period_end, up.billing_day,
+			up.canceled_at, up.change_reason, up.past_due_since, up.dunning_attempts, up.next_retry_at,
+			coalesce(up.scheduled_plan_id, 0), up.cancel_at_period_end, up.cancellation_reason,
+			up.trial_ends_at, up.trial_reminder_sent_at is not null,
+			coalesce(up.coupon_id, 0), up.coupon_periods_left, up.created_at, up.updated_at,
+			p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.status in ('trialing', 'active') and up.current_period_end <= $1
+			order by up.current_period_end`
+
+	rows, err := db.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []*Subscription
+
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// AdvancePeriod starts a new billing period for a renewed subscription, ending at periodEnd
+func (s *Subscription) AdvancePeriod(id int, periodEnd time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set current_period_start = current_period_end, current_period_end = $1, updated_at = $2
+		where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, periodEnd, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// StartTrial subscribes a user to a free trial of a plan, ending at trialEnd. Like SubscribeUserToPlan,
+// any current subscription the user has is canceled. The ID of the new subscription is returned.
+func (s *Subscription) StartTrial(userID int, plan Plan, trialEnd time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	stmt := `update user_plans set status = $1, canceled_at = $2, change_reason = $3, updated_at = $2
+			where user_id = $4 and status in ('trialing', 'active', 'past_due')`
+
+	_, err = tx.ExecContext(ctx, stmt, SubscriptionCanceled, now, fmt.Sprintf("Changed to %s", plan.PlanName), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	// the trial is the subscription's first period
+	var newID int
+	stmt = `insert into user_plans (user_id, plan_id, status, started_at, current_period_start, current_period_end,
+			billing_day, trial_ends_at, currency, change_reason, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, userID, plan.ID, SubscriptionTrialing, now, now, trialEnd, trialEnd.Day(),
+		trialEnd, plan.Currency, "Free trial", now, now).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// HasHadTrial reports whether the user has ever had a free trial of a plan in the given family
+func (s *Subscription) HasHadTrial(userID int, planFamily string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select exists (select 1 from user_plans up
+			join plans p on (p.id = up.plan_id)
+			where up.user_id = $1 and up.trial_ends_at is not null
+			and coalesce(nullif(p.plan_family, ''), p.plan_name) = $2)`
+
+	var hadTrial bool
+	err := db.QueryRowContext(ctx, query, userID, planFamily).Scan(&hadTrial)
+	if err != nil {
+		return false, err
+	}
+
+	return hadTrial, nil
+}
+
+// GetTrialsEndingBefore returns the trials that end before the given time, and whose user has
+// not yet been reminded that they are about to be charged
+func (s *Subscription) GetTrialsEndingBefore(t time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.plan_id, up.status, up.started_at,
+			coalesce(up.current_period_start, up.started_at), up.current_period_end, up.billing_day,
+			up.canceled_at, up.change_reason, up.past_due_since, up.dunning_attempts, up.next_retry_at,
+			coalesce(up.scheduled_plan_id, 0), up.cancel_at_period_end, up.cancellation_reason,
+			up.trial_ends_at, up.trial_reminder_sent_at is not null,
+			coalesce(up.coupon_id, 0), up.coupon_periods_left, up.created_at, up.updated_at,
+			p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.status = 'trialing' and up.trial_ends_at < $1
+			and up.trial_reminder_sent_at is null and not up.cancel_at_period_end
+			order by up.trial_ends_at`
+
+	rows, err := db.QueryContext(ctx, query, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []*Subscription
+
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// MarkTrialReminderSent records that the user has been reminded that their trial is ending
+func (s *Subscription) MarkTrialReminderSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set trial_reminder_sent_at = $1, updated_at = $1 where id = $2`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ChangePlan moves a subscription to another plan straight away. The subscription is canceled and
+// replaced by one for the new plan, which keeps the current billing period and the state of the
+// old one: a trial stays a trial that ends on the same day, a past due subscription stays past due,
+// and one the user canceled still runs out at the end of the period. The ID of the new subscription
+// is returned.
+func (s *Subscription) ChangePlan(id int, plan Plan, reason string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	// the row stays locked until the transaction ends, so the subscription cannot change in between
+	var userID, billingDay, dunningAttempts int
+	var status, cancellationReason string
+	var cancelAtPeriodEnd bool
+	var periodStart, periodEnd time.Time
+	var trialEndsAt, trialReminderSentAt, pastDueSince, nextRetryAt *time.Time
+	var couponID, couponPeriodsLeft *int
+	stmt := `select user_id, status, coalesce(current_period_start, started_at), current_period_end, billing_day,
+			trial_ends_at, trial_reminder_sent_at, past_due_since, dunning_attempts, next_retry_at,
+			cancel_at_period_end, cancellation_reason, coupon_id, coupon_periods_left
+			from user_plans
+			where id = $1 and status in ('trialing', 'active', 'past_due')
+			for update`
+
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(&userID, &status, &periodStart, &periodEnd, &billingDay,
+		&trialEndsAt, &trialReminderSentAt, &pastDueSince, &dunningAttempts, &nextRetryAt,
+		&cancelAtPeriodEnd, &cancellationReason, &couponID, &couponPeriodsLeft)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `update user_plans set status = $1, canceled_at = $2, change_reason = $3, scheduled_plan_id = null, updated_at = $2
+			where id = $4`
+
+	_, err = tx.ExecContext(ctx, stmt, SubscriptionCanceled, now, fmt.Sprintf("Changed to %s", plan.PlanName), id)
+	if err != nil {
+		return 0, err
+	}
+
+	// a coupon the user redeemed keeps discounting the subscription on the new plan, and a
+	// subscription the user canceled still runs out at the end of the period
+	var newID int
+	stmt = `insert into user_plans (user_id, plan_id, status, started_at, current_period_start, current_period_end,
+			billing_day, trial_ends_at, trial_reminder_sent_at, past_due_since, dunning_attempts, next_retry_at,
+			cancel_at_period_end, cancellation_reason, currency, coupon_id, coupon_periods_left, change_reason,
+			created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+			returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, userID, plan.ID, status, now, periodStart, periodEnd, billingDay,
+		trialEndsAt, trialReminderSentAt, pastDueSince, dunningAttempts, nextRetryAt,
+		cancelAtPeriodEnd, cancellationReason, plan.Currency, couponID, couponPeriodsLeft, reason, now, now).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// SchedulePlanChange sets the plan a subscription changes to when its current period ends.
+// A planID of 0 removes a scheduled change.
+func (s *Subscription) SchedulePlanChange(id int, planID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var scheduledPlanID any
+	if planID > 0 {
+		scheduledPlanID = planID
+	}
+
+	stmt := `update user_plans set scheduled_plan_id = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, scheduledPlanID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Cancel ends a subscription straight away at the user's request, recording the reason they gave, if any
+func (s *Subscription) Cancel(id int, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set
+		status = $1,
+		change_reason = 'Canceled by user',
+		cancellation_reason = $2,
+		canceled_at = $3,
+		cancel_at_period_end = false,
+		scheduled_plan_id = null,
+		past_due_since = null,
+		dunning_attempts = 0,
+		next_retry_at = null,
+		updated_at = $3
+		where id = $4 and status in ('trialing', 'active', 'past_due')`
+
+	_, err := db.ExecContext(ctx, stmt, SubscriptionCanceled, reason, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ScheduleCancellation cancels an active or trialing subscription at the end of its current period. Until then the
+// user keeps access to the plan, and can reactivate the subscription. A scheduled plan change is dropped.
+func (s *Subscription) ScheduleCancellation(id int, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set cancel_at_period_end = true, cancellation_reason = $1, scheduled_plan_id = null, updated_at = $2
+		where id = $3 and status in ('trialing', 'active')`
+
+	_, err := db.ExecContext(ctx, stmt, reason, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reactivate undoes a scheduled cancellation, so the subscription renews as usual
+func (s *Subscription) Reactivate(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set cancel_at_period_end = false, cancellation_reason = '', updated_at = $1
+		where id = $2 and status in ('trialing', 'active')`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ApplyCoupon records the coupon that discounts a subscription's invoices, and how many of them it
+// still discounts. A nil periodsLeft means the coupon discounts every invoice.
+func (s *Subscription) ApplyCoupon(id int, couponID int, periodsLeft *int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set coupon_id = $1, coupon_periods_left = $2, updated_at = $3 where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, couponID, periodsLeft, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UseCouponPeriod counts off one invoice discounted by the subscription's coupon
+func (s *Subscription) UseCouponPeriod(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set coupon_periods_left = coupon_periods_left - 1, updated_at = $1
+		where id = $2 and coupon_periods_left > 0`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// StartDunning makes a subscription past due after a failed payment, and schedules the first retry of the payment
+func (s *Subscription) StartDunning(id int, reason string, nextRetryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set
+		status = $1,
+		change_reason = $2,
+		past_due_since = $3,
+		dunning_attempts = 0,
+		next_retry_at = $4,
+		updated_at = $3
+		where id = $5`
+
+	_, err := db.ExecContext(ctx, stmt, SubscriptionPastDue, reason, time.Now(), nextRetryAt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecordFailedRetry counts another failed retry of a past due subscription's payment, and schedules the next one
+func (s *Subscription) RecordFailedRetry(id int, nextRetryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set dunning_attempts = dunning_attempts + 1, next_retry_at = $1, updated_at = $2
+		where id = $3 and status = $4`
+
+	_, err := db.ExecContext(ctx, stmt, nextRetryAt, time.Now(), id, SubscriptionPastDue)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetDueForRetry returns the past due subscriptions whose payment is due to be retried by the given time
+func (s *Subscription) GetDueForRetry(now time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select up.id, up.user_id, up.plan_id, up.status, up.started_at,
+			coalesce(up.current_period_start, up.started_at), up.current_period_end, up.billing_day,
+			up.canceled_at, up.change_reason, up.past_due_since, up.dunning_attempts, up.next_retry_at,
+			coalesce(up.scheduled_plan_id, 0), up.cancel_at_period_end, up.cancellation_reason,
+			up.trial_ends_at, up.trial_reminder_sent_at is not null,
+			coalesce(up.coupon_id, 0), up.coupon_periods_left, up.created_at, up.updated_at,
+			p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at
+			from user_plans up
+			join plans p on (p.id = up.plan_id)
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.status = 'past_due' and up.next_retry_at <= $1
+			order by up.next_retry_at`
+
+	rows, err := db.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []*Subscription
+
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSubscription(row scanner) (*Subscription, error) {
+	var subscription Subscription
+	var plan Plan
+	var price sql.NullInt64
+
+	err := row.Scan(
+		&subscription.ID,
+		&subscription.UserID,
+		&subscription.PlanID,
+		&subscription.Status,
+		&subscription.StartedAt,
+		&subscription.CurrentPeriodStart,
+		&subscription.CurrentPeriodEnd,
+		&subscription.BillingDay,
+		&subscription.CanceledAt,
+		&subscription.ChangeReason,
+		&subscription.PastDueSince,
+		&subscription.DunningAttempts,
+		&subscription.NextRetryAt,
+		&subscription.ScheduledPlanID,
+		&subscription.CancelAtPeriodEnd,
+		&subscription.CancellationReason,
+		&subscription.TrialEndsAt,
+		&subscription.TrialReminderSent,
+		&subscription.CouponID,
+		&subscription.CouponPeriodsLeft,
+		&subscription.CreatedAt,
+		&subscription.UpdatedAt,
+		&plan.ID,
+		&plan.PlanName,
+		&plan.PlanAmount,
+		&price,
+		&plan.Currency,
+		&plan.CreatedAt,
+		&plan.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// a subscription is charged in its own currency, so a plan that is not priced in it cannot be billed
+	plan.PlanAmount, err = amountIn(plan.Currency, plan.PlanAmount, price)
+	if err != nil {
+		return nil, fmt.Errorf("subscription %d: %w", subscription.ID, err)
+	}
+
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
+	subscription.Plan = &plan
+
+	return &subscription, nil
+}
+
+// NextPeriodEnd returns the end of a monthly billing period starting at t. Periods that start
+// late in a month end on the last day of the next month, rather than spilling into the one after.
+func NextPeriodEnd(t time.Time) time.Time {
+	return PeriodEndAfter(t, t.Day())
+}
+
+// PeriodEndAfter returns the end of the monthly period that follows one ending at t, for a
+// subscription billed on billingDay of the month. A month too short for the billing day ends the
+// period on its last day, and the months after it go back to the billing day, so that e.g. a
+// subscription billed on the 31st renews on January 31st, February 28th and March 31st.
+func PeriodEndAfter(t time.Time, billingDay int) time.Time {
+	if billingDay < 1 {
+		billingDay = t.Day()
+	}
+
+	year, month, _ := t.Date()
+	first := time.Date(year, month+1, 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+
+	return first.AddDate(0, 0, min(billingDay, last)-1)
+}
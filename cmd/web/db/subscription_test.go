@@ -0,0 +1,135 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCanChangeStatus(t *testing.T) {
+	var tests = []struct {
+		from     string
+		to       string
+		expected bool
+	}{
+		{SubscriptionTrialing, SubscriptionActive, true},
+		{SubscriptionTrialing, SubscriptionExpired, true},
+		{SubscriptionActive, SubscriptionPastDue, true},
+		{SubscriptionActive, SubscriptionCanceled, true},
+		{SubscriptionActive, SubscriptionTrialing, false},
+		{SubscriptionActive, SubscriptionActive, false},
+		{SubscriptionPastDue, SubscriptionActive, true},
+		{SubscriptionPastDue, SubscriptionCanceled, true},
+		{SubscriptionCanceled, SubscriptionActive, false},
+		{SubscriptionExpired, SubscriptionActive, false},
+		{SubscriptionExpired, SubscriptionCanceled, false},
+	}
+
+	for _, e := range tests {
+		if got := CanChangeStatus(e.from, e.to); got != e.expected {
+			t.Errorf("%s to %s: expected %t, got %t", e.from, e.to, e.expected, got)
+		}
+	}
+}
+
+func TestSubscription_ChangeStatus(t *testing.T) {
+	now := time.Date(2024, time.February, 6, 12, 0, 0, 0, time.UTC)
+	pastDueSince := now.AddDate(0, 0, -7)
+	nextRetry := now.AddDate(0, 0, 1)
+
+	var tests = []struct {
+		name            string
+		to              string
+		expectedError   bool
+		expectedDunning bool // whether the dunning details are kept
+		expectedCancel  bool // whether the time it was canceled is recorded
+	}{
+		{"payment received", SubscriptionActive, false, false, false},
+		{"payment not received", SubscriptionCanceled, false, false, true},
+		{"ran out", SubscriptionExpired, false, false, false},
+		{"still past due", SubscriptionPastDue, true, true, false},
+		{"back to a trial", SubscriptionTrialing, true, true, false},
+	}
+
+	for _, e := range tests {
+		subscription := Subscription{
+			ID:              1,
+			Status:          SubscriptionPastDue,
+			PastDueSince:    &pastDueSince,
+			DunningAttempts: 2,
+			NextRetryAt:     &nextRetry,
+		}
+
+		err := subscription.ChangeStatus(e.to, "Test", now)
+		if (err != nil) != e.expectedError {
+			t.Errorf("%s: expected error to be %t, got %v", e.name, e.expectedError, err)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrStatusChange) {
+				t.Errorf("%s: expected ErrStatusChange, got %v", e.name, err)
+			}
+			if subscription.Status != SubscriptionPastDue {
+				t.Errorf("%s: expected the status to stay past due, got %s", e.name, subscription.Status)
+			}
+		} else if subscription.Status != e.to || subscription.ChangeReason != "Test" {
+			t.Errorf("%s: expected status %s because of Test, got %s because of %q", e.name, e.to, subscription.Status, subscription.ChangeReason)
+		}
+
+		kept := subscription.PastDueSince != nil && subscription.DunningAttempts == 2 && subscription.NextRetryAt != nil
+		cleared := subscription.PastDueSince == nil && subscription.DunningAttempts == 0 && subscription.NextRetryAt == nil
+		if e.expectedDunning && !kept || !e.expectedDunning && !cleared {
+			t.Errorf("%s: expected the dunning details to be kept to be %t, got %+v", e.name, e.expectedDunning, subscription)
+		}
+
+		if (subscription.CanceledAt != nil) != e.expectedCancel {
+			t.Errorf("%s: expected the time it was canceled to be recorded to be %t", e.name, e.expectedCancel)
+		}
+	}
+}
+
+func TestPeriodEndAfter(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 9, 30, 0, 0, time.UTC)
+	}
+
+	var tests = []struct {
+		name       string
+		periodEnd  time.Time
+		billingDay int
+		expected   time.Time
+	}{
+		{"middle of the month", date(2024, time.March, 15), 15, date(2024, time.April, 15)},
+		{"into a short month", date(2024, time.January, 31), 31, date(2024, time.February, 29)},
+		{"out of a short month", date(2024, time.February, 29), 31, date(2024, time.March, 31)},
+		{"into a 30 day month", date(2024, time.March, 31), 31, date(2024, time.April, 30)},
+		{"out of a 30 day month", date(2024, time.April, 30), 31, date(2024, time.May, 31)},
+		{"not a leap year", date(2023, time.January, 30), 30, date(2023, time.February, 28)},
+		{"into the next year", date(2024, time.December, 31), 31, date(2025, time.January, 31)},
+		{"no billing day", date(2024, time.January, 31), 0, date(2024, time.February, 29)},
+	}
+
+	for _, e := range tests {
+		if got := PeriodEndAfter(e.periodEnd, e.billingDay); !got.Equal(e.expected) {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestSubscription_NextPeriodEnd(t *testing.T) {
+	// a subscription billed on the 31st keeps renewing on the last day of the month
+	subscription := Subscription{
+		CurrentPeriodEnd: time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC),
+		BillingDay:       31,
+	}
+
+	var got []string
+	for range 4 {
+		subscription.CurrentPeriodEnd = subscription.NextPeriodEnd()
+		got = append(got, subscription.CurrentPeriodEnd.Format("Jan 2"))
+	}
+
+	if expected := "[Feb 29 Mar 31 Apr 30 May 31]"; fmt.Sprint(got) != expected {
+		t.Errorf("expected periods to end on %s, got %v", expected, got)
+	}
+}
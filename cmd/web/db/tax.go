@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// TaxRate is the type for one row of the tax_rates table: a tax charged to customers in a country,
+// or in one region of a country. Rates for a region replace the rates for the country as a whole.
+type TaxRate struct {
+	ID            int
+	Country       string // ISO 3166-1 alpha-2 code, e.g. "CA"
+	Region        string // e.g. a province or state code; empty if the rate applies to the whole country
+	Name          string // as shown on invoices, e.g. "HST"
+	Rate          int    // in thousandths of a percent, so 13% is 13000
+	Inclusive     bool   // prices already include the tax
+	ReverseCharge bool   // business customers with a tax ID account for the tax themselves
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// InvoiceTaxLine is the type for one tax charged on an invoice
+type InvoiceTaxLine struct {
+	ID        int
+	InvoiceID int
+	Name      string
+	Rate      int // in thousandths of a percent
+	Amount    int
+	CreatedAt time.Time
+	Currency  string // copied from the invoice, to format the amount
+	Locale    string
+}
+
+// formatRate formats a rate in thousandths of a percent, e.g. 9975 as "9.975%"
+func formatRate(rate int) string {
+	return strconv.FormatFloat(float64(rate)/1000, 'f', -1, 64) + "%"
+}
+
+// RateForDisplay formats the tax rate as a percentage
+func (t *TaxRate) RateForDisplay() string {
+	return formatRate(t.Rate)
+}
+
+// Description names the tax and its rate, e.g. "HST 13%"
+func (l *InvoiceTaxLine) Description() string {
+	return fmt.Sprintf("%s %s", l.Name, formatRate(l.Rate))
+}
+
+// AmountForDisplay formats the tax amount as a currency string
+func (l *InvoiceTaxLine) AmountForDisplay() string {
+	return FormatMoney(l.Amount, l.Currency, l.Locale)
+}
+
+// GetForLocation returns the taxes charged to customers in a country and region. If there are no
+// rates for the region, the rates for the whole country are returned.
+func (t *TaxRate) GetForLocation(country, region string) ([]*TaxRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, country, region, name, rate, inclusive, reverse_charge, created_at, updated_at
+			from tax_rates
+			where country = $1 and region in ('', $2)
+			order by region desc, id`
+
+	rows, err := db.QueryContext(ctx, query, country, region)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []*TaxRate
+
+	for rows.Next() {
+		var rate TaxRate
+		err := rows.Scan(
+			&rate.ID,
+			&rate.Country,
+			&rate.Region,
+			&rate.Name,
+			&rate.Rate,
+			&rate.Inclusive,
+			&rate.ReverseCharge,
+			&rate.CreatedAt,
+			&rate.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// the region's own rates come first, and replace the country's
+		if len(rates) > 0 && rates[0].Region != "" && rate.Region == "" {
+			break
+		}
+
+		rates = append(rates, &rate)
+	}
+
+	return rates, rows.Err()
+}
@@ -2,7 +2,11 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -10,8 +14,17 @@ func TestNew(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: &UserTest{},
-		Plan: &PlanTest{},
+		User:           &UserTest{},
+		Plan:           &PlanTest{},
+		Subscription:   &SubscriptionTest{},
+		Invoice:        &InvoiceTest{},
+		IdempotencyKey: &IdempotencyKeyTest{claimed: make(map[string]bool)},
+		WebhookEvent:   &WebhookEventTest{},
+		Lock:           &LockTest{},
+		Coupon:         &CouponTest{},
+		TaxRate:        &TaxRateTest{},
+		AuditEvent:     &AuditEventTest{},
+		TwoFactor:      &TwoFactorTest{},
 	}
 }
 
@@ -30,51 +43,100 @@ type UserTest struct {
 
 func (u *UserTest) GetAll() ([]*User, error) {
 	var users []*User
+	activatedAt := time.Now().AddDate(0, -1, 0)
 
 	user := User{
-		ID:        1,
-		Email:     "test@example.com",
-		FirstName: "Test",
-		LastName:  "User",
-		Password:  "password",
-		Active:    1,
-		IsAdmin:   0,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:          1,
+		Email:       "test@example.com",
+		FirstName:   "Test",
+		LastName:    "User",
+		Password:    "password",
+		Active:      1,
+		IsAdmin:     0,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		ActivatedAt: &activatedAt,
 	}
 
 	users = append(users, &user)
 
+	inactive := user
+	inactive.ID = 2
+	inactive.Email = "jane@example.com"
+	inactive.FirstName = "Jane"
+	inactive.LastName = "Doe"
+	inactive.Active = 0
+	inactive.ActivatedAt = nil
+	users = append(users, &inactive)
+
+	admin, _ := u.GetOne(3)
+	users = append(users, admin)
+
 	return users, nil
 }
 
+// GetByEmail returns user 1 for every address but jane@example.com, the address of user 2, who
+// has not activated their account, and deactivated@example.com, the address of user 6, whose
+// account an admin deactivated
 func (u *UserTest) GetByEmail(email string) (*User, error) {
+	activatedAt := time.Now().AddDate(0, -1, 0)
+
 	user := User{
-		ID:        1,
-		Email:     "test@example.com",
-		FirstName: "Test",
-		LastName:  "User",
-		Password:  "password",
-		Active:    1,
-		IsAdmin:   0,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:          1,
+		Email:       "test@example.com",
+		FirstName:   "Test",
+		LastName:    "User",
+		Password:    "password",
+		Active:      1,
+		IsAdmin:     0,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		ActivatedAt: &activatedAt,
+	}
+
+	switch NormalizeEmail(email) {
+	case "jane@example.com":
+		user.ID = 2
+		user.Email = "jane@example.com"
+		user.FirstName = "Jane"
+		user.LastName = "Doe"
+		user.Active = 0
+		user.ActivatedAt = nil
+	case "deactivated@example.com":
+		user.ID = 6
+		user.Email = "deactivated@example.com"
+		user.Active = 0
 	}
+
 	return &user, nil
 }
 
 func (u *UserTest) GetOne(id int) (*User, error) {
+	activatedAt := time.Now().AddDate(0, -1, 0)
+
 	user := User{
-		ID:        1,
-		Email:     "test@example.com",
-		FirstName: "Test",
-		LastName:  "User",
-		Password:  "password",
-		Active:    1,
-		IsAdmin:   0,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:                1,
+		Email:             "test@example.com",
+		FirstName:         "Test",
+		LastName:          "User",
+		Password:          "password",
+		Active:            1,
+		IsAdmin:           0,
+		PaymentCustomerID: "cus_test",
+		PaymentMethodID:   "pm_card_visa",
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
+		ActivatedAt:       &activatedAt,
 	}
+
+	// user 3 is an administrator
+	if id == 3 {
+		user.ID = 3
+		user.Email = "admin@example.com"
+		user.FirstName = "Admin"
+		user.IsAdmin = 1
+	}
+
 	return &user, nil
 }
 
@@ -82,7 +144,36 @@ func (u *UserTest) Update(user User) error {
 	return nil
 }
 
-func (u *UserTest) DeleteByID(id int) error {
+// ChangeEmail refuses admin@example.com, the address of user 3
+func (u *UserTest) ChangeEmail(id int, email string) error {
+	if NormalizeEmail(email) == "admin@example.com" && id != 3 {
+		return ErrDuplicateEmail
+	}
+	return nil
+}
+
+func (u *UserTest) UpdatePaymentDetails(id int, customerID, paymentMethodID string) error {
+	return nil
+}
+
+func (u *UserTest) UpdateBillingDetails(id int, address Address, taxID string) error {
+	return nil
+}
+
+func (u *UserTest) SetCurrency(id int, currency string) (bool, error) {
+	return true, nil
+}
+
+func (u *UserTest) UpdateLocale(id int, locale string) error {
+	return nil
+}
+
+// Activate activates every account but user 6's, which an admin deactivated
+func (u *UserTest) Activate(id int) (bool, error) {
+	return id != 6, nil
+}
+
+func (u *UserTest) Anonymize(id int) error {
 	return nil
 }
 
@@ -90,12 +181,24 @@ func (u *UserTest) Insert(user User) (int, error) {
 	return 1, nil
 }
 
-func (u *UserTest) ResetPassword(password string) error {
+func (u *UserTest) ResetPassword(id int, password string) error {
 	return nil
 }
 
-func (u *UserTest) PasswordMatches(plainText string) (bool, error) {
-	return true, nil
+const (
+	// TestWrongPassword is the one password UserTest.PasswordMatches does not accept
+	TestWrongPassword = "wrong-password"
+	// TestPasswordError is the password UserTest.PasswordMatches fails to check, as for a corrupt hash
+	TestPasswordError = "password-error"
+)
+
+var errTestPassword = errors.New("test: unable to check password")
+
+func (u *UserTest) PasswordMatches(user User, plainText string) (bool, error) {
+	if plainText == TestPasswordError {
+		return false, errTestPassword
+	}
+	return plainText != TestWrongPassword, nil
 }
 
 type PlanTest struct {
@@ -115,6 +218,8 @@ func (p *PlanTest) GetAll() ([]*Plan, error) {
 		PlanName:            "Test Plan",
 		PlanAmount:          1000,
 		PlanAmountFormatted: "$10.00",
+		Currency:            DefaultCurrency,
+		Prices:              map[string]int{DefaultCurrency: 1000, "JPY": 1500},
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
@@ -124,22 +229,757 @@ func (p *PlanTest) GetAll() ([]*Plan, error) {
 }
 
 func (p *PlanTest) GetOne(id int) (*Plan, error) {
+	// the test subscription is to plan 1; plan 2 costs more, plan 3 costs less, plan 4 has a free trial,
+	// and plan 5 is archived. Every plan is also sold in JPY, which has no minor unit.
+	amount := 1000
+	trialDays := 0
+	var archivedAt *time.Time
+	switch id {
+	case 2:
+		amount = 2000
+	case 3:
+		amount = 500
+	case 4:
+		trialDays = 14
+	case 5:
+		archived := time.Now().AddDate(0, -1, 0)
+		archivedAt = &archived
+	}
+
 	plan := Plan{
 		ID:                  id,
 		PlanName:            "Test Plan",
-		PlanAmount:          1000,
-		PlanAmountFormatted: "10.00",
+		PlanAmount:          amount,
+		PlanAmountFormatted: FormatMoney(amount, DefaultCurrency, DefaultLocale),
+		Currency:            DefaultCurrency,
+		Prices:              map[string]int{DefaultCurrency: amount, "JPY": amount * 3 / 2},
+		TrialDays:           trialDays,
+		Version:             1,
+		ArchivedAt:          archivedAt,
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
 	return &plan, nil
 }
 
-func (p *PlanTest) SubscribeUserToPlan(user User, plan Plan) error {
+func (p *PlanTest) GetAllWithArchived() ([]*Plan, error) {
+	plans, _ := p.GetAll()
+	archived, _ := p.GetOne(5)
+	return append(plans, archived), nil
+}
+
+func (p *PlanTest) Insert(plan Plan) (int, error) {
+	return 6, nil
+}
+
+func (p *PlanTest) Rename(id int, name string) error {
+	return nil
+}
+
+func (p *PlanTest) Archive(id int) error {
+	return nil
+}
+
+func (p *PlanTest) Restore(id int) error {
 	return nil
 }
 
+func (p *PlanTest) NewVersion(id int, prices map[string]int) (int, error) {
+	return 6, nil
+}
+
+func (p *PlanTest) SubscribeUserToPlan(user User, plan Plan) (int, error) {
+	return 1, nil
+}
+
 func (p *PlanTest) AmountForDisplay() string {
-	amount := float64(p.PlanAmount) / 100.0
-	return fmt.Sprintf("$%.2f", amount)
+	return FormatMoney(p.PlanAmount, DefaultCurrency, DefaultLocale)
+}
+
+// SubscriptionTest records the changes it is asked to make, so tests can check them
+type SubscriptionTest struct {
+	mu      sync.Mutex
+	changes []SubscriptionChange
+}
+
+// SubscriptionChange is a change made to a subscription through SubscriptionTest
+type SubscriptionChange struct {
+	Method string // the model method that made the change, e.g. "UpdateStatus"
+	ID     int
+	Status string    // the new status, for UpdateStatus
+	Time   time.Time // the new period end, or the next retry
+}
+
+func (s *SubscriptionTest) record(change SubscriptionChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes = append(s.changes, change)
+}
+
+// Changes returns the changes that were made, in order
+func (s *SubscriptionTest) Changes() []SubscriptionChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]SubscriptionChange{}, s.changes...)
+}
+
+func (s *SubscriptionTest) GetOne(id int) (*Subscription, error) {
+	subscription := testSubscription()
+	subscription.ID = id
+	return &subscription, nil
+}
+
+func (s *SubscriptionTest) GetCurrentForUser(userID int) (*Subscription, error) {
+	// test user 2 has never subscribed
+	if userID == 2 {
+		return nil, sql.ErrNoRows
+	}
+
+	subscription := testSubscription()
+	subscription.UserID = userID
+
+	// test user 5 is on a free trial of plan 4
+	if userID == 5 {
+		trialEnd := time.Now().AddDate(0, 0, 7)
+		subscription.PlanID = 4
+		subscription.Status = SubscriptionTrialing
+		subscription.CurrentPeriodEnd = trialEnd
+		subscription.TrialEndsAt = &trialEnd
+	}
+
+	// test user 4 has not paid their last invoice
+	if userID == 4 {
+		pastDueSince := time.Now().AddDate(0, 0, -1)
+		subscription.Status = SubscriptionPastDue
+		subscription.PastDueSince = &pastDueSince
+	}
+	return &subscription, nil
+}
+
+func (s *SubscriptionTest) GetHistoryForUser(userID int) ([]*Subscription, error) {
+	current := testSubscription()
+	current.UserID = userID
+
+	canceledAt := current.StartedAt
+	previous := Subscription{
+		ID:               2,
+		UserID:           userID,
+		PlanID:           2,
+		Status:           SubscriptionCanceled,
+		StartedAt:        current.StartedAt.AddDate(0, -1, 0),
+		CurrentPeriodEnd: current.StartedAt,
+		CanceledAt:       &canceledAt,
+		ChangeReason:     "Changed to Test Plan",
+		Plan: &Plan{
+			ID:                  2,
+			PlanName:            "Old Test Plan",
+			PlanAmount:          2000,
+			PlanAmountFormatted: "$20.00",
+			Currency:            DefaultCurrency,
+		},
+	}
+
+	return []*Subscription{&current, &previous}, nil
+}
+
+func (s *SubscriptionTest) UpdateStatus(id int, status, reason string) error {
+	s.record(SubscriptionChange{Method: "UpdateStatus", ID: id, Status: status})
+	return nil
+}
+
+func (s *SubscriptionTest) GetDueForRenewal(now time.Time) ([]*Subscription, error) {
+	subscription := testSubscription()
+	subscription.CurrentPeriodEnd = now.Add(-time.Minute)
+	return []*Subscription{&subscription}, nil
+}
+
+func (s *SubscriptionTest) AdvancePeriod(id int, periodEnd time.Time) error {
+	s.record(SubscriptionChange{Method: "AdvancePeriod", ID: id, Time: periodEnd})
+	return nil
+}
+
+func (s *SubscriptionTest) StartTrial(userID int, plan Plan, trialEnd time.Time) (int, error) {
+	return 1, nil
+}
+
+func (s *SubscriptionTest) HasHadTrial(userID int, planFamily string) (bool, error) {
+	return false, nil
+}
+
+func (s *SubscriptionTest) GetTrialsEndingBefore(t time.Time) ([]*Subscription, error) {
+	subscription := testSubscription()
+	trialEnd := t.Add(-time.Hour)
+	subscription.Status = SubscriptionTrialing
+	subscription.CurrentPeriodEnd = trialEnd
+	subscription.TrialEndsAt = &trialEnd
+	return []*Subscription{&subscription}, nil
+}
+
+func (s *SubscriptionTest) MarkTrialReminderSent(id int) error {
+	return nil
+}
+
+func (s *SubscriptionTest) ChangePlan(id int, plan Plan, reason string) (int, error) {
+	s.record(SubscriptionChange{Method: "ChangePlan", ID: id})
+	return id + 1, nil
+}
+
+func (s *SubscriptionTest) SchedulePlanChange(id int, planID int) error {
+	s.record(SubscriptionChange{Method: "SchedulePlanChange", ID: id})
+	return nil
+}
+
+func (s *SubscriptionTest) Cancel(id int, reason string) error {
+	return nil
+}
+
+func (s *SubscriptionTest) ScheduleCancellation(id int, reason string) error {
+	return nil
+}
+
+func (s *SubscriptionTest) Reactivate(id int) error {
+	return nil
+}
+
+func (s *SubscriptionTest) StartDunning(id int, reason string, nextRetryAt time.Time) error {
+	s.record(SubscriptionChange{Method: "StartDunning", ID: id, Status: SubscriptionPastDue, Time: nextRetryAt})
+	return nil
+}
+
+func (s *SubscriptionTest) RecordFailedRetry(id int, nextRetryAt time.Time) error {
+	s.record(SubscriptionChange{Method: "RecordFailedRetry", ID: id, Time: nextRetryAt})
+	return nil
+}
+
+func (s *SubscriptionTest) GetDueForRetry(now time.Time) ([]*Subscription, error) {
+	subscription := testSubscription()
+	pastDueSince := now.AddDate(0, 0, -1)
+	subscription.Status = SubscriptionPastDue
+	subscription.CurrentPeriodEnd = pastDueSince
+	subscription.PastDueSince = &pastDueSince
+	subscription.NextRetryAt = &now
+	return []*Subscription{&subscription}, nil
+}
+
+func (s *SubscriptionTest) ApplyCoupon(id int, couponID int, periodsLeft *int) error {
+	return nil
+}
+
+func (s *SubscriptionTest) UseCouponPeriod(id int) error {
+	return nil
+}
+
+func testSubscription() Subscription {
+	start := time.Now().AddDate(0, 0, -10)
+	return Subscription{
+		ID:                 1,
+		UserID:             1,
+		PlanID:             1,
+		Status:             SubscriptionActive,
+		StartedAt:          start,
+		CurrentPeriodStart: start,
+		CurrentPeriodEnd:   NextPeriodEnd(start),
+		BillingDay:         start.Day(),
+		ChangeReason:       "New subscription",
+		CreatedAt:          start,
+		UpdatedAt:          start,
+		Plan: &Plan{
+			ID:                  1,
+			PlanName:            "Test Plan",
+			PlanAmount:          1000,
+			PlanAmountFormatted: "$10.00",
+			Currency:            DefaultCurrency,
+		},
+	}
+}
+
+// InvoiceTest keeps the renewal invoices it is given, so that a renewal that is run again finds
+// the invoice it issued
+type InvoiceTest struct {
+	mu       sync.Mutex
+	renewals []Invoice
+	paid     []int
+	voided   []int
+	disputed []int
+}
+
+func (i *InvoiceTest) Insert(invoice Invoice) (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if invoice.PeriodStart == nil {
+		return 1, nil
+	}
+	invoice.ID = 100 + len(i.renewals)
+	invoice.Status = InvoiceOpen
+	i.renewals = append(i.renewals, invoice)
+	return invoice.ID, nil
+}
+
+func (i *InvoiceTest) GetForPeriod(subscriptionID int, periodStart time.Time) (*Invoice, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, invoice := range i.renewals {
+		if invoice.SubscriptionID == subscriptionID && invoice.PeriodStart.Equal(periodStart) {
+			return &invoice, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// Renewals returns the renewal invoices that were issued, in order
+func (i *InvoiceTest) Renewals() []Invoice {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]Invoice{}, i.renewals...)
+}
+
+func (i *InvoiceTest) GetOne(id int) (*Invoice, error) {
+	invoice := testInvoice()
+	invoice.ID = id
+	return &invoice, nil
+}
+
+func (i *InvoiceTest) GetAllForUser(userID int) ([]*Invoice, error) {
+	invoice := testInvoice()
+	invoice.UserID = userID
+	return []*Invoice{&invoice}, nil
+}
+
+func (i *InvoiceTest) GetByChargeID(chargeID string) (*Invoice, error) {
+	invoice := testInvoice()
+	invoice.Status = InvoicePaid
+	invoice.ChargeID = chargeID
+
+	// charge ch_earlier_period paid for a period of the subscription that has ended
+	if chargeID == "ch_earlier_period" {
+		periodStart := time.Now().AddDate(0, -2, 0)
+		invoice.PeriodStart = &periodStart
+		invoice.IssuedAt = periodStart
+	}
+	return &invoice, nil
+}
+
+func (i *InvoiceTest) GetOpenForSubscription(subscriptionID int) (*Invoice, error) {
+	invoice := testInvoice()
+	invoice.SubscriptionID = subscriptionID
+	return &invoice, nil
+}
+
+func (i *InvoiceTest) MarkPaid(id int, chargeID string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.paid = append(i.paid, id)
+	for n := range i.renewals {
+		if i.renewals[n].ID == id {
+			i.renewals[n].Status = InvoicePaid
+			i.renewals[n].ChargeID = chargeID
+		}
+	}
+	return nil
+}
+
+func (i *InvoiceTest) Reopen(id int) error {
+	return nil
+}
+
+func (i *InvoiceTest) Void(id int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.voided = append(i.voided, id)
+	return nil
+}
+
+func (i *InvoiceTest) MarkDisputed(id int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.disputed = append(i.disputed, id)
+	return nil
+}
+
+// Paid returns the ids of the invoices that were marked as paid, in order
+func (i *InvoiceTest) Paid() []int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]int{}, i.paid...)
+}
+
+// Voided returns the ids of the invoices that were voided, in order
+func (i *InvoiceTest) Voided() []int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]int{}, i.voided...)
+}
+
+// Disputed returns the ids of the invoices that were marked as disputed, in order
+func (i *InvoiceTest) Disputed() []int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]int{}, i.disputed...)
+}
+
+func testInvoice() Invoice {
+	issued := time.Now()
+	return Invoice{
+		ID:             1,
+		InvoiceNumber:  1,
+		UserID:         1,
+		SubscriptionID: 1,
+		Status:         InvoiceOpen,
+		Subtotal:       1000,
+		Tax:            0,
+		Total:          1000,
+		IssuedAt:       issued,
+		DueAt:          issued.AddDate(0, 0, 7),
+		CreatedAt:      issued,
+		UpdatedAt:      issued,
+		LineItems: []*InvoiceLineItem{
+			{
+				ID:          1,
+				InvoiceID:   1,
+				Description: "Test Plan (monthly subscription)",
+				Quantity:    1,
+				UnitAmount:  1000,
+				Amount:      1000,
+				CreatedAt:   issued,
+			},
+		},
+	}
+}
+
+type IdempotencyKeyTest struct {
+	claimed map[string]bool
+}
+
+func (k *IdempotencyKeyTest) Claim(key string, userID int) (bool, error) {
+	if k.claimed[key] {
+		return false, nil
+	}
+	k.claimed[key] = true
+	return true, nil
+}
+
+func (k *IdempotencyKeyTest) Release(key string) error {
+	delete(k.claimed, key)
+	return nil
+}
+
+type WebhookEventTest struct {
+	mu        sync.Mutex
+	received  map[string]WebhookEvent
+	processed []string
+}
+
+// Record stores the event as received now, unless it says when it was received
+func (e *WebhookEventTest) Record(event WebhookEvent) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.received == nil {
+		e.received = make(map[string]WebhookEvent)
+	}
+	if _, ok := e.received[event.ID]; ok {
+		return false, nil
+	}
+	if event.ReceivedAt.IsZero() {
+		event.ReceivedAt = time.Now()
+	}
+	e.received[event.ID] = event
+	return true, nil
+}
+
+func (e *WebhookEventTest) GetUnprocessed(from, to time.Time) ([]*WebhookEvent, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var events []*WebhookEvent
+	for _, event := range e.received {
+		if slices.Contains(e.processed, event.ID) || event.ReceivedAt.Before(from) || !event.ReceivedAt.Before(to) {
+			continue
+		}
+		events = append(events, &event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ReceivedAt.Before(events[j].ReceivedAt) })
+	return events, nil
+}
+
+func (e *WebhookEventTest) MarkProcessed(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.processed = append(e.processed, id)
+	return nil
+}
+
+// Processed returns the ids of the events that were marked as processed, in order
+func (e *WebhookEventTest) Processed() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]string{}, e.processed...)
+}
+
+type LockTest struct {
+	Held bool // set to pretend another instance holds the lock
+}
+
+func (l *LockTest) TryAcquire(key int64) (func(), bool, error) {
+	if l.Held {
+		return nil, false, nil
+	}
+	return func() {}, true, nil
+}
+
+type CouponTest struct{}
+
+// GetByCode knows a coupon for each way a code can be valid or not; any other code does not exist
+func (c *CouponTest) GetByCode(code string) (*Coupon, error) {
+	coupon := Coupon{
+		ID:           1,
+		Code:         NormalizeCouponCode(code),
+		DiscountType: CouponPercent,
+		PercentOff:   20,
+		Duration:     CouponOnce,
+		Active:       true,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	switch coupon.Code {
+	case "SAVE20":
+	case "FIVEOFF":
+		coupon.ID = 2
+		coupon.DiscountType = CouponFixed
+		coupon.PercentOff = 0
+		coupon.AmountOff = 500
+		coupon.Currency = DefaultCurrency
+		coupon.Duration = CouponForever
+	case "EXPIRED":
+		coupon.ID = 3
+		expiresAt := time.Now().AddDate(0, 0, -1)
+		coupon.ExpiresAt = &expiresAt
+	case "GOLDONLY":
+		coupon.ID = 4
+		coupon.PlanID = 2
+	default:
+		return nil, sql.ErrNoRows
+	}
+
+	return &coupon, nil
+}
+
+func (c *CouponTest) GetOne(id int) (*Coupon, error) {
+	codes := map[int]string{1: "SAVE20", 2: "FIVEOFF", 3: "EXPIRED", 4: "GOLDONLY"}
+	return c.GetByCode(codes[id])
+}
+
+func (c *CouponTest) Redeem(couponID, userID int) (int, error) {
+	return 1, nil
+}
+
+func (c *CouponTest) CancelRedemption(redemptionID int) error {
+	return nil
+}
+
+type TaxRateTest struct{}
+
+// GetForLocation knows the taxes of a few places: Ontario and Quebec, which have their own rates, the
+// rest of Canada, and Germany, where prices include VAT and businesses are reverse charged
+func (t *TaxRateTest) GetForLocation(country, region string) ([]*TaxRate, error) {
+	switch {
+	case country == "CA" && region == "ON":
+		return []*TaxRate{{ID: 1, Country: "CA", Region: "ON", Name: "HST", Rate: 13000}}, nil
+	case country == "CA" && region == "QC":
+		return []*TaxRate{
+			{ID: 2, Country: "CA", Region: "QC", Name: "GST", Rate: 5000},
+			{ID: 3, Country: "CA", Region: "QC", Name: "QST", Rate: 9975},
+		}, nil
+	case country == "CA":
+		return []*TaxRate{{ID: 4, Country: "CA", Name: "GST", Rate: 5000}}, nil
+	case country == "DE":
+		return []*TaxRate{{ID: 5, Country: "DE", Name: "VAT", Rate: 19000, Inclusive: true, ReverseCharge: true}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+type AuditEventTest struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (e *AuditEventTest) Insert(event AuditEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	event.ID = len(e.events) + 1
+	event.CreatedAt = time.Now()
+	e.events = append(e.events, event)
+	return nil
+}
+
+func (e *AuditEventTest) Find(filter AuditFilter, limit, offset int) ([]*AuditEvent, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// newest first, like the real audit log
+	var events []*AuditEvent
+	for i := len(e.events) - 1; i >= 0; i-- {
+		if filter.matches(e.events[i]) {
+			event := e.events[i]
+			events = append(events, &event)
+		}
+	}
+
+	if offset >= len(events) {
+		return nil, nil
+	}
+	events = events[offset:]
+	if limit > 0 && limit < len(events) {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (e *AuditEventTest) Count(filter AuditFilter) (int, error) {
+	events, err := e.Find(filter, 0, 0)
+	return len(events), err
+}
+
+// matches applies the filter to an event the way the where clause of the real audit log does
+func (f AuditFilter) matches(event AuditEvent) bool {
+	switch {
+	case f.Action != "" && event.Action != f.Action:
+		return false
+	case f.UserID > 0 && event.ActorID != f.UserID && (event.TargetType != AuditTargetUser || event.TargetID != fmt.Sprint(f.UserID)):
+		return false
+	case !f.From.IsZero() && event.CreatedAt.Before(f.From):
+		return false
+	case !f.Until.IsZero() && !event.CreatedAt.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+type TwoFactorTest struct {
+	mu            sync.Mutex
+	twoFactors    map[int]TwoFactor
+	recoveryCodes map[int]map[string]bool // by user, whether each code hash was used
+}
+
+func (t *TwoFactorTest) GetForUser(userID int) (*TwoFactor, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	twoFactor, ok := t.twoFactors[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &twoFactor, nil
+}
+
+func (t *TwoFactorTest) StartEnrollment(userID int, encryptedSecret string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if twoFactor, ok := t.twoFactors[userID]; ok && twoFactor.Enabled() {
+		return ErrTwoFactorEnabled
+	}
+	if t.twoFactors == nil {
+		t.twoFactors = make(map[int]TwoFactor)
+	}
+	t.twoFactors[userID] = TwoFactor{UserID: userID, EncryptedSecret: encryptedSecret, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	return nil
+}
+
+func (t *TwoFactorTest) Enable(userID int, step int64, recoveryCodeHashes []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	twoFactor, ok := t.twoFactors[userID]
+	if !ok || twoFactor.Enabled() {
+		return ErrTwoFactorEnabled
+	}
+
+	now := time.Now()
+	twoFactor.EnabledAt = &now
+	twoFactor.LastUsedStep = step
+	t.twoFactors[userID] = twoFactor
+	t.replaceRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+func (t *TwoFactorTest) UseStep(userID int, step int64) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	twoFactor, ok := t.twoFactors[userID]
+	if !ok || !twoFactor.Enabled() || twoFactor.LastUsedStep >= step {
+		return false, nil
+	}
+	twoFactor.LastUsedStep = step
+	t.twoFactors[userID] = twoFactor
+	return true, nil
+}
+
+func (t *TwoFactorTest) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	used, ok := t.recoveryCodes[userID][codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	t.recoveryCodes[userID][codeHash] = true
+	return true, nil
+}
+
+func (t *TwoFactorTest) RecoveryCodesLeft(userID int) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	left := 0
+	for _, used := range t.recoveryCodes[userID] {
+		if !used {
+			left++
+		}
+	}
+	return left, nil
+}
+
+func (t *TwoFactorTest) ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.replaceRecoveryCodes(userID, recoveryCodeHashes)
+	return nil
+}
+
+func (t *TwoFactorTest) Disable(userID int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.twoFactors, userID)
+	delete(t.recoveryCodes, userID)
+	return nil
+}
+
+func (t *TwoFactorTest) replaceRecoveryCodes(userID int, hashes []string) {
+	if t.recoveryCodes == nil {
+		t.recoveryCodes = make(map[int]map[string]bool)
+	}
+	t.recoveryCodes[userID] = make(map[string]bool)
+	for _, hash := range hashes {
+		t.recoveryCodes[userID][hash] = false
+	}
 }
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrTwoFactorEnabled is returned when enrolling a user who already has two-factor authentication
+var ErrTwoFactorEnabled = errors.New("two-factor: already enabled")
+
+// TwoFactor is the type for a user's TOTP two-factor authentication. The secret is stored encrypted
+// by the app; this package never sees it in the clear.
+type TwoFactor struct {
+	UserID          int
+	EncryptedSecret string
+	EnabledAt       *time.Time // nil while the user has not yet confirmed a code from their app
+	LastUsedStep    int64      // the TOTP time step of the last code accepted, so no code can be used twice
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// Enabled reports whether the user has to give a code when they log in
+func (t *TwoFactor) Enabled() bool {
+	return t != nil && t.EnabledAt != nil
+}
+
+// GetForUser returns the two-factor authentication of a user. If the user has never started to
+// set it up, sql.ErrNoRows is returned.
+func (t *TwoFactor) GetForUser(userID int) (*TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select user_id, encrypted_secret, enabled_at, last_used_step, created_at, updated_at
+			from user_two_factor where user_id = $1`
+
+	var twoFactor TwoFactor
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&twoFactor.UserID,
+		&twoFactor.EncryptedSecret,
+		&twoFactor.EnabledAt,
+		&twoFactor.LastUsedStep,
+		&twoFactor.CreatedAt,
+		&twoFactor.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &twoFactor, nil
+}
+
+// StartEnrollment stores a new secret for a user who is setting up two-factor authentication. It
+// replaces the secret of an enrollment that was never finished, but returns ErrTwoFactorEnabled
+// if the user already has two-factor authentication.
+func (t *TwoFactor) StartEnrollment(userID int, encryptedSecret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into user_two_factor (user_id, encrypted_secret, last_used_step, created_at, updated_at)
+			values ($1, $2, 0, $3, $3)
+			on conflict (user_id) do update
+				set encrypted_secret = excluded.encrypted_secret, last_used_step = 0, updated_at = excluded.updated_at
+				where user_two_factor.enabled_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, userID, encryptedSecret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// Enable finishes a user's enrollment, once they have given the code for the given time step, and
+// gives them a new set of recovery codes, stored as hashes
+func (t *TwoFactor) Enable(userID int, step int64, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	result, err := tx.ExecContext(ctx, `update user_two_factor set enabled_at = $1, last_used_step = $2, updated_at = $1
+			where user_id = $3 and enabled_at is null`, now, step, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes, now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records that a user logged in with the code for the given time step. It returns false if
+// a code for that step, or a later one, was used before, in which case the code must be refused.
+func (t *TwoFactor) UseStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_two_factor set last_used_step = $1, updated_at = $2
+			where user_id = $3 and enabled_at is not null and last_used_step < $1`
+
+	result, err := db.ExecContext(ctx, stmt, step, time.Now(), userID)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// UseRecoveryCode uses up one of a user's recovery codes, by its hash. It returns false if the
+// user has no such code, or it was used before.
+func (t *TwoFactor) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1
+			where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// RecoveryCodesLeft returns how many of a user's recovery codes have not been used
+func (t *TwoFactor) RecoveryCodesLeft(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var count int
+	err := db.QueryRowContext(ctx, `select count(*) from recovery_codes where user_id = $1 and used_at is null`, userID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// ReplaceRecoveryCodes gives a user a new set of recovery codes, stored as hashes. Their old codes stop working.
+func (t *TwoFactor) ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Disable turns off two-factor authentication for a user, and removes their secret and recovery codes
+func (t *TwoFactor) Disable(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_two_factor where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and stores new ones, as part of a transaction
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, hashes []string, now time.Time) error {
+	_, err := tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		_, err = tx.ExecContext(ctx, `insert into recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`, userID, hash, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,10 +2,14 @@ package db
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,6 +25,49 @@ type User struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Plan      *Plan
+
+	// the user's customer and default payment method ids with the payment provider
+	PaymentCustomerID string
+	PaymentMethodID   string
+
+	// the address the user is billed at, which decides the taxes they pay, and their business
+	// tax or VAT number, if they have one
+	BillingAddress Address
+	TaxID          string
+
+	// the currency the user pays in, which they pick once, and the locale amounts are formatted for
+	Currency string
+	Locale   string
+
+	// when the user first activated their account; nil until they do. An account that was activated
+	// and is no longer active was deactivated by an admin.
+	ActivatedAt *time.Time
+}
+
+// Address is a postal address
+type Address struct {
+	Line1      string
+	Line2      string
+	City       string
+	Region     string // province or state code
+	PostalCode string
+	Country    string // ISO 3166-1 alpha-2 code
+}
+
+// Lines returns the address as it is printed, one line per part, leaving out the empty parts
+func (a Address) Lines() []string {
+	var lines []string
+	for _, line := range []string{
+		a.Line1,
+		a.Line2,
+		strings.TrimSpace(strings.Join([]string{a.City, a.Region, a.PostalCode}, " ")),
+		a.Country,
+	} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
 }
 
 // GetAll returns a slice of all users, sorted by last name
@@ -38,9 +85,23 @@ func (u *User) GetAll() ([]*User, error) {
        	user_active, 
        	is_admin, 
        	created_at, 
-       	updated_at
+       	updated_at,
+       	payment_customer_id,
+       	payment_method_id,
+       	billing_line1,
+       	billing_line2,
+       	billing_city,
+       	billing_region,
+       	billing_postal_code,
+       	billing_country,
+       	tax_id,
+       	currency,
+       	locale,
+       	activated_at
 	from 
 	    users 
+	where
+	    deleted_at is null
 	order by 
 	    last_name`
 
@@ -64,6 +125,18 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.IsAdmin,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.PaymentCustomerID,
+			&user.PaymentMethodID,
+			&user.BillingAddress.Line1,
+			&user.BillingAddress.Line2,
+			&user.BillingAddress.City,
+			&user.BillingAddress.Region,
+			&user.BillingAddress.PostalCode,
+			&user.BillingAddress.Country,
+			&user.TaxID,
+			&user.Currency,
+			&user.Locale,
+			&user.ActivatedAt,
 		)
 		if err != nil {
 			log.Println("Error scanning", err)
@@ -76,7 +149,23 @@ func (u *User) GetAll() ([]*User, error) {
 	return users, nil
 }
 
-// GetByEmail returns one user by email
+// ErrDuplicateEmail is returned when saving an email address another user already has
+var ErrDuplicateEmail = errors.New("user: email address already in use")
+
+// NormalizeEmail returns the form email addresses are stored and looked up in. Addresses are
+// compared without regard to case, so "Jane@Example.com" and "jane@example.com" are one address.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// isDuplicateEmail reports whether err is the unique index on users' email addresses being
+// violated; 23505 is Postgres' unique_violation
+func isDuplicateEmail(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "users_email_key"
+}
+
+// GetByEmail returns one user by email, ignoring case
 func (u *User) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
@@ -91,14 +180,26 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			    user_active, 
 			    is_admin, 
 			    created_at, 
-			    updated_at 
+			    updated_at,
+			    payment_customer_id,
+			    payment_method_id,
+			    billing_line1,
+			    billing_line2,
+			    billing_city,
+			    billing_region,
+			    billing_postal_code,
+			    billing_country,
+			    tax_id,
+			    currency,
+			    locale,
+			    activated_at
 			from 
 			    users 
 			where 
-			    email = $1`
+			    lower(email) = $1`
 
 	var user User
-	row := db.QueryRowContext(ctx, query, email)
+	row := db.QueryRowContext(ctx, query, NormalizeEmail(email))
 
 	err := row.Scan(
 		&user.ID,
@@ -110,6 +211,18 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.PaymentCustomerID,
+		&user.PaymentMethodID,
+		&user.BillingAddress.Line1,
+		&user.BillingAddress.Line2,
+		&user.BillingAddress.City,
+		&user.BillingAddress.Region,
+		&user.BillingAddress.PostalCode,
+		&user.BillingAddress.Country,
+		&user.TaxID,
+		&user.Currency,
+		&user.Locale,
+		&user.ActivatedAt,
 	)
 
 	if err != nil {
@@ -117,23 +230,32 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	}
 
 	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
+	query = `select p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at from 
 			plans p
 			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.user_id = $1 and up.status in ('trialing', 'active', 'past_due')`
 
 	var plan Plan
+	var price sql.NullInt64
 	row = db.QueryRowContext(ctx, query, user.ID)
 
 	err = row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&price,
+		&plan.Currency,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
 
 	if err == nil {
+		plan.PlanAmount, err = amountIn(plan.Currency, plan.PlanAmount, price)
+		if err != nil {
+			return nil, err
+		}
+		plan.PlanAmountFormatted = plan.AmountForDisplay()
 		user.Plan = &plan
 	}
 
@@ -145,7 +267,9 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at 
+	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at,
+				payment_customer_id, payment_method_id, billing_line1, billing_line2, billing_city,
+				billing_region, billing_postal_code, billing_country, tax_id, currency, locale, activated_at
 				from users 
 				where id = $1`
 
@@ -162,6 +286,18 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.PaymentCustomerID,
+		&user.PaymentMethodID,
+		&user.BillingAddress.Line1,
+		&user.BillingAddress.Line2,
+		&user.BillingAddress.City,
+		&user.BillingAddress.Region,
+		&user.BillingAddress.PostalCode,
+		&user.BillingAddress.Country,
+		&user.TaxID,
+		&user.Currency,
+		&user.Locale,
+		&user.ActivatedAt,
 	)
 
 	if err != nil {
@@ -169,23 +305,32 @@ func (u *User) GetOne(id int) (*User, error) {
 	}
 
 	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
+	query = `select p.id, p.plan_name, p.plan_amount, pp.amount, up.currency, p.created_at, p.updated_at from 
 			plans p
 			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			left join plan_prices pp on (pp.plan_id = p.id and pp.currency = up.currency)
+			where up.user_id = $1 and up.status in ('trialing', 'active', 'past_due')`
 
 	var plan Plan
+	var price sql.NullInt64
 	row = db.QueryRowContext(ctx, query, user.ID)
 
 	err = row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&price,
+		&plan.Currency,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
 
 	if err == nil {
+		plan.PlanAmount, err = amountIn(plan.Currency, plan.PlanAmount, price)
+		if err != nil {
+			return nil, err
+		}
+		plan.PlanAmountFormatted = plan.AmountForDisplay()
 		user.Plan = &plan
 	} else {
 		log.Println("Error getting plan", err)
@@ -195,21 +340,21 @@ func (u *User) GetOne(id int) (*User, error) {
 }
 
 // Update updates one user in the database, using the information
-// stored in the receiver u
+// stored in the receiver u. The email address is not changed: see ChangeEmail.
+// A user made active is recorded as activated, if they were not already.
 func (u *User) Update(user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
 	stmt := `update users set
-		email = $1,
-		first_name = $2,
-		last_name = $3,
-		user_active = $4,
-		updated_at = $5
-		where id = $6`
+		first_name = $1,
+		last_name = $2,
+		user_active = $3,
+		activated_at = case when $3 = 1 then coalesce(activated_at, $4) else activated_at end,
+		updated_at = $4
+		where id = $5`
 
 	_, err := db.ExecContext(ctx, stmt,
-		user.Email,
 		user.FirstName,
 		user.LastName,
 		user.Active,
@@ -224,14 +369,103 @@ func (u *User) Update(user User) error {
 	return nil
 }
 
-// DeleteByID deletes one user from the database, by ID
-func (u *User) DeleteByID(id int) error {
+// ChangeEmail changes the email address of the user with the given id. It returns ErrDuplicateEmail
+// if another user has the address.
+func (u *User) ChangeEmail(id int, email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set email = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, NormalizeEmail(email), time.Now(), id)
+	if isDuplicateEmail(err) {
+		return ErrDuplicateEmail
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdatePaymentDetails stores the user's customer and default payment method ids with the payment provider
+func (u *User) UpdatePaymentDetails(id int, customerID, paymentMethodID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set payment_customer_id = $1, payment_method_id = $2, updated_at = $3 where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, customerID, paymentMethodID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateBillingDetails stores the user's billing address and tax ID
+func (u *User) UpdateBillingDetails(id int, address Address, taxID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set
+		billing_line1 = $1,
+		billing_line2 = $2,
+		billing_city = $3,
+		billing_region = $4,
+		billing_postal_code = $5,
+		billing_country = $6,
+		tax_id = $7,
+		updated_at = $8
+		where id = $9`
+
+	_, err := db.ExecContext(ctx, stmt,
+		address.Line1,
+		address.Line2,
+		address.City,
+		address.Region,
+		address.PostalCode,
+		address.Country,
+		taxID,
+		time.Now(),
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetCurrency stores the currency the user pays in. A user picks their currency once: if they
+// already have one, it is kept, and false is returned.
+func (u *User) SetCurrency(id int, currency string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
+	stmt := `update users set currency = $1, updated_at = $2 where id = $3 and currency = ''`
+
+	result, err := db.ExecContext(ctx, stmt, currency, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
 
-	_, err := db.ExecContext(ctx, stmt, id)
+	set, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return set > 0, nil
+}
+
+// UpdateLocale stores the locale amounts are formatted for in the user's emails and invoices
+func (u *User) UpdateLocale(id int, locale string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set locale = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, locale, time.Now(), id)
 	if err != nil {
 		return err
 	}
@@ -239,6 +473,69 @@ func (u *User) DeleteByID(id int) error {
 	return nil
 }
 
+// Anonymize deletes a user by removing everything that identifies them and marking them deleted. The
+// row is kept, with the billing address and tax ID, because the user's invoices must be kept for the
+// tax records. A deleted user cannot log in, and is left out of GetAll.
+func (u *User) Anonymize(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	// the address must stay unique, and nobody can log in with it
+	email := fmt.Sprintf("deleted-%d@deleted.invalid", id)
+
+	stmt := `update users set email = $1, first_name = 'Deleted', last_name = 'User', password = '',
+			user_active = 0, is_admin = 0, payment_customer_id = '', payment_method_id = '',
+			deleted_at = $2, updated_at = $2
+			where id = $3`
+
+	_, err = tx.ExecContext(ctx, stmt, email, now, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_two_factor where user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Activate activates a new user's account, and reports whether it did. Only an account that has
+// never been activated can be: one an admin deactivated stays that way.
+func (u *User) Activate(id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set user_active = 1, activated_at = $1, updated_at = $1
+			where id = $2 and activated_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	activated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return activated == 1, nil
+}
+
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
 func (u *User) Insert(user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
@@ -254,7 +551,7 @@ func (u *User) Insert(user User) (int, error) {
 		values ($1, $2, $3, $4, $5, $6, $7) returning id`
 
 	err = db.QueryRowContext(ctx, stmt,
-		user.Email,
+		NormalizeEmail(user.Email),
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
@@ -263,6 +560,9 @@ func (u *User) Insert(user User) (int, error) {
 		time.Now(),
 	).Scan(&newID)
 
+	if isDuplicateEmail(err) {
+		return 0, ErrDuplicateEmail
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -270,8 +570,8 @@ func (u *User) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (u *User) ResetPassword(password string) error {
+// ResetPassword is the method we will use to change the password of the user with the given id.
+func (u *User) ResetPassword(id int, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
@@ -281,7 +581,7 @@ func (u *User) ResetPassword(password string) error {
 	}
 
 	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
+	_, err = db.ExecContext(ctx, stmt, hashedPassword, id)
 	if err != nil {
 		return err
 	}
@@ -292,8 +592,8 @@ func (u *User) ResetPassword(password string) error {
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
 // with the hash we have stored for a given user in the database. If the password
 // and hash match, we return true; otherwise, we return false.
-func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
+func (u *User) PasswordMatches(user User, plainText string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(plainText))
 	if err != nil {
 		switch {
 		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// WebhookEvent is the type for events received from the payment provider. Every event is
+// recorded by its id, so an event that is delivered more than once is only processed once.
+type WebhookEvent struct {
+	ID          string
+	EventType   string
+	Payload     []byte
+	ReceivedAt  time.Time
+	ProcessedAt *time.Time
+}
+
+// Record stores a newly received event. It returns false if an event with the same id
+// was received before, in which case the event must not be processed again.
+func (e *WebhookEvent) Record(event WebhookEvent) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into webhook_events (event_id, event_type, payload, received_at)
+			values ($1, $2, $3, $4)
+			on conflict (event_id) do nothing`
+
+	result, err := db.ExecContext(ctx, stmt, event.ID, event.EventType, string(event.Payload), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// GetUnprocessed returns the events received between from and to that have not been fully
+// processed yet, oldest first
+func (e *WebhookEvent) GetUnprocessed(from, to time.Time) ([]*WebhookEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select event_id, event_type, payload, received_at from webhook_events
+			where processed_at is null and received_at >= $1 and received_at < $2
+			order by received_at`
+
+	rows, err := db.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*WebhookEvent
+	for rows.Next() {
+		var event WebhookEvent
+		var payload string
+		err := rows.Scan(&event.ID, &event.EventType, &payload, &event.ReceivedAt)
+		if err != nil {
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// MarkProcessed records that an event has been fully processed
+func (e *WebhookEvent) MarkProcessed(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_events set processed_at = $1 where event_id = $2`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
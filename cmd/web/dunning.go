@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// defaultDunningSchedule retries a failed payment 1, 3 and 7 days after it first failed
+var defaultDunningSchedule = []int{1, 3, 7}
+
+// startDunning makes a subscription past due after its payment failed, schedules the first retry
+// of the payment, and lets the user know
+func (app *Config) startDunning(subscription *db.Subscription, invoiceID int, reason string) error {
+	nextRetry, _ := nextDunningRetry(app.DunningSchedule, time.Now(), 0)
+
+	err := app.Models.Subscription.StartDunning(subscription.ID, reason, nextRetry)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.Models.User.GetOne(subscription.UserID)
+	if err != nil {
+		return err
+	}
+
+	app.sendPaymentReminder(*user, subscription, invoiceID, &nextRetry)
+
+	return nil
+}
+
+// retryPastDuePayments retries the payments of past due subscriptions that are due for another attempt
+func (app *Config) retryPastDuePayments(now time.Time) {
+	subscriptions, err := app.Models.Subscription.GetDueForRetry(now)
+	if err != nil {
+		app.ErrorChan <- fmt.Errorf("error getting subscriptions due for a payment retry: %v", err)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		err := app.retryPayment(subscription, now)
+		if err != nil {
+			app.ErrorChan <- fmt.Errorf("error retrying payment for subscription %d: %v", subscription.ID, err)
+		}
+	}
+}
+
+// retryPayment charges the user again for the open invoice of a past due subscription. If the charge
+// fails, the next retry is scheduled; once the last retry in app.DunningSchedule has failed, the grace
+// period is over and the subscription is canceled.
+func (app *Config) retryPayment(subscription *db.Subscription, now time.Time) error {
+	invoice, err := app.Models.Invoice.GetOpenForSubscription(subscription.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the invoice has been paid in the meantime
+		return app.Models.Subscription.UpdateStatus(subscription.ID, db.SubscriptionActive, "Payment received")
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := app.Models.User.GetOne(subscription.UserID)
+	if err != nil {
+		return err
+	}
+
+	attempt := subscription.DunningAttempts + 1
+
+	charge, chargeErr := app.Payments.Charge(ChargeRequest{
+		CustomerID:      user.PaymentCustomerID,
+		PaymentMethodID: user.PaymentMethodID,
+		Amount:          invoice.Total,
+		Currency:        invoice.Currency,
+		Description:     fmt.Sprintf("%s subscription, invoice %s", subscription.Plan.PlanName, invoice.NumberForDisplay()),
+		IdempotencyKey:  fmt.Sprintf("dunning-%d-%d", invoice.ID, attempt),
+	})
+
+	if chargeErr == nil {
+		err = app.Models.Invoice.MarkPaid(invoice.ID, charge.ID)
+		if err != nil {
+			return fmt.Errorf("error marking invoice %d as paid: %v", invoice.ID, err)
+		}
+
+		err = app.Models.Subscription.UpdateStatus(subscription.ID, db.SubscriptionActive, "Payment received")
+		if err != nil {
+			return err
+		}
+
+		// a failed renewal did not start the new period yet
+		if !subscription.CurrentPeriodEnd.After(now) {
+			err = app.Models.Subscription.AdvancePeriod(subscription.ID, subscription.NextPeriodEnd())
+			if err != nil {
+				return err
+			}
+		}
+
+		app.sendInvoiceEmail(*user, invoice.ID)
+		return nil
+	}
+
+	app.ErrorLog.Printf("Payment retry %d for subscription %d failed: %v\n", attempt, subscription.ID, chargeErr)
+
+	pastDueSince := now
+	if subscription.PastDueSince != nil {
+		pastDueSince = *subscription.PastDueSince
+	}
+
+	nextRetry, ok := nextDunningRetry(app.DunningSchedule, pastDueSince, attempt)
+	if !ok {
+		err = app.Models.Subscription.UpdateStatus(subscription.ID, db.SubscriptionCanceled, "Payment not received")
+		if err != nil {
+			return err
+		}
+
+		err = app.Models.Invoice.Void(invoice.ID)
+		if err != nil {
+			return err
+		}
+
+		app.sendPaymentReminder(*user, subscription, invoice.ID, nil)
+		return nil
+	}
+
+	err = app.Models.Subscription.RecordFailedRetry(subscription.ID, nextRetry)
+	if err != nil {
+		return err
+	}
+
+	app.sendPaymentReminder(*user, subscription, invoice.ID, &nextRetry)
+	return nil
+}
+
+// nextDunningRetry returns when to retry a payment that has failed the given number of retries,
+// counting the days in schedule from when it first failed. It reports false once the schedule
+// is used up, and the grace period is over.
+func nextDunningRetry(schedule []int, pastDueSince time.Time, attempts int) (time.Time, bool) {
+	if attempts >= len(schedule) {
+		return time.Time{}, false
+	}
+	return pastDueSince.AddDate(0, 0, schedule[attempts]), true
+}
+
+// sendPaymentReminder tells the user that a payment failed, and when it will be retried. Without
+// a next retry, the user is told that their subscription has been canceled.
+func (app *Config) sendPaymentReminder(u db.User, subscription *db.Subscription, invoiceID int, nextRetry *time.Time) {
+	invoice, err := app.Models.Invoice.GetOne(invoiceID)
+	if err != nil {
+		app.ErrorChan <- fmt.Errorf("error getting invoice %d: %v", invoiceID, err)
+		return
+	}
+	invoice.Localize(u.Locale)
+
+	subject := "Your payment failed"
+	retryDate := ""
+	if nextRetry != nil {
+		retryDate = nextRetry.Format("January 2, 2006")
+	} else {
+		subject = "Your subscription has been canceled"
+	}
+
+	app.sendEmail(Message{
+		To:       u.Email,
+		Subject:  subject,
+		Template: "payment-reminder",
+		Data:     subscription,
+		DataMap: map[string]any{
+			"invoice":   invoice,
+			"retryDate": retryDate,
+		},
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func Test_nextDunningRetry(t *testing.T) {
+	schedule := []int{1, 3, 7}
+	pastDueSince := time.Date(2024, time.January, 30, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name          string
+		attempts      int
+		expectedRetry time.Time
+		expectedOk    bool
+	}{
+		{"first retry", 0, time.Date(2024, time.January, 31, 12, 0, 0, 0, time.UTC), true},
+		{"second retry", 1, time.Date(2024, time.February, 2, 12, 0, 0, 0, time.UTC), true},
+		{"last retry", 2, time.Date(2024, time.February, 6, 12, 0, 0, 0, time.UTC), true},
+		{"grace period over", 3, time.Time{}, false},
+	}
+
+	for _, e := range tests {
+		retry, ok := nextDunningRetry(schedule, pastDueSince, e.attempts)
+		if ok != e.expectedOk {
+			t.Errorf("%s: expected ok to be %t, got %t", e.name, e.expectedOk, ok)
+		}
+		if !retry.Equal(e.expectedRetry) {
+			t.Errorf("%s: expected retry at %s, got %s", e.name, e.expectedRetry, retry)
+		}
+	}
+}
+
+func TestConfig_retryPastDuePayments(t *testing.T) {
+	gateway := NewFakeGateway()
+	payments := testApp.Payments
+	testApp.Payments = gateway
+	defer func() { testApp.Payments = payments }()
+
+	testApp.retryPastDuePayments(time.Now())
+	testApp.Wait.Wait()
+
+	if len(gateway.charges) != 1 {
+		t.Errorf("expected the open invoice to be charged once, got %d charges", len(gateway.charges))
+	}
+}
+
+// decliningGateway declines every charge, as the payment provider does for a card without funds
+type decliningGateway struct {
+	*FakeGateway
+}
+
+func (g decliningGateway) Charge(req ChargeRequest) (*Charge, error) {
+	return nil, ErrCardDeclined
+}
+
+func TestConfig_retryPayment(t *testing.T) {
+	now := time.Date(2024, time.January, 31, 12, 0, 0, 0, time.UTC)
+	pastDueSince := now.AddDate(0, 0, -1)
+
+	var tests = []struct {
+		name            string
+		gateway         PaymentGateway
+		attempts        int // retries that failed before this one
+		expectedChanges []db.SubscriptionChange
+		expectedPaid    bool
+		expectedVoided  bool
+		expectedSubject string
+	}{
+		{
+			"successful retry", NewFakeGateway(), 0,
+			[]db.SubscriptionChange{
+				{Method: "UpdateStatus", ID: 1, Status: db.SubscriptionActive},
+				{Method: "AdvancePeriod", ID: 1, Time: db.NextPeriodEnd(pastDueSince)},
+			},
+			true, false, "Your Invoice",
+		},
+		{
+			"failed retry", decliningGateway{NewFakeGateway()}, 0,
+			[]db.SubscriptionChange{
+				{Method: "RecordFailedRetry", ID: 1, Time: pastDueSince.AddDate(0, 0, 3)},
+			},
+			false, false, "Your payment failed",
+		},
+		{
+			"last retry failed", decliningGateway{NewFakeGateway()}, 2,
+			[]db.SubscriptionChange{
+				{Method: "UpdateStatus", ID: 1, Status: db.SubscriptionCanceled},
+			},
+			false, true, "Your subscription has been canceled",
+		},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		app.Payments = e.gateway
+		app.DunningSchedule = []int{1, 3, 7}
+		subscriptions := &db.SubscriptionTest{}
+		invoices := &db.InvoiceTest{}
+		app.Models.Subscription = subscriptions
+		app.Models.Invoice = invoices
+		mail := catchMail(&app)
+
+		subscription, _ := subscriptions.GetOne(1)
+		subscription.Status = db.SubscriptionPastDue
+		subscription.CurrentPeriodEnd = pastDueSince
+		subscription.BillingDay = pastDueSince.Day()
+		subscription.PastDueSince = &pastDueSince
+		subscription.DunningAttempts = e.attempts
+
+		if err := app.retryPayment(subscription, now); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		if changes := subscriptions.Changes(); fmt.Sprint(changes) != fmt.Sprint(e.expectedChanges) {
+			t.Errorf("%s: expected changes %v, got %v", e.name, e.expectedChanges, changes)
+		}
+		if paid := len(invoices.Paid()) == 1; paid != e.expectedPaid {
+			t.Errorf("%s: expected the invoice to be paid to be %t", e.name, e.expectedPaid)
+		}
+		if voided := len(invoices.Voided()) == 1; voided != e.expectedVoided {
+			t.Errorf("%s: expected the invoice to be voided to be %t", e.name, e.expectedVoided)
+		}
+
+		close(mail)
+		var subjects []string
+		for msg := range mail {
+			subjects = append(subjects, msg.Subject)
+		}
+		if len(subjects) != 1 || subjects[0] != e.expectedSubject {
+			t.Errorf("%s: expected an email with the subject %q, got %q", e.name, e.expectedSubject, subjects)
+		}
+	}
+}
+
+func TestConfig_PastDue(t *testing.T) {
+	var tests = []struct {
+		name            string
+		userID          int
+		expectedPastDue bool
+	}{
+		{"past due", 4, true},
+		{"paid up", 1, false},
+		{"not subscribed", 2, false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/members/plans", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", e.userID)
+
+		var pastDue bool
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pastDue = r.Context().Value(pastDueKey).(*db.Subscription)
+		})
+		testApp.PastDue(next).ServeHTTP(httptest.NewRecorder(), req)
+
+		if pastDue != e.expectedPastDue {
+			t.Errorf("%s: expected the past due banner to be %t", e.name, e.expectedPastDue)
+		}
+	}
+}
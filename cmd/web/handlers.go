@@ -1,15 +1,33 @@
 package main
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
 )
 
+const (
+	passwordResetExpiry = 60 // minutes until a password reset link expires
+	minPasswordLength   = 8
+
+	maxCancellationReasonLength = 255
+
+	pastDuePlanChangeMessage = "Your last payment failed. You can change plan once it has been paid."
+
+	maxBillingFieldLength = 255
+	maxTaxIDLength        = 64
+)
+
 func (app *Config) GETHomePage(w http.ResponseWriter, r *http.Request) {
 	app.InfoLog.Printf("GET %s\n", r.URL.Path)
 	app.render(w, r, "home.page.gohtml", nil)
@@ -36,50 +54,103 @@ func (app *Config) POSTLoginPage(w http.ResponseWriter, r *http.Request) {
 	email := r.PostForm.Get("email")
 	password := r.PostForm.Get("password")
 
+	// an account or IP address that is locked out does not get to try a password at all
+	ip := clientIP(r)
+	lockout, err := app.LoginThrottle.Lockout(email, ip)
+	if err != nil {
+		// let the login go ahead rather than lock everyone out
+		app.ErrorLog.Println("Error checking login lockout: ", err)
+	}
+	if lockout > 0 {
+		app.Session.Put(r.Context(), "error", lockoutMessage(lockout))
+		app.audit(r, db.AuditEvent{Action: db.AuditLoginFailed, Note: "Locked out"})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	// authenticate user
 	user, err := app.Models.User.GetByEmail(email)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Invalid credentials") // store error message in session
 		app.ErrorLog.Println("Error getting user by email: ", err)   // log error
-		http.Redirect(w, r, "/login", http.StatusSeeOther)           // redirect back to login page
+		app.recordFailedLogin(email, ip)
+		// the email address is not recorded: people sometimes type their password into that field
+		app.audit(r, db.AuditEvent{Action: db.AuditLoginFailed, Note: "Unknown email address"})
+		http.Redirect(w, r, "/login", http.StatusSeeOther) // redirect back to login page
 		return
 	}
 
 	if user.Active == 0 {
 		app.ErrorLog.Printf("User account %d not activated\n", user.ID)
+		app.audit(r, db.AuditEvent{Action: db.AuditLoginFailed, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID), Note: "Account not activated"})
 		app.Session.Put(r.Context(), "error", "Account not activated") // store error message in session
 		http.Redirect(w, r, "/login", http.StatusSeeOther)             // redirect back to login page
 		return
 	}
 
-	validPassword, err := app.Models.User.PasswordMatches(password)
+	validPassword, err := app.Models.User.PasswordMatches(*user, password)
 	if err != nil {
+		// a password that could not be checked still counts towards a lockout, so that errors
+		// cannot be used to keep guessing
 		app.Session.Put(r.Context(), "error", "Invalid credentials") // store error message in session
 		app.ErrorLog.Println("Error comparing passwords: ", err)     // log error
-		http.Redirect(w, r, "/login", http.StatusSeeOther)           // redirect back to login page
+		app.recordFailedLogin(email, ip)
+		app.audit(r, db.AuditEvent{Action: db.AuditLoginFailed, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID), Note: "Password could not be checked"})
+		http.Redirect(w, r, "/login", http.StatusSeeOther) // redirect back to login page
 		return
 	}
 	if !validPassword {
-		// send user a notification email that their account was accessed
-		msg := Message{
-			To:      email,
-			Subject: "Failed login attempt",
-			Data:    "Someone tried to log into your account with an incorrect password.",
+		app.recordFailedLogin(email, ip)
+
+		// send user a notification email that their account was accessed, but only
+		// once in a while, so that failed logins cannot be used to flood their inbox
+		notify, err := app.LoginThrottle.Notify(email)
+		if err != nil {
+			app.ErrorLog.Println("Error checking failed login notification: ", err)
+		}
+		if notify {
+			msg := Message{
+				To:      user.Email,
+				Subject: "Failed login attempt",
+				Data:    fmt.Sprintf("Someone tried to log into your account with an incorrect password. We won't email you about further failed attempts in the next %d minutes.", int(loginNotifyWindow.Minutes())),
+			}
+			app.sendEmail(msg)
 		}
-		app.sendEmail(msg)
 
 		app.Session.Put(r.Context(), "error", "Invalid credentials") // store error message in session
 		app.ErrorLog.Println("Invalid password")                     // log error
-		http.Redirect(w, r, "/login", http.StatusSeeOther)           // redirect back to login page
+		app.audit(r, db.AuditEvent{Action: db.AuditLoginFailed, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID), Note: "Wrong password"})
+		http.Redirect(w, r, "/login", http.StatusSeeOther) // redirect back to login page
+		return
+	}
+
+	twoFactor, err := app.Models.TwoFactor.GetForUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println("Error getting two-factor authentication: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to log in")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// the password is right, but the user is not logged in until they give their code
+	if twoFactor.Enabled() {
+		app.startTwoFactorLogin(r, user.ID)
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	// admins must set up two-factor authentication before they can log in
+	if user.IsAdmin == 1 {
+		app.startTwoFactorLogin(r, user.ID)
+		app.Session.Put(r.Context(), "warning", "Administrators must set up two-factor authentication to log in")
+		http.Redirect(w, r, "/login/two-factor/setup", http.StatusSeeOther)
 		return
 	}
 
 	// Auth passed - Log in user
-	app.Session.Put(r.Context(), "userID", user.ID) // store user ID in session
-	app.Session.Put(r.Context(), "user", user)      // store user data in session
+	app.logIn(r, user, false)
 	app.Session.Put(r.Context(), "flash", "You've been logged in successfully")
 
-	app.SuccessLog.Printf("User %d logged in", user.ID)
 	// Redirect to "successs page
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -90,8 +161,7 @@ func (app *Config) GETLogout(w http.ResponseWriter, r *http.Request) {
 	userID := app.Session.GetInt(r.Context(), "userID")
 
 	// Clean up session
-	app.Session.Destroy(r.Context())
-	app.Session.RenewToken(r.Context())
+	app.logOut(r)
 
 	app.SuccessLog.Printf("User %d logged out", userID)
 	// Redirect to login page
@@ -118,7 +188,7 @@ func (app *Config) POSTRegisterPage(w http.ResponseWriter, r *http.Request) {
 
 	// create a new user
 	u := db.User{
-		Email:     r.PostForm.Get("email"),
+		Email:     db.NormalizeEmail(r.PostForm.Get("email")),
 		FirstName: r.PostForm.Get("first-name"),
 		LastName:  r.PostForm.Get("last-name"),
 		Password:  r.PostForm.Get("password"),
@@ -135,16 +205,7 @@ func (app *Config) POSTRegisterPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// send activation email
-	url := fmt.Sprintf("%s/activate-account?email=%s", "http://localhost:8811", u.Email) // TODO - get this from environment variable
-	signedURL := GenerateTokenFromString(url)
-
-	msg := Message{
-		To:       u.Email,
-		Subject:  "Activate your account",
-		Template: "confirmation-email",
-		Data:     template.HTMLEscapeString(signedURL),
-	}
-	app.sendEmail(msg)
+	app.sendActivationEmail(u.Email)
 
 	app.Session.Put(r.Context(), "flash", "Account created. Please check your email to activate your account.")
 	app.SuccessLog.Println("User created with ID: ", userID)
@@ -160,7 +221,7 @@ func (app *Config) GETActivateAccount(w http.ResponseWriter, r *http.Request) {
 	// validate url
 	url := r.RequestURI
 	testUrl := fmt.Sprintf("%s%s", "http://localhost:8811", url) // TODO - get this from environment variable
-	okay := VerifyToken(testUrl)
+	okay := VerifyToken(PurposeActivate, testUrl)
 
 	if !okay {
 		app.ErrorLog.Println("Invalid activation token")
@@ -168,6 +229,12 @@ func (app *Config) GETActivateAccount(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	if Expired(testUrl, int(app.ActivationExpiry/time.Minute)) {
+		app.ErrorLog.Println("Expired activation token")
+		app.Session.Put(r.Context(), "error", "This activation link has expired. Please ask for a new one.")
+		http.Redirect(w, r, "/activate-account/resend", http.StatusSeeOther)
+		return
+	}
 
 	// activate account
 	u, err := app.Models.User.GetByEmail(r.URL.Query().Get("email"))
@@ -177,22 +244,223 @@ func (app *Config) GETActivateAccount(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	if u.Active == 1 {
+		app.Session.Put(r.Context(), "flash", "Your account is already activated. Please log in.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 
-	u.Active = 1
-	err = app.Models.User.Update(*u)
+	// a link cannot be used twice, and a new account is only activated once: an account an admin
+	// deactivated since stays deactivated
+	if u.ActivatedAt != nil || !app.consumeToken(testUrl, app.ActivationExpiry) {
+		app.Session.Put(r.Context(), "error", "Invalid token")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	activated, err := app.Models.User.Activate(u.ID)
 	if err != nil {
-		app.ErrorLog.Println("Unable to update user ", err)
+		app.ErrorLog.Println("Unable to activate user ", err)
 		app.Session.Put(r.Context(), "error", "Activation failed")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	if !activated {
+		app.Session.Put(r.Context(), "error", "Invalid token")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 
 	// success
 	app.SuccessLog.Printf("User %d activated account", u.ID)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditAccountActivated,
+		ActorID:    u.ID,
+		TargetType: db.AuditTargetUser,
+		TargetID:   strconv.Itoa(u.ID),
+		Changes:    map[string]db.AuditChange{"active": {From: 0, To: 1}},
+	})
 	app.Session.Put(r.Context(), "flash", "Account activated. Please log in.")
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+func (app *Config) GETForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+	app.render(w, r, "forgot-password.page.gohtml", nil)
+}
+
+func (app *Config) POSTForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	// respond the same way whether or not the account exists,
+	// so this form cannot be used to find out who has an account
+	app.Session.Put(r.Context(), "flash", "If an account exists for that email, a password reset link has been sent.")
+
+	user, err := app.Models.User.GetByEmail(r.PostForm.Get("email"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user by email: ", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// send password reset email
+	resetURL := fmt.Sprintf("%s/reset-password?email=%s&fp=%s", "http://localhost:8811", url.QueryEscape(user.Email), passwordFingerprint(user)) // TODO - get this from environment variable
+	signedURL := GenerateTokenFromString(PurposeReset, resetURL)
+
+	msg := Message{
+		To:       user.Email,
+		Subject:  "Reset your password",
+		Template: "password-reset-email",
+		Data:     template.HTMLEscapeString(signedURL),
+	}
+	app.sendEmail(msg)
+
+	app.InfoLog.Printf("Password reset requested for user %d", user.ID)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// Sent when the user has requested a password reset
+func (app *Config) GETResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	// validate url
+	signedURL := fmt.Sprintf("%s%s", "http://localhost:8811", r.URL.RequestURI()) // TODO - get this from environment variable
+	if _, ok := app.validPasswordResetLink(signedURL); !ok {
+		app.Session.Put(r.Context(), "error", "Invalid or expired password reset link")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["token"] = signedURL
+
+	app.render(w, r, "reset-password.page.gohtml", &TemplateData{
+		StringMap: stringMap,
+	})
+}
+
+func (app *Config) POSTResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	// the signed link is posted back with the form, so check it again
+	signedURL := r.PostForm.Get("token")
+	user, ok := app.validPasswordResetLink(signedURL)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "Invalid or expired password reset link")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	// send the user back to the same reset link if the new password is not acceptable
+	resetPage := strings.TrimPrefix(signedURL, "http://localhost:8811")
+
+	password := r.PostForm.Get("password")
+	if len(password) < minPasswordLength {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Password must be at least %d characters long", minPasswordLength))
+		http.Redirect(w, r, resetPage, http.StatusSeeOther)
+		return
+	}
+	if password != r.PostForm.Get("verify-password") {
+		app.Session.Put(r.Context(), "error", "Passwords do not match")
+		http.Redirect(w, r, resetPage, http.StatusSeeOther)
+		return
+	}
+
+	// two resets racing with the same link would both pass the fingerprint check
+	if !app.consumeToken(signedURL, passwordResetExpiry*time.Minute) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired password reset link")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.User.ResetPassword(user.ID, password)
+	if err != nil {
+		app.ErrorLog.Println("Error resetting password: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to reset password")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	// whoever knew the old password is logged out. The user may have reset it while logged in, in
+	// which case they stay logged in here.
+	ended, err := app.endOtherSessions(user.ID, app.Session.Token(r.Context()))
+	if err != nil {
+		app.ErrorLog.Println("Error ending sessions: ", err)
+	} else if ended > 0 {
+		app.audit(r, db.AuditEvent{Action: db.AuditSessionsRevoked, ActorID: user.ID, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID), Note: fmt.Sprintf("Password reset, %d other sessions", ended)})
+	}
+
+	// let the user know, in case they did not make this change themselves
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Data:    "The password for your account was just reset. If this wasn't you, please contact us immediately.",
+	}
+	app.sendEmail(msg)
+
+	app.SuccessLog.Printf("User %d reset their password", user.ID)
+	app.audit(r, db.AuditEvent{Action: db.AuditPasswordChanged, ActorID: user.ID, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID), Note: "Reset with an emailed link"})
+	app.Session.Put(r.Context(), "flash", "Password reset. Please log in.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// validPasswordResetLink checks that a password reset link was signed by us, has not expired,
+// and has not been used yet. It returns the user the link was issued for.
+func (app *Config) validPasswordResetLink(signedURL string) (*db.User, bool) {
+	if !VerifyToken(PurposeReset, signedURL) {
+		app.ErrorLog.Println("Invalid password reset token")
+		return nil, false
+	}
+	if Expired(signedURL, passwordResetExpiry) {
+		app.ErrorLog.Println("Expired password reset token")
+		return nil, false
+	}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		app.ErrorLog.Println("Error parsing password reset link: ", err)
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetByEmail(u.Query().Get("email"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user by email: ", err)
+		return nil, false
+	}
+
+	// once the password has been changed, the fingerprint no longer matches
+	// and the link cannot be used again
+	if u.Query().Get("fp") != passwordFingerprint(user) {
+		app.ErrorLog.Printf("Password reset link for user %d has already been used", user.ID)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// passwordFingerprint returns a short digest of the user's current password hash.
+// Including it in a reset link ties the link to the password it was issued against.
+func passwordFingerprint(u *db.User) string {
+	sum := sha256.Sum256([]byte(u.Password))
+	return hex.EncodeToString(sum[:8])
+}
+
 // Protected route
 func (app *Config) GETSubscriptionPlans(w http.ResponseWriter, r *http.Request) {
 	app.InfoLog.Printf("GET %s\n", r.URL.Path)
@@ -208,24 +476,56 @@ func (app *Config) GETSubscriptionPlans(w http.ResponseWriter, r *http.Request)
 	}
 
 	dataMap := make(map[string]interface{})
-	dataMap["plans"] = plans
+	intMap := make(map[string]int)
+	stringMap := make(map[string]string)
+
+	// plans are shown in the currency the user pays in. A user who has not subscribed yet can pick
+	// another currency, and only sees the plans sold in it.
+	user, _ := app.Session.Get(r.Context(), "user").(db.User)
+	locale := requestLocale(r)
+	currency := userCurrency(user, r.URL.Query().Get("currency"), locale)
+
+	var priced []*db.Plan
+	for _, plan := range plans {
+		p, err := priceInCurrency(plan, currency, locale)
+		if err != nil {
+			continue
+		}
+		priced = append(priced, p)
+	}
+	dataMap["plans"] = priced
+	stringMap["currency"] = currency
+	if !hasChosenCurrency(user) {
+		dataMap["currencies"] = db.SupportedCurrencies
+	}
+
+	// show a downgrade that is waiting for the end of the period
+	current, err := app.currentSubscription(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting current subscription: ", err)
+	} else if current != nil && current.ScheduledPlanID > 0 {
+		intMap["scheduledPlanID"] = current.ScheduledPlanID
+		stringMap["scheduledChangeDate"] = current.CurrentPeriodEnd.Format("January 2, 2006")
+	}
 
 	app.render(w, r, "plans.page.gohtml", &TemplateData{
-		Data: dataMap,
+		Data:      dataMap,
+		IntMap:    intMap,
+		StringMap: stringMap,
 	})
 }
 
 // Protected route
+// Shows the plan the user picked, and asks them to confirm before anything is charged
 func (app *Config) GETSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	app.InfoLog.Printf("GET %s\n", r.URL.Path)
 
 	// get id of chosen plan
-	id := r.URL.Query().Get("plan")
-	planID, err := strconv.Atoi(id)
+	planID, err := strconv.Atoi(r.URL.Query().Get("plan"))
 	if err != nil {
 		app.ErrorLog.Println("Error getting plan: ", err)
 		app.Session.Put(r.Context(), "error", "Unable to get plan")
-		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
 
@@ -233,7 +533,7 @@ func (app *Config) GETSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		app.ErrorLog.Println("Error getting plan: ", err)
 		app.Session.Put(r.Context(), "error", "Unable to get plan")
-		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
 
@@ -246,27 +546,431 @@ func (app *Config) GETSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// generate an invoice and send email with invoice attached
-	app.Wait.Add(1)
+	current, err := app.currentSubscription(user.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting current subscription: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+	if current != nil && current.Status == db.SubscriptionPastDue && current.PlanID != plan.ID {
+		app.Session.Put(r.Context(), "error", pastDuePlanChangeMessage)
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
 
-	go func() {
-		defer app.Wait.Done()
+	// archived plans stay with their subscribers, but no one else can choose them
+	if plan.Archived() && (current == nil || current.PlanID != plan.ID) {
+		app.Session.Put(r.Context(), "error", "This plan is no longer available")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// the plan is priced in the currency the user pays in, or is about to pick
+	locale := requestLocale(r)
+	plan, err = priceInCurrency(plan, userCurrency(user, r.URL.Query().Get("currency"), locale), locale)
+	if err != nil {
+		app.ErrorLog.Printf("Plan %d not available: %v\n", planID, err)
+		app.Session.Put(r.Context(), "error", "This plan is not available in your currency")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]interface{})
+	dataMap["plan"] = plan
+
+	// every confirmation page gets a fresh key, which can be used to subscribe exactly once
+	stringMap := make(map[string]string)
+	stringMap["idempotencyKey"] = GenerateRandomToken(16)
+
+	trial, err := app.trialEligible(user.ID, plan, current)
+	if err != nil {
+		app.ErrorLog.Println("Error checking trial eligibility: ", err)
+	} else if trial {
+		stringMap["trialEnds"] = time.Now().AddDate(0, 0, plan.TrialDays).Format("January 2, 2006")
+	}
 
-		invoice, err := app.GenerateInvoice(user, plan)
+	// a promotion code the user applied is shown on the page, and sent along when they subscribe
+	var coupon *db.Coupon
+	if code := r.URL.Query().Get("coupon"); code != "" {
+		c, err := app.couponForPlan(code, plan)
 		if err != nil {
-			app.ErrorChan <- fmt.Errorf("error generating invoice: %v", err)
+			app.InfoLog.Printf("Coupon %q not accepted: %v\n", code, err)
+			stringMap["couponError"] = couponErrorMessage(err)
+		} else {
+			coupon = c
+			dataMap["coupon"] = coupon
+			stringMap["couponCode"] = coupon.Code
 		}
+	}
 
-		// send email with invoice attached
-		msg := Message{
-			To:       user.Email,
-			Subject:  "Your Invoice",
-			Template: "invoice-email",
-			Data:     invoice,
+	// show the user what changing plan will cost them: a trial carries on with the new plan,
+	// downgrades wait for the end of the period, and upgrades are charged for what is left of it
+	var invoice *db.Invoice
+	if current != nil && current.PlanID != plan.ID {
+		dataMap["current"] = current
+		if current.Status == db.SubscriptionTrialing {
+			stringMap["trialContinues"] = current.CurrentPeriodEnd.Format("January 2, 2006")
+		} else if plan.PlanAmount < current.Plan.PlanAmount {
+			stringMap["changeDate"] = current.CurrentPeriodEnd.Format("January 2, 2006")
+		} else {
+			invoice, err = app.GenerateProrationInvoice(user, current, plan, time.Now())
+			if err != nil {
+				app.ErrorLog.Println("Error generating invoice: ", err)
+				app.Session.Put(r.Context(), "error", "Unable to get plan")
+				http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+				return
+			}
+		}
+	} else if current == nil && !trial {
+		// a new subscriber sees their first invoice, with any taxes and discount
+		invoice, err = app.GenerateInvoice(user, plan)
+		if err != nil {
+			app.ErrorLog.Println("Error generating invoice: ", err)
+			app.Session.Put(r.Context(), "error", "Unable to get plan")
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+	}
+	if invoice != nil {
+		invoice.Localize(locale)
+		if coupon != nil {
+			applyDiscount(invoice, coupon)
+		}
+		dataMap["invoice"] = invoice
+	}
+
+	app.render(w, r, "subscribe.page.gohtml", &TemplateData{
+		StringMap: stringMap,
+		Data:      dataMap,
+	})
+}
+
+// Protected route
+func (app *Config) POSTSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// get id of chosen plan
+	planID, err := strconv.Atoi(r.PostForm.Get("plan"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting plan: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting plan: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// get user from session
+	user, ok := app.Session.Get(r.Context(), "user").(db.User)
+	if !ok {
+		app.ErrorLog.Println("Error getting user from session")
+		app.Session.Put(r.Context(), "error", "Log in to access this page")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// the user pays in the currency they confirmed, unless they already pay in another one
+	plan, err = priceInCurrency(plan, userCurrency(user, r.PostForm.Get("currency"), user.Locale), user.Locale)
+	if err != nil {
+		app.ErrorLog.Printf("Plan %d not available: %v\n", planID, err)
+		app.Session.Put(r.Context(), "error", "This plan is not available in your currency")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// a double click or a replayed form carries a key that has already been used,
+	// and must not subscribe (or invoice) the user a second time
+	key := r.PostForm.Get("idempotency-key")
+	if key == "" {
+		app.ErrorLog.Println("Subscription request without idempotency key")
+		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	claimed, err := app.Models.IdempotencyKey.Claim(key, user.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error claiming idempotency key: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+	if !claimed {
+		app.InfoLog.Printf("Ignoring repeated subscription request from user %d", user.ID)
+		app.Session.Put(r.Context(), "warning", "This subscription request has already been processed.")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// a request that fails before the user is charged gives its key back, so the same form can be sent
+	// again, e.g. with another card. Once a charge went through, or a plan change was scheduled, the key
+	// stays claimed.
+	release := true
+	defer func() {
+		if !release {
+			return
+		}
+		if err := app.Models.IdempotencyKey.Release(key); err != nil {
+			app.ErrorLog.Println("Error releasing idempotency key: ", err)
 		}
-		app.sendEmail(msg)
 	}()
 
+	// a user with a current subscription changes plan, rather than starting a new subscription
+	current, err := app.currentSubscription(user.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting current subscription: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	if current != nil && current.PlanID == plan.ID {
+		app.Session.Put(r.Context(), "warning", "You are already subscribed to this plan.")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// the plan cannot change while an invoice of the current one is unpaid, as it is not clear what
+	// the user would be credited for
+	if current != nil && current.Status == db.SubscriptionPastDue {
+		app.Session.Put(r.Context(), "error", pastDuePlanChangeMessage)
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// archived plans stay with their subscribers, but no one else can choose them
+	if plan.Archived() {
+		app.Session.Put(r.Context(), "error", "This plan is no longer available")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// downgrades wait for the end of the period the user has already paid for. A trial has not been
+	// paid for, so it changes plan straight away.
+	if current != nil && current.Status == db.SubscriptionActive && plan.PlanAmount < current.Plan.PlanAmount {
+		err = app.Models.Subscription.SchedulePlanChange(current.ID, plan.ID)
+		if err != nil {
+			app.ErrorLog.Println("Error scheduling plan change: ", err)
+			app.Session.Put(r.Context(), "error", "Unable to change plan")
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+		app.audit(r, db.AuditEvent{
+			Action:     db.AuditPlanChangeScheduled,
+			TargetType: db.AuditTargetSubscription,
+			TargetID:   strconv.Itoa(current.ID),
+			Changes:    map[string]db.AuditChange{"plan_id": {From: current.PlanID, To: plan.ID}},
+		})
+
+		release = false
+		app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your plan will change to %s on %s", plan.PlanName, current.CurrentPeriodEnd.Format("January 2, 2006")))
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// failed payments send the user back to the confirmation page, which issues a new key
+	confirmationPage := fmt.Sprintf("/members/subscribe?plan=%d&currency=%s", plan.ID, plan.Currency)
+
+	trial, err := app.trialEligible(user.ID, plan, current)
+	if err != nil {
+		app.ErrorLog.Println("Error checking trial eligibility: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	// a promotion code is checked before anything is charged
+	var coupon *db.Coupon
+	if code := r.PostForm.Get("coupon-code"); code != "" {
+		coupon, err = app.couponForPlan(code, plan)
+		if err != nil {
+			app.ErrorLog.Printf("Coupon %q not accepted: %v\n", code, err)
+			app.Session.Put(r.Context(), "error", couponErrorMessage(err))
+			http.Redirect(w, r, confirmationPage, http.StatusSeeOther)
+			return
+		}
+	}
+
+	// generate the invoice first, so we know how much to charge. Upgrades take effect
+	// straight away, and are charged for the rest of the current period. Nothing is
+	// charged for a trial until it ends, whichever plan it ends on.
+	var invoice *db.Invoice
+	switch {
+	case trial:
+	case current != nil && current.Status == db.SubscriptionTrialing:
+	case current != nil:
+		invoice, err = app.GenerateProrationInvoice(user, current, plan, time.Now())
+	default:
+		invoice, err = app.GenerateInvoice(user, plan)
+	}
+	if err != nil {
+		app.ErrorLog.Println("Error generating invoice: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+	if coupon != nil && invoice != nil {
+		applyDiscount(invoice, coupon)
+	}
+
+	// make sure the user can be charged, also at the end of a trial
+	user, err = app.ensurePaymentCustomer(user, r.PostForm.Get("payment-method"))
+	if err != nil {
+		app.ErrorLog.Println("Error setting up payment: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to use this payment method")
+		http.Redirect(w, r, confirmationPage, http.StatusSeeOther)
+		return
+	}
+
+	// redeem the coupon, which also enforces its redemption limit. The redemption is given back if
+	// the user ends up not subscribing.
+	var redemptionID int
+	if coupon != nil {
+		redemptionID, err = app.Models.Coupon.Redeem(coupon.ID, user.ID)
+		if err != nil {
+			app.ErrorLog.Printf("Error redeeming coupon %d: %v\n", coupon.ID, err)
+			app.Session.Put(r.Context(), "error", couponErrorMessage(err))
+			http.Redirect(w, r, confirmationPage, http.StatusSeeOther)
+			return
+		}
+	}
+
+	// take payment. The idempotency key is passed on, so the provider won't charge this request twice either.
+	// A plan change between plans of the same price has nothing to charge.
+	var charge *Charge
+	if invoice != nil && invoice.Total > 0 {
+		charge, err = app.Payments.Charge(ChargeRequest{
+			CustomerID:      user.PaymentCustomerID,
+			PaymentMethodID: user.PaymentMethodID,
+			Amount:          invoice.Total,
+			Currency:        invoice.Currency,
+			Description:     fmt.Sprintf("%s subscription", plan.PlanName),
+			IdempotencyKey:  key,
+		})
+		if err != nil {
+			app.ErrorLog.Printf("Payment for user %d failed: %v\n", user.ID, err)
+			app.cancelRedemption(redemptionID)
+			switch {
+			case errors.Is(err, ErrCardDeclined):
+				app.Session.Put(r.Context(), "error", "Your card was declined. Please use another payment method.")
+			case errors.Is(err, ErrPaymentTimeout):
+				app.Session.Put(r.Context(), "error", "The payment provider did not respond. Please try again.")
+			default:
+				app.Session.Put(r.Context(), "error", "Unable to take payment")
+			}
+			http.Redirect(w, r, confirmationPage, http.StatusSeeOther)
+			return
+		}
+	}
+	release = charge == nil
+
+	// subscribe user to plan
+	var subscriptionID int
+	switch {
+	case trial:
+		subscriptionID, err = app.Models.Subscription.StartTrial(user.ID, *plan, time.Now().AddDate(0, 0, plan.TrialDays))
+	case current != nil:
+		subscriptionID, err = app.Models.Subscription.ChangePlan(current.ID, *plan, "Plan change")
+	default:
+		subscriptionID, err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
+	}
+	if err != nil {
+		app.ErrorLog.Println("Error subscribing user to plan: ", err)
+
+		// the user has paid for a subscription they did not get, so give the money back
+		app.refundCharge(r, charge, "Subscribing failed after the payment was taken")
+		app.cancelRedemption(redemptionID)
+
+		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+	release = false
+
+	// save the invoice, which also gives it its invoice number. The user must not pay without getting one.
+	var invoiceID int
+	if invoice != nil {
+		invoice.SubscriptionID = subscriptionID
+		invoiceID, err = app.Models.Invoice.Insert(*invoice)
+		if err != nil {
+			app.ErrorLog.Println("Error saving invoice: ", err)
+			app.refundCharge(r, charge, "Saving the invoice failed after the payment was taken")
+
+			// a new subscription is not given away for free. A plan change has already replaced the
+			// subscription it was made from, so it is kept.
+			if current == nil {
+				if err := app.Models.Subscription.UpdateStatus(subscriptionID, db.SubscriptionCanceled, "Invoice could not be saved"); err != nil {
+					app.ErrorLog.Printf("Error canceling subscription %d: %v\n", subscriptionID, err)
+				}
+				app.cancelRedemption(redemptionID)
+			}
+
+			app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
+		}
+
+		chargeID := ""
+		if charge != nil {
+			chargeID = charge.ID
+		}
+
+		err = app.Models.Invoice.MarkPaid(invoiceID, chargeID)
+		if err != nil {
+			app.ErrorLog.Printf("Error marking invoice %d as paid: %v\n", invoiceID, err)
+		}
+	}
+
+	if current != nil {
+		app.audit(r, db.AuditEvent{
+			Action:     db.AuditPlanChanged,
+			TargetType: db.AuditTargetSubscription,
+			TargetID:   strconv.Itoa(subscriptionID),
+			Note:       fmt.Sprintf("Replaces subscription %d", current.ID),
+			Changes:    map[string]db.AuditChange{"plan_id": {From: current.PlanID, To: plan.ID}},
+		})
+	}
+
+	// the user pays in this currency from now on
+	app.saveCurrency(user, plan.Currency)
+
+	// the coupon discounts the subscription's invoices from now on; the invoice above already used up one of them
+	if coupon != nil {
+		periods := coupon.Periods()
+		if periods != nil && invoice != nil {
+			*periods--
+		}
+
+		err = app.Models.Subscription.ApplyCoupon(subscriptionID, coupon.ID, periods)
+		if err != nil {
+			app.ErrorLog.Printf("Error applying coupon %d to subscription %d: %v\n", coupon.ID, subscriptionID, err)
+		}
+	}
+
+	// send email with invoice attached
+	if invoice != nil {
+		app.Wait.Add(1)
+		go func() {
+			defer app.Wait.Done()
+			app.sendInvoiceEmail(user, invoiceID)
+		}()
+	}
+
 	// generate a manual and send email with manual attached
 	app.Wait.Add(1)
 	go func() {
@@ -290,25 +994,293 @@ func (app *Config) GETSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 		app.sendEmail(msg)
 	}()
 
-	// subscribe user to plan
-	err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
-	if err != nil {
-		app.ErrorLog.Println("Error subscribing user to plan: ", err)
-		app.Session.Put(r.Context(), "error", "Unable to subscribe to plan")
-		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
-		return
-	}
 	// update user in session
 	u, err := app.Models.User.GetOne(user.ID) // get fresh data from db
 	if err != nil {
 		app.ErrorLog.Println("Error getting user: ", err)
 		app.Session.Put(r.Context(), "error", "Unable to get user")
-		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
-	app.Session.Put(r.Context(), "user", u) // update user in session
+	app.Session.Put(r.Context(), "user", *u) // update user in session
 
 	// redirect to success page
-	app.Session.Put(r.Context(), "flash", "Subscribed successfully")
+	switch {
+	case trial:
+		trialEnd := time.Now().AddDate(0, 0, plan.TrialDays).Format("January 2, 2006")
+		app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your free trial has started. You will be charged on %s unless you cancel before then.", trialEnd))
+	case current != nil && current.Status == db.SubscriptionTrialing:
+		trialEnd := current.CurrentPeriodEnd.Format("January 2, 2006")
+		app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your free trial continues on %s. You will be charged on %s unless you cancel before then.", plan.PlanName, trialEnd))
+	default:
+		app.Session.Put(r.Context(), "flash", "Subscribed successfully")
+	}
 	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 }
+
+// Protected route
+// Shows the user's subscription, and lets them cancel or reactivate it
+func (app *Config) GETSubscriptionPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	dataMap := make(map[string]interface{})
+
+	locale := requestLocale(r)
+
+	current, err := app.Models.Subscription.GetCurrentForUser(userID)
+	if err == nil {
+		current.Plan.Localize(locale)
+		dataMap["subscription"] = current
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println("Error getting current subscription: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get your subscription")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	history, err := app.Models.Subscription.GetHistoryForUser(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting subscription history: ", err)
+	}
+	for _, subscription := range history {
+		subscription.Plan.Localize(locale)
+	}
+	dataMap["history"] = history
+
+	app.render(w, r, "subscription.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// Protected route
+// Cancels the user's subscription, either straight away or at the end of the current period
+func (app *Config) POSTCancelSubscription(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to cancel subscription")
+		http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+		return
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(db.User)
+	if !ok {
+		app.ErrorLog.Println("Error getting user from session")
+		app.Session.Put(r.Context(), "error", "Log in to access this page")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	subscription, err := app.Models.Subscription.GetCurrentForUser(user.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting current subscription: ", err)
+		app.Session.Put(r.Context(), "error", "You do not have a subscription to cancel")
+		http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+		return
+	}
+
+	// the reason is kept to as many characters as it is stored with, and cut on a character
+	// boundary, so what is stored is still valid UTF-8
+	reason := strings.TrimSpace(r.PostForm.Get("reason"))
+	if runes := []rune(reason); len(runes) > maxCancellationReasonLength {
+		reason = string(runes[:maxCancellationReasonLength])
+	}
+
+	// only an active subscription or a trial has a period to run out; a past due subscription ends now
+	atPeriodEnd := r.PostForm.Get("when") == "period-end" && subscription.Status != db.SubscriptionPastDue
+
+	if atPeriodEnd {
+		err = app.Models.Subscription.ScheduleCancellation(subscription.ID, reason)
+	} else {
+		err = app.Models.Subscription.Cancel(subscription.ID, reason)
+	}
+	if err != nil {
+		app.ErrorLog.Println("Error canceling subscription: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to cancel subscription")
+		http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+		return
+	}
+
+	if !atPeriodEnd {
+		// nothing is owed for a subscription that has ended
+		invoice, err := app.Models.Invoice.GetOpenForSubscription(subscription.ID)
+		if err == nil {
+			err = app.Models.Invoice.Void(invoice.ID)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.ErrorLog.Printf("Error voiding open invoice for subscription %d: %v\n", subscription.ID, err)
+		}
+
+		// the user no longer has a plan
+		u, err := app.Models.User.GetOne(user.ID)
+		if err != nil {
+			app.ErrorLog.Println("Error getting user: ", err)
+		} else {
+			app.Session.Put(r.Context(), "user", *u)
+		}
+	}
+
+	accessUntil := ""
+	if atPeriodEnd {
+		accessUntil = subscription.CurrentPeriodEnd.Format("January 2, 2006")
+	}
+
+	app.sendEmail(Message{
+		To:       user.Email,
+		Subject:  "Your subscription has been canceled",
+		Template: "cancellation-email",
+		Data:     subscription,
+		DataMap: map[string]any{
+			"accessUntil": accessUntil,
+		},
+	})
+
+	if atPeriodEnd {
+		app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your subscription will end on %s. You can reactivate it until then.", accessUntil))
+	} else {
+		app.Session.Put(r.Context(), "flash", "Your subscription has been canceled")
+	}
+	http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+}
+
+// Protected route
+// Undoes a cancellation at the end of the period, before the period has ended
+func (app *Config) POSTReactivateSubscription(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	subscription, err := app.Models.Subscription.GetCurrentForUser(userID)
+	if err != nil || !subscription.CancelAtPeriodEnd {
+		if err != nil {
+			app.ErrorLog.Println("Error getting current subscription: ", err)
+		}
+		app.Session.Put(r.Context(), "error", "There is no canceled subscription to reactivate")
+		http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.Subscription.Reactivate(subscription.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error reactivating subscription: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to reactivate subscription")
+		http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your subscription has been reactivated")
+	http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+}
+
+// Protected route
+// Shows the user's billing address and tax ID, which decide the taxes on their invoices
+func (app *Config) GETBillingPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get your billing details")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "billing.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"user": user,
+		},
+	})
+}
+
+// Protected route
+func (app *Config) POSTBillingPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save your billing details")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	address, taxID, err := billingDetailsFromForm(r.PostForm)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+	err = app.Models.User.UpdateBillingDetails(userID, address, taxID)
+	if err != nil {
+		app.ErrorLog.Println("Error saving billing details: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save your billing details")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	// update user in session, so new invoices are taxed at the new address
+	u, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+	} else {
+		app.Session.Put(r.Context(), "user", *u)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your billing details have been saved")
+	http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+}
+
+// billingDetailsFromForm reads a billing address and tax ID from a submitted form. Country and
+// region codes, and tax IDs, are stored in upper case. The error is fit to show to the user.
+func billingDetailsFromForm(form url.Values) (db.Address, string, error) {
+	address := db.Address{
+		Line1:      strings.TrimSpace(form.Get("line1")),
+		Line2:      strings.TrimSpace(form.Get("line2")),
+		City:       strings.TrimSpace(form.Get("city")),
+		Region:     strings.ToUpper(strings.TrimSpace(form.Get("region"))),
+		PostalCode: strings.ToUpper(strings.TrimSpace(form.Get("postal-code"))),
+		Country:    strings.ToUpper(strings.TrimSpace(form.Get("country"))),
+	}
+	taxID := strings.ToUpper(strings.ReplaceAll(form.Get("tax-id"), " ", ""))
+
+	for _, field := range []string{address.Line1, address.Line2, address.City, address.Region, address.PostalCode} {
+		if len(field) > maxBillingFieldLength {
+			return address, taxID, fmt.Errorf("Address lines can be at most %d characters long", maxBillingFieldLength)
+		}
+	}
+
+	// the country decides the taxes, so it must be given with any address
+	if address.Country == "" && (address.Line1 != "" || address.City != "" || taxID != "") {
+		return address, taxID, errors.New("Please choose the country of your billing address")
+	}
+	if address.Country != "" && !isCountryCode(address.Country) {
+		return address, taxID, errors.New("Please enter the two letter code of your country, for example CA")
+	}
+	if len(taxID) > maxTaxIDLength {
+		return address, taxID, fmt.Errorf("A tax ID can be at most %d characters long", maxTaxIDLength)
+	}
+	if taxID != "" && !validTaxID(address.Country, taxID) {
+		return address, taxID, errors.New("Please enter a valid VAT number for your country, starting with its country code")
+	}
+
+	return address, taxID, nil
+}
+
+// isCountryCode reports whether code looks like an ISO 3166-1 alpha-2 country code
+func isCountryCode(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
 )
@@ -53,6 +57,14 @@ var pageTests = []struct {
 		expectedStatusCode: http.StatusOK,
 		expectedHTML:       `<h1 class="mt-5">Register</h1>`,
 	},
+	{
+		testName:           "forgot password page",
+		url:                "/forgot-password",
+		httpVerb:           "GET",
+		handler:            testApp.GETForgotPasswordPage,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `<h1 class="mt-5">Forgot Password</h1>`,
+	},
 	// { // TODO test token validity
 	// 	testName:           "activate account page",
 	// 	url:                "/activate-account",
@@ -72,6 +84,30 @@ var pageTests = []struct {
 		expectedStatusCode: http.StatusOK,
 		expectedHTML:       `<h1 class="mt-5">Plans</h1>`,
 	},
+	{
+		testName: "subscription page",
+		url:      "/members/subscription",
+		httpVerb: "GET",
+		handler:  testApp.GETSubscriptionPage,
+		sessionData: map[string]interface{}{
+			"userID": 1,
+			"user":   db.User{ID: 1, Active: 1},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `<h1 class="mt-5">Subscription</h1>`,
+	},
+	{
+		testName: "billing page",
+		url:      "/members/billing",
+		httpVerb: "GET",
+		handler:  testApp.GETBillingPage,
+		sessionData: map[string]interface{}{
+			"userID": 1,
+			"user":   db.User{ID: 1, Active: 1},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `<h1 class="mt-5">Billing Details</h1>`,
+	},
 }
 
 func Test_Pages(t *testing.T) {
@@ -130,6 +166,45 @@ func TestConfig_POSTLoginPage(t *testing.T) {
 	}
 }
 
+func TestConfig_POSTLoginPage_CSRF(t *testing.T) {
+	var tests = []struct {
+		name               string
+		sentToken          string
+		expectedStatusCode int
+	}{
+		{"missing token", "", http.StatusForbidden},
+		{"wrong token", "not-the-session-token", http.StatusForbidden},
+		{"valid token", "session-token", http.StatusSeeOther},
+	}
+
+	for _, e := range tests {
+		postedData := strings.NewReader(url.Values{
+			"email":      {"testman@example.com"},
+			"password":   {"abc12345"},
+			"csrf_token": {e.sentToken},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/login", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		testApp.Session.Put(ctx, "csrf_token", "session-token")
+
+		// run the handler behind the CSRF middleware, as it is in routes()
+		handler := testApp.CSRF(http.HandlerFunc(testApp.POSTLoginPage))
+		handler.ServeHTTP(res, req)
+
+		if res.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, res.Code)
+		}
+		if e.expectedStatusCode == http.StatusForbidden && testApp.Session.Exists(ctx, "userID") {
+			t.Errorf("%s: user was logged in despite the rejected request", e.name)
+		}
+	}
+}
+
 func TestConfig_GETSubscribeToPlan(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/members/subscribe?plan=1", nil) // build a request to test
 	ctx := getCtx(req)                                                 // add session to request context
@@ -137,6 +212,7 @@ func TestConfig_GETSubscribeToPlan(t *testing.T) {
 	res := httptest.NewRecorder() // create a response recorder
 
 	// add session data to the request context
+	testApp.Session.Put(ctx, "userID", 1)
 	testApp.Session.Put(ctx, "user", db.User{
 		ID:        1,
 		Active:    1,
@@ -148,8 +224,655 @@ func TestConfig_GETSubscribeToPlan(t *testing.T) {
 	handler := http.HandlerFunc(testApp.GETSubscribeToPlan)
 	handler.ServeHTTP(res, req)
 
-	// test results
-	if res.Code != http.StatusSeeOther {
-		t.Errorf("expected status 303, got %d", res.Code)
+	// test results - the GET request only asks for confirmation
+	if res.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", res.Code)
+	}
+	html := res.Body.String()
+	if !strings.Contains(html, `<h1 class="mt-5">Confirm Subscription</h1>`) {
+		t.Error("confirmation page not rendered")
+	}
+	if !strings.Contains(html, `name="idempotency-key"`) {
+		t.Error("confirmation form does not carry an idempotency key")
+	}
+}
+
+func TestConfig_POSTSubscribeToPlan(t *testing.T) {
+	var tests = []struct {
+		name             string
+		idempotencyKey   string
+		expectedFlashKey string
+	}{
+		{"first request", "subscribe-key-1", "flash"},
+		{"replayed request", "subscribe-key-1", "warning"},
+		{"missing key", "", "error"},
+	}
+
+	for _, e := range tests {
+		postedData := strings.NewReader(url.Values{
+			"plan":            {"2"},
+			"idempotency-key": {e.idempotencyKey},
+			"payment-method":  {FakeCardSuccess},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/members/subscribe", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		// add session data to the request context
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", db.User{
+			ID:        1,
+			Active:    1,
+			Email:     "testUser@example.com",
+			FirstName: "Test",
+			LastName:  "User",
+		})
+
+		handler := http.HandlerFunc(testApp.POSTSubscribeToPlan)
+		handler.ServeHTTP(res, req)
+
+		// test results
+		if res.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status 303, got %d", e.name, res.Code)
+		}
+		if res.Header().Get("Location") != "/members/plans" {
+			t.Errorf("%s: expected redirect to /members/plans, got %s", e.name, res.Header().Get("Location"))
+		}
+		if !testApp.Session.Exists(ctx, e.expectedFlashKey) {
+			t.Errorf("%s: expected %s message in session", e.name, e.expectedFlashKey)
+		}
+	}
+
+	testApp.Wait.Wait() // let the invoice and manual goroutines finish
+}
+
+func TestConfig_POSTSubscribeToPlan_FailedPayment(t *testing.T) {
+	var tests = []struct {
+		name          string
+		paymentMethod string
+		expectedError string
+	}{
+		{"declined card", FakeCardDeclined, "Your card was declined. Please use another payment method."},
+		{"provider timeout", FakeCardTimeout, "The payment provider did not respond. Please try again."},
+		{"no payment method", "", "Unable to use this payment method"},
+	}
+
+	for i, e := range tests {
+		postedData := strings.NewReader(url.Values{
+			"plan":            {"2"},
+			"idempotency-key": {fmt.Sprintf("failed-payment-key-%d", i)},
+			"payment-method":  {e.paymentMethod},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/members/subscribe", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", db.User{ID: 1, Active: 1, Email: "testUser@example.com"})
+
+		handler := http.HandlerFunc(testApp.POSTSubscribeToPlan)
+		handler.ServeHTTP(res, req)
+
+		// test results - the user is sent back to confirm again, and is not subscribed
+		if res.Header().Get("Location") != "/members/subscribe?plan=2&currency=USD" {
+			t.Errorf("%s: expected redirect to the confirmation page, got %s", e.name, res.Header().Get("Location"))
+		}
+		if msg := testApp.Session.GetString(ctx, "error"); msg != e.expectedError {
+			t.Errorf("%s: expected error %q, got %q", e.name, e.expectedError, msg)
+		}
+		if testApp.Session.Exists(ctx, "flash") {
+			t.Errorf("%s: user should not have been subscribed", e.name)
+		}
+	}
+}
+
+func TestConfig_POSTSubscribeToPlan_RetryAfterFailure(t *testing.T) {
+	// the same confirmation form is sent again after the first card was declined
+	var tests = []struct {
+		name             string
+		paymentMethod    string
+		expectedFlashKey string
+	}{
+		{"declined card", FakeCardDeclined, "error"},
+		{"another card", FakeCardSuccess, "flash"},
+		{"replayed request", FakeCardSuccess, "warning"},
+	}
+
+	for _, e := range tests {
+		postedData := strings.NewReader(url.Values{
+			"plan":            {"2"},
+			"idempotency-key": {"retried-key"},
+			"payment-method":  {e.paymentMethod},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/members/subscribe", postedData)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", db.User{ID: 1, Active: 1, Email: "testUser@example.com"})
+
+		http.HandlerFunc(testApp.POSTSubscribeToPlan).ServeHTTP(res, req)
+
+		if !testApp.Session.Exists(ctx, e.expectedFlashKey) {
+			t.Errorf("%s: expected %s message in session", e.name, e.expectedFlashKey)
+		}
+	}
+
+	testApp.Wait.Wait() // let the invoice and manual goroutines finish
+}
+
+// failingInvoices is an InvoiceTest that cannot save invoices
+type failingInvoices struct {
+	*db.InvoiceTest
+}
+
+func (i failingInvoices) Insert(invoice db.Invoice) (int, error) {
+	return 0, errors.New("invoice: insert failed")
+}
+
+func TestConfig_POSTSubscribeToPlan_InvoiceNotSaved(t *testing.T) {
+	app := testApp
+	gateway := NewFakeGateway()
+	app.Payments = gateway
+	subscriptions := &db.SubscriptionTest{}
+	app.Models.Subscription = subscriptions
+	app.Models.Invoice = failingInvoices{&db.InvoiceTest{}}
+
+	// test user 2 has never subscribed
+	postedData := strings.NewReader(url.Values{
+		"plan":            {"2"},
+		"idempotency-key": {"invoice-not-saved-key"},
+		"payment-method":  {FakeCardSuccess},
+	}.Encode())
+
+	req, _ := http.NewRequest("POST", "/members/subscribe", postedData)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	app.Session.Put(ctx, "userID", 2)
+	app.Session.Put(ctx, "user", db.User{ID: 2, Active: 1, Email: "jane@example.com"})
+
+	http.HandlerFunc(app.POSTSubscribeToPlan).ServeHTTP(res, req)
+
+	if !app.Session.Exists(ctx, "error") || app.Session.Exists(ctx, "flash") {
+		t.Error("expected the user to be told subscribing failed")
+	}
+
+	// the charge is given back, and the subscription it paid for does not carry on
+	if len(gateway.charges) != 1 {
+		t.Fatalf("expected one charge, got %d", len(gateway.charges))
+	}
+	for id, charge := range gateway.charges {
+		if gateway.refunded[id] != charge.Amount {
+			t.Errorf("expected charge %s to be refunded in full, got %d of %d refunded", id, gateway.refunded[id], charge.Amount)
+		}
+	}
+	if changes := subscriptions.Changes(); len(changes) != 1 || changes[0].Status != db.SubscriptionCanceled {
+		t.Errorf("expected the new subscription to be canceled, got %v", changes)
+	}
+}
+
+func TestConfig_GETSubscribeToPlan_ChangePlan(t *testing.T) {
+	// the test user is subscribed to plan 1; plan 2 costs more and plan 3 costs less
+	var tests = []struct {
+		name         string
+		url          string
+		expectedText string
+	}{
+		{"upgrade", "/members/subscribe?plan=2", "Due today"},
+		{"downgrade", "/members/subscribe?plan=3", "Your new plan starts on"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil) // build a request to test
+		ctx := getCtx(req)                           // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", db.User{ID: 1, Active: 1, Email: "testUser@example.com"})
+
+		handler := http.HandlerFunc(testApp.GETSubscribeToPlan)
+		handler.ServeHTTP(res, req)
+
+		if !strings.Contains(res.Body.String(), e.expectedText) {
+			t.Errorf("%s: expected the confirmation page to contain %q", e.name, e.expectedText)
+		}
+	}
+}
+
+func TestConfig_POSTSubscribeToPlan_ChangePlan(t *testing.T) {
+	var tests = []struct {
+		name             string
+		plan             string
+		expectedFlashKey string
+		expectedMessage  string
+	}{
+		{"current plan", "1", "warning", "You are already subscribed to this plan."},
+		{"downgrade", "3", "flash", "Your plan will change to Test Plan on "},
+	}
+
+	gateway := NewFakeGateway()
+	payments := testApp.Payments
+	testApp.Payments = gateway
+	defer func() { testApp.Payments = payments }()
+
+	for i, e := range tests {
+		postedData := strings.NewReader(url.Values{
+			"plan":            {e.plan},
+			"idempotency-key": {fmt.Sprintf("change-plan-key-%d", i)},
+			"payment-method":  {FakeCardSuccess},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/members/subscribe", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", db.User{ID: 1, Active: 1, Email: "testUser@example.com"})
+
+		handler := http.HandlerFunc(testApp.POSTSubscribeToPlan)
+		handler.ServeHTTP(res, req)
+
+		if res.Header().Get("Location") != "/members/plans" {
+			t.Errorf("%s: expected redirect to /members/plans, got %s", e.name, res.Header().Get("Location"))
+		}
+		if msg := testApp.Session.GetString(ctx, e.expectedFlashKey); !strings.HasPrefix(msg, e.expectedMessage) {
+			t.Errorf("%s: expected %s message %q, got %q", e.name, e.expectedFlashKey, e.expectedMessage, msg)
+		}
+	}
+
+	// neither staying on the same plan nor scheduling a downgrade charges the user
+	if len(gateway.charges) != 0 {
+		t.Errorf("expected no charges, got %d", len(gateway.charges))
+	}
+}
+
+func TestConfig_SubscribeToPlan_ChangePlanDuringTrial(t *testing.T) {
+	// test user 5 is on a free trial of plan 4, and test user 4 has not paid their last invoice
+	var tests = []struct {
+		name             string
+		userID           int
+		plan             string
+		expectedText     string
+		expectedFlashKey string
+		expectedMessage  string
+		expectedChanges  string
+	}{
+		{"upgrade during trial", 5, "2", "Your free trial continues on the new plan", "flash", "Your free trial continues on Test Plan.", "[ChangePlan]"},
+		{"downgrade during trial", 5, "3", "Your free trial continues on the new plan", "flash", "Your free trial continues on Test Plan.", "[ChangePlan]"},
+		{"same plan during trial", 5, "4", "", "warning", "You are already subscribed to this plan.", "[]"},
+		{"past due", 4, "2", "", "error", pastDuePlanChangeMessage, "[]"},
+	}
+
+	for i, e := range tests {
+		app := testApp
+		gateway := NewFakeGateway()
+		app.Payments = gateway
+		subscriptions := &db.SubscriptionTest{}
+		app.Models.Subscription = subscriptions
+		user := db.User{ID: e.userID, Active: 1, Email: "trialUser@example.com"}
+
+		req, _ := http.NewRequest("GET", "/members/subscribe?plan="+e.plan, nil) // build a request to test
+		ctx := getCtx(req)                                                       // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		app.Session.Put(ctx, "userID", user.ID)
+		app.Session.Put(ctx, "user", user)
+
+		http.HandlerFunc(app.GETSubscribeToPlan).ServeHTTP(res, req)
+
+		if e.expectedText != "" && !strings.Contains(res.Body.String(), e.expectedText) {
+			t.Errorf("%s: expected the confirmation page to contain %q", e.name, e.expectedText)
+		}
+		if strings.Contains(res.Body.String(), "Due today") {
+			t.Errorf("%s: did not expect anything to be due today", e.name)
+		}
+
+		postedData := strings.NewReader(url.Values{
+			"plan":            {e.plan},
+			"idempotency-key": {fmt.Sprintf("trial-change-key-%d", i)},
+			"payment-method":  {FakeCardSuccess},
+		}.Encode())
+
+		req, _ = http.NewRequest("POST", "/members/subscribe", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx = getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res = httptest.NewRecorder() // create a response recorder
+
+		app.Session.Put(ctx, "userID", user.ID)
+		app.Session.Put(ctx, "user", user)
+
+		http.HandlerFunc(app.POSTSubscribeToPlan).ServeHTTP(res, req)
+		app.Wait.Wait() // let the manual goroutine finish
+
+		if msg := app.Session.GetString(ctx, e.expectedFlashKey); !strings.HasPrefix(msg, e.expectedMessage) {
+			t.Errorf("%s: expected %s message %q, got %q", e.name, e.expectedFlashKey, e.expectedMessage, msg)
+		}
+		var changes []string
+		for _, change := range subscriptions.Changes() {
+			changes = append(changes, change.Method)
+		}
+		if fmt.Sprint(changes) != e.expectedChanges {
+			t.Errorf("%s: expected changes %s, got %v", e.name, e.expectedChanges, changes)
+		}
+		// the trial carries on, so nothing is charged until it ends
+		if len(gateway.charges) != 0 {
+			t.Errorf("%s: expected no charges, got %d", e.name, len(gateway.charges))
+		}
+	}
+}
+
+func TestConfig_SubscribeToPlan_Trial(t *testing.T) {
+	gateway := NewFakeGateway()
+	payments := testApp.Payments
+	testApp.Payments = gateway
+	defer func() { testApp.Payments = payments }()
+
+	// test user 2 has never subscribed, and plan 4 has a free trial
+	user := db.User{ID: 2, Active: 1, Email: "newUser@example.com"}
+
+	req, _ := http.NewRequest("GET", "/members/subscribe?plan=4", nil) // build a request to test
+	ctx := getCtx(req)                                                 // add session to request context
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder() // create a response recorder
+
+	testApp.Session.Put(ctx, "userID", user.ID)
+	testApp.Session.Put(ctx, "user", user)
+
+	http.HandlerFunc(testApp.GETSubscribeToPlan).ServeHTTP(res, req)
+
+	if !strings.Contains(res.Body.String(), "14-day free trial starts today") {
+		t.Error("expected the confirmation page to offer a free trial")
+	}
+
+	postedData := strings.NewReader(url.Values{
+		"plan":            {"4"},
+		"idempotency-key": {"trial-key"},
+		"payment-method":  {FakeCardSuccess},
+	}.Encode())
+
+	req, _ = http.NewRequest("POST", "/members/subscribe", postedData) // build a request to test
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx = getCtx(req) // add session to request context
+	req = req.WithContext(ctx)
+	res = httptest.NewRecorder() // create a response recorder
+
+	testApp.Session.Put(ctx, "userID", user.ID)
+	testApp.Session.Put(ctx, "user", user)
+
+	http.HandlerFunc(testApp.POSTSubscribeToPlan).ServeHTTP(res, req)
+	testApp.Wait.Wait() // let the manual goroutine finish
+
+	if msg := testApp.Session.GetString(ctx, "flash"); !strings.HasPrefix(msg, "Your free trial has started.") {
+		t.Errorf("expected the trial to start, got flash message %q", msg)
+	}
+	if len(gateway.charges) != 0 {
+		t.Errorf("expected no charge when a trial starts, got %d", len(gateway.charges))
+	}
+}
+
+func TestConfig_SubscribeToPlan_Coupon(t *testing.T) {
+	gateway := NewFakeGateway()
+	payments := testApp.Payments
+	testApp.Payments = gateway
+	defer func() { testApp.Payments = payments }()
+
+	// test user 2 has never subscribed; plan 2 costs $20.00
+	user := db.User{ID: 2, Active: 1, Email: "newUser@example.com"}
+
+	var pageTests = []struct {
+		name         string
+		url          string
+		expectedText string
+	}{
+		{"valid code", "/members/subscribe?plan=2&coupon=save20", "Promotion code SAVE20 applied"},
+		{"expired code", "/members/subscribe?plan=2&coupon=EXPIRED", "That promotion code has expired."},
+		{"unknown code", "/members/subscribe?plan=2&coupon=NOSUCHCODE", "That promotion code is not valid."},
+	}
+
+	for _, e := range pageTests {
+		req, _ := http.NewRequest("GET", e.url, nil) // build a request to test
+		ctx := getCtx(req)                           // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		testApp.Session.Put(ctx, "userID", user.ID)
+		testApp.Session.Put(ctx, "user", user)
+
+		http.HandlerFunc(testApp.GETSubscribeToPlan).ServeHTTP(res, req)
+
+		if !strings.Contains(res.Body.String(), e.expectedText) {
+			t.Errorf("%s: expected the confirmation page to contain %q", e.name, e.expectedText)
+		}
+	}
+
+	var tests = []struct {
+		name             string
+		plan             string
+		couponCode       string
+		expectedLocation string
+	}{
+		{"code restricted to the plan", "2", "GOLDONLY", "/members/plans"},
+		{"code restricted to another plan", "1", "GOLDONLY", "/members/subscribe?plan=1&currency=USD"},
+		{"expired code", "2", "EXPIRED", "/members/subscribe?plan=2&currency=USD"},
+	}
+
+	for i, e := range tests {
+		postedData := strings.NewReader(url.Values{
+			"plan":            {e.plan},
+			"idempotency-key": {fmt.Sprintf("coupon-key-%d", i)},
+			"payment-method":  {FakeCardSuccess},
+			"coupon-code":     {e.couponCode},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/members/subscribe", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		testApp.Session.Put(ctx, "userID", user.ID)
+		testApp.Session.Put(ctx, "user", user)
+
+		http.HandlerFunc(testApp.POSTSubscribeToPlan).ServeHTTP(res, req)
+
+		if res.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, res.Header().Get("Location"))
+		}
+	}
+	testApp.Wait.Wait() // let the invoice and manual goroutines finish
+
+	// only the subscription with a valid code is charged, with 20% off the first invoice
+	var charged []int
+	for _, charge := range gateway.charges {
+		charged = append(charged, charge.Amount)
+	}
+	if len(charged) != 1 || charged[0] != 1600 {
+		t.Errorf("expected a single discounted charge of 1600, got %v", charged)
+	}
+}
+
+func TestConfig_POSTCancelSubscription(t *testing.T) {
+	var tests = []struct {
+		name            string
+		when            string
+		expectedMessage string
+	}{
+		{"at period end", "period-end", "Your subscription will end on "},
+		{"straight away", "now", "Your subscription has been canceled"},
+	}
+
+	for _, e := range tests {
+		postedData := strings.NewReader(url.Values{
+			"when":   {e.when},
+			"reason": {"Too expensive"},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/members/subscription/cancel", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", db.User{ID: 1, Active: 1, Email: "testUser@example.com"})
+
+		handler := http.HandlerFunc(testApp.POSTCancelSubscription)
+		handler.ServeHTTP(res, req)
+
+		if res.Header().Get("Location") != "/members/subscription" {
+			t.Errorf("%s: expected redirect to /members/subscription, got %s", e.name, res.Header().Get("Location"))
+		}
+		if msg := testApp.Session.GetString(ctx, "flash"); !strings.HasPrefix(msg, e.expectedMessage) {
+			t.Errorf("%s: expected flash message %q, got %q", e.name, e.expectedMessage, msg)
+		}
+	}
+
+	testApp.Wait.Wait() // let the cancellation emails go out
+}
+
+// cancellingSubscriptions records the reason given for canceling a subscription
+type cancellingSubscriptions struct {
+	*db.SubscriptionTest
+	reason string
+}
+
+func (s *cancellingSubscriptions) ScheduleCancellation(id int, reason string) error {
+	s.reason = reason
+	return nil
+}
+
+func TestConfig_POSTCancelSubscription_LongReason(t *testing.T) {
+	app := testApp
+	subscriptions := &cancellingSubscriptions{SubscriptionTest: &db.SubscriptionTest{}}
+	app.Models.Subscription = subscriptions
+	catchMail(&app)
+
+	// each character of the reason takes two bytes
+	postedData := strings.NewReader(url.Values{
+		"when":   {"period-end"},
+		"reason": {strings.Repeat("é", maxCancellationReasonLength+10)},
+	}.Encode())
+
+	req, _ := http.NewRequest("POST", "/members/subscription/cancel", postedData)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	app.Session.Put(ctx, "userID", 1)
+	app.Session.Put(ctx, "user", db.User{ID: 1, Active: 1, Email: "testUser@example.com"})
+
+	http.HandlerFunc(app.POSTCancelSubscription).ServeHTTP(res, req)
+
+	if subscriptions.reason != strings.Repeat("é", maxCancellationReasonLength) {
+		t.Errorf("expected the reason to be cut to %d characters, got %d bytes, valid UTF-8: %t",
+			maxCancellationReasonLength, len(subscriptions.reason), utf8.ValidString(subscriptions.reason))
+	}
+}
+
+func TestConfig_POSTReactivateSubscription(t *testing.T) {
+	// the test subscription has not been canceled, so there is nothing to reactivate
+	req, _ := http.NewRequest("POST", "/members/subscription/reactivate", nil) // build a request to test
+	ctx := getCtx(req)                                                         // add session to request context
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder() // create a response recorder
+
+	testApp.Session.Put(ctx, "userID", 1)
+
+	handler := http.HandlerFunc(testApp.POSTReactivateSubscription)
+	handler.ServeHTTP(res, req)
+
+	if res.Header().Get("Location") != "/members/subscription" {
+		t.Errorf("expected redirect to /members/subscription, got %s", res.Header().Get("Location"))
+	}
+	if !testApp.Session.Exists(ctx, "error") {
+		t.Error("expected an error message in session")
+	}
+}
+
+func TestConfig_GETResetPasswordPage(t *testing.T) {
+	// test users have the password hash "password"
+	user, _ := testApp.Models.User.GetByEmail("test@example.com")
+	link := fmt.Sprintf("http://localhost:8811/reset-password?email=%s&fp=%s", user.Email, passwordFingerprint(user))
+
+	var tests = []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+	}{
+		{"valid link", GenerateTokenFromString(PurposeReset, link), http.StatusOK},
+		{"unsigned link", link, http.StatusSeeOther},
+		{"tampered link", strings.Replace(GenerateTokenFromString(PurposeReset, link), "test@", "admin@", 1), http.StatusSeeOther},
+		{"used link", GenerateTokenFromString(PurposeReset, strings.Replace(link, passwordFingerprint(user), "0000000000000000", 1)), http.StatusSeeOther},
+		{"link for another purpose", GenerateTokenFromString(PurposeActivate, link), http.StatusSeeOther},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", strings.TrimPrefix(e.url, "http://localhost:8811"), nil) // build a request to test
+		ctx := getCtx(req)                                                                        // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		handler := http.HandlerFunc(testApp.GETResetPasswordPage)
+		handler.ServeHTTP(res, req)
+
+		if res.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, res.Code)
+		}
+	}
+}
+
+func TestConfig_POSTResetPasswordPage(t *testing.T) {
+	app := testApp
+	app.UsedTokens = NewMemoryTokenStore(time.Now)
+
+	user, _ := app.Models.User.GetByEmail("test@example.com")
+	link := fmt.Sprintf("http://localhost:8811/reset-password?email=%s&fp=%s", user.Email, passwordFingerprint(user))
+	token := GenerateTokenFromString(PurposeReset, link)
+
+	// the same link is posted twice; only the first time resets the password
+	for i, expectedLocation := range []string{"/login", "/forgot-password"} {
+		postedData := strings.NewReader(url.Values{
+			"token":           {token},
+			"password":        {"new-password"},
+			"verify-password": {"new-password"},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/reset-password", postedData) // build a request to test
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req) // add session to request context
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder() // create a response recorder
+
+		handler := http.HandlerFunc(app.POSTResetPasswordPage)
+		handler.ServeHTTP(res, req)
+
+		// test results
+		if res.Code != http.StatusSeeOther {
+			t.Errorf("post %d: expected status 303, got %d", i+1, res.Code)
+		}
+		if res.Header().Get("Location") != expectedLocation {
+			t.Errorf("post %d: expected redirect to %s, got %s", i+1, expectedLocation, res.Header().Get("Location"))
+		}
+		if (app.Session.GetString(ctx, "flash") == "Password reset. Please log in.") != (i == 0) {
+			t.Errorf("post %d: expected password reset flash message in session to be %t", i+1, i == 0)
+		}
 	}
 }
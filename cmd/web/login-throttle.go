@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// LoginThrottle slows down password guessing. Failed logins are counted per account and per IP
+// address, and once either has failed too often it is locked out for a while. Every further
+// failure doubles the lockout, up to a maximum.
+type LoginThrottle interface {
+	// Lockout returns how long the account and IP address must wait before they may try to log in again; 0 if they may try now
+	Lockout(account, ip string) (time.Duration, error)
+	// Failed records a failed login, and returns the lockout it causes
+	Failed(account, ip string) (time.Duration, error)
+	// Succeeded forgets the failed logins of an account. Those of the IP address are kept, so an
+	// attacker cannot clear them by logging in to an account of their own.
+	Succeeded(account string) error
+	// Notify reports whether the owner of an account should be emailed about a failed login. They
+	// are emailed at most once per loginNotifyWindow, so failed logins cannot flood their inbox.
+	Notify(account string) (bool, error)
+}
+
+// throttlePolicy is how many failed logins are allowed, and how long they lock out for
+type throttlePolicy struct {
+	FreeAttempts int           // failures allowed before the first lockout
+	BaseLockout  time.Duration // the first lockout; every further failure doubles it
+	MaxLockout   time.Duration
+	Window       time.Duration // failures are forgotten this long after the last one
+}
+
+var (
+	accountPolicy = throttlePolicy{FreeAttempts: 5, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: 24 * time.Hour}
+	// many people can share an IP address, e.g. behind an office router, so it is allowed more failures
+	ipPolicy = throttlePolicy{FreeAttempts: 20, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: 24 * time.Hour}
+)
+
+const loginNotifyWindow = time.Hour
+
+// lockout returns how long the given number of failures locks out for
+func (p throttlePolicy) lockout(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	lockout := p.BaseLockout
+	for i := p.FreeAttempts + 1; i < failures && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, p.MaxLockout)
+}
+
+// accountKey returns the key the failed logins of an account are counted under. Email addresses
+// are compared without regard to case, so "Jane@example.com" cannot be used to get around a lockout.
+func accountKey(account string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(account))
+}
+
+// throttleKeys returns the keys the failed logins of an account and IP address are counted under,
+// with the policy for each
+func throttleKeys(account, ip string) map[string]throttlePolicy {
+	return map[string]throttlePolicy{
+		accountKey(account): accountPolicy,
+		"ip:" + ip:          ipPolicy,
+	}
+}
+
+// recordFailedLogin counts a failed login towards locking out the account and IP address it came from
+func (app *Config) recordFailedLogin(account, ip string) {
+	lockout, err := app.LoginThrottle.Failed(account, ip)
+	if err != nil {
+		app.ErrorLog.Println("Error recording failed login: ", err)
+		return
+	}
+	if lockout > 0 {
+		app.InfoLog.Printf("Logins from %s or to the account they tried are locked out for %s\n", ip, lockout)
+	}
+}
+
+// lockoutMessage tells the user how long they are locked out for, in whole minutes. It does not say
+// whether the account or the IP address is locked out.
+func lockoutMessage(lockout time.Duration) string {
+	minutes := int((lockout + time.Minute - 1) / time.Minute)
+	if minutes == 1 {
+		return "Too many failed login attempts. Please try again in 1 minute."
+	}
+	return fmt.Sprintf("Too many failed login attempts. Please try again in %d minutes.", minutes)
+}
+
+// RedisLoginThrottle is a LoginThrottle that keeps its counts in Redis, so that they are shared by
+// every instance of the app and survive restarts
+type RedisLoginThrottle struct {
+	Pool *redis.Pool
+}
+
+func (t *RedisLoginThrottle) Lockout(account, ip string) (time.Duration, error) {
+	conn := t.Pool.Get()
+	defer conn.Close()
+
+	var lockout time.Duration
+	for key := range throttleKeys(account, ip) {
+		// PTTL is negative for a key that does not exist
+		ms, err := redis.Int64(conn.Do("PTTL", "login:lockout:"+key))
+		if err != nil {
+			return 0, err
+		}
+		lockout = max(lockout, time.Duration(ms)*time.Millisecond)
+	}
+
+	return lockout, nil
+}
+
+func (t *RedisLoginThrottle) Failed(account, ip string) (time.Duration, error) {
+	conn := t.Pool.Get()
+	defer conn.Close()
+
+	var lockout time.Duration
+	for key, policy := range throttleKeys(account, ip) {
+		failures, err := redis.Int(conn.Do("INCR", "login:failures:"+key))
+		if err != nil {
+			return 0, err
+		}
+		_, err = conn.Do("PEXPIRE", "login:failures:"+key, policy.Window.Milliseconds())
+		if err != nil {
+			return 0, err
+		}
+
+		if l := policy.lockout(failures); l > 0 {
+			_, err = conn.Do("SET", "login:lockout:"+key, failures, "PX", l.Milliseconds())
+			if err != nil {
+				return 0, err
+			}
+			lockout = max(lockout, l)
+		}
+	}
+
+	return lockout, nil
+}
+
+func (t *RedisLoginThrottle) Succeeded(account string) error {
+	conn := t.Pool.Get()
+	defer conn.Close()
+
+	key := accountKey(account)
+	_, err := conn.Do("DEL", "login:failures:"+key, "login:lockout:"+key)
+	return err
+}
+
+func (t *RedisLoginThrottle) Notify(account string) (bool, error) {
+	conn := t.Pool.Get()
+	defer conn.Close()
+
+	// SET NX only succeeds for the first failure in the window
+	reply, err := redis.String(conn.Do("SET", "login:notified:"+accountKey(account), 1, "NX", "PX", loginNotifyWindow.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return reply == "OK", nil
+}
+
+// MemoryLoginThrottle is an in-process LoginThrottle for tests
+type MemoryLoginThrottle struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	failures map[string]int
+	lastFail map[string]time.Time
+	lockouts map[string]time.Time // the time each lockout ends
+	notified map[string]time.Time
+}
+
+func NewMemoryLoginThrottle(now func() time.Time) *MemoryLoginThrottle {
+	return &MemoryLoginThrottle{
+		now:      now,
+		failures: make(map[string]int),
+		lastFail: make(map[string]time.Time),
+		lockouts: make(map[string]time.Time),
+		notified: make(map[string]time.Time),
+	}
+}
+
+func (t *MemoryLoginThrottle) Lockout(account, ip string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lockout time.Duration
+	for key := range throttleKeys(account, ip) {
+		lockout = max(lockout, t.lockouts[key].Sub(t.now()))
+	}
+	return lockout, nil
+}
+
+func (t *MemoryLoginThrottle) Failed(account, ip string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	var lockout time.Duration
+	for key, policy := range throttleKeys(account, ip) {
+		if now.Sub(t.lastFail[key]) > policy.Window {
+			t.failures[key] = 0
+		}
+		t.failures[key]++
+		t.lastFail[key] = now
+
+		if l := policy.lockout(t.failures[key]); l > 0 {
+			t.lockouts[key] = now.Add(l)
+			lockout = max(lockout, l)
+		}
+	}
+	return lockout, nil
+}
+
+func (t *MemoryLoginThrottle) Succeeded(account string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := accountKey(account)
+	delete(t.failures, key)
+	delete(t.lockouts, key)
+	return nil
+}
+
+func (t *MemoryLoginThrottle) Notify(account string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := accountKey(account)
+	if last, ok := t.notified[key]; ok && t.now().Sub(last) < loginNotifyWindow {
+		return false, nil
+	}
+	t.notified[key] = t.now()
+	return true, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func Test_throttlePolicy_lockout(t *testing.T) {
+	policy := throttlePolicy{FreeAttempts: 5, BaseLockout: time.Minute, MaxLockout: time.Hour}
+
+	var tests = []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 0},
+		{5, 0},
+		{6, time.Minute},
+		{7, 2 * time.Minute},
+		{8, 4 * time.Minute},
+		{12, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, e := range tests {
+		if got := policy.lockout(e.failures); got != e.expected {
+			t.Errorf("%d failures: expected a lockout of %s, got %s", e.failures, e.expected, got)
+		}
+	}
+}
+
+func TestMemoryLoginThrottle(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttle := NewMemoryLoginThrottle(func() time.Time { return now })
+
+	// the account is locked out once it has used up its free attempts
+	for i := 0; i < accountPolicy.FreeAttempts; i++ {
+		if lockout, _ := throttle.Failed("Jane@Example.com", "203.0.113.1"); lockout != 0 {
+			t.Fatalf("failure %d: did not expect a lockout, got %s", i+1, lockout)
+		}
+	}
+	if lockout, _ := throttle.Failed("jane@example.com", "203.0.113.2"); lockout != accountPolicy.BaseLockout {
+		t.Errorf("expected the account to be locked out for %s, got %s", accountPolicy.BaseLockout, lockout)
+	}
+	if lockout, _ := throttle.Lockout(" JANE@example.com", "203.0.113.3"); lockout <= 0 {
+		t.Error("expected the account to be locked out from any IP address, in any case")
+	}
+	if lockout, _ := throttle.Lockout("other@example.com", "203.0.113.3"); lockout != 0 {
+		t.Errorf("did not expect another account to be locked out, got %s", lockout)
+	}
+
+	// the lockout runs out
+	now = now.Add(accountPolicy.BaseLockout)
+	if lockout, _ := throttle.Lockout("jane@example.com", "203.0.113.3"); lockout > 0 {
+		t.Errorf("expected the lockout to have run out, got %s", lockout)
+	}
+
+	// but the next failure locks the account out for twice as long
+	if lockout, _ := throttle.Failed("jane@example.com", "203.0.113.3"); lockout != 2*accountPolicy.BaseLockout {
+		t.Errorf("expected the lockout to double, got %s", lockout)
+	}
+
+	// a successful login clears the account
+	throttle.Succeeded("jane@example.com")
+	if lockout, _ := throttle.Lockout("jane@example.com", "203.0.113.3"); lockout != 0 {
+		t.Errorf("expected a successful login to clear the lockout, got %s", lockout)
+	}
+
+	// an IP address that tries many accounts is locked out too
+	for i := 0; i < ipPolicy.FreeAttempts+1; i++ {
+		throttle.Failed("user"+strings.Repeat("x", i)+"@example.com", "198.51.100.7")
+	}
+	if lockout, _ := throttle.Lockout("new@example.com", "198.51.100.7"); lockout <= 0 {
+		t.Error("expected the IP address to be locked out")
+	}
+}
+
+func TestMemoryLoginThrottle_Notify(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttle := NewMemoryLoginThrottle(func() time.Time { return now })
+
+	if notify, _ := throttle.Notify("jane@example.com"); !notify {
+		t.Error("expected the first failure to be notified")
+	}
+	if notify, _ := throttle.Notify("JANE@example.com"); notify {
+		t.Error("did not expect a second notification in the same window")
+	}
+
+	now = now.Add(loginNotifyWindow)
+	if notify, _ := throttle.Notify("jane@example.com"); !notify {
+		t.Error("expected a notification in the next window")
+	}
+}
+
+func Test_lockoutMessage(t *testing.T) {
+	var tests = []struct {
+		lockout  time.Duration
+		expected string
+	}{
+		{30 * time.Second, "1 minute."},
+		{time.Minute, "1 minute."},
+		{61 * time.Second, "2 minutes."},
+		{time.Hour, "60 minutes."},
+	}
+
+	for _, e := range tests {
+		if got := lockoutMessage(e.lockout); !strings.HasSuffix(got, e.expected) {
+			t.Errorf("%s: expected a message ending in %q, got %q", e.lockout, e.expected, got)
+		}
+	}
+}
+
+func TestConfig_POSTLoginPage_Lockout(t *testing.T) {
+	// a throttle of its own, so other tests are not locked out
+	app := testApp
+	throttle := NewMemoryLoginThrottle(time.Now)
+	app.LoginThrottle = throttle
+
+	login := func(password string) (*http.Request, *httptest.ResponseRecorder) {
+		postedData := strings.NewReader(url.Values{
+			"email":    {"test@example.com"},
+			"password": {password},
+		}.Encode())
+
+		req, _ := http.NewRequest("POST", "/login", postedData)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(app.POSTLoginPage)
+		handler.ServeHTTP(res, req)
+		return req, res
+	}
+
+	for i := 0; i <= accountPolicy.FreeAttempts; i++ {
+		login(db.TestWrongPassword)
+	}
+
+	// the right password is not even checked while the account is locked out
+	req, _ := login("abc12345")
+	if testApp.Session.Exists(req.Context(), "userID") {
+		t.Error("did not expect a locked out account to log in")
+	}
+	if msg := testApp.Session.GetString(req.Context(), "error"); !strings.HasPrefix(msg, "Too many failed login attempts") {
+		t.Errorf("expected to be told about the lockout, got %q", msg)
+	}
+
+	// the owner was emailed about the first failure only
+	if notify, _ := throttle.Notify("test@example.com"); notify {
+		t.Error("expected the owner to have been notified already")
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -24,11 +28,20 @@ import (
 func main() {
 	fmt.Println("Hello, Subscription Service!")
 
+	// settings the app cannot run without are checked before connecting to anything
+	totp, err := totpKey()
+	if err != nil {
+		log.Fatalln("Unable to start:", err)
+	}
+
 	// connect to database
 	database := initDB()
 
+	// connect to redis, which holds sessions, the sessions of each user, and login attempts
+	redisPool := initRedis()
+
 	// create sessions
-	session := initSession()
+	session := initSession(redisPool)
 
 	// Create loggers
 	infoLog := log.New(os.Stdout, color.GreenString("[INFO\t] "), log.Ldate|log.Ltime)
@@ -51,14 +64,31 @@ func main() {
 		SuccessLog:    successLog,
 		ErrorLog:      errorLog,
 		Models:        db.New(database),
+		Payments:      NewFakeGateway(), // TODO - connect to a real payment provider
+		LoginThrottle: &RedisLoginThrottle{Pool: redisPool},
+		SessionIndex:  &RedisSessionIndex{Pool: redisPool, Lifetime: session.Lifetime},
+		WebhookSecret: []byte(os.Getenv("WEBHOOK_SECRET")),
+		TOTPKey:       totp,
+		SellerCountry: strings.ToUpper(os.Getenv("SELLER_COUNTRY")),
 		ErrorChan:     make(chan error),
 		ErrorChanDone: make(chan bool),
+
+		RenewalInterval: renewalInterval(),
+		RenewalDone:     make(chan bool),
+		DunningSchedule: dunningSchedule(),
+
+		RateLimiter:      &RedisRateLimiter{Pool: redisPool},
+		UsedTokens:       &RedisTokenStore{Pool: redisPool},
+		ActivationExpiry: activationExpiry(),
 	}
 
 	// set up mail
 	app.Mailer = app.initMailer()
 	go app.listenForMail()
 
+	// renew subscriptions in the background
+	go app.listenForRenewals()
+
 	// listen for errors
 	go app.listenForErrors()
 
@@ -118,13 +148,13 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func initSession() *scs.SessionManager {
+func initSession(redisPool *redis.Pool) *scs.SessionManager {
 	// register custom types
 	gob.Register(db.User{})
 
 	// Create a new session manager and store it in the Config struct
 	session := scs.New()
-	session.Store = redisstore.New(initRedis()) // Use Redis to store session data
+	session.Store = redisstore.New(redisPool) // Use Redis to store session data
 
 	// Set session options
 	session.Lifetime = 24 * time.Hour              // 24 hours before session expires
@@ -167,6 +197,52 @@ func (app *Config) initMailer() Mail {
 	return m
 }
 
+// renewalInterval reads how often to run renewals from the environment, e.g. RENEWAL_INTERVAL=5m
+func renewalInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("RENEWAL_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return time.Minute
+	}
+	return interval
+}
+
+// activationExpiry reads how long activation links work for from the environment, e.g. ACTIVATION_EXPIRY=72h
+func activationExpiry() time.Duration {
+	expiry, err := time.ParseDuration(os.Getenv("ACTIVATION_EXPIRY"))
+	if err != nil || expiry < time.Minute {
+		return defaultActivationExpiry
+	}
+	return expiry
+}
+
+// totpKey reads the key that encrypts two-factor secrets from the environment, base64 encoded, e.g.
+// TOTP_KEY=$(openssl rand -base64 32). Without it, nobody could log in with two-factor authentication.
+func totpKey() ([]byte, error) {
+	value := os.Getenv("TOTP_KEY")
+	if value == "" {
+		return nil, errors.New("TOTP_KEY is not set; generate one with: openssl rand -base64 32")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("TOTP_KEY must be 32 bytes, base64 encoded; generate one with: openssl rand -base64 32")
+	}
+	return key, nil
+}
+
+// dunningSchedule reads the days on which to retry failed payments from the environment, e.g. DUNNING_SCHEDULE=1,3,7
+func dunningSchedule() []int {
+	var schedule []int
+	for _, field := range strings.Split(os.Getenv("DUNNING_SCHEDULE"), ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || days <= 0 || (len(schedule) > 0 && days <= schedule[len(schedule)-1]) {
+			return defaultDunningSchedule
+		}
+		schedule = append(schedule, days)
+	}
+	return schedule
+}
+
 func (app *Config) serve() {
 	// start http server
 	server := &http.Server{
@@ -194,6 +270,9 @@ func (app *Config) shutdown() {
 	// Do cleanup here
 	app.InfoLog.Println("Waiting for background processes to finish...")
 
+	// stop the renewal scheduler first; this waits for a renewal run that is under way
+	app.RenewalDone <- true
+
 	// block until waitgroup counter is 0
 	app.Wait.Wait()
 
@@ -206,6 +285,7 @@ func (app *Config) shutdown() {
 	close(app.Mailer.ErrorChan)
 	close(app.Mailer.DoneChan)
 	close(app.ErrorChan)
+	close(app.RenewalDone)
 
 	time.Sleep(800 * time.Millisecond) // wait for 0.8 seconds
 	app.InfoLog.Println("All background processes finished. Shut down complete.")
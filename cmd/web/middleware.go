@@ -1,11 +1,53 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+type contextKey string
+
+// pastDueKey holds the user's past due subscription in the request context
+const pastDueKey contextKey = "pastDue"
 
 func (app *Config) SessionLoad(next http.Handler) http.Handler {
 	return app.Session.LoadAndSave(next)
 }
 
+// CSRF issues a token for every session, and rejects state-changing requests that do not
+// send it back, either in the csrf_token form field or in the X-CSRF-Token header
+func (app *Config) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := app.Session.GetString(r.Context(), "csrf_token")
+		if token == "" {
+			token = GenerateRandomToken(32)
+			app.Session.Put(r.Context(), "csrf_token", token)
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sent := r.Header.Get("X-CSRF-Token")
+		if sent == "" {
+			sent = r.PostFormValue("csrf_token")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			app.ErrorLog.Printf("Invalid CSRF token for %s %s\n", r.Method, r.URL.Path)
+			http.Error(w, "Invalid or missing CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *Config) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.Session.Exists(r.Context(), "userID") {
@@ -16,3 +58,66 @@ func (app *Config) Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// TrackSession records, after each request of a logged in user, which session they used and from
+// where, so that they can see and end their sessions on the security page
+func (app *Config) TrackSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		// the handler may have logged the user in or out, or renewed the token
+		userID := app.Session.GetInt(r.Context(), "userID")
+		token := app.Session.Token(r.Context())
+		if userID == 0 || token == "" {
+			return
+		}
+
+		now := time.Now()
+		err := app.SessionIndex.Touch(userID, SessionInfo{
+			Token:     token,
+			UserAgent: userAgent(r),
+			IPAddress: clientIP(r),
+			CreatedAt: now,
+			LastSeen:  now,
+		})
+		if err != nil {
+			app.ErrorLog.Println("Error recording session: ", err)
+		}
+	})
+}
+
+// PastDue looks up whether the user's subscription is past due, so that members pages can show a banner
+func (app *Config) PastDue(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscription, err := app.Models.Subscription.GetCurrentForUser(app.Session.GetInt(r.Context(), "userID"))
+		if err == nil && subscription.Status == db.SubscriptionPastDue {
+			r = r.WithContext(context.WithValue(r.Context(), pastDueKey, subscription))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminOnly lets only administrators through. It runs after Auth, and looks the user up again rather
+// than trusting the session, so an admin whose rights are taken away loses access straight away.
+// Admins must also have logged in with two-factor authentication.
+func (app *Config) AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+		if err != nil || user.IsAdmin != 1 || user.Active != 1 {
+			if err != nil {
+				app.ErrorLog.Println("Error getting user: ", err)
+			}
+			app.ErrorLog.Printf("Denied admin access to %s %s\n", r.Method, r.URL.Path)
+			app.Session.Put(r.Context(), "error", "You do not have access to that page.")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if !app.Session.GetBool(r.Context(), "twoFactor") {
+			app.ErrorLog.Printf("Denied admin access to %s %s without two-factor authentication\n", r.Method, r.URL.Path)
+			app.Session.Put(r.Context(), "warning", "Please set up two-factor authentication to use the admin pages.")
+			http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// PaymentGateway is the interface to a payment provider. Amounts are in the minor unit of the charge's currency.
+type PaymentGateway interface {
+	CreateCustomer(user db.User) (string, error)
+	AttachPaymentMethod(customerID, paymentMethod string) (string, error)
+	Charge(req ChargeRequest) (*Charge, error)
+	Refund(chargeID string, amount int) (*Refund, error)
+	DeleteCustomer(customerID string) error
+}
+
+// ChargeRequest describes one payment to collect from a customer. Requests with the same
+// IdempotencyKey are only ever charged once.
+type ChargeRequest struct {
+	CustomerID      string
+	PaymentMethodID string
+	Amount          int
+	Currency        string
+	Description     string
+	IdempotencyKey  string
+}
+
+// Charge is a successful payment
+type Charge struct {
+	ID              string
+	CustomerID      string
+	PaymentMethodID string
+	Amount          int
+	Currency        string
+	Description     string
+	CreatedAt       time.Time
+}
+
+// Refund returns (part of) a charge to the customer
+type Refund struct {
+	ID        string
+	ChargeID  string
+	Amount    int
+	CreatedAt time.Time
+}
+
+var (
+	ErrCardDeclined        = errors.New("payment: card declined")
+	ErrPaymentTimeout      = errors.New("payment: provider timed out")
+	ErrNoPaymentMethod     = errors.New("payment: no payment method")
+	ErrUnknownCharge       = errors.New("payment: unknown charge")
+	ErrRefundExceedsCharge = errors.New("payment: refund exceeds the amount left on the charge")
+)
+
+// Test payment methods understood by FakeGateway. Charging a payment method always
+// has the same outcome, so checkout can be exercised without a real processor.
+const (
+	FakeCardSuccess  = "pm_card_visa"
+	FakeCardDeclined = "pm_card_declined"
+	FakeCardTimeout  = "pm_card_timeout"
+)
+
+// FakeGateway is an in-process PaymentGateway for development and tests
+type FakeGateway struct {
+	mu        sync.Mutex
+	sequence  int
+	charges   map[string]*Charge // by charge id
+	keys      map[string]*Charge // by idempotency key
+	refunded  map[string]int     // total refunded, by charge id
+	customers map[string]string  // customer id by user email
+}
+
+// NewFakeGateway creates an empty FakeGateway
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		charges:   make(map[string]*Charge),
+		keys:      make(map[string]*Charge),
+		refunded:  make(map[string]int),
+		customers: make(map[string]string),
+	}
+}
+
+func (g *FakeGateway) nextID(prefix string) string {
+	g.sequence++
+	return fmt.Sprintf("%s_fake_%06d", prefix, g.sequence)
+}
+
+// CreateCustomer creates a customer for the user. Creating a customer twice for the same
+// user returns the same customer.
+func (g *FakeGateway) CreateCustomer(user db.User) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if id, ok := g.customers[user.Email]; ok {
+		return id, nil
+	}
+
+	id := g.nextID("cus")
+	g.customers[user.Email] = id
+	return id, nil
+}
+
+// AttachPaymentMethod accepts any of the Fake* test cards, and returns it as the payment method id
+func (g *FakeGateway) AttachPaymentMethod(customerID, paymentMethod string) (string, error) {
+	switch paymentMethod {
+	case FakeCardSuccess, FakeCardDeclined, FakeCardTimeout:
+		return paymentMethod, nil
+	default:
+		return "", fmt.Errorf("payment: unknown test payment method %q", paymentMethod)
+	}
+}
+
+// Charge succeeds, is declined, or times out, depending on the test card being charged
+func (g *FakeGateway) Charge(req ChargeRequest) (*Charge, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if req.IdempotencyKey != "" {
+		if charge, ok := g.keys[req.IdempotencyKey]; ok {
+			return charge, nil
+		}
+	}
+
+	switch req.PaymentMethodID {
+	case "":
+		return nil, ErrNoPaymentMethod
+	case FakeCardDeclined:
+		return nil, ErrCardDeclined
+	case FakeCardTimeout:
+		return nil, ErrPaymentTimeout
+	}
+
+	charge := &Charge{
+		ID:              g.nextID("ch"),
+		CustomerID:      req.CustomerID,
+		PaymentMethodID: req.PaymentMethodID,
+		Amount:          req.Amount,
+		Currency:        req.Currency,
+		Description:     req.Description,
+		CreatedAt:       time.Now(),
+	}
+
+	g.charges[charge.ID] = charge
+	if req.IdempotencyKey != "" {
+		g.keys[req.IdempotencyKey] = charge
+	}
+
+	return charge, nil
+}
+
+// Refund returns amount cents of a charge. A charge can be refunded in parts,
+// up to its full amount.
+func (g *FakeGateway) Refund(chargeID string, amount int) (*Refund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	charge, ok := g.charges[chargeID]
+	if !ok {
+		return nil, ErrUnknownCharge
+	}
+
+	if amount <= 0 || g.refunded[chargeID]+amount > charge.Amount {
+		return nil, ErrRefundExceedsCharge
+	}
+	g.refunded[chargeID] += amount
+
+	return &Refund{
+		ID:        g.nextID("re"),
+		ChargeID:  chargeID,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// DeleteCustomer removes a customer, and the payment methods saved for them. Deleting a customer
+// that does not exist succeeds, so that a deletion can be retried.
+func (g *FakeGateway) DeleteCustomer(customerID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for email, id := range g.customers {
+		if id == customerID {
+			delete(g.customers, email)
+		}
+	}
+	return nil
+}
+
+// ensurePaymentCustomer makes sure the user exists as a customer with the payment provider, and
+// attaches paymentMethod to them if one is given. The user's payment details are saved when they
+// change, and the updated user is returned.
+func (app *Config) ensurePaymentCustomer(user db.User, paymentMethod string) (db.User, error) {
+	customerID := user.PaymentCustomerID
+	paymentMethodID := user.PaymentMethodID
+
+	var err error
+	if customerID == "" {
+		customerID, err = app.Payments.CreateCustomer(user)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	if paymentMethod != "" {
+		paymentMethodID, err = app.Payments.AttachPaymentMethod(customerID, paymentMethod)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	if paymentMethodID == "" {
+		return user, ErrNoPaymentMethod
+	}
+
+	if customerID != user.PaymentCustomerID || paymentMethodID != user.PaymentMethodID {
+		err = app.Models.User.UpdatePaymentDetails(user.ID, customerID, paymentMethodID)
+		if err != nil {
+			return user, err
+		}
+		user.PaymentCustomerID = customerID
+		user.PaymentMethodID = paymentMethodID
+	}
+
+	return user, nil
+}
+
+// refundCharge gives the user back the whole of a charge they paid for something they did not get.
+// There is nothing to refund for a nil charge.
+func (app *Config) refundCharge(r *http.Request, charge *Charge, note string) {
+	if charge == nil {
+		return
+	}
+
+	if _, err := app.Payments.Refund(charge.ID, charge.Amount); err != nil {
+		app.ErrorLog.Printf("Error refunding charge %s: %v\n", charge.ID, err)
+		return
+	}
+
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditRefunded,
+		TargetType: db.AuditTargetCharge,
+		TargetID:   charge.ID,
+		Note:       note,
+		Changes:    map[string]db.AuditChange{"refunded": {From: 0, To: db.FormatMoney(charge.Amount, charge.Currency, db.DefaultLocale)}},
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func TestFakeGateway_Charge(t *testing.T) {
+	gateway := NewFakeGateway()
+
+	customerID, err := gateway.CreateCustomer(db.User{ID: 1, Email: "test@example.com"})
+	if err != nil {
+		t.Fatal("error creating customer: ", err)
+	}
+
+	var tests = []struct {
+		name          string
+		paymentMethod string
+		expectedErr   error
+	}{
+		{"successful charge", FakeCardSuccess, nil},
+		{"declined card", FakeCardDeclined, ErrCardDeclined},
+		{"provider timeout", FakeCardTimeout, ErrPaymentTimeout},
+	}
+
+	for _, e := range tests {
+		paymentMethodID, err := gateway.AttachPaymentMethod(customerID, e.paymentMethod)
+		if err != nil {
+			t.Fatalf("%s: error attaching payment method: %v", e.name, err)
+		}
+
+		charge, err := gateway.Charge(ChargeRequest{
+			CustomerID:      customerID,
+			PaymentMethodID: paymentMethodID,
+			Amount:          1000,
+		})
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+		if e.expectedErr == nil && (charge == nil || charge.Amount != 1000) {
+			t.Errorf("%s: expected a charge for 1000, got %+v", e.name, charge)
+		}
+	}
+
+	if _, err := gateway.AttachPaymentMethod(customerID, "pm_not_a_test_card"); err == nil {
+		t.Error("expected an error attaching an unknown payment method")
+	}
+}
+
+func TestFakeGateway_ChargeIdempotency(t *testing.T) {
+	gateway := NewFakeGateway()
+
+	req := ChargeRequest{
+		CustomerID:      "cus_test",
+		PaymentMethodID: FakeCardSuccess,
+		Amount:          2000,
+		IdempotencyKey:  "same-key",
+	}
+
+	first, _ := gateway.Charge(req)
+	second, _ := gateway.Charge(req)
+	if first.ID != second.ID {
+		t.Errorf("expected a repeated request to return charge %s, got %s", first.ID, second.ID)
+	}
+
+	req.IdempotencyKey = "other-key"
+	third, _ := gateway.Charge(req)
+	if third.ID == first.ID {
+		t.Error("expected a new charge for a new idempotency key")
+	}
+}
+
+func TestFakeGateway_Refund(t *testing.T) {
+	gateway := NewFakeGateway()
+
+	charge, _ := gateway.Charge(ChargeRequest{
+		CustomerID:      "cus_test",
+		PaymentMethodID: FakeCardSuccess,
+		Amount:          3000,
+	})
+
+	if _, err := gateway.Refund(charge.ID, 1000); err != nil {
+		t.Error("unexpected error for a partial refund: ", err)
+	}
+	if _, err := gateway.Refund(charge.ID, 2500); !errors.Is(err, ErrRefundExceedsCharge) {
+		t.Errorf("expected %v refunding more than is left, got %v", ErrRefundExceedsCharge, err)
+	}
+	if _, err := gateway.Refund(charge.ID, 2000); err != nil {
+		t.Error("unexpected error refunding the rest of the charge: ", err)
+	}
+	if _, err := gateway.Refund("ch_unknown", 100); !errors.Is(err, ErrUnknownCharge) {
+		t.Errorf("expected %v for an unknown charge, got %v", ErrUnknownCharge, err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+const emailChangeExpiry = 60 // minutes until an email change link expires
+
+// Protected route
+// Shows the user's name and email address, with forms to change them
+func (app *Config) GETProfilePage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get your profile")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "profile.page.gohtml", &TemplateData{
+		Data: map[string]any{"user": user},
+	})
+}
+
+// Protected route
+// Saves the user's name
+func (app *Config) POSTProfilePage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	firstName, lastName, err := nameFromForm(r.PostForm)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save your profile")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	user.FirstName = firstName
+	user.LastName = lastName
+
+	err = app.Models.User.Update(*user)
+	if err != nil {
+		app.ErrorLog.Println("Error updating user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to save your profile")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+	app.refreshSessionUser(r, user.ID)
+
+	app.Session.Put(r.Context(), "flash", "Profile saved")
+	http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+}
+
+// Protected route
+// Starts changing the user's email address. The new address gets a link to confirm it, and the
+// address is only changed once the link is followed. The old address is told about the change.
+func (app *Config) POSTChangeEmail(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	email, err := emailFromForm(r.PostForm)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to change your email address")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	if email == user.Email {
+		app.Session.Put(r.Context(), "error", "That is already your email address")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	// whether another user has the address is only checked once the link is followed, so this
+	// form cannot be used to find out who has an account
+	confirmURL := fmt.Sprintf("%s/confirm-email?id=%d&email=%s&fp=%s", "http://localhost:8811", user.ID, url.QueryEscape(email), emailFingerprint(user)) // TODO - get this from environment variable
+	signedURL := GenerateTokenFromString(PurposeEmailChange, confirmURL)
+
+	app.sendEmail(Message{
+		To:       email,
+		Subject:  "Confirm your new email address",
+		Template: "email-change-email",
+		Data:     template.HTMLEscapeString(signedURL),
+	})
+
+	// let the user know, in case they did not make this change themselves
+	app.sendEmail(Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Data:    "Someone asked to change the email address of your account. It will change once the new address is confirmed. If this wasn't you, please reset your password and contact us immediately.",
+	})
+
+	app.InfoLog.Printf("Email change requested for user %d", user.ID)
+	app.Session.Put(r.Context(), "flash", "We sent a link to your new email address. Your email address will change once you follow it.")
+	http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+}
+
+// Sent to the new email address when a user changes theirs
+func (app *Config) GETConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	// the link may be opened on a device the user is not logged in on
+	done := "/login"
+	if app.IsAuthenticated(r) {
+		done = "/members/profile"
+	}
+
+	signedURL := fmt.Sprintf("%s%s", "http://localhost:8811", r.URL.RequestURI()) // TODO - get this from environment variable
+	user, email, ok := app.validEmailChangeLink(signedURL)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "Invalid or expired email confirmation link")
+		http.Redirect(w, r, done, http.StatusSeeOther)
+		return
+	}
+
+	if !app.consumeToken(signedURL, emailChangeExpiry*time.Minute) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired email confirmation link")
+		http.Redirect(w, r, done, http.StatusSeeOther)
+		return
+	}
+
+	err := app.Models.User.ChangeEmail(user.ID, email)
+	if errors.Is(err, db.ErrDuplicateEmail) {
+		app.Session.Put(r.Context(), "error", "Another account already uses that email address")
+		http.Redirect(w, r, done, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println("Error changing email address: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to change your email address")
+		http.Redirect(w, r, done, http.StatusSeeOther)
+		return
+	}
+	app.refreshSessionUser(r, user.ID)
+
+	app.SuccessLog.Printf("User %d changed their email address", user.ID)
+	app.audit(r, db.AuditEvent{
+		Action:     db.AuditEmailChanged,
+		ActorID:    user.ID,
+		TargetType: db.AuditTargetUser,
+		TargetID:   strconv.Itoa(user.ID),
+		Changes:    map[string]db.AuditChange{"email": {From: user.Email, To: email}},
+	})
+	app.Session.Put(r.Context(), "flash", "Your email address was changed")
+	http.Redirect(w, r, done, http.StatusSeeOther)
+}
+
+// validEmailChangeLink checks that an email change link was signed by us, has not expired, and
+// has not been used yet. It returns the user the link was issued for, and their new address.
+func (app *Config) validEmailChangeLink(signedURL string) (*db.User, string, bool) {
+	if !VerifyToken(PurposeEmailChange, signedURL) {
+		app.ErrorLog.Println("Invalid email change token")
+		return nil, "", false
+	}
+	if Expired(signedURL, emailChangeExpiry) {
+		app.ErrorLog.Println("Expired email change token")
+		return nil, "", false
+	}
+
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		app.ErrorLog.Println("Error parsing email change link: ", err)
+		return nil, "", false
+	}
+
+	userID, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		app.ErrorLog.Println("Invalid user id in email change link: ", err)
+		return nil, "", false
+	}
+
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		return nil, "", false
+	}
+
+	// once the email address has been changed, the fingerprint no longer matches and the link
+	// cannot be used again
+	if u.Query().Get("fp") != emailFingerprint(user) {
+		app.ErrorLog.Printf("Email change link for user %d has already been used", user.ID)
+		return nil, "", false
+	}
+
+	return user, db.NormalizeEmail(u.Query().Get("email")), true
+}
+
+// emailFingerprint returns a short digest of the user's current email address. It is put in email
+// change links, so that a link stops working once the address has been changed.
+func emailFingerprint(u *db.User) string {
+	sum := sha256.Sum256([]byte(u.Email))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sendEmailChangedNotice tells an old email address that it no longer belongs to an account
+func (app *Config) sendEmailChangedNotice(oldEmail string) {
+	app.sendEmail(Message{
+		To:      oldEmail,
+		Subject: "Your email address was changed",
+		Data:    "The email address of your account was changed, and this address will no longer receive emails about it. If you didn't expect this, please contact us immediately.",
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func Test_emailFromForm(t *testing.T) {
+	var tests = []struct {
+		name        string
+		email       string
+		expected    string
+		expectError bool
+	}{
+		{"valid", "jane@example.com", "jane@example.com", false},
+		{"normalized", " Jane.Doe@Example.COM ", "jane.doe@example.com", false},
+		{"invalid", "jane", "jane", true},
+		{"with a name", "Jane <jane@example.com>", "", true},
+		{"too long", strings.Repeat("a", maxNameLength) + "@example.com", "", true},
+	}
+
+	for _, e := range tests {
+		email, err := emailFromForm(url.Values{"email": {e.email}})
+		if (err != nil) != e.expectError {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectError, err)
+		}
+		if !e.expectError && email != e.expected {
+			t.Errorf("%s: expected %q, got %q", e.name, e.expected, email)
+		}
+	}
+}
+
+// catchMail gives a copy of testApp a mailer of its own, and returns the channel the messages it
+// sends arrive on
+func catchMail(app *Config) chan Message {
+	app.Wait = &sync.WaitGroup{}
+	app.Mailer = Mail{MailerChan: make(chan Message, 10)}
+	return app.Mailer.MailerChan
+}
+
+func TestConfig_POSTChangeEmail(t *testing.T) {
+	var tests = []struct {
+		name          string
+		email         string
+		expectedFlash bool
+		expectedTo    []string
+	}{
+		{"invalid email", "nope", false, nil},
+		{"same email", " TEST@example.com", false, nil},
+		{"new email", "New@Example.com", true, []string{"new@example.com", "test@example.com"}},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		mail := catchMail(&app)
+
+		req, _ := http.NewRequest("POST", "/members/profile/email", strings.NewReader(url.Values{"email": {e.email}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		app.Session.Put(ctx, "userID", 1)
+
+		http.HandlerFunc(app.POSTChangeEmail).ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != "/members/profile" {
+			t.Errorf("%s: expected redirect to /members/profile, got %s", e.name, location)
+		}
+		if app.Session.Exists(ctx, "flash") != e.expectedFlash {
+			t.Errorf("%s: expected a flash message to be %t", e.name, e.expectedFlash)
+		}
+
+		close(mail)
+		var to []string
+		for msg := range mail {
+			to = append(to, msg.To)
+			if msg.To == "new@example.com" && !strings.Contains(msg.Data.(string), "/confirm-email?id=1&amp;email=new%40example.com") {
+				t.Errorf("%s: did not find the confirmation link in %q", e.name, msg.Data)
+			}
+		}
+		if fmt.Sprint(to) != fmt.Sprint(e.expectedTo) {
+			t.Errorf("%s: expected mail to %v, got %v", e.name, e.expectedTo, to)
+		}
+	}
+}
+
+func TestConfig_GETConfirmEmail(t *testing.T) {
+	user, _ := testApp.Models.User.GetOne(1)
+	link := func(email, fingerprint string) string {
+		return fmt.Sprintf("http://localhost:8811/confirm-email?id=1&email=%s&fp=%s", url.QueryEscape(email), fingerprint)
+	}
+
+	var tests = []struct {
+		name             string
+		url              string
+		loggedIn         bool
+		expectedLocation string
+		expectedFlash    bool
+	}{
+		{"valid link", GenerateTokenFromString(PurposeEmailChange, link("new@example.com", emailFingerprint(user))), false, "/login", true},
+		{"valid link, logged in", GenerateTokenFromString(PurposeEmailChange, link("new@example.com", emailFingerprint(user))), true, "/members/profile", true},
+		{"unsigned link", link("new@example.com", emailFingerprint(user)), false, "/login", false},
+		{"tampered link", strings.Replace(GenerateTokenFromString(PurposeEmailChange, link("new@example.com", emailFingerprint(user))), "new%40", "evil%40", 1), false, "/login", false},
+		{"used link", GenerateTokenFromString(PurposeEmailChange, link("new@example.com", "0000000000000000")), false, "/login", false},
+		{"address in use", GenerateTokenFromString(PurposeEmailChange, link("admin@example.com", emailFingerprint(user))), false, "/login", false},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		app.Models.AuditEvent = &db.AuditEventTest{}
+		app.UsedTokens = NewMemoryTokenStore(time.Now)
+
+		req, _ := http.NewRequest("GET", strings.TrimPrefix(e.url, "http://localhost:8811"), nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		if e.loggedIn {
+			app.Session.Put(ctx, "userID", 1)
+		}
+
+		http.HandlerFunc(app.GETConfirmEmail).ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, location)
+		}
+		if app.Session.Exists(ctx, "flash") != e.expectedFlash {
+			t.Errorf("%s: expected a flash message to be %t", e.name, e.expectedFlash)
+		}
+
+		events, _ := app.Models.AuditEvent.Find(db.AuditFilter{Action: db.AuditEmailChanged}, 0, 0)
+		if (len(events) == 1) != e.expectedFlash {
+			t.Errorf("%s: expected the change to be audited to be %t", e.name, e.expectedFlash)
+		}
+		if len(events) == 1 && events[0].Changes["email"].To != "new@example.com" {
+			t.Errorf("%s: expected the new address to be audited, got %v", e.name, events[0].Changes)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// rateLimit is how many times something may be done in a window of time
+type rateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimiter counts how often something is done, e.g. sending an email to an address, so that it
+// cannot be done too often. The count starts again when the window of the first time runs out.
+type RateLimiter interface {
+	// Allow counts one more time under the key, and reports whether it is within the limit
+	Allow(key string, limit rateLimit) (bool, error)
+}
+
+// RedisRateLimiter is a RateLimiter that keeps its counts in Redis, so that they are shared by
+// every instance of the app
+type RedisRateLimiter struct {
+	Pool *redis.Pool
+}
+
+func (l *RedisRateLimiter) Allow(key string, limit rateLimit) (bool, error) {
+	conn := l.Pool.Get()
+	defer conn.Close()
+
+	count, err := redis.Int(conn.Do("INCR", "ratelimit:"+key))
+	if err != nil {
+		return false, err
+	}
+	if count == 1 {
+		_, err = conn.Do("PEXPIRE", "ratelimit:"+key, limit.Window.Milliseconds())
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return count <= limit.Limit, nil
+}
+
+// MemoryRateLimiter is an in-process RateLimiter for tests
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	counts  map[string]int
+	resetAt map[string]time.Time
+}
+
+func NewMemoryRateLimiter(now func() time.Time) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		now:     now,
+		counts:  make(map[string]int),
+		resetAt: make(map[string]time.Time),
+	}
+}
+
+func (l *MemoryRateLimiter) Allow(key string, limit rateLimit) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if !now.Before(l.resetAt[key]) {
+		l.counts[key] = 0
+		l.resetAt[key] = now.Add(limit.Window)
+	}
+	l.counts[key]++
+
+	return l.counts[key] <= limit.Limit, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewMemoryRateLimiter(func() time.Time { return now })
+	limit := rateLimit{Limit: 2, Window: time.Hour}
+
+	for i, expected := range []bool{true, true, false, false} {
+		if allowed, _ := limiter.Allow("a", limit); allowed != expected {
+			t.Errorf("time %d: expected allowed to be %t", i+1, expected)
+		}
+	}
+	if allowed, _ := limiter.Allow("b", limit); !allowed {
+		t.Error("expected another key to have a count of its own")
+	}
+
+	// the count starts again once the window runs out
+	now = now.Add(time.Hour)
+	if allowed, _ := limiter.Allow("a", limit); !allowed {
+		t.Error("expected the window to have run out")
+	}
+}
@@ -23,6 +23,7 @@ type TemplateData struct {
 	Authenticated bool
 	Now           time.Time
 	User          *db.User
+	PastDue       *db.Subscription // set on members pages while the user's subscription is past due
 }
 
 func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
@@ -63,6 +64,7 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 	td.Flash = app.Session.PopString(r.Context(), "flash")     // get the flash message from the session
 	td.Warning = app.Session.PopString(r.Context(), "warning") // get the warning message from the session
 	td.Error = app.Session.PopString(r.Context(), "error")     // get the error message from the session
+	td.CSRFToken = app.Session.GetString(r.Context(), "csrf_token")
 	if app.IsAuthenticated(r) {
 		td.Authenticated = true
 		// Get other user info and add it to the template data
@@ -73,6 +75,9 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 			td.User = &user
 		}
 	}
+	if subscription, ok := r.Context().Value(pastDueKey).(*db.Subscription); ok {
+		td.PastDue = subscription
+	}
 	td.Now = time.Now() // add the current time to the template data
 
 	return td
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
 )
 
 func TestConfig_AddDefaultData(t *testing.T) {
@@ -15,6 +20,7 @@ func TestConfig_AddDefaultData(t *testing.T) {
 	testApp.Session.Put(ctx, "flash", "flash message")
 	testApp.Session.Put(ctx, "warning", "warning message")
 	testApp.Session.Put(ctx, "error", "error message")
+	testApp.Session.Put(ctx, "csrf_token", "csrf token")
 
 	// construct a render template
 	td := testApp.AddDefaultData(&TemplateData{}, req)
@@ -29,6 +35,9 @@ func TestConfig_AddDefaultData(t *testing.T) {
 	if td.Error != "error message" {
 		t.Error("error value not set in template data")
 	}
+	if td.CSRFToken != "csrf token" {
+		t.Error("csrf token not set in template data")
+	}
 }
 
 func TestConfig_IsAuthenticated(t *testing.T) {
@@ -65,3 +74,27 @@ func TestConfig_render(t *testing.T) {
 		t.Errorf("expected status 200, got %d", res.Code)
 	}
 }
+
+func TestConfig_render_PastDueBanner(t *testing.T) {
+	nextRetry := time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC)
+	subscription := &db.Subscription{
+		Status:      db.SubscriptionPastDue,
+		NextRetryAt: &nextRetry,
+		Plan:        &db.Plan{PlanName: "Gold Plan"},
+	}
+
+	req, _ := http.NewRequest("GET", "/members/plans", nil) // build a request to test
+	ctx := getCtx(req)                                      // add session to request context
+	req = req.WithContext(context.WithValue(ctx, pastDueKey, subscription))
+
+	res := httptest.NewRecorder() // create a response recorder
+
+	testApp.render(res, req, "home.page.gohtml", &TemplateData{})
+
+	if !strings.Contains(res.Body.String(), "Your last payment for the Gold Plan plan failed.") {
+		t.Error("expected the past due banner")
+	}
+	if !strings.Contains(res.Body.String(), "March 4, 2024") {
+		t.Error("expected the past due banner to show the next retry date")
+	}
+}
@@ -13,18 +13,40 @@ func (app *Config) routes() http.Handler {
 
 	// set up middleware
 	mux.Use(middleware.Recoverer) // recover from panics
-	mux.Use(app.SessionLoad)      // load and save session data
 
-	// set up routes
-	mux.Get("/", app.GETHomePage)
-	mux.Get("/login", app.GETLoginPage)
-	mux.Post("/login", app.POSTLoginPage)
-	mux.Get("/logout", app.GETLogout)
-	mux.Get("/register", app.GETRegisterPage)
-	mux.Post("/register", app.POSTRegisterPage)
-	mux.Get("/activate-account", app.GETActivateAccount)
+	// webhooks come from the payment provider, not a browser: they have no session,
+	// and are authenticated by their signature rather than a CSRF token
+	mux.Post("/webhooks/payments", app.POSTPaymentWebhook)
 
-	mux.Mount("/members", app.authRouter())
+	mux.Group(func(mux chi.Router) {
+		// set up middleware
+		mux.Use(app.SessionLoad)  // load and save session data
+		mux.Use(app.CSRF)         // protect forms against cross-site request forgery
+		mux.Use(app.TrackSession) // remember the sessions of each user
+
+		// set up routes
+		mux.Get("/", app.GETHomePage)
+		mux.Get("/login", app.GETLoginPage)
+		mux.Post("/login", app.POSTLoginPage)
+		mux.Get("/login/two-factor", app.GETLoginTwoFactor)
+		mux.Post("/login/two-factor", app.POSTLoginTwoFactor)
+		mux.Get("/login/two-factor/setup", app.GETLoginTwoFactorSetup)
+		mux.Post("/login/two-factor/setup", app.POSTLoginTwoFactorSetup)
+		mux.Get("/logout", app.GETLogout)
+		mux.Get("/register", app.GETRegisterPage)
+		mux.Post("/register", app.POSTRegisterPage)
+		mux.Get("/activate-account", app.GETActivateAccount)
+		mux.Get("/activate-account/resend", app.GETResendActivationPage)
+		mux.Post("/activate-account/resend", app.POSTResendActivationPage)
+		mux.Get("/confirm-email", app.GETConfirmEmail)
+		mux.Get("/forgot-password", app.GETForgotPasswordPage)
+		mux.Post("/forgot-password", app.POSTForgotPasswordPage)
+		mux.Get("/reset-password", app.GETResetPasswordPage)
+		mux.Post("/reset-password", app.POSTResetPasswordPage)
+
+		mux.Mount("/members", app.authRouter())
+		mux.Mount("/admin", app.adminRouter())
+	})
 
 	return mux
 }
@@ -35,10 +57,55 @@ func (app *Config) authRouter() http.Handler {
 
 	// set up middleware
 	mux.Use(app.Auth)
+	mux.Use(app.PastDue)
 
 	// set up protected routes
 	mux.Get("/plans", app.GETSubscriptionPlans)
 	mux.Get("/subscribe", app.GETSubscribeToPlan)
+	mux.Post("/subscribe", app.POSTSubscribeToPlan)
+	mux.Get("/subscription", app.GETSubscriptionPage)
+	mux.Post("/subscription/cancel", app.POSTCancelSubscription)
+	mux.Post("/subscription/reactivate", app.POSTReactivateSubscription)
+	mux.Get("/billing", app.GETBillingPage)
+	mux.Post("/billing", app.POSTBillingPage)
+	mux.Get("/profile", app.GETProfilePage)
+	mux.Post("/profile", app.POSTProfilePage)
+	mux.Post("/profile/email", app.POSTChangeEmail)
+	mux.Get("/security", app.GETSecurityPage)
+	mux.Post("/security/revoke", app.POSTRevokeSession)
+	mux.Post("/security/logout-everywhere", app.POSTLogoutEverywhere)
+	mux.Get("/two-factor", app.GETTwoFactorPage)
+	mux.Post("/two-factor/enable", app.POSTEnableTwoFactor)
+	mux.Post("/two-factor/disable", app.POSTDisableTwoFactor)
+	mux.Post("/two-factor/recovery-codes", app.POSTRecoveryCodes)
+
+	return mux
+}
+
+func (app *Config) adminRouter() http.Handler {
+	// create a new chi router
+	mux := chi.NewRouter()
+
+	// set up middleware
+	mux.Use(app.Auth)
+	mux.Use(app.AdminOnly)
+
+	// set up admin routes
+	mux.Get("/users", app.GETAdminUsers)
+	mux.Get("/user", app.GETAdminUser)
+	mux.Post("/user", app.POSTAdminUser)
+	mux.Post("/user/deactivate", app.POSTAdminDeactivateUser)
+	mux.Post("/user/reactivate", app.POSTAdminReactivateUser)
+	mux.Post("/user/delete", app.POSTAdminDeleteUser)
+	mux.Get("/plans", app.GETAdminPlans)
+	mux.Post("/plans", app.POSTAdminPlans)
+	mux.Get("/plan", app.GETAdminPlan)
+	mux.Post("/plan", app.POSTAdminPlan)
+	mux.Post("/plan/prices", app.POSTAdminPlanPrices)
+	mux.Post("/plan/archive", app.POSTAdminArchivePlan)
+	mux.Post("/plan/restore", app.POSTAdminRestorePlan)
+	mux.Get("/audit", app.GETAdminAudit)
+	mux.Get("/audit/export", app.GETAdminAuditExport)
 
 	return mux
 }
@@ -11,11 +11,43 @@ var routes = []string{
 	// populate this slice with the routes from the routes.go file
 	"/",
 	"/login",
+	"/login/two-factor",
+	"/login/two-factor/setup",
 	"/logout",
 	"/register",
 	"/activate-account",
+	"/activate-account/resend",
+	"/confirm-email",
+	"/forgot-password",
+	"/reset-password",
 	"/members/plans",
 	"/members/subscribe",
+	"/members/subscription",
+	"/members/subscription/cancel",
+	"/members/subscription/reactivate",
+	"/members/billing",
+	"/members/profile",
+	"/members/profile/email",
+	"/members/security",
+	"/members/security/revoke",
+	"/members/security/logout-everywhere",
+	"/members/two-factor",
+	"/members/two-factor/enable",
+	"/members/two-factor/disable",
+	"/members/two-factor/recovery-codes",
+	"/admin/users",
+	"/admin/user",
+	"/admin/user/deactivate",
+	"/admin/user/reactivate",
+	"/admin/user/delete",
+	"/admin/plans",
+	"/admin/plan",
+	"/admin/plan/prices",
+	"/admin/plan/archive",
+	"/admin/plan/restore",
+	"/admin/audit",
+	"/admin/audit/export",
+	"/webhooks/payments",
 }
 
 func Test_Routes_Exist(t *testing.T) {
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// renewalLockKey identifies the advisory lock held while renewals run. Every instance of the app
+// uses the same key, so only one of them renews subscriptions at a time.
+const renewalLockKey int64 = 7_200_001
+
+// listenForRenewals renews subscriptions on every tick of app.RenewalInterval, until told to stop on
+// app.RenewalDone. A run that is under way is finished before the stop signal is picked up.
+func (app *Config) listenForRenewals() {
+	ticker := time.NewTicker(app.RenewalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			app.runRenewals(now)
+		case <-app.RenewalDone:
+			return
+		}
+	}
+}
+
+// runRenewals renews every subscription whose period ended by now, converts trials that have ended,
+// retries the payments of past due subscriptions, and processes again the webhook events that
+// failed, provided no other instance of the app is already doing so
+func (app *Config) runRenewals(now time.Time) {
+	release, acquired, err := app.Models.Lock.TryAcquire(renewalLockKey)
+	if err != nil {
+		app.ErrorChan <- fmt.Errorf("error acquiring renewal lock: %v", err)
+		return
+	}
+	if !acquired {
+		app.InfoLog.Println("Renewals are being run by another instance")
+		return
+	}
+	defer release()
+
+	app.sendTrialReminders(now)
+
+	subscriptions, err := app.Models.Subscription.GetDueForRenewal(now)
+	if err != nil {
+		app.ErrorChan <- fmt.Errorf("error getting subscriptions due for renewal: %v", err)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		err := app.renewSubscription(subscription)
+		if err != nil {
+			app.ErrorChan <- fmt.Errorf("error renewing subscription %d: %v", subscription.ID, err)
+		}
+	}
+
+	app.retryPastDuePayments(now)
+	app.reprocessWebhookEvents(now)
+}
+
+// renewSubscription charges the user for the next period of their subscription and invoices them.
+// A trial that has ended is converted to a paid subscription the same way.
+// If the payment fails, the invoice is left open and the subscription goes into dunning.
+func (app *Config) renewSubscription(subscription *db.Subscription) error {
+	// a subscription the user canceled runs out instead of renewing
+	if subscription.CancelAtPeriodEnd {
+		return app.Models.Subscription.UpdateStatus(subscription.ID, db.SubscriptionExpired, "Canceled at the end of the period")
+	}
+
+	user, err := app.Models.User.GetOne(subscription.UserID)
+	if err != nil {
+		return err
+	}
+
+	// a downgrade scheduled by the user takes effect now, and the new plan is renewed instead
+	if subscription.ScheduledPlanID > 0 {
+		plan, err := app.Models.Plan.GetOne(subscription.ScheduledPlanID)
+		if err != nil {
+			return err
+		}
+
+		// the user keeps paying in the currency of their subscription
+		plan, err = plan.InCurrency(subscription.Plan.Currency)
+		if err != nil {
+			return err
+		}
+
+		subscriptionID, err := app.Models.Subscription.ChangePlan(subscription.ID, *plan, "Scheduled plan change")
+		if err != nil {
+			return err
+		}
+		app.audit(nil, db.AuditEvent{
+			Action:     db.AuditPlanChanged,
+			TargetType: db.AuditTargetSubscription,
+			TargetID:   strconv.Itoa(subscriptionID),
+			Note:       fmt.Sprintf("Scheduled change of subscription %d", subscription.ID),
+			Changes:    map[string]db.AuditChange{"plan_id": {From: subscription.PlanID, To: plan.ID}},
+		})
+
+		subscription, err = app.Models.Subscription.GetOne(subscriptionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a renewal that is run again, e.g. after a crash, finds the invoice it already issued for the
+	// period, so the period is never invoiced twice
+	invoice, err := app.Models.Invoice.GetForPeriod(subscription.ID, subscription.CurrentPeriodEnd)
+	if errors.Is(err, sql.ErrNoRows) {
+		invoice, err = app.issueRenewalInvoice(*user, subscription)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch invoice.Status {
+	case db.InvoiceVoid:
+		return fmt.Errorf("invoice %d for the period was voided", invoice.ID)
+	case db.InvoiceOpen:
+		// the key is fixed for each period, so a renewal that is retried after a crash is not charged twice.
+		// An invoice discounted to nothing is not charged at all.
+		chargeID := ""
+		if invoice.Total > 0 {
+			charge, err := app.Payments.Charge(ChargeRequest{
+				CustomerID:      user.PaymentCustomerID,
+				PaymentMethodID: user.PaymentMethodID,
+				Amount:          invoice.Total,
+				Currency:        invoice.Currency,
+				Description:     fmt.Sprintf("%s subscription renewal", subscription.Plan.PlanName),
+				IdempotencyKey:  fmt.Sprintf("renewal-%d-%d", subscription.ID, subscription.CurrentPeriodEnd.Unix()),
+			})
+			if err != nil {
+				app.ErrorLog.Printf("Renewal payment for subscription %d failed: %v\n", subscription.ID, err)
+				return app.startDunning(subscription, invoice.ID, "Renewal payment failed")
+			}
+			chargeID = charge.ID
+		}
+
+		err = app.Models.Invoice.MarkPaid(invoice.ID, chargeID)
+		if err != nil {
+			return fmt.Errorf("error marking invoice %d as paid: %v", invoice.ID, err)
+		}
+	}
+
+	err = app.Models.Subscription.AdvancePeriod(subscription.ID, subscription.NextPeriodEnd())
+	if err != nil {
+		return err
+	}
+
+	if subscription.Status == db.SubscriptionTrialing {
+		err = app.Models.Subscription.UpdateStatus(subscription.ID, db.SubscriptionActive, "Trial converted")
+		if err != nil {
+			return err
+		}
+	}
+
+	app.sendInvoiceEmail(*user, invoice.ID)
+
+	return nil
+}
+
+// issueRenewalInvoice saves the invoice for the period of a subscription that starts when the
+// current one ends, with the subscription's coupon applied
+func (app *Config) issueRenewalInvoice(user db.User, subscription *db.Subscription) (*db.Invoice, error) {
+	invoice, err := app.GenerateInvoice(user, subscription.Plan)
+	if err != nil {
+		return nil, err
+	}
+	invoice.SubscriptionID = subscription.ID
+	periodStart := subscription.CurrentPeriodEnd
+	invoice.PeriodStart = &periodStart
+
+	coupon, err := app.subscriptionCoupon(subscription)
+	if err != nil {
+		return nil, fmt.Errorf("error getting coupon: %v", err)
+	}
+	if coupon != nil {
+		applyDiscount(invoice, coupon)
+	}
+
+	invoice.ID, err = app.Models.Invoice.Insert(*invoice)
+	if err != nil {
+		return nil, fmt.Errorf("error saving invoice: %v", err)
+	}
+	invoice.Status = db.InvoiceOpen
+
+	// the discount is used up by issuing the invoice, whether or not it is paid straight away
+	if coupon != nil {
+		err = app.Models.Subscription.UseCouponPeriod(subscription.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error using coupon period: %v", err)
+		}
+	}
+
+	return invoice, nil
+}
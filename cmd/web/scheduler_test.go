@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func TestConfig_runRenewals(t *testing.T) {
+	gateway := NewFakeGateway()
+	payments := testApp.Payments
+	testApp.Payments = gateway
+	defer func() { testApp.Payments = payments }()
+
+	now := time.Now()
+
+	// running twice at the same time must only charge the renewal and the payment retry once
+	testApp.runRenewals(now)
+	testApp.runRenewals(now)
+	testApp.Wait.Wait()
+
+	if len(gateway.charges) != 2 {
+		t.Errorf("expected a renewal charge and a retry charge, got %d charges", len(gateway.charges))
+	}
+
+	// another instance holds the lock, so nothing should be renewed here
+	lock := testApp.Models.Lock.(*db.LockTest)
+	lock.Held = true
+	defer func() { lock.Held = false }()
+
+	testApp.runRenewals(now.Add(time.Hour))
+	testApp.Wait.Wait()
+
+	if len(gateway.charges) != 2 {
+		t.Errorf("expected no charges while the lock is held elsewhere, got %d", len(gateway.charges)-2)
+	}
+}
+
+func TestConfig_renewSubscription_RunAgain(t *testing.T) {
+	app := testApp
+	gateway := NewFakeGateway()
+	app.Payments = gateway
+	invoices := &db.InvoiceTest{}
+	app.Models.Invoice = invoices
+
+	subscription, _ := app.Models.Subscription.GetOne(1)
+
+	// the subscription test model does not advance the period, as if the app crashed before it could
+	for i := 0; i < 2; i++ {
+		if err := app.renewSubscription(subscription); err != nil {
+			t.Fatalf("renewal %d: %v", i+1, err)
+		}
+	}
+	app.Wait.Wait()
+
+	renewals := invoices.Renewals()
+	if len(renewals) != 1 {
+		t.Fatalf("expected the period to be invoiced once, got %d invoices", len(renewals))
+	}
+	if !renewals[0].PeriodStart.Equal(subscription.CurrentPeriodEnd) {
+		t.Errorf("expected the invoice to be for the period starting %s, got %s", subscription.CurrentPeriodEnd, renewals[0].PeriodStart)
+	}
+	if renewals[0].Status != db.InvoicePaid {
+		t.Errorf("expected the invoice to be paid, got %s", renewals[0].Status)
+	}
+	if len(gateway.charges) != 1 {
+		t.Errorf("expected the period to be charged once, got %d charges", len(gateway.charges))
+	}
+}
+
+func TestConfig_listenForRenewals(t *testing.T) {
+	stopped := make(chan bool)
+
+	go func() {
+		testApp.listenForRenewals()
+		stopped <- true
+	}()
+
+	testApp.RenewalDone <- true
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("renewal scheduler did not stop")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// sessionView is a session as the security page shows it
+type sessionView struct {
+	ID        string // stands in for the token, which is never shown
+	Device    string
+	IPAddress string
+	CreatedAt time.Time
+	LastSeen  time.Time
+	Current   bool // the session the page was loaded with
+}
+
+// Protected route
+// Lists the sessions the user is logged in with, so they can end those they do not recognise
+func (app *Config) GETSecurityPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	sessions, err := app.userSessions(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting sessions: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get your sessions")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	current := app.Session.Token(r.Context())
+	views := make([]sessionView, 0, len(sessions))
+	for _, s := range sessions {
+		views = append(views, sessionView{
+			ID:        sessionID(s.Token),
+			Device:    describeDevice(s.UserAgent),
+			IPAddress: s.IPAddress,
+			CreatedAt: s.CreatedAt,
+			LastSeen:  s.LastSeen,
+			Current:   s.Token == current,
+		})
+	}
+
+	app.render(w, r, "security.page.gohtml", &TemplateData{
+		Data: map[string]any{"sessions": views},
+	})
+}
+
+// Protected route
+// Logs the user out of one of their other sessions
+func (app *Config) POSTRevokeSession(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	sessions, err := app.userSessions(userID)
+	if err != nil {
+		app.ErrorLog.Println("Error getting sessions: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to end the session")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	// only sessions of the user themselves can be found this way
+	token := ""
+	for _, s := range sessions {
+		if sessionID(s.Token) == r.PostForm.Get("session") {
+			token = s.Token
+		}
+	}
+	if token == "" {
+		app.Session.Put(r.Context(), "error", "That session has already ended")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+	if token == app.Session.Token(r.Context()) {
+		app.Session.Put(r.Context(), "error", "To end this session, log out")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	err = app.endSessions(userID, token)
+	if err != nil {
+		app.ErrorLog.Println("Error ending session: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to end the session")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, db.AuditEvent{Action: db.AuditSessionsRevoked, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(userID), Note: "1 session"})
+	app.Session.Put(r.Context(), "flash", "The session was logged out")
+	http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+}
+
+// Protected route
+// Logs the user out of every session, this one included
+func (app *Config) POSTLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	n, err := app.endOtherSessions(userID, app.Session.Token(r.Context()))
+	if err != nil {
+		app.ErrorLog.Println("Error ending sessions: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to log out of your other sessions")
+		http.Redirect(w, r, "/members/security", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, db.AuditEvent{Action: db.AuditSessionsRevoked, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(userID), Note: fmt.Sprintf("Logged out everywhere, %d other sessions", n)})
+
+	// and then this session, as GETLogout does
+	app.logOut(r)
+	app.Session.Put(r.Context(), "flash", "You have been logged out everywhere")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// logOut ends the session of the request
+func (app *Config) logOut(r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+	if userID > 0 {
+		err := app.SessionIndex.Remove(userID, app.Session.Token(r.Context()))
+		if err != nil {
+			app.ErrorLog.Println("Error removing session: ", err)
+		}
+	}
+
+	app.Session.Destroy(r.Context())
+	app.Session.RenewToken(r.Context())
+}
+
+// userSessions returns the sessions a user is logged in with, most recently used first. Sessions
+// that have expired, or were ended without going through the index, are dropped from the index.
+func (app *Config) userSessions(userID int) ([]SessionInfo, error) {
+	sessions, err := app.SessionIndex.List(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var live []SessionInfo
+	var ended []string
+	for _, s := range sessions {
+		_, found, err := app.Session.Store.Find(s.Token)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			live = append(live, s)
+		} else {
+			ended = append(ended, s.Token)
+		}
+	}
+
+	err = app.SessionIndex.Remove(userID, ended...)
+	if err != nil {
+		app.ErrorLog.Println("Error removing ended sessions: ", err)
+	}
+
+	sort.Slice(live, func(i, j int) bool { return live[i].LastSeen.After(live[j].LastSeen) })
+	return live, nil
+}
+
+// endSessions logs a user out of sessions, by token. The next request with one of them starts
+// a new, logged out, session.
+func (app *Config) endSessions(userID int, tokens ...string) error {
+	for _, token := range tokens {
+		err := app.Session.Store.Delete(token)
+		if err != nil {
+			return err
+		}
+	}
+	return app.SessionIndex.Remove(userID, tokens...)
+}
+
+// endOtherSessions logs a user out of every session but the one with the given token, and
+// returns how many sessions were ended
+func (app *Config) endOtherSessions(userID int, keep string) (int, error) {
+	sessions, err := app.SessionIndex.List(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var tokens []string
+	for _, s := range sessions {
+		if s.Token != keep {
+			tokens = append(tokens, s.Token)
+		}
+	}
+
+	return len(tokens), app.endSessions(userID, tokens...)
+}
+
+// sessionID returns what a session is known by on the security page. It is derived from the
+// token, but the token cannot be worked out from it.
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// describeDevice names the browser and operating system of a user agent, e.g. "Firefox on Windows"
+func describeDevice(userAgent string) string {
+	browser := "Unknown browser"
+	// most browsers claim to be several others, so the most specific ones are checked first
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	system := "an unknown device"
+	switch {
+	case strings.Contains(userAgent, "iPhone"):
+		system = "iPhone"
+	case strings.Contains(userAgent, "iPad"):
+		system = "iPad"
+	case strings.Contains(userAgent, "Android"):
+		system = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		system = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		system = "Linux"
+	}
+
+	return browser + " on " + system
+}
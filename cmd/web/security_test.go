@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_describeDevice(t *testing.T) {
+	var tests = []struct {
+		userAgent string
+		expected  string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0", "Firefox on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15", "Safari on macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1", "Safari on iPhone"},
+		{"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0", "Edge on Windows"},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36", "Chrome on Linux"},
+		{"curl/8.5.0", "Unknown browser on an unknown device"},
+		{"", "Unknown browser on an unknown device"},
+	}
+
+	for _, e := range tests {
+		if got := describeDevice(e.userAgent); got != e.expected {
+			t.Errorf("%q: expected %q, got %q", e.userAgent, e.expected, got)
+		}
+	}
+}
+
+func Test_sessionID(t *testing.T) {
+	token := "abcdefghijklmnopqrstuvwxyz012345"
+
+	if sessionID(token) != sessionID(token) {
+		t.Error("the same token gave different ids")
+	}
+	if sessionID(token) == sessionID(token+"6") {
+		t.Error("different tokens gave the same id")
+	}
+	if strings.Contains(token, sessionID(token)) || strings.Contains(sessionID(token), token) {
+		t.Error("the id gives away the token")
+	}
+}
+
+// loggedInSession stores a session in which the user is logged in, as if they had logged in from
+// a browser, and returns its context and token
+func loggedInSession(t *testing.T, app Config, userID int, userAgent string) (context.Context, string) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	ctx := getCtx(req)
+
+	app.Session.Put(ctx, "userID", userID)
+	token, _, err := app.Session.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.SessionIndex.Touch(userID, SessionInfo{Token: token, UserAgent: userAgent, IPAddress: "192.0.2.1", CreatedAt: time.Now(), LastSeen: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx, token
+}
+
+func TestConfig_TrackSession(t *testing.T) {
+	app := testApp
+	app.SessionIndex = NewMemorySessionIndex()
+
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0")
+	req.RemoteAddr = "192.0.2.7:51234"
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	// a handler that logs user 1 in, as POSTLoginPage does
+	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.Session.RenewToken(r.Context())
+		app.Session.Put(r.Context(), "userID", 1)
+	})
+	app.TrackSession(login).ServeHTTP(res, req)
+
+	sessions, _ := app.SessionIndex.List(1)
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].Token != app.Session.Token(ctx) {
+		t.Error("did not record the token the user was logged in with")
+	}
+	if sessions[0].IPAddress != "192.0.2.7" || describeDevice(sessions[0].UserAgent) != "Firefox on Linux" {
+		t.Errorf("did not record where the session is used from: %+v", sessions[0])
+	}
+
+	// requests of users who are not logged in are not recorded
+	req, _ = http.NewRequest("GET", "/", nil)
+	req = req.WithContext(getCtx(req))
+	app.TrackSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+
+	if sessions, _ := app.SessionIndex.List(0); len(sessions) != 0 {
+		t.Errorf("recorded %d sessions of nobody", len(sessions))
+	}
+}
+
+func TestConfig_GETSecurityPage(t *testing.T) {
+	app := testApp
+	app.SessionIndex = NewMemorySessionIndex()
+
+	ctx, _ := loggedInSession(t, app, 1, "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0")
+	loggedInSession(t, app, 1, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) Version/17.4 Mobile/15E148 Safari/604.1")
+	// a session that has since expired
+	_ = app.SessionIndex.Touch(1, SessionInfo{Token: "expired-token", UserAgent: "Opera", CreatedAt: time.Now(), LastSeen: time.Now()})
+
+	req, _ := http.NewRequest("GET", "/members/security", nil)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	http.HandlerFunc(app.GETSecurityPage).ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.Code)
+	}
+	for _, expected := range []string{"Firefox on Windows", "Safari on iPhone", "This device", "192.0.2.1"} {
+		if !strings.Contains(res.Body.String(), expected) {
+			t.Errorf("did not find %q", expected)
+		}
+	}
+	if strings.Contains(res.Body.String(), app.Session.Token(ctx)) {
+		t.Error("the page gives away the session token")
+	}
+	if sessions, _ := app.SessionIndex.List(1); len(sessions) != 2 {
+		t.Errorf("expected the expired session to be dropped, %d sessions left", len(sessions))
+	}
+}
+
+func TestConfig_POSTRevokeSession(t *testing.T) {
+	app := testApp
+	app.SessionIndex = NewMemorySessionIndex()
+
+	ctx, current := loggedInSession(t, app, 1, "Firefox")
+	_, other := loggedInSession(t, app, 1, "Safari")
+	_, someoneElse := loggedInSession(t, app, 2, "Chrome")
+
+	var tests = []struct {
+		name          string
+		session       string
+		expectedFlash bool
+	}{
+		{"another user's session", sessionID(someoneElse), false},
+		{"this session", sessionID(current), false},
+		{"unknown session", "not-a-session", false},
+		{"other session", sessionID(other), true},
+		{"other session again", sessionID(other), false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/members/security/revoke", strings.NewReader(url.Values{"session": {e.session}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		http.HandlerFunc(app.POSTRevokeSession).ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != "/members/security" {
+			t.Errorf("%s: expected redirect to /members/security, got %s", e.name, location)
+		}
+		if flash := app.Session.PopString(ctx, "flash") != ""; flash != e.expectedFlash {
+			t.Errorf("%s: expected the session to be ended to be %t", e.name, e.expectedFlash)
+		}
+		app.Session.Remove(ctx, "error")
+	}
+
+	for token, expected := range map[string]bool{current: true, other: false, someoneElse: true} {
+		if _, found, _ := app.Session.Store.Find(token); found != expected {
+			t.Errorf("expected session %s to exist to be %t", sessionID(token), expected)
+		}
+	}
+}
+
+func TestConfig_POSTLogoutEverywhere(t *testing.T) {
+	app := testApp
+	app.SessionIndex = NewMemorySessionIndex()
+
+	ctx, current := loggedInSession(t, app, 1, "Firefox")
+	_, other := loggedInSession(t, app, 1, "Safari")
+	_, someoneElse := loggedInSession(t, app, 2, "Chrome")
+
+	req, _ := http.NewRequest("POST", "/members/security/logout-everywhere", nil)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	http.HandlerFunc(app.POSTLogoutEverywhere).ServeHTTP(res, req)
+
+	if location := res.Header().Get("Location"); location != "/login" {
+		t.Errorf("expected redirect to /login, got %s", location)
+	}
+	if app.Session.Exists(ctx, "userID") {
+		t.Error("this session is still logged in")
+	}
+	for token, expected := range map[string]bool{current: false, other: false, someoneElse: true} {
+		if _, found, _ := app.Session.Store.Find(token); found != expected {
+			t.Errorf("expected session %s to exist to be %t", sessionID(token), expected)
+		}
+	}
+	if sessions, _ := app.SessionIndex.List(1); len(sessions) != 0 {
+		t.Errorf("expected no sessions left, got %d", len(sessions))
+	}
+}
+
+func TestConfig_POSTResetPasswordPage_EndsSessions(t *testing.T) {
+	app := testApp
+	app.SessionIndex = NewMemorySessionIndex()
+	app.UsedTokens = NewMemoryTokenStore(time.Now)
+
+	_, other := loggedInSession(t, app, 1, "Safari")
+
+	user, _ := app.Models.User.GetByEmail("test@example.com")
+	link := fmt.Sprintf("http://localhost:8811/reset-password?email=%s&fp=%s", user.Email, passwordFingerprint(user))
+
+	req, _ := http.NewRequest("POST", "/reset-password", strings.NewReader(url.Values{
+		"token":           {GenerateTokenFromString(PurposeReset, link)},
+		"password":        {"new-password"},
+		"verify-password": {"new-password"},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(getCtx(req))
+	res := httptest.NewRecorder()
+
+	http.HandlerFunc(app.POSTResetPasswordPage).ServeHTTP(res, req)
+
+	if location := res.Header().Get("Location"); location != "/login" {
+		t.Fatalf("expected redirect to /login, got %s", location)
+	}
+	if _, found, _ := app.Session.Store.Find(other); found {
+		t.Error("the session logged in with the old password was not ended")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// SessionInfo describes one of the sessions a user is logged in with
+type SessionInfo struct {
+	Token     string    `json:"token"`
+	UserAgent string    `json:"user_agent"`
+	IPAddress string    `json:"ip_address"`
+	CreatedAt time.Time `json:"created_at"` // when the user logged in
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// SessionIndex keeps track of the sessions each user is logged in with. The sessions themselves
+// are kept by the session manager, which cannot look them up by user.
+type SessionIndex interface {
+	// Touch records that a user just used a session. The session keeps the CreatedAt it was first
+	// recorded with.
+	Touch(userID int, session SessionInfo) error
+	// List returns the sessions recorded for a user, in no particular order. Sessions that have
+	// since expired may be among them.
+	List(userID int) ([]SessionInfo, error)
+	// Remove forgets sessions of a user, by token
+	Remove(userID int, tokens ...string) error
+}
+
+// RedisSessionIndex is a SessionIndex that keeps, next to the sessions in Redis, a hash of the
+// sessions of each user by token
+type RedisSessionIndex struct {
+	Pool     *redis.Pool
+	Lifetime time.Duration // of a session; a user's index is dropped once they have not used it for this long
+}
+
+func sessionIndexKey(userID int) string {
+	return "sessions:user:" + strconv.Itoa(userID)
+}
+
+func (s *RedisSessionIndex) Touch(userID int, session SessionInfo) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	key := sessionIndexKey(userID)
+
+	existing, err := redis.Bytes(conn.Do("HGET", key, session.Token))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if err == nil {
+		var recorded SessionInfo
+		if json.Unmarshal(existing, &recorded) == nil && !recorded.CreatedAt.IsZero() {
+			session.CreatedAt = recorded.CreatedAt
+		}
+	}
+
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", key, session.Token, value)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("PEXPIRE", key, s.Lifetime.Milliseconds())
+	return err
+}
+
+func (s *RedisSessionIndex) List(userID int) ([]SessionInfo, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("HVALS", sessionIndexKey(userID)))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []SessionInfo
+	for _, value := range values {
+		var session SessionInfo
+		err = json.Unmarshal(value, &session)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (s *RedisSessionIndex) Remove(userID int, tokens ...string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(sessionIndexKey(userID)).AddFlat(tokens)
+	_, err := conn.Do("HDEL", args...)
+	return err
+}
+
+// MemorySessionIndex is an in-process SessionIndex for tests
+type MemorySessionIndex struct {
+	mu       sync.Mutex
+	sessions map[int]map[string]SessionInfo
+}
+
+func NewMemorySessionIndex() *MemorySessionIndex {
+	return &MemorySessionIndex{sessions: make(map[int]map[string]SessionInfo)}
+}
+
+func (s *MemorySessionIndex) Touch(userID int, session SessionInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions[userID] == nil {
+		s.sessions[userID] = make(map[string]SessionInfo)
+	}
+	if recorded, ok := s.sessions[userID][session.Token]; ok {
+		session.CreatedAt = recorded.CreatedAt
+	}
+	s.sessions[userID][session.Token] = session
+	return nil
+}
+
+func (s *MemorySessionIndex) List(userID int) ([]SessionInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sessions []SessionInfo
+	for _, session := range s.sessions[userID] {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (s *MemorySessionIndex) Remove(userID int, tokens ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range tokens {
+		delete(s.sessions[userID], token)
+	}
+	return nil
+}
@@ -38,12 +38,26 @@ func TestMain(m *testing.M) {
 		Session:       session,
 		DB:            nil,             // do not connect to database for this test
 		Models:        db.TestNew(nil), // "database free" models
+		Payments:      NewFakeGateway(),
+		LoginThrottle: NewMemoryLoginThrottle(time.Now),
+		SessionIndex:  NewMemorySessionIndex(),
+		WebhookSecret: []byte("test-webhook-secret"),
+		TOTPKey:       []byte("test-totp-key-of-exactly-32-byte"),
+		SellerCountry: "US",
 		InfoLog:       log.New(os.Stdout, color.GreenString("[INFO\t] "), log.Ldate|log.Ltime),
 		SuccessLog:    log.New(os.Stdout, color.CyanString("[SUCCESS] "), log.Ldate|log.Ltime),
 		ErrorLog:      log.New(os.Stdout, color.RedString("[ERROR\t] "), log.Ldate|log.Ltime|log.Lshortfile),
 		Wait:          &sync.WaitGroup{},
 		ErrorChan:     make(chan error),
 		ErrorChanDone: make(chan bool),
+
+		RenewalInterval: time.Hour,
+		RenewalDone:     make(chan bool),
+		DunningSchedule: []int{1, 3, 7},
+
+		RateLimiter:      NewMemoryRateLimiter(time.Now),
+		UsedTokens:       NewMemoryTokenStore(time.Now),
+		ActivationExpiry: defaultActivationExpiry,
 	}
 
 	// create a dummy mailer
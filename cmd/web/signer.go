@@ -1,6 +1,10 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strings"
@@ -18,11 +22,29 @@ func NewURLSigner() {
 	secretKey = []byte(secret)
 }
 
-// GenerateTokenFromString generates a signed token
-func GenerateTokenFromString(data string) string {
+// TokenPurpose is what a signed link is for. The purpose is signed into the link, so that a link
+// made for one purpose cannot be used for another.
+type TokenPurpose string
+
+const (
+	PurposeActivate    TokenPurpose = "activate"
+	PurposeReset       TokenPurpose = "reset"
+	PurposeEmailChange TokenPurpose = "email-change"
+	PurposeDownload    TokenPurpose = "download"
+)
+
+// purposeKey derives the key that signs the links of a purpose from the secret
+func purposeKey(purpose TokenPurpose) []byte {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// GenerateTokenFromString generates a signed token for a purpose
+func GenerateTokenFromString(purpose TokenPurpose, data string) string {
 	var urlToSign string
 
-	s := goalone.New(secretKey, goalone.Timestamp)
+	s := goalone.New(purposeKey(purpose), goalone.Timestamp)
 	if strings.Contains(data, "?") {
 		urlToSign = fmt.Sprintf("%s&hash=", data) // append hash to existing query string
 	} else {
@@ -35,14 +57,14 @@ func GenerateTokenFromString(data string) string {
 	return token
 }
 
-// VerifyToken verifies a signed token
-func VerifyToken(token string) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
+// VerifyToken verifies a token was signed for the purpose
+func VerifyToken(purpose TokenPurpose, token string) bool {
+	s := goalone.New(purposeKey(purpose), goalone.Timestamp)
 	_, err := s.Unsign([]byte(token))
 
 	if err != nil {
-		// signature is not valid. Token was tampered with, forged, or maybe it's
-		// not even a token at all! Either way, it's not safe to use it.
+		// signature is not valid. Token was tampered with, forged, made for another purpose, or
+		// maybe it's not even a token at all! Either way, it's not safe to use it.
 		return false
 	}
 	// valid hash
@@ -58,3 +80,13 @@ func Expired(token string, minutesUntilExpire int) bool {
 	// time.Duration(seconds)*time.Second
 	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
 }
+
+// GenerateRandomToken returns a random, URL safe string made from n random bytes
+func GenerateRandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// the system's secure random number generator is broken, nothing sensible can be done
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
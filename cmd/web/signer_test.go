@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestVerifyToken(t *testing.T) {
+	token := GenerateTokenFromString(PurposeReset, "http://localhost:8811/reset-password?email=test%40example.com")
+
+	var tests = []struct {
+		name     string
+		purpose  TokenPurpose
+		token    string
+		expected bool
+	}{
+		{"same purpose", PurposeReset, token, true},
+		{"other purpose", PurposeActivate, token, false},
+		{"tampered", PurposeReset, token[:len(token)-1] + "x", false},
+		{"not a token", PurposeReset, "http://localhost:8811/reset-password", false},
+	}
+
+	for _, e := range tests {
+		if got := VerifyToken(e.purpose, e.token); got != e.expected {
+			t.Errorf("%s: expected %t, got %t", e.name, e.expected, got)
+		}
+	}
+}
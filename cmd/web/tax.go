@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"regexp"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// vatNumbers are the formats of the VAT numbers of EU countries, including the prefix they start with.
+// Greece uses EL rather than its country code.
+var vatNumbers = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^ATU\d{8}$`),
+	"BE": regexp.MustCompile(`^BE[01]\d{9}$`),
+	"BG": regexp.MustCompile(`^BG\d{9,10}$`),
+	"CY": regexp.MustCompile(`^CY\d{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^CZ\d{8,10}$`),
+	"DE": regexp.MustCompile(`^DE\d{9}$`),
+	"DK": regexp.MustCompile(`^DK\d{8}$`),
+	"EE": regexp.MustCompile(`^EE\d{9}$`),
+	"ES": regexp.MustCompile(`^ES[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^FI\d{8}$`),
+	"FR": regexp.MustCompile(`^FR[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"GR": regexp.MustCompile(`^EL\d{9}$`),
+	"HR": regexp.MustCompile(`^HR\d{11}$`),
+	"HU": regexp.MustCompile(`^HU\d{8}$`),
+	"IE": regexp.MustCompile(`^IE(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^IT\d{11}$`),
+	"LT": regexp.MustCompile(`^LT(\d{9}|\d{12})$`),
+	"LU": regexp.MustCompile(`^LU\d{8}$`),
+	"LV": regexp.MustCompile(`^LV\d{11}$`),
+	"MT": regexp.MustCompile(`^MT\d{8}$`),
+	"NL": regexp.MustCompile(`^NL\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^PL\d{10}$`),
+	"PT": regexp.MustCompile(`^PT\d{9}$`),
+	"RO": regexp.MustCompile(`^RO\d{2,10}$`),
+	"SE": regexp.MustCompile(`^SE\d{12}$`),
+	"SI": regexp.MustCompile(`^SI\d{8}$`),
+	"SK": regexp.MustCompile(`^SK\d{10}$`),
+}
+
+// validTaxID reports whether a tax ID has the format of the VAT numbers of a country. Only the format is
+// checked: the number is not looked up with VIES, so it may not belong to a registered business. Tax IDs
+// of countries without a known format are accepted as they are.
+func validTaxID(country, taxID string) bool {
+	format, ok := vatNumbers[country]
+	return !ok || format.MatchString(taxID)
+}
+
+// applyTax adds the taxes the user pays to an invoice, and works out its totals. The taxes are looked up
+// from the user's billing address; a user without one is not charged tax. Business customers with a valid
+// VAT number in another country than the seller are reverse charged where the rates allow it: they pay no
+// tax, and prices that include tax are charged without it.
+func (app *Config) applyTax(invoice *db.Invoice, u db.User) error {
+	invoice.TaxLines = nil
+	invoice.TaxInclusive = false
+	invoice.ReverseCharge = false
+
+	if u.BillingAddress.Country != "" {
+		rates, err := app.Models.TaxRate.GetForLocation(u.BillingAddress.Country, u.BillingAddress.Region)
+		if err != nil {
+			return err
+		}
+
+		if app.reverseCharged(rates, u) {
+			invoice.ReverseCharge = true
+
+			inclusive := 0
+			for _, rate := range rates {
+				if rate.Inclusive {
+					inclusive += rate.Rate
+				}
+			}
+			if inclusive > 0 {
+				for _, item := range invoice.LineItems {
+					item.UnitAmount = withoutTax(item.UnitAmount, inclusive)
+					item.Amount = withoutTax(item.Amount, inclusive)
+				}
+			}
+		} else {
+			for _, rate := range rates {
+				// the rates for one place should agree on whether prices include them
+				invoice.TaxInclusive = rate.Inclusive
+				invoice.TaxLines = append(invoice.TaxLines, &db.InvoiceTaxLine{
+					Name: rate.Name,
+					Rate: rate.Rate,
+				})
+			}
+		}
+	}
+
+	calculateTotals(invoice)
+
+	return nil
+}
+
+// reverseCharged reports whether a user is reverse charged the taxes of their billing address. Sales within
+// the seller's own country are never reverse charged.
+func (app *Config) reverseCharged(rates []*db.TaxRate, u db.User) bool {
+	if u.TaxID == "" || u.BillingAddress.Country == app.SellerCountry || !validTaxID(u.BillingAddress.Country, u.TaxID) {
+		return false
+	}
+	for _, rate := range rates {
+		if rate.ReverseCharge {
+			return true
+		}
+	}
+	return false
+}
+
+// taxOn returns the tax at a rate in thousandths of a percent on an amount, rounded to the nearest cent
+func taxOn(amount, rate int) int {
+	return int(math.Round(float64(amount) * float64(rate) / 100_000))
+}
+
+// withoutTax returns the net part of an amount that includes tax at a rate in thousandths of a percent
+func withoutTax(amount, rate int) int {
+	return int(math.Round(float64(amount) * 100_000 / float64(100_000+rate)))
+}
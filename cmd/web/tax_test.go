@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func TestConfig_applyTax(t *testing.T) {
+	plan := &db.Plan{ID: 1, PlanName: "Test Plan", PlanAmount: 1000}
+
+	var tests = []struct {
+		name          string
+		address       db.Address
+		taxID         string
+		expectedLines int
+		expectedTax   int
+		expectedTotal int
+	}{
+		{"no billing address", db.Address{}, "", 0, 0, 1000},
+		{"province with its own rate", db.Address{Country: "CA", Region: "ON"}, "", 1, 130, 1130},
+		{"province with two rates", db.Address{Country: "CA", Region: "QC"}, "", 2, 150, 1150},
+		{"rest of the country", db.Address{Country: "CA", Region: "AB"}, "", 1, 50, 1050},
+		{"country without tax", db.Address{Country: "US"}, "", 0, 0, 1000},
+		{"tax inclusive prices", db.Address{Country: "DE"}, "", 1, 160, 1000},
+		{"reverse charge", db.Address{Country: "DE"}, "DE123456789", 0, 0, 840},
+		{"invalid VAT number", db.Address{Country: "DE"}, "ANYTHING", 1, 160, 1000},
+		{"VAT number of another country", db.Address{Country: "DE"}, "FR12345678901", 1, 160, 1000},
+		{"tax ID where there is no reverse charge", db.Address{Country: "CA", Region: "ON"}, "CA123456", 1, 130, 1130},
+	}
+
+	for _, e := range tests {
+		user := db.User{ID: 1, BillingAddress: e.address, TaxID: e.taxID}
+		reverseCharged := e.expectedLines == 0 && e.taxID != ""
+
+		invoice, err := testApp.GenerateInvoice(user, plan)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", e.name, err)
+		}
+
+		if len(invoice.TaxLines) != e.expectedLines {
+			t.Errorf("%s: expected %d tax lines, got %d", e.name, e.expectedLines, len(invoice.TaxLines))
+		}
+		if invoice.Tax != e.expectedTax {
+			t.Errorf("%s: expected tax %d, got %d", e.name, e.expectedTax, invoice.Tax)
+		}
+		if invoice.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d, got %d", e.name, e.expectedTotal, invoice.Total)
+		}
+		if invoice.ReverseCharge != reverseCharged {
+			t.Errorf("%s: expected reverse charge to be %t", e.name, reverseCharged)
+		}
+	}
+}
+
+func TestConfig_applyTax_SellerCountry(t *testing.T) {
+	app := testApp
+	app.SellerCountry = "DE"
+
+	// a business in the seller's own country pays VAT like anyone else there
+	user := db.User{ID: 1, BillingAddress: db.Address{Country: "DE"}, TaxID: "DE123456789"}
+
+	invoice, err := app.GenerateInvoice(user, &db.Plan{ID: 1, PlanName: "Test Plan", PlanAmount: 1000})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if invoice.ReverseCharge || invoice.Tax != 160 || invoice.Total != 1000 {
+		t.Errorf("expected 160 VAT included in a total of 1000, got reverse charge %t, tax %d, total %d", invoice.ReverseCharge, invoice.Tax, invoice.Total)
+	}
+}
+
+func TestConfig_applyTax_AfterDiscount(t *testing.T) {
+	user := db.User{ID: 1, BillingAddress: db.Address{Country: "CA", Region: "ON"}}
+
+	invoice, _ := testApp.GenerateInvoice(user, &db.Plan{ID: 1, PlanName: "Test Plan", PlanAmount: 1000})
+	applyDiscount(invoice, &db.Coupon{Code: "SAVE20", DiscountType: db.CouponPercent, PercentOff: 20})
+
+	// tax is charged on the discounted price
+	if invoice.Subtotal != 800 || invoice.Tax != 104 || invoice.Total != 904 {
+		t.Errorf("expected 800 + 104 tax = 904, got %d + %d tax = %d", invoice.Subtotal, invoice.Tax, invoice.Total)
+	}
+}
+
+func Test_billingDetailsFromForm(t *testing.T) {
+	var tests = []struct {
+		name          string
+		form          url.Values
+		expectedError bool
+	}{
+		{"full address", url.Values{"line1": {"1 Main St"}, "city": {"Toronto"}, "region": {"on"}, "country": {"ca"}}, false},
+		{"no address", url.Values{}, false},
+		{"address without country", url.Values{"line1": {"1 Main St"}}, true},
+		{"tax ID without country", url.Values{"tax-id": {"DE123456789"}}, true},
+		{"VAT number", url.Values{"country": {"de"}, "tax-id": {"de 123 456 789"}}, false},
+		{"VAT number that is too short", url.Values{"country": {"DE"}, "tax-id": {"DE12345"}}, true},
+		{"VAT number without prefix", url.Values{"country": {"DE"}, "tax-id": {"123456789"}}, true},
+		{"Greek VAT number", url.Values{"country": {"GR"}, "tax-id": {"EL123456789"}}, false},
+		{"country name instead of code", url.Values{"country": {"Canada"}}, true},
+	}
+
+	for _, e := range tests {
+		_, _, err := billingDetailsFromForm(e.form)
+		if (err != nil) != e.expectedError {
+			t.Errorf("%s: expected error %t, got %v", e.name, e.expectedError, err)
+		}
+	}
+
+	address, taxID, _ := billingDetailsFromForm(url.Values{"region": {" qc "}, "country": {"ca"}, "tax-id": {"ca 123 456"}})
+	if address.Region != "QC" || address.Country != "CA" || taxID != "CA123456" {
+		t.Errorf("expected codes in upper case, got %q, %q, %q", address.Region, address.Country, taxID)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// TokenStore remembers the signed links that have been used, so that a one-time link cannot be
+// used again. A link only has to be remembered until it expires, after which it is refused anyway.
+type TokenStore interface {
+	// Consume marks the token as used, and reports whether it had not been used before
+	Consume(token string, expiry time.Duration) (bool, error)
+}
+
+// RedisTokenStore is a TokenStore that keeps used tokens in Redis, so that a link used on one
+// instance of the app cannot be used on another
+type RedisTokenStore struct {
+	Pool *redis.Pool
+}
+
+func (s *RedisTokenStore) Consume(token string, expiry time.Duration) (bool, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	// SET NX only succeeds for the first use of the token
+	reply, err := conn.Do("SET", "token:used:"+tokenDigest(token), 1, "NX", "PX", expiry.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// MemoryTokenStore is an in-process TokenStore for tests
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	usedAt map[string]time.Time // when each token can be forgotten
+}
+
+func NewMemoryTokenStore(now func() time.Time) *MemoryTokenStore {
+	return &MemoryTokenStore{
+		now:    now,
+		usedAt: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryTokenStore) Consume(token string, expiry time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := tokenDigest(token)
+	if s.now().Before(s.usedAt[key]) {
+		return false, nil
+	}
+	s.usedAt[key] = s.now().Add(expiry)
+	return true, nil
+}
+
+// tokenDigest is what a used token is remembered by, so that the store does not hold working links
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// consumeToken marks a one-time link as used, and reports whether it may be used now. If the
+// store cannot be reached the link is refused, as it cannot be told apart from a replayed one.
+func (app *Config) consumeToken(token string, expiry time.Duration) bool {
+	ok, err := app.UsedTokens.Consume(token, expiry)
+	if err != nil {
+		app.ErrorLog.Println("Error checking whether a link has been used: ", err)
+		return false
+	}
+	if !ok {
+		app.ErrorLog.Println("Link has already been used")
+	}
+	return ok
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenStore(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryTokenStore(func() time.Time { return now })
+
+	if ok, _ := store.Consume("a", time.Hour); !ok {
+		t.Error("expected the first use of a token to be allowed")
+	}
+	if ok, _ := store.Consume("a", time.Hour); ok {
+		t.Error("expected a token to be refused the second time")
+	}
+	if ok, _ := store.Consume("b", time.Hour); !ok {
+		t.Error("expected another token to be allowed")
+	}
+
+	// the token is forgotten once it has expired
+	now = now.Add(time.Hour)
+	if ok, _ := store.Consume("a", time.Hour); !ok {
+		t.Error("expected an expired token to be forgotten")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// trialReminderDays is how many days before a trial converts the user is reminded that they will be charged
+const trialReminderDays = 3
+
+// trialEligible reports whether subscribing the user to the plan starts a free trial. Only new
+// subscribers get a trial, and only one per plan family.
+func (app *Config) trialEligible(userID int, plan *db.Plan, current *db.Subscription) (bool, error) {
+	if plan.TrialDays <= 0 || current != nil {
+		return false, nil
+	}
+
+	hadTrial, err := app.Models.Subscription.HasHadTrial(userID, plan.Family())
+	if err != nil {
+		return false, err
+	}
+
+	return !hadTrial, nil
+}
+
+// sendTrialReminders lets users know that their trial is about to end, and that they will be charged
+func (app *Config) sendTrialReminders(now time.Time) {
+	subscriptions, err := app.Models.Subscription.GetTrialsEndingBefore(now.AddDate(0, 0, trialReminderDays))
+	if err != nil {
+		app.ErrorChan <- fmt.Errorf("error getting trials that are ending: %v", err)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		user, err := app.Models.User.GetOne(subscription.UserID)
+		if err != nil {
+			app.ErrorChan <- fmt.Errorf("error getting user %d: %v", subscription.UserID, err)
+			continue
+		}
+
+		// record the reminder first; a missed reminder is better than a repeated one
+		err = app.Models.Subscription.MarkTrialReminderSent(subscription.ID)
+		if err != nil {
+			app.ErrorChan <- fmt.Errorf("error marking trial reminder for subscription %d: %v", subscription.ID, err)
+			continue
+		}
+		subscription.Plan.Localize(user.Locale)
+
+		app.sendEmail(Message{
+			To:       user.Email,
+			Subject:  "Your free trial is ending soon",
+			Template: "trial-reminder",
+			Data:     subscription,
+			DataMap: map[string]any{
+				"trialEnds": subscription.CurrentPeriodEnd.Format("January 2, 2006"),
+			},
+		})
+	}
+}
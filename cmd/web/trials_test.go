@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func TestConfig_trialEligible(t *testing.T) {
+	current, _ := testApp.Models.Subscription.GetCurrentForUser(1)
+
+	var tests = []struct {
+		name     string
+		plan     *db.Plan
+		current  *db.Subscription
+		expected bool
+	}{
+		{"new subscriber", &db.Plan{ID: 4, PlanName: "Trial Plan", TrialDays: 14}, nil, true},
+		{"plan without a trial", &db.Plan{ID: 1, PlanName: "Test Plan"}, nil, false},
+		{"existing subscriber", &db.Plan{ID: 4, PlanName: "Trial Plan", TrialDays: 14}, current, false},
+	}
+
+	for _, e := range tests {
+		eligible, err := testApp.trialEligible(2, e.plan, e.current)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", e.name, err)
+		}
+		if eligible != e.expected {
+			t.Errorf("%s: expected %t, got %t", e.name, e.expected, eligible)
+		}
+	}
+}
+
+func TestPlan_Family(t *testing.T) {
+	plan := db.Plan{PlanName: "Gold Plan"}
+	if plan.Family() != "Gold Plan" {
+		t.Errorf("expected a plan without a family to be its own family, got %q", plan.Family())
+	}
+
+	plan.PlanFamily = "Metal Plans"
+	if plan.Family() != "Metal Plans" {
+		t.Errorf("expected family %q, got %q", "Metal Plans", plan.Family())
+	}
+}
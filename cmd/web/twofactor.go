@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+const (
+	totpIssuer = "Subscription Service" // shown next to the account in the user's authenticator app
+	totpPeriod = 30                     // seconds each code is valid for
+	totpSkew   = 1                      // codes this many periods early or late are accepted, for clocks that drift
+
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10 // characters, not counting the dash in the middle
+
+	twoFactorLoginTimeout = 10 * time.Minute // to give the code after the password was accepted
+)
+
+var (
+	errWrongTwoFactorCode = errors.New("two-factor: wrong code")
+	errTwoFactorTimeout   = errors.New("two-factor: login timed out")
+
+	// recovery codes leave out letters and digits that are easily mistaken for each other
+	recoveryCodeEncoding = base32.NewEncoding("abcdefghjkmnpqrstuvwxyz23456789_").WithPadding(base32.NoPadding)
+)
+
+// Login route
+// Asks a user whose password was accepted for the code from their authenticator app
+func (app *Config) GETLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	if _, err := app.pendingTwoFactorUser(r); err != nil {
+		app.twoFactorLoginFailed(w, r, err)
+		return
+	}
+
+	app.render(w, r, "login-two-factor.page.gohtml", nil)
+}
+
+// Login route
+// Checks the code from the user's authenticator app, or one of their recovery codes, and logs them in
+func (app *Config) POSTLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	user, err := app.pendingTwoFactorUser(r)
+	if err != nil {
+		app.twoFactorLoginFailed(w, r, err)
+		return
+	}
+
+	// guessing codes is throttled the same way as guessing passwords
+	ip := clientIP(r)
+	lockout, err := app.LoginThrottle.Lockout(user.Email, ip)
+	if err != nil {
+		app.ErrorLog.Println("Error checking login lockout: ", err)
+	}
+	if lockout > 0 {
+		app.Session.Put(r.Context(), "error", lockoutMessage(lockout))
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	usedRecoveryCode, err := app.checkTwoFactorCode(user.ID, r.PostForm.Get("code"), time.Now())
+	if err != nil {
+		if !errors.Is(err, errWrongTwoFactorCode) {
+			app.ErrorLog.Println("Error checking two-factor code: ", err)
+		}
+		app.recordFailedLogin(user.Email, ip)
+		app.audit(r, db.AuditEvent{Action: db.AuditLoginFailed, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID), Note: "Wrong two-factor code"})
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.logIn(r, user, true)
+	app.Session.Put(r.Context(), "flash", "You've been logged in successfully")
+
+	if usedRecoveryCode {
+		left, err := app.Models.TwoFactor.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			app.ErrorLog.Println("Error counting recovery codes: ", err)
+		} else if left <= recoveryCodeCount/2 {
+			app.Session.Put(r.Context(), "warning", fmt.Sprintf("You logged in with a recovery code. You have %d left, so you may want to make new ones.", left))
+		}
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Login route
+// Admins must set up two-factor authentication before they can log in. Shows the QR code to add
+// to their authenticator app.
+func (app *Config) GETLoginTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	user, err := app.pendingTwoFactorUser(r)
+	if err != nil {
+		app.twoFactorLoginFailed(w, r, err)
+		return
+	}
+
+	app.renderTwoFactorSetup(w, r, user, "/login/two-factor/setup", "/login")
+}
+
+// Login route
+// Finishes setting up two-factor authentication for an admin, logs them in, and shows their recovery codes
+func (app *Config) POSTLoginTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	user, err := app.pendingTwoFactorUser(r)
+	if err != nil {
+		app.twoFactorLoginFailed(w, r, err)
+		return
+	}
+
+	codes, ok := app.enableTwoFactor(w, r, user, "/login/two-factor/setup")
+	if !ok {
+		return
+	}
+
+	app.logIn(r, user, true)
+	app.renderRecoveryCodes(w, r, codes, "Two-factor authentication is set up, and you are logged in.")
+}
+
+// Protected route
+// Shows whether the user has two-factor authentication. If they do not, shows the QR code to set it up.
+func (app *Config) GETTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("GET %s\n", r.URL.Path)
+
+	user, twoFactor, ok := app.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !twoFactor.Enabled() {
+		app.renderTwoFactorSetup(w, r, user, "/members/two-factor/enable", "/members/two-factor")
+		return
+	}
+
+	left, err := app.Models.TwoFactor.RecoveryCodesLeft(user.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error counting recovery codes: ", err)
+	}
+
+	app.render(w, r, "two-factor.page.gohtml", &TemplateData{
+		IntMap: map[string]int{"recoveryCodesLeft": left},
+		Data: map[string]any{
+			"twoFactor": twoFactor,
+			"isAdmin":   user.IsAdmin == 1,
+		},
+	})
+}
+
+// Protected route
+// Finishes setting up two-factor authentication, and shows the user their recovery codes
+func (app *Config) POSTEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	user, _, ok := app.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	codes, ok := app.enableTwoFactor(w, r, user, "/members/two-factor")
+	if !ok {
+		return
+	}
+
+	// the user has just shown they have their authenticator app
+	app.Session.Put(r.Context(), "twoFactor", true)
+	app.renderRecoveryCodes(w, r, codes, "Two-factor authentication is set up.")
+}
+
+// Protected route
+// Turns off two-factor authentication, once the user has given a code. Admins cannot turn it off.
+func (app *Config) POSTDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	user, twoFactor, ok := app.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.IsAdmin == 1 {
+		app.Session.Put(r.Context(), "error", "Administrators must keep two-factor authentication")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+	if !app.confirmTwoFactorCode(w, r, user, twoFactor) {
+		return
+	}
+
+	err := app.Models.TwoFactor.Disable(user.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error disabling two-factor authentication: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to turn off two-factor authentication")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Remove(r.Context(), "twoFactor")
+	app.audit(r, db.AuditEvent{Action: db.AuditTwoFactorDisabled, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID)})
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is turned off")
+	http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+}
+
+// Protected route
+// Replaces the user's recovery codes with new ones, once they have given a code
+func (app *Config) POSTRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	user, twoFactor, ok := app.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	if !app.confirmTwoFactorCode(w, r, user, twoFactor) {
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	err := app.Models.TwoFactor.ReplaceRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		app.ErrorLog.Println("Error replacing recovery codes: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to make new recovery codes")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, db.AuditEvent{Action: db.AuditRecoveryCodesReset, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID)})
+	app.renderRecoveryCodes(w, r, codes, "Your old recovery codes no longer work.")
+}
+
+// startTwoFactorLogin remembers, for a while, that the user gave the right password, so they can
+// give their code next. The user is not logged in until they do.
+func (app *Config) startTwoFactorLogin(r *http.Request, userID int) {
+	app.Session.Put(r.Context(), "twoFactorUserID", userID)
+	app.Session.Put(r.Context(), "twoFactorExpires", time.Now().Add(twoFactorLoginTimeout).Unix())
+}
+
+// pendingTwoFactorUser returns the user who gave the right password, and still has to give their code
+func (app *Config) pendingTwoFactorUser(r *http.Request) (*db.User, error) {
+	userID := app.Session.GetInt(r.Context(), "twoFactorUserID")
+	if userID == 0 {
+		return nil, errTwoFactorTimeout
+	}
+
+	if time.Now().Unix() > app.Session.GetInt64(r.Context(), "twoFactorExpires") {
+		app.Session.Remove(r.Context(), "twoFactorUserID")
+		app.Session.Remove(r.Context(), "twoFactorExpires")
+		return nil, errTwoFactorTimeout
+	}
+
+	return app.Models.User.GetOne(userID)
+}
+
+// twoFactorLoginFailed sends a user whose two-factor login cannot go on back to the login page
+func (app *Config) twoFactorLoginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errTwoFactorTimeout) {
+		app.Session.Put(r.Context(), "warning", "Please log in again.")
+	} else {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to log in")
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// logIn logs in a user whose password, and code if they use two-factor authentication, were accepted
+func (app *Config) logIn(r *http.Request, user *db.User, twoFactor bool) {
+	// amounts in the user's emails and invoices are formatted for the locale they last logged in with
+	if locale := requestLocale(r); locale != user.Locale {
+		err := app.Models.User.UpdateLocale(user.ID, locale)
+		if err != nil {
+			app.ErrorLog.Println("Error updating locale: ", err)
+		} else {
+			user.Locale = locale
+		}
+	}
+
+	err := app.LoginThrottle.Succeeded(user.Email)
+	if err != nil {
+		app.ErrorLog.Println("Error clearing failed logins: ", err)
+	}
+
+	// a new token for the new privileges
+	app.Session.RenewToken(r.Context())
+	app.Session.Remove(r.Context(), "twoFactorUserID")
+	app.Session.Remove(r.Context(), "twoFactorExpires")
+
+	app.Session.Put(r.Context(), "userID", user.ID) // store user ID in session
+	app.Session.Put(r.Context(), "user", *user)     // store user data in session
+	if twoFactor {
+		app.Session.Put(r.Context(), "twoFactor", true)
+	}
+
+	app.SuccessLog.Printf("User %d logged in", user.ID)
+	note := ""
+	if twoFactor {
+		note = "With two-factor authentication"
+	}
+	app.audit(r, db.AuditEvent{Action: db.AuditLoginSucceeded, ActorID: user.ID, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID), Note: note})
+}
+
+// twoFactorUser gets the logged in user and their two-factor authentication, which is nil if they
+// never set it up. If that fails, the user is redirected, and false is returned.
+func (app *Config) twoFactorUser(w http.ResponseWriter, r *http.Request) (*db.User, *db.TwoFactor, bool) {
+	user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println("Error getting user: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get user")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil, nil, false
+	}
+
+	twoFactor, err := app.Models.TwoFactor.GetForUser(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println("Error getting two-factor authentication: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to get your two-factor authentication")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil, nil, false
+	}
+
+	return user, twoFactor, true
+}
+
+// renderTwoFactorSetup shows the QR code for the user to add to their authenticator app, and a form
+// to post a code from the app to. The secret of an unfinished setup is reused, so reloading the
+// page does not invalidate what the user has scanned.
+func (app *Config) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, user *db.User, action, errorPage string) {
+	secret, err := app.twoFactorEnrollmentSecret(user.ID)
+	if err != nil {
+		app.ErrorLog.Println("Error starting two-factor enrollment: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to set up two-factor authentication")
+		http.Redirect(w, r, errorPage, http.StatusSeeOther)
+		return
+	}
+
+	qrCode, err := totpQRCode(secret, user.Email)
+	if err != nil {
+		app.ErrorLog.Println("Error generating QR code: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to set up two-factor authentication")
+		http.Redirect(w, r, errorPage, http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "two-factor-setup.page.gohtml", &TemplateData{
+		StringMap: map[string]string{
+			"action": action,
+			"qrCode": qrCode,
+			"secret": secret,
+		},
+	})
+}
+
+// twoFactorEnrollmentSecret returns the secret of the user's unfinished setup, or starts a new setup
+func (app *Config) twoFactorEnrollmentSecret(userID int) (string, error) {
+	twoFactor, err := app.Models.TwoFactor.GetForUser(userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if twoFactor.Enabled() {
+		return "", db.ErrTwoFactorEnabled
+	}
+	if twoFactor != nil {
+		return decryptSecret(app.TOTPKey, twoFactor.EncryptedSecret)
+	}
+
+	secret := newTOTPSecret()
+	encrypted, err := encryptSecret(app.TOTPKey, secret)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.Models.TwoFactor.StartEnrollment(userID, encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// enableTwoFactor checks the code the user gave from their authenticator app against the secret
+// they are setting up, and if it is right, turns on two-factor authentication and returns their
+// recovery codes. Otherwise the user is redirected to the setup page, and false is returned.
+func (app *Config) enableTwoFactor(w http.ResponseWriter, r *http.Request, user *db.User, setupPage string) ([]string, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, setupPage, http.StatusSeeOther)
+		return nil, false
+	}
+
+	twoFactor, err := app.Models.TwoFactor.GetForUser(user.ID)
+	if err != nil || twoFactor.Enabled() {
+		if err != nil {
+			app.ErrorLog.Println("Error getting two-factor enrollment: ", err)
+		}
+		app.Session.Put(r.Context(), "error", "Unable to set up two-factor authentication")
+		http.Redirect(w, r, setupPage, http.StatusSeeOther)
+		return nil, false
+	}
+
+	secret, err := decryptSecret(app.TOTPKey, twoFactor.EncryptedSecret)
+	if err != nil {
+		app.ErrorLog.Println("Error decrypting two-factor secret: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to set up two-factor authentication")
+		http.Redirect(w, r, setupPage, http.StatusSeeOther)
+		return nil, false
+	}
+
+	step, ok := matchTOTP(secret, r.PostForm.Get("code"), time.Now())
+	if !ok {
+		app.Session.Put(r.Context(), "error", "That code is not right. Please check the time on your device, and try the next code.")
+		http.Redirect(w, r, setupPage, http.StatusSeeOther)
+		return nil, false
+	}
+
+	codes, hashes := newRecoveryCodes()
+	err = app.Models.TwoFactor.Enable(user.ID, step, hashes)
+	if err != nil {
+		app.ErrorLog.Println("Error enabling two-factor authentication: ", err)
+		app.Session.Put(r.Context(), "error", "Unable to set up two-factor authentication")
+		http.Redirect(w, r, setupPage, http.StatusSeeOther)
+		return nil, false
+	}
+
+	app.audit(r, db.AuditEvent{Action: db.AuditTwoFactorEnabled, ActorID: user.ID, TargetType: db.AuditTargetUser, TargetID: strconv.Itoa(user.ID)})
+	return codes, true
+}
+
+// confirmTwoFactorCode checks the code posted with a form that changes the user's two-factor
+// authentication. If it is not right, the user is redirected, and false is returned.
+func (app *Config) confirmTwoFactorCode(w http.ResponseWriter, r *http.Request, user *db.User, twoFactor *db.TwoFactor) bool {
+	if !twoFactor.Enabled() {
+		app.Session.Put(r.Context(), "error", "You have not set up two-factor authentication")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return false
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println("Error parsing form: ", err)
+		app.Session.Put(r.Context(), "error", "Something went wrong. Please try again.")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return false
+	}
+
+	_, err = app.checkTwoFactorCode(user.ID, r.PostForm.Get("code"), time.Now())
+	if err != nil {
+		if !errors.Is(err, errWrongTwoFactorCode) {
+			app.ErrorLog.Println("Error checking two-factor code: ", err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return false
+	}
+
+	return true
+}
+
+// checkTwoFactorCode accepts a code from the user's authenticator app, or one of their recovery
+// codes, and uses it up. It reports whether a recovery code was used, and returns
+// errWrongTwoFactorCode if the code is not right, or was used before.
+func (app *Config) checkTwoFactorCode(userID int, code string, now time.Time) (bool, error) {
+	twoFactor, err := app.Models.TwoFactor.GetForUser(userID)
+	if err != nil {
+		return false, err
+	}
+	if !twoFactor.Enabled() {
+		return false, errWrongTwoFactorCode
+	}
+
+	secret, err := decryptSecret(app.TOTPKey, twoFactor.EncryptedSecret)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := matchTOTP(secret, code, now); ok {
+		// the same code cannot be used twice, e.g. by someone looking over the user's shoulder
+		fresh, err := app.Models.TwoFactor.UseStep(userID, step)
+		if err != nil {
+			return false, err
+		}
+		if !fresh {
+			return false, errWrongTwoFactorCode
+		}
+		return false, nil
+	}
+
+	used, err := app.Models.TwoFactor.UseRecoveryCode(userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	if !used {
+		return false, errWrongTwoFactorCode
+	}
+	return true, nil
+}
+
+// renderRecoveryCodes shows the user their new recovery codes. They are shown only this once,
+// and only their hashes are stored.
+func (app *Config) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string, flash string) {
+	app.Session.Put(r.Context(), "flash", flash)
+	app.render(w, r, "recovery-codes.page.gohtml", &TemplateData{
+		Data: map[string]any{"codes": codes},
+	})
+}
+
+// newTOTPSecret returns a random secret for an authenticator app, base32 encoded as the apps expect
+func newTOTPSecret() string {
+	b := make([]byte, 20) // 160 bits, as recommended for HMAC-SHA1 by RFC 4226
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// totpStep returns the TOTP time step of t: the number of periods since the Unix epoch
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode returns the code an authenticator app shows for the secret during a time step
+func totpCode(secret string, step int64) (string, error) {
+	return hotp.GenerateCodeCustom(secret, uint64(step), hotp.ValidateOpts{
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+}
+
+// matchTOTP returns the time step of the code, if it is right for the secret at any step within
+// totpSkew of now
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != otp.DigitsSix.Length() {
+		return 0, false
+	}
+
+	step := totpStep(now)
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		expected, err := totpCode(secret, s)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpQRCode returns the QR code an authenticator app scans to add the secret, as a data URL for an <img>
+func totpQRCode(secret, account string) (string, error) {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(otp.DigitsSix.Length()))
+	query.Set("period", strconv.Itoa(totpPeriod))
+
+	keyURL := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+
+	key, err := otp.NewKeyFromURL(keyURL.String())
+	if err != nil {
+		return "", err
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return "", err
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// newRecoveryCodes returns a set of recovery codes to show the user, e.g. "abcde-fghjk", and their
+// hashes to store
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeLength*5/8)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		code := recoveryCodeEncoding.EncodeToString(b)
+		code = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored as. Recovery codes are random and
+// long enough that a plain SHA-256 hash cannot be reversed. Case, spaces and dashes do not matter.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// encryptSecret encrypts a two-factor secret with AES-GCM, for storing
+func encryptSecret(key []byte, secret string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	// the nonce is stored in front of the ciphertext
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// decryptSecret decrypts a two-factor secret encrypted by encryptSecret
+func decryptSecret(key []byte, encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("two-factor: encrypted secret too short")
+	}
+
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// the secret of the test vectors in RFC 6238, "12345678901234567890", base32 encoded
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func Test_encryptSecret(t *testing.T) {
+	encrypted, err := encryptSecret(testApp.TOTPKey, rfcTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, rfcTOTPSecret) {
+		t.Error("the encrypted secret contains the secret")
+	}
+
+	secret, err := decryptSecret(testApp.TOTPKey, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != rfcTOTPSecret {
+		t.Errorf("expected %s, got %s", rfcTOTPSecret, secret)
+	}
+
+	if _, err := decryptSecret([]byte("another-key-of-exactly-32-bytes!"), encrypted); err == nil {
+		t.Error("decrypted the secret with the wrong key")
+	}
+
+	again, _ := encryptSecret(testApp.TOTPKey, rfcTOTPSecret)
+	if again == encrypted {
+		t.Error("the same secret encrypted twice gave the same result")
+	}
+}
+
+func Test_matchTOTP(t *testing.T) {
+	var tests = []struct {
+		name         string
+		now          int64 // Unix time
+		code         string
+		expectedStep int64
+		expectedOK   bool
+	}{
+		// from RFC 6238, the last 6 of the 8 digits
+		{"RFC 6238 at 59", 59, "287082", 1, true},
+		{"RFC 6238 at 1111111109", 1111111109, "081804", 37037036, true},
+		{"spaces", 59, " 287 082 ", 1, true},
+		{"one period late", 89, "287082", 1, true},
+		{"one period early", 29, "287082", 1, true},
+		{"too late", 59 + 2*totpPeriod, "287082", 0, false},
+		{"wrong code", 59, "287083", 0, false},
+		{"too short", 59, "28708", 0, false},
+		{"empty", 59, "", 0, false},
+	}
+
+	for _, e := range tests {
+		step, ok := matchTOTP(rfcTOTPSecret, e.code, time.Unix(e.now, 0))
+		if ok != e.expectedOK || step != e.expectedStep {
+			t.Errorf("%s: expected step %d, %t, got %d, %t", e.name, e.expectedStep, e.expectedOK, step, ok)
+		}
+	}
+}
+
+func Test_newRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("expected %d codes and hashes, got %d and %d", recoveryCodeCount, len(codes), len(hashes))
+	}
+
+	format := regexp.MustCompile(`^[a-z2-9_]{5}-[a-z2-9_]{5}$`)
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q does not look like a recovery code", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was made twice", code)
+		}
+		seen[code] = true
+
+		if hashes[i] != hashRecoveryCode(code) {
+			t.Errorf("hash of code %q does not match", code)
+		}
+	}
+}
+
+func Test_hashRecoveryCode(t *testing.T) {
+	expected := hashRecoveryCode("abcde-fghjk")
+
+	for _, code := range []string{"abcdefghjk", "ABCDE-FGHJK", " abcde fghjk "} {
+		if got := hashRecoveryCode(code); got != expected {
+			t.Errorf("%q: expected the same hash as abcde-fghjk", code)
+		}
+	}
+
+	if hashRecoveryCode("abcde-fghjm") == expected {
+		t.Error("different codes have the same hash")
+	}
+}
+
+// twoFactorTestApp returns a copy of testApp in which user 1 has two-factor authentication with
+// the RFC 6238 secret, and the given recovery code
+func twoFactorTestApp(t *testing.T, recoveryCode string) Config {
+	app := testApp
+	app.LoginThrottle = NewMemoryLoginThrottle(time.Now)
+	app.Models.TwoFactor = &db.TwoFactorTest{}
+
+	encrypted, err := encryptSecret(app.TOTPKey, rfcTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.Models.TwoFactor.StartEnrollment(1, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.Models.TwoFactor.Enable(1, 0, []string{hashRecoveryCode(recoveryCode)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+func TestConfig_POSTLoginPage_TwoFactor(t *testing.T) {
+	app := twoFactorTestApp(t, "abcde-fghjk")
+
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(url.Values{
+		"email":    {"test@example.com"},
+		"password": {"password"},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	http.HandlerFunc(app.POSTLoginPage).ServeHTTP(res, req)
+
+	if location := res.Header().Get("Location"); location != "/login/two-factor" {
+		t.Errorf("expected redirect to /login/two-factor, got %s", location)
+	}
+	if app.Session.Exists(ctx, "userID") {
+		t.Error("user was logged in before giving their code")
+	}
+	if app.Session.GetInt(ctx, "twoFactorUserID") != 1 {
+		t.Error("did not remember which user is logging in")
+	}
+
+	// members pages stay closed until the code is given
+	req, _ = http.NewRequest("GET", "/members/plans", nil)
+	req = req.WithContext(ctx)
+	res = httptest.NewRecorder()
+	app.Auth(http.HandlerFunc(app.GETSubscriptionPlans)).ServeHTTP(res, req)
+
+	if location := res.Header().Get("Location"); location != "/login" {
+		t.Errorf("expected Auth to redirect to /login, got %s", location)
+	}
+}
+
+func TestConfig_POSTLoginTwoFactor(t *testing.T) {
+	code, err := totpCode(rfcTOTPSecret, totpStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name             string
+		code             string
+		expectedLocation string
+		expectedLoggedIn bool
+	}{
+		{"wrong code", "000000", "/login/two-factor", false},
+		{"right code", code, "/", true},
+		{"same code again", code, "/login/two-factor", false},
+		{"recovery code", "ABCDE-FGHJK", "/", true},
+		{"same recovery code again", "abcde-fghjk", "/login/two-factor", false},
+	}
+
+	// the same app for every test, so codes stay used
+	app := twoFactorTestApp(t, "abcde-fghjk")
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/login/two-factor", strings.NewReader(url.Values{"code": {e.code}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		app.startTwoFactorLogin(req, 1)
+
+		http.HandlerFunc(app.POSTLoginTwoFactor).ServeHTTP(res, req)
+
+		if location := res.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, location)
+		}
+		if app.Session.Exists(ctx, "userID") != e.expectedLoggedIn {
+			t.Errorf("%s: expected logged in to be %t", e.name, e.expectedLoggedIn)
+		}
+		if e.expectedLoggedIn && (!app.Session.GetBool(ctx, "twoFactor") || app.Session.Exists(ctx, "twoFactorUserID")) {
+			t.Errorf("%s: the session was not moved on from the two-factor login", e.name)
+		}
+	}
+}
+
+func TestConfig_POSTLoginTwoFactor_Expired(t *testing.T) {
+	app := twoFactorTestApp(t, "abcde-fghjk")
+
+	req, _ := http.NewRequest("POST", "/login/two-factor", strings.NewReader(url.Values{"code": {"abcde-fghjk"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	app.Session.Put(ctx, "twoFactorUserID", 1)
+	app.Session.Put(ctx, "twoFactorExpires", time.Now().Add(-time.Minute).Unix())
+
+	http.HandlerFunc(app.POSTLoginTwoFactor).ServeHTTP(res, req)
+
+	if location := res.Header().Get("Location"); location != "/login" {
+		t.Errorf("expected redirect to /login, got %s", location)
+	}
+	if app.Session.Exists(ctx, "userID") {
+		t.Error("user was logged in after the two-factor login timed out")
+	}
+}
+
+func TestConfig_LoginTwoFactorSetup(t *testing.T) {
+	app := testApp
+	app.Models.TwoFactor = &db.TwoFactorTest{}
+
+	// the admin gave the right password, and has not set up two-factor authentication
+	req, _ := http.NewRequest("GET", "/login/two-factor/setup", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	app.startTwoFactorLogin(req, 3)
+	http.HandlerFunc(app.GETLoginTwoFactorSetup).ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), "data:image/png;base64,") {
+		t.Error("did not find the QR code")
+	}
+
+	twoFactor, err := app.Models.TwoFactor.GetForUser(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := decryptSecret(app.TOTPKey, twoFactor.EncryptedSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Body.String(), secret) {
+		t.Error("did not find the secret to type in")
+	}
+	code, _ := totpCode(secret, totpStep(time.Now()))
+
+	req, _ = http.NewRequest("POST", "/login/two-factor/setup", strings.NewReader(url.Values{"code": {code}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(ctx)
+	res = httptest.NewRecorder()
+
+	http.HandlerFunc(app.POSTLoginTwoFactorSetup).ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), "Your Recovery Codes") {
+		t.Error("did not show the recovery codes")
+	}
+	if app.Session.GetInt(ctx, "userID") != 3 || !app.Session.GetBool(ctx, "twoFactor") {
+		t.Error("admin was not logged in with two-factor authentication")
+	}
+	if left, _ := app.Models.TwoFactor.RecoveryCodesLeft(3); left != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %d", recoveryCodeCount, left)
+	}
+}
+
+func TestConfig_POSTDisableTwoFactor(t *testing.T) {
+	var tests = []struct {
+		name            string
+		userID          int
+		code            string
+		expectedEnabled bool
+	}{
+		{"wrong code", 1, "000000", true},
+		{"admin", 3, "abcde-fghjk", true},
+		{"recovery code", 1, "abcde-fghjk", false},
+	}
+
+	app := twoFactorTestApp(t, "abcde-fghjk")
+	encrypted, _ := encryptSecret(app.TOTPKey, rfcTOTPSecret)
+	_ = app.Models.TwoFactor.StartEnrollment(3, encrypted)
+	_ = app.Models.TwoFactor.Enable(3, 0, []string{hashRecoveryCode("abcde-fghjk")})
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/members/two-factor/disable", strings.NewReader(url.Values{"code": {e.code}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		res := httptest.NewRecorder()
+
+		app.Session.Put(ctx, "userID", e.userID)
+
+		http.HandlerFunc(app.POSTDisableTwoFactor).ServeHTTP(res, req)
+
+		twoFactor, _ := app.Models.TwoFactor.GetForUser(e.userID)
+		if twoFactor.Enabled() != e.expectedEnabled {
+			t.Errorf("%s: expected enabled to be %t", e.name, e.expectedEnabled)
+		}
+	}
+}
+
+func Test_totpKey(t *testing.T) {
+	var tests = []struct {
+		name          string
+		value         string
+		expectedError bool
+	}{
+		{"not set", "", true},
+		{"not base64", "not a key!", true},
+		{"too short", "c2hvcnQ=", true},
+		{"32 bytes", "dGVzdC10b3RwLWtleS1vZi1leGFjdGx5LTMyLWJ5dGU=", false},
+	}
+
+	for _, e := range tests {
+		t.Setenv("TOTP_KEY", e.value)
+
+		_, err := totpKey()
+		if (err != nil) != e.expectedError {
+			t.Errorf("%s: expected error to be %t, got %v", e.name, e.expectedError, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "TOTP_KEY") {
+			t.Errorf("%s: expected the error to name TOTP_KEY, got %q", e.name, err)
+		}
+	}
+}
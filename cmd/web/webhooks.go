@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+// Payment events sent by the payment provider
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+	EventDisputeOpened    = "dispute.opened"
+)
+
+const (
+	webhookSignatureHeader = "X-Payment-Signature"
+	webhookTolerance       = 5 * time.Minute // how old a signed webhook may be before it is rejected
+	maxWebhookBodySize     = 64 * 1024
+
+	webhookRetryDelay  = 10 * time.Minute   // events received more recently may still be being processed
+	webhookRetryWindow = 3 * 24 * time.Hour // events that still fail after this are left to be looked at by hand
+)
+
+var (
+	ErrWebhookSignature = errors.New("webhook: invalid signature")
+	ErrWebhookStale     = errors.New("webhook: timestamp outside of tolerance")
+)
+
+// PaymentEvent is the body of a webhook sent by the payment provider
+type PaymentEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		ChargeID   string `json:"charge_id"`
+		CustomerID string `json:"customer_id"`
+		Amount     int    `json:"amount"`
+		Reason     string `json:"reason"`
+	} `json:"data"`
+}
+
+// POSTPaymentWebhook receives events from the payment provider. Events are acknowledged as soon as
+// they are verified and recorded; the actual processing happens in the background.
+func (app *Config) POSTPaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	app.InfoLog.Printf("POST %s\n", r.URL.Path)
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		app.ErrorLog.Println("Error reading webhook body: ", err)
+		http.Error(w, "Unable to read request body", http.StatusBadRequest)
+		return
+	}
+
+	err = verifyWebhookSignature(r.Header.Get(webhookSignatureHeader), body, app.WebhookSecret, time.Now())
+	if err != nil {
+		app.ErrorLog.Println("Rejected webhook: ", err)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+
+	var event PaymentEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" || event.Type == "" {
+		app.ErrorLog.Println("Invalid webhook payload: ", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	// the provider may deliver the same event more than once
+	isNew, err := app.Models.WebhookEvent.Record(db.WebhookEvent{
+		ID:        event.ID,
+		EventType: event.Type,
+		Payload:   body,
+	})
+	if err != nil {
+		app.ErrorLog.Println("Error recording webhook event: ", err)
+		http.Error(w, "Unable to record event", http.StatusInternalServerError) // the provider will retry
+		return
+	}
+
+	if isNew {
+		app.Wait.Add(1)
+		go app.processPaymentEvent(event)
+	} else {
+		app.InfoLog.Printf("Ignoring duplicate webhook event %s\n", event.ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// processPaymentEvent processes an event in the background, once it has been acknowledged
+func (app *Config) processPaymentEvent(event PaymentEvent) {
+	defer app.Wait.Done()
+
+	if err := app.handlePaymentEvent(event); err != nil {
+		// the event is left unprocessed, and tried again by reprocessWebhookEvents
+		app.ErrorChan <- err
+	}
+}
+
+// reprocessWebhookEvents tries again the events that failed to process. The provider does not
+// send them again, as they were acknowledged when they were received.
+func (app *Config) reprocessWebhookEvents(now time.Time) {
+	events, err := app.Models.WebhookEvent.GetUnprocessed(now.Add(-webhookRetryWindow), now.Add(-webhookRetryDelay))
+	if err != nil {
+		app.ErrorChan <- fmt.Errorf("error getting unprocessed webhook events: %v", err)
+		return
+	}
+
+	for _, e := range events {
+		var event PaymentEvent
+		if err := json.Unmarshal(e.Payload, &event); err != nil {
+			app.ErrorChan <- fmt.Errorf("invalid payload of webhook event %s: %v", e.ID, err)
+			continue
+		}
+
+		app.InfoLog.Printf("Processing webhook event %s again\n", e.ID)
+		if err := app.handlePaymentEvent(event); err != nil {
+			app.ErrorChan <- err
+		}
+	}
+}
+
+// handlePaymentEvent brings invoices and subscriptions up to date with an event from the payment
+// provider, and marks the event as processed
+func (app *Config) handlePaymentEvent(event PaymentEvent) error {
+	var err error
+	switch event.Type {
+	case EventPaymentSucceeded:
+		err = app.handlePaymentSucceeded(event)
+	case EventPaymentFailed:
+		err = app.handlePaymentFailed(event)
+	case EventDisputeOpened:
+		err = app.handleDisputeOpened(event)
+	default:
+		app.InfoLog.Printf("Ignoring webhook event %s of type %s\n", event.ID, event.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error processing webhook event %s: %v", event.ID, err)
+	}
+
+	if err := app.Models.WebhookEvent.MarkProcessed(event.ID); err != nil {
+		return fmt.Errorf("error marking webhook event %s as processed: %v", event.ID, err)
+	}
+	return nil
+}
+
+func (app *Config) handlePaymentSucceeded(event PaymentEvent) error {
+	invoice, err := app.Models.Invoice.GetByChargeID(event.Data.ChargeID)
+	if err != nil {
+		return fmt.Errorf("no invoice for charge %s: %v", event.Data.ChargeID, err)
+	}
+
+	if invoice.Status == db.InvoiceOpen {
+		if err := app.Models.Invoice.MarkPaid(invoice.ID, event.Data.ChargeID); err != nil {
+			return err
+		}
+	}
+
+	return app.updateSubscriptionForInvoice(invoice, db.SubscriptionPastDue, db.SubscriptionActive, "Payment received")
+}
+
+func (app *Config) handlePaymentFailed(event PaymentEvent) error {
+	invoice, err := app.Models.Invoice.GetByChargeID(event.Data.ChargeID)
+	if err != nil {
+		return fmt.Errorf("no invoice for charge %s: %v", event.Data.ChargeID, err)
+	}
+
+	if invoice.Status == db.InvoicePaid {
+		if err := app.Models.Invoice.Reopen(invoice.ID); err != nil {
+			return err
+		}
+	}
+
+	if invoice.SubscriptionID == 0 {
+		return nil
+	}
+
+	subscription, err := app.Models.Subscription.GetOne(invoice.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	if subscription.Status != db.SubscriptionActive {
+		return nil
+	}
+
+	return app.startDunning(subscription, invoice.ID, "Payment failed")
+}
+
+// handleDisputeOpened flags the disputed invoice, so the dispute can be resolved by hand. The
+// subscription keeps its status, as there is no payment to retry while the dispute is open.
+// Disputes about an earlier period, or a subscription that has since ended, are only logged.
+func (app *Config) handleDisputeOpened(event PaymentEvent) error {
+	invoice, err := app.Models.Invoice.GetByChargeID(event.Data.ChargeID)
+	if err != nil {
+		return fmt.Errorf("no invoice for charge %s: %v", event.Data.ChargeID, err)
+	}
+
+	app.ErrorLog.Printf("Dispute opened for invoice %s (charge %s): %s\n", invoice.NumberForDisplay(), event.Data.ChargeID, event.Data.Reason)
+
+	if invoice.SubscriptionID > 0 {
+		subscription, err := app.Models.Subscription.GetOne(invoice.SubscriptionID)
+		if err != nil {
+			return err
+		}
+
+		if !subscription.IsCurrent() || !billsCurrentPeriod(invoice, subscription) {
+			return nil
+		}
+	}
+
+	return app.Models.Invoice.MarkDisputed(invoice.ID)
+}
+
+// billsCurrentPeriod reports whether an invoice is for the current period of its subscription: a
+// renewal invoice for the period, or an invoice issued during it
+func billsCurrentPeriod(invoice *db.Invoice, subscription *db.Subscription) bool {
+	if invoice.PeriodStart != nil {
+		return invoice.PeriodStart.Equal(subscription.CurrentPeriodStart)
+	}
+	return !invoice.IssuedAt.Before(subscription.CurrentPeriodStart)
+}
+
+// updateSubscriptionForInvoice moves the subscription an invoice belongs to from one state to another.
+// Subscriptions in any other state are left alone.
+func (app *Config) updateSubscriptionForInvoice(invoice *db.Invoice, from, to, reason string) error {
+	if invoice.SubscriptionID == 0 {
+		return nil
+	}
+
+	subscription, err := app.Models.Subscription.GetOne(invoice.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	if subscription.Status != from {
+		return nil
+	}
+
+	return app.Models.Subscription.UpdateStatus(subscription.ID, to, reason)
+}
+
+// signWebhookPayload produces the signature header for a webhook body, as the payment provider does:
+// a timestamp, and an HMAC-SHA256 of the timestamp and body
+func signWebhookPayload(body, secret []byte, timestamp time.Time) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// verifyWebhookSignature checks that the signature header was produced for this body with our secret,
+// and that it is recent, so a captured webhook cannot be replayed later on
+func verifyWebhookSignature(header string, body, secret []byte, now time.Time) error {
+	if len(secret) == 0 {
+		return errors.New("webhook: no secret configured")
+	}
+
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return ErrWebhookSignature
+	}
+
+	expected := signWebhookPayload(body, secret, time.Unix(seconds, 0))
+	if !hmac.Equal([]byte(expected), []byte(fmt.Sprintf("t=%s,v1=%s", timestamp, signature))) {
+		return ErrWebhookSignature
+	}
+
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > webhookTolerance || age < -webhookTolerance {
+		return ErrWebhookStale
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/chriskoorzen/go-subscription-webapp/cmd/web/db"
+)
+
+func TestConfig_POSTPaymentWebhook(t *testing.T) {
+	body := []byte(`{"id":"evt_test_1","type":"payment.succeeded","created":1700000000,"data":{"charge_id":"ch_test_1","amount":1000}}`)
+
+	var tests = []struct {
+		name               string
+		body               []byte
+		signature          string
+		expectedStatusCode int
+		expectProcessed    bool
+	}{
+		{"valid event", body, signWebhookPayload(body, testApp.WebhookSecret, time.Now()), http.StatusOK, true},
+		{"duplicate event", body, signWebhookPayload(body, testApp.WebhookSecret, time.Now()), http.StatusOK, false},
+		{"missing signature", body, "", http.StatusBadRequest, false},
+		{"wrong secret", body, signWebhookPayload(body, []byte("not-the-secret"), time.Now()), http.StatusBadRequest, false},
+		{"tampered body", bytes.Replace(body, []byte("1000"), []byte("9999"), 1), signWebhookPayload(body, testApp.WebhookSecret, time.Now()), http.StatusBadRequest, false},
+		{"stale timestamp", body, signWebhookPayload(body, testApp.WebhookSecret, time.Now().Add(-time.Hour)), http.StatusBadRequest, false},
+	}
+
+	events := testApp.Models.WebhookEvent.(*db.WebhookEventTest)
+
+	for _, e := range tests {
+		processedBefore := len(events.Processed())
+
+		req, _ := http.NewRequest("POST", "/webhooks/payments", bytes.NewReader(e.body)) // build a request to test
+		req.Header.Set("Content-Type", "application/json")
+		if e.signature != "" {
+			req.Header.Set(webhookSignatureHeader, e.signature)
+		}
+		res := httptest.NewRecorder() // create a response recorder
+
+		handler := http.HandlerFunc(testApp.POSTPaymentWebhook)
+		handler.ServeHTTP(res, req)
+
+		testApp.Wait.Wait() // let background processing finish
+
+		if res.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, res.Code)
+		}
+
+		processed := len(events.Processed()) > processedBefore
+		if processed != e.expectProcessed {
+			t.Errorf("%s: expected event processed to be %t, got %t", e.name, e.expectProcessed, processed)
+		}
+	}
+}
+
+func Test_verifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":"evt_test_2"}`)
+	secret := []byte("secret")
+	now := time.Now()
+
+	var tests = []struct {
+		name        string
+		header      string
+		expectedErr error
+	}{
+		{"valid", signWebhookPayload(body, secret, now), nil},
+		{"slightly in the future", signWebhookPayload(body, secret, now.Add(time.Minute)), nil},
+		{"too old", signWebhookPayload(body, secret, now.Add(-webhookTolerance-time.Second)), ErrWebhookStale},
+		{"too far in the future", signWebhookPayload(body, secret, now.Add(webhookTolerance+time.Second)), ErrWebhookStale},
+		{"garbage", "garbage", ErrWebhookSignature},
+		{"missing signature", "t=1700000000", ErrWebhookSignature},
+	}
+
+	for _, e := range tests {
+		err := verifyWebhookSignature(e.header, body, secret, now)
+		if err != e.expectedErr {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
+
+func TestConfig_reprocessWebhookEvents(t *testing.T) {
+	app := testApp
+	events := &db.WebhookEventTest{}
+	app.Models.WebhookEvent = events
+
+	now := time.Now()
+	payload := func(id string) []byte {
+		return []byte(`{"id":"` + id + `","type":"payment.succeeded","created":1700000000,"data":{"charge_id":"ch_test_1","amount":1000}}`)
+	}
+
+	var tests = []struct {
+		id              string
+		receivedAt      time.Time
+		processed       bool
+		expectProcessed bool
+	}{
+		{"evt_failed", now.Add(-time.Hour), false, true},
+		{"evt_in_flight", now.Add(-time.Minute), false, false},
+		{"evt_too_old", now.Add(-webhookRetryWindow - time.Hour), false, false},
+		{"evt_done", now.Add(-time.Hour), true, false},
+	}
+
+	for _, e := range tests {
+		_, _ = events.Record(db.WebhookEvent{ID: e.id, EventType: EventPaymentSucceeded, Payload: payload(e.id), ReceivedAt: e.receivedAt})
+		if e.processed {
+			_ = events.MarkProcessed(e.id)
+		}
+	}
+
+	app.reprocessWebhookEvents(now)
+
+	for _, e := range tests {
+		if e.processed {
+			continue
+		}
+		processed := slices.Contains(events.Processed(), e.id)
+		if processed != e.expectProcessed {
+			t.Errorf("%s: expected event processed to be %t, got %t", e.id, e.expectProcessed, processed)
+		}
+	}
+}
+
+func TestConfig_handleDisputeOpened(t *testing.T) {
+	var tests = []struct {
+		name             string
+		chargeID         string
+		expectedDisputed int
+	}{
+		{"current period", "ch_current_period", 1},
+		{"earlier period", "ch_earlier_period", 0},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		invoices := &db.InvoiceTest{}
+		app.Models.Invoice = invoices
+		subscriptions := &db.SubscriptionTest{}
+		app.Models.Subscription = subscriptions
+
+		event := PaymentEvent{ID: "evt_dispute", Type: EventDisputeOpened}
+		event.Data.ChargeID = e.chargeID
+		event.Data.Reason = "fraudulent"
+
+		if err := app.handlePaymentEvent(event); err != nil {
+			t.Fatalf("%s: unexpected error: %v", e.name, err)
+		}
+
+		if disputed := invoices.Disputed(); len(disputed) != e.expectedDisputed {
+			t.Errorf("%s: expected %d invoice marked as disputed, got %v", e.name, e.expectedDisputed, disputed)
+		}
+		// the subscription is not put into a state nothing would move it out of
+		if changes := subscriptions.Changes(); len(changes) != 0 {
+			t.Errorf("%s: expected the subscription to be left alone, got %v", e.name, changes)
+		}
+	}
+}
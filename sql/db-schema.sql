@@ -6,6 +6,11 @@ CREATE TABLE public.plans (
                               id integer NOT NULL,
                               plan_name character varying(255),
                               plan_amount integer,
+                              trial_days integer DEFAULT 0 NOT NULL,
+                              plan_family character varying(255) DEFAULT '' NOT NULL,
+                              version integer DEFAULT 1 NOT NULL,
+                              previous_version_id integer,
+                              archived_at timestamp without time zone,
                               created_at timestamp without time zone,
                               updated_at timestamp without time zone
 );
@@ -45,11 +50,37 @@ CREATE TABLE public.user_plans (
                                    id integer NOT NULL,
                                    user_id integer,
                                    plan_id integer,
+                                   status character varying(20) DEFAULT 'active' NOT NULL,
+                                   started_at timestamp without time zone,
+                                   current_period_start timestamp without time zone,
+                                   current_period_end timestamp without time zone,
+                                   billing_day integer DEFAULT 0 NOT NULL,
+                                   canceled_at timestamp without time zone,
+                                   change_reason character varying(255) DEFAULT '' NOT NULL,
+                                   currency character(3) DEFAULT 'USD' NOT NULL,
+                                   past_due_since timestamp without time zone,
+                                   dunning_attempts integer DEFAULT 0 NOT NULL,
+                                   next_retry_at timestamp without time zone,
+                                   scheduled_plan_id integer,
+                                   cancel_at_period_end boolean DEFAULT false NOT NULL,
+                                   cancellation_reason character varying(255) DEFAULT '' NOT NULL,
+                                   trial_ends_at timestamp without time zone,
+                                   trial_reminder_sent_at timestamp without time zone,
+                                   coupon_id integer,
+                                   coupon_periods_left integer,
                                    created_at timestamp without time zone,
-                                   updated_at timestamp without time zone
+                                   updated_at timestamp without time zone,
+                                   CONSTRAINT user_plans_status_check CHECK (((status)::text = ANY ((ARRAY['trialing'::character varying, 'active'::character varying, 'past_due'::character varying, 'canceled'::character varying, 'expired'::character varying])::text[])))
 );
 
 
+--
+-- Existing subscriptions are billed on the day of the month they started, or their trial ended
+--
+
+UPDATE public.user_plans SET billing_day = EXTRACT(DAY FROM COALESCE(trial_ends_at, started_at)) WHERE billing_day = 0;
+
+
 --
 -- Name: user_plans_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
@@ -73,7 +104,369 @@ CREATE TABLE public.users (
                               user_active integer DEFAULT 0,
                               is_admin integer default 0,
                               created_at timestamp without time zone,
-                              updated_at timestamp without time zone
+                              updated_at timestamp without time zone,
+                              payment_customer_id character varying(255) DEFAULT '' NOT NULL,
+                              payment_method_id character varying(255) DEFAULT '' NOT NULL,
+                              billing_line1 character varying(255) DEFAULT '' NOT NULL,
+                              billing_line2 character varying(255) DEFAULT '' NOT NULL,
+                              billing_city character varying(255) DEFAULT '' NOT NULL,
+                              billing_region character varying(64) DEFAULT '' NOT NULL,
+                              billing_postal_code character varying(32) DEFAULT '' NOT NULL,
+                              billing_country character varying(2) DEFAULT '' NOT NULL,
+                              tax_id character varying(64) DEFAULT '' NOT NULL,
+                              currency character varying(3) DEFAULT '' NOT NULL,
+                              locale character varying(35) DEFAULT '' NOT NULL,
+                              activated_at timestamp without time zone,
+                              deleted_at timestamp without time zone
+);
+
+
+--
+-- Existing active users were activated when they signed up
+--
+
+UPDATE public.users SET activated_at = created_at WHERE user_active = 1 AND activated_at IS NULL;
+
+
+--
+-- Name: idempotency_keys; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.idempotency_keys (
+                                         key character varying(255) NOT NULL,
+                                         user_id integer,
+                                         created_at timestamp without time zone
+);
+
+
+--
+-- Name: invoices; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoices (
+                                 id integer NOT NULL,
+                                 invoice_number integer NOT NULL,
+                                 user_id integer,
+                                 subscription_id integer,
+                                 status character varying(20) DEFAULT 'open' NOT NULL,
+                                 subtotal integer DEFAULT 0 NOT NULL,
+                                 tax integer DEFAULT 0 NOT NULL,
+                                 total integer DEFAULT 0 NOT NULL,
+                                 currency character(3) DEFAULT 'USD' NOT NULL,
+                                 tax_inclusive boolean DEFAULT false NOT NULL,
+                                 reverse_charge boolean DEFAULT false NOT NULL,
+                                 issued_at timestamp without time zone,
+                                 due_at timestamp without time zone,
+                                 paid_at timestamp without time zone,
+                                 voided_at timestamp without time zone,
+                                 disputed_at timestamp without time zone,
+                                 charge_id character varying(255) DEFAULT '' NOT NULL,
+                                 period_start timestamp without time zone,
+                                 created_at timestamp without time zone,
+                                 updated_at timestamp without time zone,
+                                 CONSTRAINT invoices_status_check CHECK (((status)::text = ANY ((ARRAY['open'::character varying, 'paid'::character varying, 'void'::character varying])::text[])))
+);
+
+
+--
+-- Name: invoices_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.invoices ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.invoices_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoice_line_items; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoice_line_items (
+                                           id integer NOT NULL,
+                                           invoice_id integer,
+                                           description character varying(255),
+                                           quantity integer DEFAULT 1 NOT NULL,
+                                           unit_amount integer DEFAULT 0 NOT NULL,
+                                           amount integer DEFAULT 0 NOT NULL,
+                                           created_at timestamp without time zone
+);
+
+
+--
+-- Name: invoice_line_items_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.invoice_line_items ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.invoice_line_items_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoice_numbers; Type: TABLE; Schema: public; Owner: -
+-- Holds the last invoice number handed out. Unlike a sequence, the counter is updated inside
+-- the invoice's transaction, so a rolled back invoice does not leave a gap in the numbering.
+--
+
+CREATE TABLE public.invoice_numbers (
+                                        id integer NOT NULL,
+                                        last_number integer NOT NULL
+);
+
+
+--
+-- Name: webhook_events; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.webhook_events (
+                                       event_id character varying(255) NOT NULL,
+                                       event_type character varying(255) NOT NULL,
+                                       payload jsonb,
+                                       received_at timestamp without time zone,
+                                       processed_at timestamp without time zone
+);
+
+
+--
+-- Name: coupons; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.coupons (
+                                id integer NOT NULL,
+                                code character varying(64) NOT NULL,
+                                discount_type character varying(20) NOT NULL,
+                                percent_off integer DEFAULT 0 NOT NULL,
+                                amount_off integer DEFAULT 0 NOT NULL,
+                                currency character varying(3) DEFAULT '' NOT NULL,
+                                duration character varying(20) DEFAULT 'once' NOT NULL,
+                                duration_months integer DEFAULT 0 NOT NULL,
+                                max_redemptions integer DEFAULT 0 NOT NULL,
+                                times_redeemed integer DEFAULT 0 NOT NULL,
+                                expires_at timestamp without time zone,
+                                plan_id integer,
+                                active boolean DEFAULT true NOT NULL,
+                                created_at timestamp without time zone,
+                                updated_at timestamp without time zone,
+                                CONSTRAINT coupons_discount_type_check CHECK (((discount_type)::text = ANY ((ARRAY['percent'::character varying, 'fixed'::character varying])::text[]))),
+                                CONSTRAINT coupons_duration_check CHECK (((duration)::text = ANY ((ARRAY['once'::character varying, 'repeating'::character varying, 'forever'::character varying])::text[]))),
+                                CONSTRAINT coupons_percent_off_check CHECK (((percent_off >= 0) AND (percent_off <= 100)))
+);
+
+
+--
+-- Name: coupons_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.coupons ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.coupons_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: coupon_redemptions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.coupon_redemptions (
+                                           id integer NOT NULL,
+                                           coupon_id integer NOT NULL,
+                                           user_id integer NOT NULL,
+                                           redeemed_at timestamp without time zone
+);
+
+
+--
+-- Name: coupon_redemptions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.coupon_redemptions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.coupon_redemptions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoice_tax_lines; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoice_tax_lines (
+                                          id integer NOT NULL,
+                                          invoice_id integer,
+                                          name character varying(255) NOT NULL,
+                                          rate integer NOT NULL,
+                                          amount integer DEFAULT 0 NOT NULL,
+                                          created_at timestamp without time zone
+);
+
+
+--
+-- Name: invoice_tax_lines_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.invoice_tax_lines ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.invoice_tax_lines_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: tax_rates; Type: TABLE; Schema: public; Owner: -
+-- Rates are in thousandths of a percent. A region's rates replace the rates for the whole country,
+-- which have an empty region.
+--
+
+CREATE TABLE public.tax_rates (
+                                  id integer NOT NULL,
+                                  country character(2) NOT NULL,
+                                  region character varying(64) DEFAULT '' NOT NULL,
+                                  name character varying(255) NOT NULL,
+                                  rate integer NOT NULL,
+                                  inclusive boolean DEFAULT false NOT NULL,
+                                  reverse_charge boolean DEFAULT false NOT NULL,
+                                  created_at timestamp without time zone,
+                                  updated_at timestamp without time zone,
+                                  CONSTRAINT tax_rates_rate_check CHECK (((rate >= 0) AND (rate <= 100000)))
+);
+
+
+--
+-- Name: tax_rates_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.tax_rates ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.tax_rates_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: plan_prices; Type: TABLE; Schema: public; Owner: -
+-- A plan's prices in the currencies other than USD it is sold in, in the currency's minor unit.
+-- The USD price is plans.plan_amount.
+--
+
+CREATE TABLE public.plan_prices (
+                                    id integer NOT NULL,
+                                    plan_id integer NOT NULL,
+                                    currency character(3) NOT NULL,
+                                    amount integer NOT NULL,
+                                    created_at timestamp without time zone,
+                                    updated_at timestamp without time zone,
+                                    CONSTRAINT plan_prices_amount_check CHECK ((amount >= 0))
+);
+
+
+--
+-- Name: plan_prices_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.plan_prices ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.plan_prices_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: audit_events; Type: TABLE; Schema: public; Owner: -
+-- Append-only: see audit_events_append_only below.
+--
+
+CREATE TABLE public.audit_events (
+                                     id bigint NOT NULL,
+                                     action character varying(64) NOT NULL,
+                                     actor_id integer,
+                                     target_type character varying(32) DEFAULT '' NOT NULL,
+                                     target_id character varying(255) DEFAULT '' NOT NULL,
+                                     ip_address character varying(45) DEFAULT '' NOT NULL,
+                                     user_agent character varying(512) DEFAULT '' NOT NULL,
+                                     note character varying(255) DEFAULT '' NOT NULL,
+                                     changes jsonb DEFAULT '{}'::jsonb NOT NULL,
+                                     created_at timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: audit_events_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.audit_events ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.audit_events_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: user_two_factor; Type: TABLE; Schema: public; Owner: -
+-- encrypted_secret is encrypted by the app with TOTP_KEY.
+--
+
+CREATE TABLE public.user_two_factor (
+                                        user_id integer NOT NULL,
+                                        encrypted_secret character varying(255) NOT NULL,
+                                        enabled_at timestamp without time zone,
+                                        last_used_step bigint DEFAULT 0 NOT NULL,
+                                        created_at timestamp without time zone NOT NULL,
+                                        updated_at timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: recovery_codes; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.recovery_codes (
+                                       id integer NOT NULL,
+                                       user_id integer NOT NULL,
+                                       code_hash character varying(64) NOT NULL,
+                                       used_at timestamp without time zone,
+                                       created_at timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: recovery_codes_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.recovery_codes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.recovery_codes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
 );
 
 
@@ -85,10 +478,166 @@ ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: user_plans_current_user_id_idx; Type: INDEX; Schema: public; Owner: -
+-- A user has at most one current subscription; ended subscriptions are kept as history.
+--
+
+CREATE UNIQUE INDEX user_plans_current_user_id_idx ON public.user_plans USING btree (user_id) WHERE ((status)::text = ANY ((ARRAY['trialing'::character varying, 'active'::character varying, 'past_due'::character varying])::text[]));
+
+
 ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: users_email_key; Type: INDEX; Schema: public; Owner: -
+-- Two users cannot have the same email address, whatever its case.
+--
+
+CREATE UNIQUE INDEX users_email_key ON public.users USING btree (lower((email)::text));
+
+
+ALTER TABLE ONLY public.idempotency_keys
+    ADD CONSTRAINT idempotency_keys_pkey PRIMARY KEY (key);
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_invoice_number_key UNIQUE (invoice_number);
+
+
+ALTER TABLE ONLY public.invoice_line_items
+    ADD CONSTRAINT invoice_line_items_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.invoice_numbers
+    ADD CONSTRAINT invoice_numbers_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.webhook_events
+    ADD CONSTRAINT webhook_events_pkey PRIMARY KEY (event_id);
+
+
+--
+-- Name: invoices_subscription_period_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX invoices_subscription_period_idx ON public.invoices USING btree (subscription_id, period_start);
+
+
+--
+-- Name: webhook_events_unprocessed_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX webhook_events_unprocessed_idx ON public.webhook_events USING btree (received_at) WHERE (processed_at IS NULL);
+
+
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_code_key UNIQUE (code);
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_coupon_id_user_id_key UNIQUE (coupon_id, user_id);
+
+
+ALTER TABLE ONLY public.invoice_tax_lines
+    ADD CONSTRAINT invoice_tax_lines_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.tax_rates
+    ADD CONSTRAINT tax_rates_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.tax_rates
+    ADD CONSTRAINT tax_rates_country_region_name_key UNIQUE (country, region, name);
+
+
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_plan_id_currency_key UNIQUE (plan_id, currency);
+
+
+ALTER TABLE ONLY public.audit_events
+    ADD CONSTRAINT audit_events_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: audit_events_created_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_created_at_idx ON public.audit_events USING btree (created_at);
+
+
+--
+-- Name: audit_events_actor_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_actor_id_idx ON public.audit_events USING btree (actor_id);
+
+
+--
+-- Name: audit_events_target_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_target_idx ON public.audit_events USING btree (target_type, target_id);
+
+
+ALTER TABLE ONLY public.user_two_factor
+    ADD CONSTRAINT user_two_factor_pkey PRIMARY KEY (user_id);
+
+
+ALTER TABLE ONLY public.recovery_codes
+    ADD CONSTRAINT recovery_codes_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.recovery_codes
+    ADD CONSTRAINT recovery_codes_user_id_code_hash_key UNIQUE (user_id, code_hash);
+
+
+--
+-- Name: audit_events_append_only(); Type: FUNCTION; Schema: public; Owner: -
+-- Audit events are never changed or removed once recorded. actor_id has no foreign key for the
+-- same reason: the events of a deleted user are kept.
+--
+
+CREATE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$;
+
+
+--
+-- Name: audit_events audit_events_no_update_or_delete; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER audit_events_no_update_or_delete BEFORE DELETE OR UPDATE ON public.audit_events FOR EACH ROW EXECUTE FUNCTION public.audit_events_append_only();
+
+
+--
+-- Name: audit_events audit_events_no_truncate; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON public.audit_events FOR EACH STATEMENT EXECUTE FUNCTION public.audit_events_append_only();
+
+
 ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
 
@@ -97,4 +646,57 @@ ALTER TABLE ONLY public.user_plans
     ADD CONSTRAINT user_plans_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
 
 
+ALTER TABLE ONLY public.user_plans
+    ADD CONSTRAINT user_plans_scheduled_plan_id_fkey FOREIGN KEY (scheduled_plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.idempotency_keys
+    ADD CONSTRAINT idempotency_keys_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_subscription_id_fkey FOREIGN KEY (subscription_id) REFERENCES public.user_plans(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.invoice_line_items
+    ADD CONSTRAINT invoice_line_items_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES public.invoices(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.user_plans
+    ADD CONSTRAINT user_plans_coupon_id_fkey FOREIGN KEY (coupon_id) REFERENCES public.coupons(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_coupon_id_fkey FOREIGN KEY (coupon_id) REFERENCES public.coupons(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.invoice_tax_lines
+    ADD CONSTRAINT invoice_tax_lines_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES public.invoices(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.plans
+    ADD CONSTRAINT plans_previous_version_id_fkey FOREIGN KEY (previous_version_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE SET NULL;
+
+
+ALTER TABLE ONLY public.user_two_factor
+    ADD CONSTRAINT user_two_factor_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
 
+ALTER TABLE ONLY public.recovery_codes
+    ADD CONSTRAINT recovery_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
@@ -2,9 +2,9 @@
 -- Seed data for the application
 --
 
-INSERT INTO "public"."users"("email","first_name","last_name","password","user_active", "is_admin", "created_at","updated_at")
+INSERT INTO "public"."users"("email","first_name","last_name","password","user_active", "is_admin", "created_at","updated_at","activated_at")
 VALUES
-    (E'admin@example.com',E'Admin',E'User',E'$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe',1,1,E'2022-03-14 00:00:00',E'2022-03-14 00:00:00');
+    (E'admin@example.com',E'Admin',E'User',E'$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe',1,1,E'2022-03-14 00:00:00',E'2022-03-14 00:00:00',E'2022-03-14 00:00:00');
 
 SELECT pg_catalog.setval('public.plans_id_seq', 1, false);
 
@@ -18,4 +18,28 @@ INSERT INTO "public"."plans"("plan_name","plan_amount","created_at","updated_at"
 VALUES
     (E'Bronze Plan',1000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
     (E'Silver Plan',2000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
-    (E'Gold Plan',3000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
\ No newline at end of file
+    (E'Gold Plan',3000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+
+INSERT INTO "public"."tax_rates"("country","region","name","rate","inclusive","reverse_charge","created_at","updated_at")
+VALUES
+    (E'CA',E'',E'GST',5000,false,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'CA',E'ON',E'HST',13000,false,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'CA',E'QC',E'GST',5000,false,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'CA',E'QC',E'QST',9975,false,false,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'DE',E'',E'VAT',19000,true,true,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'FR',E'',E'VAT',20000,true,true,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+
+INSERT INTO "public"."plan_prices"("plan_id","currency","amount","created_at","updated_at")
+VALUES
+    (1,E'CAD',1300,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'CAD',2700,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'CAD',4000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (1,E'EUR',900,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'EUR',1900,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'EUR',2800,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (1,E'GBP',800,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'GBP',1600,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'GBP',2400,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (1,E'JPY',1500,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (2,E'JPY',3000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (3,E'JPY',4500,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
\ No newline at end of file